@@ -0,0 +1,97 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"unsafe"
+)
+
+// nativeLittleEndian reports whether the host is little-endian. Ring indices
+// are always little-endian in guest memory.
+var nativeLittleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// word returns the aligned 32-bit word of mem containing the 16-bit field at off.
+//
+// The ring indices are shared with the other side of the queue, which may run
+// concurrently. Go has no 16-bit atomics, so they are accessed through the
+// aligned word containing them. mem must be 4-byte aligned, off 2-byte aligned.
+func word(mem []byte, off uint64) *uint32 {
+	return (*uint32)(unsafe.Pointer(&mem[off&^3]))
+}
+
+// load16 atomically loads the little-endian 16-bit field at off.
+func load16(mem []byte, off uint64) uint16 {
+	return half(atomic.LoadUint32(word(mem, off)), off&2 != 0)
+}
+
+// store16 atomically stores v as the little-endian 16-bit field at off,
+// leaving the other half of the word untouched.
+func store16(mem []byte, off uint64, v uint16) {
+	w := word(mem, off)
+	for {
+		old := atomic.LoadUint32(w)
+		if atomic.CompareAndSwapUint32(w, old, setHalf(old, off&2 != 0, v)) {
+			return
+		}
+	}
+}
+
+// load32 atomically loads the little-endian 32-bit field at off, which must
+// be 4-byte aligned.
+func load32(mem []byte, off uint64) uint32 {
+	v := atomic.LoadUint32(word(mem, off))
+	if !nativeLittleEndian {
+		v = bits.ReverseBytes32(v)
+	}
+
+	return v
+}
+
+// store32 atomically stores v as the little-endian 32-bit field at off, which
+// must be 4-byte aligned.
+func store32(mem []byte, off uint64, v uint32) {
+	if !nativeLittleEndian {
+		v = bits.ReverseBytes32(v)
+	}
+	atomic.StoreUint32(word(mem, off), v)
+}
+
+// half returns the little-endian 16-bit field of the native word w.
+// high selects the field at byte offset 2.
+func half(w uint32, high bool) uint16 {
+	if nativeLittleEndian {
+		if high {
+			return uint16(w >> 16)
+		}
+		return uint16(w)
+	}
+
+	if high {
+		return bits.ReverseBytes16(uint16(w))
+	}
+	return bits.ReverseBytes16(uint16(w >> 16))
+}
+
+// setHalf returns w with the little-endian 16-bit field selected by high set to v.
+func setHalf(w uint32, high bool, v uint16) uint32 {
+	if !nativeLittleEndian {
+		v = bits.ReverseBytes16(v)
+		high = !high
+	}
+
+	if high {
+		return w&0x0000ffff | uint32(v)<<16
+	}
+	return w&0xffff0000 | uint32(v)
+}
+
+// aligned reports whether the start of mem is 4-byte aligned in host memory.
+func aligned(mem []byte) bool {
+	return len(mem) == 0 || uintptr(unsafe.Pointer(&mem[0]))&3 == 0
+}
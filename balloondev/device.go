@@ -0,0 +1,284 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package balloondev
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// list of device feature bits.
+const (
+	FeatureMustTellHost  virtio.Features = 1 << 0 // VIRTIO_BALLOON_F_MUST_TELL_HOST
+	FeatureStatsVQ       virtio.Features = 1 << 1 // VIRTIO_BALLOON_F_STATS_VQ
+	FeatureDeflateOnOOM  virtio.Features = 1 << 2 // VIRTIO_BALLOON_F_DEFLATE_ON_OOM
+	FeatureFreePageHint  virtio.Features = 1 << 3 // VIRTIO_BALLOON_F_FREE_PAGE_HINT
+	FeaturePagePoison    virtio.Features = 1 << 4 // VIRTIO_BALLOON_F_PAGE_POISON
+	FeaturePageReporting virtio.Features = 1 << 5 // VIRTIO_BALLOON_F_PAGE_REPORTING
+)
+
+// list of queue indices. The stats, free page hint and reporting queues
+// exist with their feature, each following the previous queues.
+const (
+	inflateQueue = iota
+	deflateQueue
+)
+
+// list of free page hint command ids of the configuration space. The ids of
+// the hinting sessions start at hintMinID.
+const (
+	hintStop  = 0 // VIRTIO_BALLOON_CMD_ID_STOP
+	hintDone  = 1 // VIRTIO_BALLOON_CMD_ID_DONE
+	hintMinID = 2
+)
+
+const (
+	// queueSize is the maximum size of the queues.
+	queueSize = 256
+
+	// PageSize is the size of the pages of the balloon, whatever the page
+	// size of the guest.
+	PageSize = 1 << pfnShift
+	pfnShift = 12 // VIRTIO_BALLOON_PFN_SHIFT
+
+	// pfnChunk is the number of page frame numbers read at once.
+	pfnChunk = 256
+
+	// configSize is the size of struct virtio_balloon_config, and actualOff
+	// the offset of its actual field, the only one written by the driver.
+	configSize = 16
+	actualOff  = 4
+)
+
+// ErrQueues is returned by Activate when the driver did not enable the
+// inflate and deflate queues, or the queue of a negotiated feature.
+var ErrQueues = errors.New("balloondev: the inflate, deflate and negotiated queues are required")
+
+func init() {
+	virtio.Register(virtio.DeviceBalloon, func() virtio.Device { return &Device{} })
+}
+
+// Device is a virtio-balloon device. Its fields are set before the device is
+// activated.
+type Device struct {
+	// DeflateOnOOM offers FeatureDeflateOnOOM, letting the guest deflate
+	// the balloon when it runs out of memory.
+	DeflateOnOOM bool
+
+	// Discard is called with the ranges of guest memory given up by the
+	// guest, which may be released. If nil, the ranges are passed to the
+	// Discard method of the guest memory if it has one, like
+	// virtio.Memory.
+	Discard func(addr, n uint64)
+
+	mu       sync.Mutex
+	features virtio.Features
+	irq      virtio.Interrupter
+	done     chan struct{}
+	wg       sync.WaitGroup
+	discard  func(addr, n uint64)
+
+	// size of the balloon in pages: the target of the host and the actual
+	// size reported by the driver.
+	target, actual uint32
+
+	// hintID is the free page hint command id of the configuration space,
+	// lastHintID the id of the last session, and hinting the session the
+	// driver reported hints for.
+	hintID, lastHintID, hinting uint32
+
+	// stats are the last statistics of the driver, and statsUpdated is
+	// closed when they are replaced. statsRequest asks the stats queue for
+	// new statistics.
+	stats        map[Stat]uint64
+	statsUpdated chan struct{}
+	statsRequest chan struct{}
+}
+
+var _ virtio.Device = (*Device)(nil)
+
+// DeviceID implements virtio.Device.DeviceID.
+func (d *Device) DeviceID() virtio.DeviceID {
+	return virtio.DeviceBalloon
+}
+
+// Features implements virtio.Device.Features.
+func (d *Device) Features() virtio.Features {
+	f := FeatureStatsVQ | FeatureFreePageHint | FeaturePageReporting |
+		virtio.FeatureIndirectDesc | virtio.FeatureEventIdx | virtio.FeatureRingPacked
+	if d.DeflateOnOOM {
+		f |= FeatureDeflateOnOOM
+	}
+
+	return f
+}
+
+// AckFeatures implements virtio.Device.AckFeatures.
+func (d *Device) AckFeatures(f virtio.Features) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.features = f
+}
+
+// QueueMaxSizes implements virtio.Device.QueueMaxSizes.
+func (d *Device) QueueMaxSizes() []uint16 {
+	return []uint16{queueSize, queueSize, queueSize, queueSize, queueSize}
+}
+
+// optionalQueues returns the indices of the stats, free page hint and
+// reporting queues with the features f, -1 for a queue without its feature.
+func optionalQueues(f virtio.Features) (stats, hint, report int) {
+	stats, hint, report = -1, -1, -1
+	next := deflateQueue + 1
+	if f.Has(FeatureStatsVQ) {
+		stats, next = next, next+1
+	}
+	if f.Has(FeatureFreePageHint) {
+		hint, next = next, next+1
+	}
+	if f.Has(FeaturePageReporting) {
+		report = next
+	}
+
+	return stats, hint, report
+}
+
+// config returns struct virtio_balloon_config. d.mu must be held.
+func (d *Device) config() []byte {
+	b := make([]byte, configSize)
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], d.target)
+	le.PutUint32(b[actualOff:], d.actual)
+	le.PutUint32(b[8:], d.hintID)
+
+	return b
+}
+
+// ReadConfig implements virtio.Device.ReadConfig.
+func (d *Device) ReadConfig(off uint64, p []byte) {
+	d.mu.Lock()
+	config := d.config()
+	d.mu.Unlock()
+
+	for i := range p {
+		p[i] = 0
+	}
+	if off < uint64(len(config)) {
+		copy(p, config[off:])
+	}
+}
+
+// WriteConfig implements virtio.Device.WriteConfig. Only the actual field is
+// writable.
+func (d *Device) WriteConfig(off uint64, p []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if off < actualOff || off+uint64(len(p)) > actualOff+4 {
+		return
+	}
+	config := d.config()
+	copy(config[off:], p)
+	d.actual = binary.LittleEndian.Uint32(config[actualOff:])
+}
+
+// Activate implements virtio.Device.Activate.
+func (d *Device) Activate(mem virtio.GuestMemory, queues []*virtio.Queue, irq virtio.Interrupter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats, hint, report := optionalQueues(d.features)
+	for _, i := range []int{inflateQueue, deflateQueue, stats, hint, report} {
+		if i >= 0 && queues[i] == nil {
+			return ErrQueues
+		}
+	}
+
+	d.discard = d.Discard
+	if m, ok := mem.(interface{ Discard(addr, n uint64) error }); ok && d.discard == nil {
+		d.discard = func(addr, n uint64) { _ = m.Discard(addr, n) }
+	}
+	d.irq = irq
+	d.done = make(chan struct{})
+	d.hintID, d.hinting = hintStop, hintStop
+
+	d.wg.Add(2)
+	go d.serve(queues[inflateQueue], irq, d.inflate, d.done)
+	go d.serve(queues[deflateQueue], irq, d.deflate, d.done)
+	if stats >= 0 {
+		d.stats, d.statsUpdated = nil, make(chan struct{})
+		d.statsRequest = make(chan struct{}, 1)
+		d.wg.Add(1)
+		go d.serveStats(queues[stats], irq, d.statsRequest, d.done)
+	}
+	if hint >= 0 {
+		d.wg.Add(1)
+		go d.serve(queues[hint], irq, d.hint, d.done)
+	}
+	if report >= 0 {
+		d.wg.Add(1)
+		go d.serve(queues[report], irq, d.report, d.done)
+	}
+
+	return nil
+}
+
+// Reset implements virtio.Device.Reset. The target of the host is kept.
+func (d *Device) Reset() {
+	d.mu.Lock()
+	done := d.done
+	d.irq, d.done = nil, nil
+	d.features = 0
+	d.actual = 0
+	d.hintID, d.hinting = hintStop, hintStop
+	d.stats, d.statsRequest = nil, nil
+	d.mu.Unlock()
+
+	if done != nil {
+		close(done)
+		d.wg.Wait()
+	}
+}
+
+// SetTarget sets the size of the balloon the driver should reach, in pages of
+// PageSize bytes, notifying the driver if the device is active.
+func (d *Device) SetTarget(pages uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.target = pages
+	if d.irq != nil {
+		d.irq.InterruptConfig()
+	}
+}
+
+// Target returns the size of the balloon set by SetTarget, in pages.
+func (d *Device) Target() uint32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.target
+}
+
+// Actual returns the size of the balloon reported by the driver, in pages.
+func (d *Device) Actual() uint32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.actual
+}
+
+// serve passes the chains of q to handle until done is closed.
+func (d *Device) serve(q *virtio.Queue, irq virtio.Interrupter, handle func(c *virtio.DescriptorChain), done <-chan struct{}) {
+	defer d.wg.Done()
+
+	q.Serve(irq, done, func(c *virtio.DescriptorChain) bool {
+		handle(c)
+		return true
+	})
+}
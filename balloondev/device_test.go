@@ -0,0 +1,338 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package balloondev
+
+import (
+	"context"
+	"encoding/binary"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/go-hypervisor/virtio"
+	"github.com/go-hypervisor/virtio/driver"
+	"github.com/go-hypervisor/virtio/driver/drivertest"
+)
+
+// guest is the driver side of a device over a loopback.
+type guest struct {
+	t       *testing.T
+	ctx     context.Context
+	l       *driver.Loopback
+	queues  []*driver.Queue // by index
+	configs chan struct{}
+}
+
+// newGuest returns the guest of dev with the queues of the features.
+func newGuest(t *testing.T, dev *Device, features virtio.Features) *guest {
+	t.Helper()
+
+	stats, hint, report := optionalQueues(features)
+	n := 2
+	for _, i := range []int{stats, hint, report} {
+		if i >= 0 {
+			n++
+		}
+	}
+	g := &guest{t: t, configs: make(chan struct{}, 16)}
+	dg := drivertest.New(t, dev, drivertest.Config{
+		Features: features,
+		Queues:   drivertest.Range(n),
+		Memory:   4 << 20,
+		Config:   func() { g.configs <- struct{}{} },
+	})
+	g.ctx, g.l, g.queues = dg.Ctx, dg.Loopback, dg.Queues
+
+	return g
+}
+
+// do submits r to the queue i and waits for its completion.
+func (g *guest) do(i int, r *driver.Request) {
+	g.t.Helper()
+
+	if err := g.queues[i].Do(g.ctx, r); err != nil {
+		g.t.Fatal(err)
+	}
+}
+
+// config returns the field of the configuration space at off.
+func (g *guest) config(off uint64) uint32 {
+	var b [4]byte
+	g.l.ReadConfig(off, b[:])
+
+	return binary.LittleEndian.Uint32(b[:])
+}
+
+// configChange waits for a configuration change notification.
+func (g *guest) configChange() {
+	g.t.Helper()
+
+	select {
+	case <-g.configs:
+	case <-g.ctx.Done():
+		g.t.Fatal("no configuration change")
+	}
+}
+
+// pfns returns the array of page frame numbers.
+func pfns(pfns ...uint32) []byte {
+	b := make([]byte, 4*len(pfns))
+	for i, pfn := range pfns {
+		binary.LittleEndian.PutUint32(b[4*i:], pfn)
+	}
+
+	return b
+}
+
+// discards records the ranges passed to Device.Discard.
+type discards struct {
+	mu     sync.Mutex
+	ranges [][2]uint64
+}
+
+func (d *discards) discard(addr, n uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.ranges = append(d.ranges, [2]uint64{addr, n})
+}
+
+// take returns the ranges recorded since the last call.
+func (d *discards) take() [][2]uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ranges := d.ranges
+	d.ranges = nil
+
+	return ranges
+}
+
+func TestInflate(t *testing.T) {
+	var discarded discards
+	dev := &Device{Discard: discarded.discard}
+	dev.SetTarget(8)
+	g := newGuest(t, dev, 0)
+
+	if n := g.config(0); n != 8 {
+		t.Fatalf("num_pages %d", n)
+	}
+	dev.SetTarget(16)
+	g.configChange()
+	if n := g.config(0); n != 16 || dev.Target() != 16 {
+		t.Fatalf("num_pages %d", n)
+	}
+
+	g.do(inflateQueue, &driver.Request{Out: [][]byte{pfns(10, 11, 12, 20, 13)}})
+	want := [][2]uint64{{10 * PageSize, 3 * PageSize}, {20 * PageSize, PageSize}, {13 * PageSize, PageSize}}
+	if got := discarded.take(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("discarded %v, want %v", got, want)
+	}
+
+	// the runs are merged across the chunks read.
+	var long []uint32
+	for i := uint32(0); i < pfnChunk+44; i++ {
+		long = append(long, 1000+i)
+	}
+	long = append(long, 5, 6)
+	g.do(inflateQueue, &driver.Request{Out: [][]byte{pfns(long...)}})
+	want = [][2]uint64{{1000 * PageSize, (pfnChunk + 44) * PageSize}, {5 * PageSize, 2 * PageSize}}
+	if got := discarded.take(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("discarded %v, want %v", got, want)
+	}
+	g.l.WriteConfig(actualOff, []byte{5, 0, 0, 0})
+	if n := dev.Actual(); n != 5 {
+		t.Fatalf("actual %d", n)
+	}
+
+	// the other fields are read-only.
+	g.l.WriteConfig(0, []byte{1, 0, 0, 0})
+	if n := g.config(0); n != 16 {
+		t.Fatalf("num_pages %d after write", n)
+	}
+
+	g.do(deflateQueue, &driver.Request{Out: [][]byte{pfns(10, 11)}})
+	if got := discarded.take(); got != nil {
+		t.Fatalf("deflate discarded %v", got)
+	}
+}
+
+func TestDiscardMemory(t *testing.T) {
+	dev := &Device{}
+	g := newGuest(t, dev, 0)
+
+	// the pages at the end of the memory are not used by the driver.
+	data := g.l.Memory.Regions()[0].Data
+	pfn := uint32(len(data)/PageSize - 2)
+	page := data[int(pfn)*PageSize:]
+	for i := range page {
+		page[i] = 0xff
+	}
+	g.do(inflateQueue, &driver.Request{Out: [][]byte{pfns(pfn)}})
+	for i, b := range page {
+		want := byte(0xff)
+		if i < PageSize {
+			want = 0
+		}
+		if b != want {
+			t.Fatalf("byte %d = %#x, want %#x", i, b, want)
+		}
+	}
+}
+
+func TestPageReporting(t *testing.T) {
+	var discarded discards
+	g := newGuest(t, &Device{Discard: discarded.discard}, FeaturePageReporting)
+
+	_, _, report := optionalQueues(FeaturePageReporting)
+	r := &driver.Request{In: [][]byte{make([]byte, 2*PageSize), make([]byte, PageSize)}}
+	g.do(report, r)
+	got := discarded.take()
+	if len(got) != 2 || got[0][1] != 2*PageSize || got[1][1] != PageSize || r.Written != 0 {
+		t.Fatalf("discarded %v, %d bytes written", got, r.Written)
+	}
+}
+
+func TestFreePageHint(t *testing.T) {
+	var discarded discards
+	dev := &Device{Discard: discarded.discard}
+	g := newGuest(t, dev, FeatureFreePageHint)
+	_, hint, _ := optionalQueues(FeatureFreePageHint)
+
+	// send sends the command id of a session, then hints a page.
+	send := func(id uint32) [][2]uint64 {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, id)
+		g.do(hint, &driver.Request{Out: [][]byte{b}})
+		g.do(hint, &driver.Request{In: [][]byte{make([]byte, PageSize)}})
+		return discarded.take()
+	}
+
+	if got := send(hintMinID); got != nil {
+		t.Fatalf("discarded %v without session", got)
+	}
+	if !dev.StartFreePageHints() {
+		t.Fatal("no hinting")
+	}
+	g.configChange()
+	id := g.config(8)
+	if id < hintMinID {
+		t.Fatalf("command id %d", id)
+	}
+	if got := send(id); len(got) != 1 || got[0][1] != PageSize {
+		t.Fatalf("discarded %v", got)
+	}
+
+	dev.StopFreePageHints()
+	g.configChange()
+	if id := g.config(8); id != hintDone {
+		t.Fatalf("command id %d after stop", id)
+	}
+	if got := send(id); got != nil {
+		t.Fatalf("discarded %v after stop", got)
+	}
+
+	// the hints of the previous session are ignored.
+	dev.StartFreePageHints()
+	g.configChange()
+	if next := g.config(8); next == id {
+		t.Fatalf("command id %d reused", next)
+	}
+	if got := send(id); got != nil {
+		t.Fatalf("discarded %v of another session", got)
+	}
+}
+
+// statsBuffer returns the array of struct virtio_balloon_stat of stats.
+func statsBuffer(stats map[Stat]uint64) []byte {
+	var b []byte
+	for tag, v := range stats {
+		s := make([]byte, statSize)
+		binary.LittleEndian.PutUint16(s, uint16(tag))
+		binary.LittleEndian.PutUint64(s[2:], v)
+		b = append(b, s...)
+	}
+
+	return b
+}
+
+func TestStats(t *testing.T) {
+	dev := &Device{}
+	g := newGuest(t, dev, FeatureStatsVQ)
+	stats, _, _ := optionalQueues(FeatureStatsVQ)
+
+	type result struct {
+		stats map[Stat]uint64
+		err   error
+	}
+	request := func() <-chan result {
+		res := make(chan result, 1)
+		go func() {
+			s, err := dev.Stats(g.ctx)
+			res <- result{s, err}
+		}()
+		return res
+	}
+	check := func(res <-chan result, want map[Stat]uint64) {
+		t.Helper()
+		if r := <-res; r.err != nil || !reflect.DeepEqual(r.stats, want) {
+			t.Fatalf("Stats = %v, %v, want %v", r.stats, r.err, want)
+		}
+	}
+
+	// the first statistics of the driver may answer the first request.
+	first := map[Stat]uint64{StatFreeMemory: 1 << 30, StatTotalMemory: 4 << 30}
+	r := &driver.Request{Out: [][]byte{statsBuffer(first)}}
+	if err := g.queues[stats].Submit(r); err != nil {
+		t.Fatal(err)
+	}
+	res := request()
+	select {
+	case <-r.Done():
+	case got := <-res:
+		if got.err != nil || !reflect.DeepEqual(got.stats, first) {
+			t.Fatalf("Stats = %v, %v, want %v", got.stats, got.err, first)
+		}
+		res = request()
+	}
+
+	// the device gives the buffer back for new statistics.
+	if err := r.Wait(g.ctx); err != nil {
+		t.Fatal(err)
+	}
+	next := map[Stat]uint64{StatFreeMemory: 1 << 29, StatTotalMemory: 4 << 30, StatSwapIn: 7}
+	if err := g.queues[stats].Submit(&driver.Request{Out: [][]byte{statsBuffer(next)}}); err != nil {
+		t.Fatal(err)
+	}
+	check(res, next)
+}
+
+func TestQueues(t *testing.T) {
+	for _, tt := range []struct {
+		features            virtio.Features
+		stats, hint, report int
+	}{
+		{0, -1, -1, -1},
+		{FeatureStatsVQ | FeatureFreePageHint | FeaturePageReporting, 2, 3, 4},
+		{FeatureFreePageHint | FeaturePageReporting, -1, 2, 3},
+		{FeatureStatsVQ | FeaturePageReporting, 2, -1, 3},
+	} {
+		stats, hint, report := optionalQueues(tt.features)
+		if stats != tt.stats || hint != tt.hint || report != tt.report {
+			t.Errorf("queues of %v: %d %d %d, want %d %d %d", tt.features, stats, hint, report, tt.stats, tt.hint, tt.report)
+		}
+	}
+
+	dev := &Device{}
+	dev.AckFeatures(FeaturePageReporting)
+	if err := dev.Activate(nil, make([]*virtio.Queue, 5), nil); err != ErrQueues {
+		t.Fatalf("Activate without queues: %v", err)
+	}
+	if _, err := dev.Stats(context.Background()); err != ErrNoStats {
+		t.Fatalf("Stats of an inactive device: %v", err)
+	}
+	if dev.StartFreePageHints() {
+		t.Fatal("hinting on an inactive device")
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package balloondev implements the device side of virtio-balloon.
+//
+// A Device lets the host take memory back from the guest: SetTarget asks the
+// driver to inflate the balloon to a number of pages, which the driver
+// allocates and lists on the inflate queue, and deflating gives pages back.
+// The pages given up by the guest, inflated, hinted free with
+// FeatureFreePageHint or reported free with FeaturePageReporting, are passed
+// to the Discard callback of the device, by default the Discard method of the
+// guest memory, which releases them with madvise on a virtio.Memory. The
+// guest memory statistics of the stats queue are returned by Stats.
+package balloondev
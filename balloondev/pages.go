@@ -0,0 +1,124 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package balloondev
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// inflate discards the pages listed in c, an array of 32-bit page frame
+// numbers read pfnChunk at a time. Runs of consecutive pages are discarded
+// at once.
+func (d *Device) inflate(c *virtio.DescriptorChain) {
+	var b [4 * pfnChunk]byte
+	var start, n uint64
+	for {
+		k, err := io.ReadFull(c, b[:])
+		for i := 0; i+4 <= k; i += 4 {
+			pfn := uint64(binary.LittleEndian.Uint32(b[i:]))
+			if n > 0 && pfn == start+n {
+				n++
+				continue
+			}
+			d.discardPages(start, n)
+			start, n = pfn, 1
+		}
+		if err != nil {
+			break
+		}
+	}
+	d.discardPages(start, n)
+}
+
+// deflate consumes the pages listed in c, given back to the guest. The memory
+// of a discarded page comes back on its first access.
+func (d *Device) deflate(c *virtio.DescriptorChain) {
+	_, _ = io.Copy(io.Discard, c)
+}
+
+// discardPages discards the n pages from the page frame number pfn.
+func (d *Device) discardPages(pfn, n uint64) {
+	if n > 0 && d.discard != nil {
+		d.discard(pfn<<pfnShift, n<<pfnShift)
+	}
+}
+
+// discardBuffers discards the memory of the device-writable buffers of c.
+func (d *Device) discardBuffers(c *virtio.DescriptorChain) {
+	if d.discard == nil {
+		return
+	}
+	for _, desc := range c.Writable {
+		if desc.Len > 0 {
+			d.discard(desc.Addr, uint64(desc.Len))
+		}
+	}
+}
+
+// report discards the free pages reported in c.
+func (d *Device) report(c *virtio.DescriptorChain) {
+	d.discardBuffers(c)
+}
+
+// hint handles c on the free page hint queue: the command id of the session
+// the driver starts or stops hinting for, or free pages, discarded while the
+// session is that of the configuration space.
+func (d *Device) hint(c *virtio.DescriptorChain) {
+	if len(c.Readable) > 0 {
+		var b [4]byte
+		if _, err := io.ReadFull(c, b[:]); err == nil {
+			d.mu.Lock()
+			d.hinting = binary.LittleEndian.Uint32(b[:])
+			d.mu.Unlock()
+		}
+		return
+	}
+
+	// the pages are discarded with d.mu held so none is once
+	// StopFreePageHints returns.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.hintID >= hintMinID && d.hinting == d.hintID {
+		d.discardBuffers(c)
+	}
+}
+
+// StartFreePageHints starts a session of free page hints with
+// FeatureFreePageHint: the driver hints the free pages of the guest, which are
+// discarded until StopFreePageHints. It returns false if the device is not
+// active or the feature was not negotiated.
+func (d *Device) StartFreePageHints() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.irq == nil || !d.features.Has(FeatureFreePageHint) {
+		return false
+	}
+	d.lastHintID++
+	if d.lastHintID < hintMinID {
+		d.lastHintID = hintMinID
+	}
+	d.hintID = d.lastHintID
+	d.irq.InterruptConfig()
+
+	return true
+}
+
+// StopFreePageHints ends the session of free page hints: the driver stops
+// hinting and returns the hinted pages to the guest. No page is discarded
+// once it returns.
+func (d *Device) StopFreePageHints() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.irq == nil || d.hintID < hintMinID {
+		return
+	}
+	d.hintID = hintDone
+	d.irq.InterruptConfig()
+}
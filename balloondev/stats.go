@@ -0,0 +1,150 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package balloondev
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// Stat is the tag of a memory statistic of the guest.
+type Stat uint16
+
+// list of memory statistics. The memory sizes are in bytes.
+const (
+	StatSwapIn             Stat = 0 // VIRTIO_BALLOON_S_SWAP_IN, pages swapped in
+	StatSwapOut            Stat = 1 // VIRTIO_BALLOON_S_SWAP_OUT, pages swapped out
+	StatMajorFaults        Stat = 2 // VIRTIO_BALLOON_S_MAJFLT
+	StatMinorFaults        Stat = 3 // VIRTIO_BALLOON_S_MINFLT
+	StatFreeMemory         Stat = 4 // VIRTIO_BALLOON_S_MEMFREE
+	StatTotalMemory        Stat = 5 // VIRTIO_BALLOON_S_MEMTOT
+	StatAvailableMemory    Stat = 6 // VIRTIO_BALLOON_S_AVAIL
+	StatDiskCaches         Stat = 7 // VIRTIO_BALLOON_S_CACHES
+	StatHugetlbAllocations Stat = 8 // VIRTIO_BALLOON_S_HTLB_PGALLOC
+	StatHugetlbFailures    Stat = 9 // VIRTIO_BALLOON_S_HTLB_PGFAIL
+)
+
+// statSize is the size of struct virtio_balloon_stat.
+const statSize = 10
+
+// ErrNoStats is returned by Stats when the device is not active or the driver
+// did not negotiate FeatureStatsVQ.
+var ErrNoStats = errors.New("balloondev: no statistics queue")
+
+// Stats asks the driver for the memory statistics of the guest, with
+// FeatureStatsVQ, and returns them once received.
+func (d *Device) Stats(ctx context.Context) (map[Stat]uint64, error) {
+	d.mu.Lock()
+	updated, request, done := d.statsUpdated, d.statsRequest, d.done
+	d.mu.Unlock()
+	if request == nil {
+		return nil, ErrNoStats
+	}
+
+	select {
+	case request <- struct{}{}:
+	default:
+	}
+	select {
+	case <-updated:
+	case <-done:
+		return nil, ErrNoStats
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stats == nil {
+		return nil, ErrNoStats
+	}
+	stats := make(map[Stat]uint64, len(d.stats))
+	for tag, v := range d.stats {
+		stats[tag] = v
+	}
+
+	return stats, nil
+}
+
+// serveStats reads the statistics of the stats queue q until done is closed.
+// The driver keeps a single buffer in the queue, which the device holds until
+// it requests new statistics by giving it back.
+func (d *Device) serveStats(q *virtio.Queue, irq virtio.Interrupter, request <-chan struct{}, done <-chan struct{}) {
+	defer d.wg.Done()
+
+	for {
+		c, err := pop(q, done)
+		if err != nil {
+			<-done
+			return
+		}
+		if c == nil {
+			return
+		}
+		stats := readStats(c)
+
+		// a request made before these statistics is answered by them.
+		select {
+		case <-request:
+		default:
+		}
+		d.mu.Lock()
+		d.stats = stats
+		close(d.statsUpdated)
+		d.statsUpdated = make(chan struct{})
+		d.mu.Unlock()
+
+		select {
+		case <-done:
+			return
+		case <-request:
+		}
+		if err := q.PushChain(c); err != nil {
+			<-done
+			return
+		}
+		if q.NeedsNotification() {
+			irq.InterruptQueue(q.Index())
+		}
+	}
+}
+
+// readStats returns the array of struct virtio_balloon_stat of c.
+func readStats(c *virtio.DescriptorChain) map[Stat]uint64 {
+	stats := make(map[Stat]uint64)
+	var b [statSize]byte
+	for {
+		if _, err := io.ReadFull(c, b[:]); err != nil {
+			return stats
+		}
+		stats[Stat(binary.LittleEndian.Uint16(b[0:]))] = binary.LittleEndian.Uint64(b[2:])
+	}
+}
+
+// pop returns the next chain of q, waiting for one until done is closed, then
+// returning nil.
+func pop(q *virtio.Queue, done <-chan struct{}) (*virtio.DescriptorChain, error) {
+	for {
+		c, ok, err := q.PopChain()
+		if err != nil || ok {
+			return c, err
+		}
+		q.EnableNotifications()
+		if c, ok, err = q.PopChain(); err != nil || ok {
+			q.DisableNotifications()
+			return c, err
+		}
+
+		select {
+		case <-done:
+			return nil, nil
+		case <-q.Notified():
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package blkdev
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// Backend is the storage of a device. Its methods are called concurrently by
+// the request queues.
+type Backend interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Size returns the size of the storage in bytes.
+	Size() int64
+
+	// Flush makes the completed writes durable.
+	Flush() error
+
+	// Close closes the storage.
+	Close() error
+}
+
+// Discarder is implemented by a backend which can release the storage of a
+// range, which then reads unspecified data.
+type Discarder interface {
+	Discard(off, n int64) error
+}
+
+// Zeroer is implemented by a backend which can zero a range without writing
+// it, releasing its storage if unmap. Otherwise the device writes zeros.
+type Zeroer interface {
+	WriteZeroes(off, n int64, unmap bool) error
+}
+
+// ErrRange is returned by the in-memory backend for accesses beyond its
+// size.
+var ErrRange = errors.New("blkdev: access beyond the end of the disk")
+
+// Memory is an in-memory disk.
+type Memory struct {
+	mu sync.RWMutex
+	b  []byte
+}
+
+var (
+	_ Backend   = (*Memory)(nil)
+	_ Discarder = (*Memory)(nil)
+	_ Zeroer    = (*Memory)(nil)
+)
+
+// NewMemory returns a zeroed disk of size bytes.
+func NewMemory(size int64) *Memory {
+	return &Memory{b: make([]byte, size)}
+}
+
+// slice returns the range of n bytes at off, or ErrRange.
+func (m *Memory) slice(off, n int64) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > int64(len(m.b)) || off+n < off {
+		return nil, ErrRange
+	}
+
+	return m.b[off : off+n], nil
+}
+
+// ReadAt implements Backend.ReadAt.
+func (m *Memory) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b, err := m.slice(off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+
+	return copy(p, b), nil
+}
+
+// WriteAt implements Backend.WriteAt.
+func (m *Memory) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, err := m.slice(off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+
+	return copy(b, p), nil
+}
+
+// Size implements Backend.Size.
+func (m *Memory) Size() int64 {
+	return int64(len(m.b))
+}
+
+// Flush implements Backend.Flush.
+func (m *Memory) Flush() error {
+	return nil
+}
+
+// Close implements Backend.Close.
+func (m *Memory) Close() error {
+	return nil
+}
+
+// Discard implements Discarder.Discard. The range reads zeros.
+func (m *Memory) Discard(off, n int64) error {
+	return m.WriteZeroes(off, n, true)
+}
+
+// WriteZeroes implements Zeroer.WriteZeroes.
+func (m *Memory) WriteZeroes(off, n int64, unmap bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, err := m.slice(off, n)
+	if err != nil {
+		return err
+	}
+	for i := range b {
+		b[i] = 0
+	}
+
+	return nil
+}
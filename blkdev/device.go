@@ -0,0 +1,340 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package blkdev
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sync"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// list of device feature bits.
+const (
+	FeatureSizeMax     virtio.Features = 1 << 1  // VIRTIO_BLK_F_SIZE_MAX
+	FeatureSegMax      virtio.Features = 1 << 2  // VIRTIO_BLK_F_SEG_MAX
+	FeatureRO          virtio.Features = 1 << 5  // VIRTIO_BLK_F_RO
+	FeatureBlkSize     virtio.Features = 1 << 6  // VIRTIO_BLK_F_BLK_SIZE
+	FeatureFlush       virtio.Features = 1 << 9  // VIRTIO_BLK_F_FLUSH
+	FeatureTopology    virtio.Features = 1 << 10 // VIRTIO_BLK_F_TOPOLOGY
+	FeatureMQ          virtio.Features = 1 << 12 // VIRTIO_BLK_F_MQ
+	FeatureDiscard     virtio.Features = 1 << 13 // VIRTIO_BLK_F_DISCARD
+	FeatureWriteZeroes virtio.Features = 1 << 14 // VIRTIO_BLK_F_WRITE_ZEROES
+)
+
+const (
+	// SectorSize is the unit of the sectors of the requests and of the
+	// capacity, whatever the block size.
+	SectorSize = 512
+
+	// queueSize is the maximum size of the queues.
+	queueSize = 256
+
+	// segMax is the maximum number of data buffers of a request: the
+	// descriptors of a chain but the header and the status.
+	segMax = queueSize - 2
+
+	// maxQueues is the largest number of request queues.
+	maxQueues = 0x10000 - 1
+
+	// maxRangeSectors is the largest range of a discard or write zeroes
+	// segment, and maxRangeSegs the largest number of segments of a request.
+	maxRangeSectors = 1 << 22
+	maxRangeSegs    = 32
+
+	// IDSize is the length of the serial returned by GET_ID.
+	IDSize = 20
+)
+
+var (
+	// ErrNoBackend is returned by Activate for a device without backend.
+	ErrNoBackend = errors.New("blkdev: no backend")
+
+	// ErrQueues is returned by Activate when the driver did not enable the
+	// first request queue.
+	ErrQueues = errors.New("blkdev: the first request queue is required")
+)
+
+func init() {
+	virtio.Register(virtio.DeviceBlock, func() virtio.Device { return &Device{} })
+}
+
+// Device is a virtio-blk device. Its fields are set before the device is
+// activated.
+type Device struct {
+	// Backend is the storage of the disk. Its size is rounded down to a
+	// sector.
+	Backend Backend
+
+	// ReadOnly rejects the writes, offering FeatureRO.
+	ReadOnly bool
+
+	// ID is the serial returned by GET_ID, truncated to IDSize bytes.
+	ID string
+
+	// BlockSize is the logical block size reported to the driver, 512 if
+	// zero.
+	BlockSize uint32
+
+	// PhysicalBlockSize, MinIOSize and OptIOSize are the topology of the
+	// disk in bytes, offered with FeatureTopology if one of them is set.
+	PhysicalBlockSize uint32
+	MinIOSize         uint32
+	OptIOSize         uint32
+
+	// Queues is the number of request queues, offered with FeatureMQ if
+	// more than 1. Zero means 1.
+	Queues int
+
+	// Engine, if set, runs the reads, writes and flushes on Backend
+	// asynchronously: the requests taken at a notification are submitted
+	// as a batch, and returned to the driver as they complete, in any
+	// order. It is closed by Close.
+	Engine Engine
+
+	mu       sync.Mutex
+	features virtio.Features
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+var _ virtio.Device = (*Device)(nil)
+
+// DeviceID implements virtio.Device.DeviceID.
+func (d *Device) DeviceID() virtio.DeviceID {
+	return virtio.DeviceBlock
+}
+
+// Features implements virtio.Device.Features.
+func (d *Device) Features() virtio.Features {
+	f := FeatureSegMax | FeatureBlkSize | FeatureFlush |
+		virtio.FeatureIndirectDesc | virtio.FeatureEventIdx | virtio.FeatureRingPacked
+	if d.ReadOnly {
+		f |= FeatureRO
+	} else {
+		f |= FeatureWriteZeroes
+		if _, ok := d.Backend.(Discarder); ok {
+			f |= FeatureDiscard
+		}
+	}
+	if d.PhysicalBlockSize != 0 || d.MinIOSize != 0 || d.OptIOSize != 0 {
+		f |= FeatureTopology
+	}
+	if d.queues() > 1 {
+		f |= FeatureMQ
+	}
+
+	return f
+}
+
+// AckFeatures implements virtio.Device.AckFeatures.
+func (d *Device) AckFeatures(f virtio.Features) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.features = f
+}
+
+// queues returns the number of request queues.
+func (d *Device) queues() int {
+	switch {
+	case d.Queues < 1:
+		return 1
+	case d.Queues > maxQueues:
+		return maxQueues
+	}
+
+	return d.Queues
+}
+
+// QueueMaxSizes implements virtio.Device.QueueMaxSizes.
+func (d *Device) QueueMaxSizes() []uint16 {
+	sizes := make([]uint16, d.queues())
+	for i := range sizes {
+		sizes[i] = queueSize
+	}
+
+	return sizes
+}
+
+// blockSize returns the logical block size.
+func (d *Device) blockSize() uint32 {
+	if d.BlockSize == 0 {
+		return SectorSize
+	}
+
+	return d.BlockSize
+}
+
+// capacity returns the size of the disk in sectors.
+func (d *Device) capacity() uint64 {
+	if d.Backend == nil {
+		return 0
+	}
+
+	return uint64(d.Backend.Size()) / SectorSize
+}
+
+// config returns struct virtio_blk_config.
+func (d *Device) config() []byte {
+	var b [60]byte
+	le := binary.LittleEndian
+	le.PutUint64(b[0:], d.capacity())
+	le.PutUint32(b[12:], segMax)
+	bs := d.blockSize()
+	le.PutUint32(b[20:], bs)
+
+	// topology, in logical blocks.
+	if d.PhysicalBlockSize > bs {
+		b[24] = uint8(bits.Len32(d.PhysicalBlockSize/bs) - 1)
+	}
+	le.PutUint16(b[26:], uint16(d.MinIOSize/bs))
+	le.PutUint32(b[28:], d.OptIOSize/bs)
+
+	le.PutUint16(b[34:], uint16(d.queues()))
+	le.PutUint32(b[36:], maxRangeSectors)
+	le.PutUint32(b[40:], maxRangeSegs)
+	le.PutUint32(b[44:], bs/SectorSize)
+	le.PutUint32(b[48:], maxRangeSectors)
+	le.PutUint32(b[52:], maxRangeSegs)
+	if _, ok := d.Backend.(Zeroer); ok {
+		b[56] = 1
+	}
+
+	return b[:]
+}
+
+// ReadConfig implements virtio.Device.ReadConfig.
+func (d *Device) ReadConfig(off uint64, p []byte) {
+	config := d.config()
+	for i := range p {
+		p[i] = 0
+	}
+	if off < uint64(len(config)) {
+		copy(p, config[off:])
+	}
+}
+
+// WriteConfig implements virtio.Device.WriteConfig. The configuration space is
+// read-only.
+func (d *Device) WriteConfig(off uint64, p []byte) {}
+
+// Activate implements virtio.Device.Activate.
+func (d *Device) Activate(mem virtio.GuestMemory, queues []*virtio.Queue, irq virtio.Interrupter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case d.Backend == nil:
+		return ErrNoBackend
+	case queues[0] == nil:
+		return ErrQueues
+	}
+	n := 1
+	if d.features.Has(FeatureMQ) {
+		n = len(queues)
+	}
+
+	d.done = make(chan struct{})
+	for _, q := range queues[:n] {
+		if q == nil {
+			continue
+		}
+		d.wg.Add(1)
+		go d.serve(q, irq, d.features, d.done)
+	}
+
+	return nil
+}
+
+// Reset implements virtio.Device.Reset. It waits for the requests in
+// progress.
+func (d *Device) Reset() {
+	d.mu.Lock()
+	done := d.done
+	d.done, d.features = nil, 0
+	d.mu.Unlock()
+
+	if done != nil {
+		close(done)
+		d.wg.Wait()
+	}
+}
+
+// Close resets the device and closes its engine and backend.
+func (d *Device) Close() error {
+	d.Reset()
+	var err error
+	if d.Engine != nil {
+		err = d.Engine.Close()
+	}
+	if d.Backend != nil {
+		if berr := d.Backend.Close(); err == nil {
+			err = berr
+		}
+	}
+
+	return err
+}
+
+// serve handles the requests of q with the negotiated features f until done
+// is closed.
+func (d *Device) serve(q *virtio.Queue, irq virtio.Interrupter, f virtio.Features, done <-chan struct{}) {
+	defer d.wg.Done()
+
+	// the requests in flight use guest memory: they are waited for however
+	// serve returns.
+	w := &worker{d: d, features: f, completed: make(chan *request, queueSize)}
+	defer w.wait()
+	for {
+		if err := d.drain(q, irq, w); err != nil {
+			// a broken queue is left alone until the driver resets.
+			<-done
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		case <-q.Notified():
+		case r := <-w.completed:
+			if err := d.complete(q, irq, w, r); err != nil {
+				<-done
+				return
+			}
+		}
+	}
+}
+
+// drain handles the requests of q with virtio.Queue.Drain. The requests for
+// the engine are submitted together on return, and pushed once completed.
+func (d *Device) drain(q *virtio.Queue, irq virtio.Interrupter, w *worker) error {
+	defer w.submit()
+
+	return q.Drain(irq, func(c *virtio.DescriptorChain) bool {
+		return !w.handle(c)
+	})
+}
+
+// complete returns r and the other requests completed by the engine to the
+// driver.
+func (d *Device) complete(q *virtio.Queue, irq virtio.Interrupter, w *worker, r *request) error {
+	for {
+		w.complete(r)
+		if err := q.PushChain(r.c); err != nil {
+			return err
+		}
+		if q.NeedsNotification() {
+			irq.InterruptQueue(q.Index())
+		}
+
+		select {
+		case r = <-w.completed:
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package blkdev
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-hypervisor/virtio"
+	"github.com/go-hypervisor/virtio/driver"
+	"github.com/go-hypervisor/virtio/driver/drivertest"
+)
+
+// diskSize is the size of the disks of the tests.
+const diskSize = 64 * SectorSize
+
+// guest is the driver side of a device over a loopback.
+type guest struct {
+	t   *testing.T
+	ctx context.Context
+	l   *driver.Loopback
+	qs  []*driver.Queue
+}
+
+func newGuest(t *testing.T, dev *Device, features virtio.Features) *guest {
+	t.Helper()
+
+	n := 1
+	if features.Has(FeatureMQ) {
+		n = dev.queues()
+	}
+	dg := drivertest.New(t, dev, drivertest.Config{Features: features, Queues: drivertest.Range(n)})
+
+	return &guest{t: t, ctx: dg.Ctx, l: dg.Loopback, qs: dg.Queues}
+}
+
+// newRequest returns the request typ at sector with the readable data, reading
+// in bytes of data before the status.
+func newRequest(typ uint32, sector uint64, data [][]byte, in int) *driver.Request {
+	h := make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(h[0:], typ)
+	binary.LittleEndian.PutUint64(h[8:], sector)
+	r := &driver.Request{Out: append([][]byte{h}, data...), In: [][]byte{{0xff}}}
+	if in > 0 {
+		r.In = [][]byte{make([]byte, in), r.In[0]}
+	}
+
+	return r
+}
+
+// result returns the data read by r and its status.
+func result(r *driver.Request) ([]byte, uint8) {
+	status := r.In[len(r.In)-1][0]
+	if len(r.In) == 1 {
+		return nil, status
+	}
+
+	return r.In[0], status
+}
+
+// do sends the request typ at sector with the readable data on the queue q,
+// and returns in bytes of data read and the status.
+func (g *guest) do(q int, typ uint32, sector uint64, data [][]byte, in int) ([]byte, uint8) {
+	g.t.Helper()
+
+	r := newRequest(typ, sector, data, in)
+	if err := g.qs[q].Do(g.ctx, r); err != nil {
+		g.t.Fatal(err)
+	}
+	if r.Written != uint32(in+1) {
+		g.t.Fatalf("request %d: %d bytes written, want %d", typ, r.Written, in+1)
+	}
+	return result(r)
+}
+
+// mustDo sends a request expected to succeed.
+func (g *guest) mustDo(typ uint32, sector uint64, data [][]byte, in int) []byte {
+	g.t.Helper()
+
+	b, status := g.do(0, typ, sector, data, in)
+	if status != statusOK {
+		g.t.Fatalf("request %d at %d: status %d", typ, sector, status)
+	}
+
+	return b
+}
+
+// segment returns struct virtio_blk_discard_write_zeroes.
+func segment(sector uint64, sectors, flags uint32) []byte {
+	b := make([]byte, rangeSize)
+	binary.LittleEndian.PutUint64(b[0:], sector)
+	binary.LittleEndian.PutUint32(b[8:], sectors)
+	binary.LittleEndian.PutUint32(b[12:], flags)
+
+	return b
+}
+
+func pattern(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = seed + byte(i/SectorSize)
+	}
+
+	return b
+}
+
+func TestReadWrite(t *testing.T) {
+	for _, features := range []virtio.Features{0, virtio.FeatureEventIdx | virtio.FeatureRingPacked} {
+		t.Run(fmt.Sprint(features), func(t *testing.T) {
+			mem := NewMemory(diskSize)
+			g := newGuest(t, &Device{Backend: mem}, features)
+
+			data := pattern(3*SectorSize, 1)
+			g.mustDo(typeOut, 5, [][]byte{data[:SectorSize], data[SectorSize:]}, 0)
+			if got := mem.b[5*SectorSize : 8*SectorSize]; !bytes.Equal(got, data) {
+				t.Fatal("disk content differs")
+			}
+			if got := g.mustDo(typeIn, 5, nil, 3*SectorSize); !bytes.Equal(got, data) {
+				t.Fatal("read content differs")
+			}
+			if got := g.mustDo(typeIn, 63, nil, SectorSize); !bytes.Equal(got, make([]byte, SectorSize)) {
+				t.Fatal("last sector not zero")
+			}
+
+			for _, tt := range []struct {
+				typ    uint32
+				sector uint64
+				data   [][]byte
+				in     int
+			}{
+				{typeIn, 63, nil, 2 * SectorSize},      // beyond the end
+				{typeIn, 1 << 60, nil, SectorSize},     // overflowing
+				{typeIn, 0, nil, 100},                  // partial sector
+				{typeOut, 64, [][]byte{data[:512]}, 0}, // beyond the end
+				{typeOut, 0, [][]byte{data[:100]}, 0},  // partial sector
+			} {
+				if _, status := g.do(0, tt.typ, tt.sector, tt.data, tt.in); status != statusIOErr {
+					t.Errorf("request %d at %d: status %d", tt.typ, tt.sector, status)
+				}
+			}
+		})
+	}
+}
+
+// flushCounter counts the flushes of a backend.
+type flushCounter struct {
+	*Memory
+	flushes int32
+}
+
+func (f *flushCounter) Flush() error {
+	atomic.AddInt32(&f.flushes, 1)
+	return nil
+}
+
+func TestFlush(t *testing.T) {
+	b := &flushCounter{Memory: NewMemory(diskSize)}
+	g := newGuest(t, &Device{Backend: b}, FeatureFlush)
+
+	g.mustDo(typeFlush, 0, nil, 0)
+	if n := atomic.LoadInt32(&b.flushes); n != 1 {
+		t.Fatalf("%d flushes", n)
+	}
+}
+
+func TestGetID(t *testing.T) {
+	g := newGuest(t, &Device{Backend: NewMemory(diskSize), ID: "serial-0001"}, 0)
+
+	want := append([]byte("serial-0001"), make([]byte, IDSize-11)...)
+	if got := g.mustDo(typeGetID, 0, nil, IDSize); !bytes.Equal(got, want) {
+		t.Fatalf("id %q", got)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	mem := NewMemory(diskSize)
+	g := newGuest(t, &Device{Backend: mem}, FeatureDiscard)
+
+	g.mustDo(typeOut, 0, [][]byte{pattern(8*SectorSize, 1)}, 0)
+	g.mustDo(typeDiscard, 0, [][]byte{segment(1, 2, 0), segment(6, 1, 0)}, 0)
+	want := pattern(8*SectorSize, 1)
+	for _, s := range []int{1, 2, 6} {
+		copy(want[s*SectorSize:], make([]byte, SectorSize))
+	}
+	if !bytes.Equal(mem.b[:8*SectorSize], want) {
+		t.Fatal("disk content differs")
+	}
+
+	var many []byte
+	for i := 0; i <= maxRangeSegs; i++ {
+		many = append(many, segment(uint64(i), 1, 0)...)
+	}
+	for _, tt := range []struct {
+		segs   [][]byte
+		status uint8
+	}{
+		{[][]byte{segment(0, 1, rangeUnmap)}, statusUnsupp}, // unmap is reserved
+		{[][]byte{segment(0, maxRangeSectors+1, 0)}, statusUnsupp},
+		{[][]byte{many}, statusUnsupp},
+		{[][]byte{segment(0, 1, 0)[:8]}, statusUnsupp}, // partial segment
+		{[][]byte{segment(60, 8, 0)}, statusIOErr},
+	} {
+		if _, status := g.do(0, typeDiscard, 0, tt.segs, 0); status != tt.status {
+			t.Errorf("%d segments: status %d, want %d", len(tt.segs), status, tt.status)
+		}
+	}
+}
+
+func TestWriteZeroes(t *testing.T) {
+	for _, zeroer := range []bool{true, false} {
+		t.Run(fmt.Sprint(zeroer), func(t *testing.T) {
+			mem := NewMemory(diskSize)
+			var backend Backend = mem
+			if !zeroer {
+				// the device writes the zeros itself.
+				backend = struct{ Backend }{mem}
+			}
+			g := newGuest(t, &Device{Backend: backend}, FeatureWriteZeroes)
+
+			g.mustDo(typeOut, 0, [][]byte{pattern(4*SectorSize, 1)}, 0)
+			g.mustDo(typeWriteZeroes, 0, [][]byte{segment(1, 2, rangeUnmap)}, 0)
+			want := pattern(4*SectorSize, 1)
+			copy(want[SectorSize:], make([]byte, 2*SectorSize))
+			if got := g.mustDo(typeIn, 0, nil, 4*SectorSize); !bytes.Equal(got, want) {
+				t.Fatal("disk content differs")
+			}
+
+			b := make([]byte, 1)
+			g.l.ReadConfig(56, b)
+			if zeroer != (b[0] == 1) {
+				t.Fatalf("write_zeroes_may_unmap %d", b[0])
+			}
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dev := &Device{Backend: NewMemory(diskSize), ReadOnly: true}
+	if f := dev.Features(); !f.Has(FeatureRO) || f.Has(FeatureDiscard) || f.Has(FeatureWriteZeroes) {
+		t.Fatalf("features %v", f)
+	}
+	g := newGuest(t, dev, FeatureRO)
+
+	if _, status := g.do(0, typeOut, 0, [][]byte{make([]byte, SectorSize)}, 0); status != statusIOErr {
+		t.Fatalf("write status %d", status)
+	}
+	if _, status := g.do(0, typeWriteZeroes, 0, [][]byte{segment(0, 1, 0)}, 0); status != statusUnsupp {
+		t.Fatalf("write zeroes status %d", status)
+	}
+	g.mustDo(typeIn, 0, nil, SectorSize)
+}
+
+func TestUnsupported(t *testing.T) {
+	g := newGuest(t, &Device{Backend: NewMemory(diskSize)}, 0)
+
+	for _, typ := range []uint32{typeDiscard, typeWriteZeroes, 99} {
+		if _, status := g.do(0, typ, 0, [][]byte{segment(0, 1, 0)}, 0); status != statusUnsupp {
+			t.Errorf("request %d: status %d", typ, status)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dev := &Device{
+		Backend:           NewMemory(diskSize + 100),
+		BlockSize:         4096,
+		PhysicalBlockSize: 16384,
+		MinIOSize:         8192,
+		OptIOSize:         65536,
+		Queues:            3,
+	}
+	want := FeatureBlkSize | FeatureSegMax | FeatureTopology | FeatureMQ
+	if f := dev.Features(); f&want != want {
+		t.Fatalf("features %v", f)
+	}
+	g := newGuest(t, dev, want)
+
+	b := make([]byte, 60)
+	g.l.ReadConfig(0, b)
+	le := binary.LittleEndian
+	for _, tt := range []struct {
+		name      string
+		got, want uint64
+	}{
+		{"capacity", le.Uint64(b[0:]), diskSize / SectorSize},
+		{"seg_max", uint64(le.Uint32(b[12:])), segMax},
+		{"blk_size", uint64(le.Uint32(b[20:])), 4096},
+		{"physical_block_exp", uint64(b[24]), 2},
+		{"min_io_size", uint64(le.Uint16(b[26:])), 2},
+		{"opt_io_size", uint64(le.Uint32(b[28:])), 16},
+		{"num_queues", uint64(le.Uint16(b[34:])), 3},
+		{"discard_sector_alignment", uint64(le.Uint32(b[44:])), 8},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestMultiqueue(t *testing.T) {
+	mem := NewMemory(diskSize)
+	g := newGuest(t, &Device{Backend: mem, Queues: 4}, FeatureMQ)
+	if len(g.qs) != 4 {
+		t.Fatalf("%d queues", len(g.qs))
+	}
+
+	for i := range g.qs {
+		data := pattern(SectorSize, byte(i+1))
+		if _, status := g.do(i, typeOut, uint64(i), [][]byte{data}, 0); status != statusOK {
+			t.Fatalf("queue %d: write status %d", i, status)
+		}
+	}
+	for i := range g.qs {
+		got, status := g.do((i+1)%len(g.qs), typeIn, uint64(i), nil, SectorSize)
+		if status != statusOK || !bytes.Equal(got, pattern(SectorSize, byte(i+1))) {
+			t.Fatalf("sector %d: status %d", i, status)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package blkdev implements the device side of virtio-blk.
+//
+// A Device serves the read, write, flush, discard and write zeroes requests
+// of its queues from a Backend: a raw image file or block device, or an
+// in-memory disk for tests. Each request queue is served by its own
+// goroutine, so a backend must allow concurrent calls.
+//
+// With an Engine, the reads, writes and flushes move straight between guest
+// memory and the backend asynchronously, and complete out of order: over
+// io_uring for a File where the kernel supports it, or on a pool of
+// goroutines otherwise.
+package blkdev
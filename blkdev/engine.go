@@ -0,0 +1,137 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package blkdev
+
+import (
+	"errors"
+	"sync"
+)
+
+// OpType is the type of an I/O operation.
+type OpType uint8
+
+// list of operation types.
+const (
+	OpRead  OpType = iota // read into Bufs at Off
+	OpWrite               // write Bufs at Off
+	OpFlush               // flush the written data to stable storage
+)
+
+// Op is an I/O operation run by an Engine.
+type Op struct {
+	Type OpType
+	Off  int64
+
+	// Bufs are the memory read into or written, in order from Off. They
+	// are usually guest memory, and must not be touched until Done.
+	Bufs [][]byte
+
+	// Done is called once the operation completes with the number of
+	// bytes transferred, from a goroutine of the engine. It must not
+	// block.
+	Done func(n int, err error)
+}
+
+// Engine runs the I/O operations of the requests asynchronously, completing
+// them in any order.
+type Engine interface {
+	// Submit starts a batch of operations. Each completes through its
+	// Done, failures included. ops may be reused once Submit returns.
+	Submit(ops []*Op)
+
+	// Close waits for the operations in flight and releases the engine.
+	// Submit must not be called from then on.
+	Close() error
+}
+
+// ErrNoURing is returned by NewURing where io_uring is not available.
+var ErrNoURing = errors.New("blkdev: io_uring is not available")
+
+// NewEngine returns an io_uring engine over a File backend where the kernel
+// supports it, and a Pool of workers goroutines otherwise.
+func NewEngine(b Backend, workers int) Engine {
+	if f, ok := b.(*File); ok {
+		if e, err := NewURing(f, 0); err == nil {
+			return e
+		}
+	}
+
+	return NewPool(b, workers)
+}
+
+// Pool is an Engine running operations on a pool of goroutines, with the
+// ReadAt and WriteAt of a backend: pread and pwrite for a File.
+type Pool struct {
+	b   Backend
+	ops chan *Op
+	wg  sync.WaitGroup
+}
+
+var _ Engine = (*Pool)(nil)
+
+// NewPool returns a pool of workers goroutines over b, at least one.
+func NewPool(b Backend, workers int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &Pool{b: b, ops: make(chan *Op, workers)}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// Submit implements Engine.Submit. It blocks while all the workers are busy.
+func (p *Pool) Submit(ops []*Op) {
+	for _, op := range ops {
+		p.ops <- op
+	}
+}
+
+// Close implements Engine.Close.
+func (p *Pool) Close() error {
+	close(p.ops)
+	p.wg.Wait()
+
+	return nil
+}
+
+// work runs operations until the pool is closed.
+func (p *Pool) work() {
+	defer p.wg.Done()
+
+	for op := range p.ops {
+		op.Done(p.run(op))
+	}
+}
+
+// run runs op, a buffer at a time.
+func (p *Pool) run(op *Op) (int, error) {
+	if op.Type == OpFlush {
+		return 0, p.b.Flush()
+	}
+
+	var n int
+	off := op.Off
+	for _, b := range op.Bufs {
+		var (
+			k   int
+			err error
+		)
+		if op.Type == OpWrite {
+			k, err = p.b.WriteAt(b, off)
+		} else {
+			k, err = p.b.ReadAt(b, off)
+		}
+		n, off = n+k, off+int64(k)
+		// a read may return io.EOF along with the last bytes of a file.
+		if k < len(b) {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
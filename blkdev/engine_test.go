@@ -0,0 +1,268 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package blkdev
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-hypervisor/virtio/driver"
+)
+
+// newTestFile returns a File backend over a zeroed disk, and its path.
+func newTestFile(t *testing.T, readOnly bool) (*File, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, make([]byte, diskSize), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(path, readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	return f, path
+}
+
+// engines are the engines tested, over f.
+var engines = []struct {
+	name string
+	new  func(f *File) (Engine, error)
+}{
+	{"pool", func(f *File) (Engine, error) { return NewPool(f, 4), nil }},
+	{"uring", func(f *File) (Engine, error) { return NewURing(f, 8) }},
+}
+
+// newTestEngine returns the engine e over f, skipping the test if the
+// system does not support it.
+func newTestEngine(t *testing.T, new func(f *File) (Engine, error), f *File) Engine {
+	t.Helper()
+
+	e, err := new(f)
+	if errors.Is(err, ErrNoURing) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+type opResult struct {
+	n   int
+	err error
+}
+
+// run submits ops as a batch and returns their results in order.
+func run(t *testing.T, e Engine, ops ...*Op) []opResult {
+	t.Helper()
+
+	type indexed struct {
+		i int
+		opResult
+	}
+	c := make(chan indexed, len(ops))
+	for i, op := range ops {
+		i := i
+		op.Done = func(n int, err error) { c <- indexed{i, opResult{n, err}} }
+	}
+	e.Submit(ops)
+
+	res := make([]opResult, len(ops))
+	timeout := time.After(10 * time.Second)
+	for range ops {
+		select {
+		case r := <-c:
+			res[r.i] = r.opResult
+		case <-timeout:
+			t.Fatal("operations not completed")
+		}
+	}
+
+	return res
+}
+
+func TestEngines(t *testing.T) {
+	for _, tt := range engines {
+		t.Run(tt.name, func(t *testing.T) {
+			f, path := newTestFile(t, false)
+			e := newTestEngine(t, tt.new, f)
+
+			// more single-sector writes than a small ring holds, each of
+			// two buffers.
+			var ops []*Op
+			for i := 0; i < 32; i++ {
+				b := pattern(SectorSize, byte(i))
+				ops = append(ops, &Op{Type: OpWrite, Off: int64(i) * SectorSize, Bufs: [][]byte{b[:100], b[100:]}})
+			}
+			for i, r := range run(t, e, ops...) {
+				if r.n != SectorSize || r.err != nil {
+					t.Fatalf("write %d: %d, %v", i, r.n, r.err)
+				}
+			}
+			if r := run(t, e, &Op{Type: OpFlush}); r[0].err != nil {
+				t.Fatalf("flush: %v", r[0].err)
+			}
+
+			a, b := make([]byte, SectorSize/2), make([]byte, SectorSize)
+			end := make([]byte, SectorSize)
+			res := run(t, e,
+				&Op{Type: OpRead, Off: 3*SectorSize + SectorSize/2, Bufs: [][]byte{a, b}},
+				&Op{Type: OpRead, Off: diskSize - 100, Bufs: [][]byte{end}},
+			)
+			want := make([]byte, 0, 3*SectorSize/2)
+			want = append(want, pattern(SectorSize, 3)[SectorSize/2:]...)
+			want = append(want, pattern(SectorSize, 4)...)
+			if res[0].n != len(want) || !bytes.Equal(append(a, b...), want) {
+				t.Fatalf("read %d bytes, %v", res[0].n, res[0].err)
+			}
+			if res[1].n != 100 {
+				t.Fatalf("read %d bytes at the end", res[1].n)
+			}
+			if err := e.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			disk, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 32; i++ {
+				if !bytes.Equal(disk[i*SectorSize:(i+1)*SectorSize], pattern(SectorSize, byte(i))) {
+					t.Fatalf("sector %d differs", i)
+				}
+			}
+		})
+	}
+}
+
+func TestEngineError(t *testing.T) {
+	for _, tt := range engines {
+		t.Run(tt.name, func(t *testing.T) {
+			f, _ := newTestFile(t, true)
+			e := newTestEngine(t, tt.new, f)
+			defer e.Close()
+
+			r := run(t, e, &Op{Type: OpWrite, Bufs: [][]byte{make([]byte, SectorSize)}})
+			if r[0].err == nil {
+				t.Fatalf("write to a read-only file: %d bytes", r[0].n)
+			}
+		})
+	}
+}
+
+func TestDeviceEngine(t *testing.T) {
+	for _, tt := range engines {
+		t.Run(tt.name, func(t *testing.T) {
+			f, path := newTestFile(t, false)
+			dev := &Device{Backend: f, Engine: newTestEngine(t, tt.new, f)}
+			t.Cleanup(func() { dev.Close() })
+			g := newGuest(t, dev, FeatureFlush)
+
+			// requests in flight together, completing in any order.
+			var rs []*driver.Request
+			for i := 0; i < 4; i++ {
+				data := pattern(4*SectorSize, byte(4*i))
+				rs = append(rs, newRequest(typeOut, uint64(4*i), [][]byte{data}, 0))
+			}
+			rs = append(rs, newRequest(typeIn, 100, nil, SectorSize)) // beyond the end
+			for _, r := range rs {
+				if err := g.qs[0].Submit(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, r := range rs {
+				if err := r.Wait(g.ctx); err != nil {
+					t.Fatal(err)
+				}
+				if _, status := result(r); status != statusOK && i < 4 {
+					t.Fatalf("write %d: status %d", i, status)
+				}
+			}
+			if _, status := result(rs[4]); status != statusIOErr {
+				t.Fatalf("read beyond the end: status %d", status)
+			}
+			g.mustDo(typeFlush, 0, nil, 0)
+
+			got := g.mustDo(typeIn, 0, nil, 16*SectorSize)
+			disk, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, pattern(16*SectorSize, 0)) || !bytes.Equal(disk[:16*SectorSize], got) {
+				t.Fatal("disk content differs")
+			}
+		})
+	}
+}
+
+// heldEngine holds the operations until the test runs them.
+type heldEngine struct {
+	p   *Pool
+	ops chan *Op
+}
+
+func (e *heldEngine) Submit(ops []*Op) {
+	for _, op := range ops {
+		e.ops <- op
+	}
+}
+
+func (e *heldEngine) Close() error {
+	return nil
+}
+
+func (e *heldEngine) next(t *testing.T) *Op {
+	t.Helper()
+
+	select {
+	case op := <-e.ops:
+		return op
+	case <-time.After(10 * time.Second):
+		t.Fatal("no operation submitted")
+		return nil
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	mem := NewMemory(diskSize)
+	copy(mem.b, pattern(diskSize, 0))
+	e := &heldEngine{p: &Pool{b: mem}, ops: make(chan *Op, queueSize)}
+	g := newGuest(t, &Device{Backend: mem, Engine: e}, 0)
+
+	var rs []*driver.Request
+	for i := 0; i < 3; i++ {
+		r := newRequest(typeIn, uint64(i), nil, SectorSize)
+		if err := g.qs[0].Submit(r); err != nil {
+			t.Fatal(err)
+		}
+		rs = append(rs, r)
+	}
+	ops := []*Op{e.next(t), e.next(t), e.next(t)}
+
+	// the last request completes first.
+	for i := 2; i >= 0; i-- {
+		ops[i].Done(e.p.run(ops[i]))
+		if err := rs[i].Wait(g.ctx); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < i; j++ {
+			select {
+			case <-rs[j].Done():
+				t.Fatalf("request %d completed before its operation", j)
+			default:
+			}
+		}
+		if b, status := result(rs[i]); status != statusOK || !bytes.Equal(b, pattern(SectorSize, byte(i))) {
+			t.Fatalf("request %d: status %d", i, status)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package blkdev
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// File is a backend over a raw image file or a block device, read and
+// written with pread and pwrite.
+type File struct {
+	f    *os.File
+	size int64
+}
+
+var (
+	_ Backend   = (*File)(nil)
+	_ Discarder = (*File)(nil)
+	_ Zeroer    = (*File)(nil)
+)
+
+// OpenFile opens the image or block device at path, read-only if readOnly.
+func OpenFile(path string, readOnly bool) (*File, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, fmt.Errorf("blkdev: %w", err)
+	}
+	b, err := NewFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// NewFile returns a backend over f, which it closes. The size of f is
+// fixed from then on.
+func NewFile(f *os.File) (*File, error) {
+	// seeking to the end also gives the size of a block device, which
+	// Stat does not.
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("blkdev: size of %s: %w", f.Name(), err)
+	}
+
+	return &File{f: f, size: size}, nil
+}
+
+// ReadAt implements Backend.ReadAt.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	return f.f.ReadAt(p, off)
+}
+
+// WriteAt implements Backend.WriteAt.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	return f.f.WriteAt(p, off)
+}
+
+// Size implements Backend.Size.
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// Close implements Backend.Close.
+func (f *File) Close() error {
+	return f.f.Close()
+}
+
+// writeZeroes writes n zeros at off.
+func writeZeroes(w io.WriterAt, off, n int64) error {
+	zeros := make([]byte, 64<<10)
+	for n > 0 {
+		m := int64(len(zeros))
+		if m > n {
+			m = n
+		}
+		if _, err := w.WriteAt(zeros[:m], off); err != nil {
+			return err
+		}
+		off, n = off+m, n-m
+	}
+
+	return nil
+}
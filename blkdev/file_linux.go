@@ -0,0 +1,69 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package blkdev
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// control calls fn with the descriptor of f.
+func (f *File) control(fn func(fd int) error) error {
+	c, err := f.f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := c.Control(func(fd uintptr) { ferr = fn(int(fd)) }); err != nil {
+		return err
+	}
+
+	return ferr
+}
+
+// Flush implements Backend.Flush with fdatasync.
+func (f *File) Flush() error {
+	if err := f.control(unix.Fdatasync); err != nil {
+		return fmt.Errorf("blkdev: fdatasync: %w", err)
+	}
+
+	return nil
+}
+
+// Discard implements Discarder.Discard by punching a hole. A file system
+// without holes keeps the data, as discarded ranges read unspecified data.
+func (f *File) Discard(off, n int64) error {
+	err := f.control(func(fd int) error {
+		return unix.Fallocate(fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, n)
+	})
+	if err != nil && !errors.Is(err, unix.EOPNOTSUPP) {
+		return fmt.Errorf("blkdev: discard: %w", err)
+	}
+
+	return nil
+}
+
+// WriteZeroes implements Zeroer.WriteZeroes by punching a hole if unmap, or
+// zeroing the range, falling back to writing zeros.
+func (f *File) WriteZeroes(off, n int64, unmap bool) error {
+	mode := uint32(unix.FALLOC_FL_ZERO_RANGE | unix.FALLOC_FL_KEEP_SIZE)
+	if unmap {
+		mode = unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE
+	}
+	err := f.control(func(fd int) error {
+		return unix.Fallocate(fd, mode, off, n)
+	})
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.ENODEV):
+		return writeZeroes(f.f, off, n)
+	}
+
+	return fmt.Errorf("blkdev: write zeroes: %w", err)
+}
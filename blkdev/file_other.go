@@ -0,0 +1,28 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package blkdev
+
+import "fmt"
+
+// Flush implements Backend.Flush with fsync.
+func (f *File) Flush() error {
+	if err := f.f.Sync(); err != nil {
+		return fmt.Errorf("blkdev: fsync: %w", err)
+	}
+
+	return nil
+}
+
+// Discard implements Discarder.Discard. The data is kept, as discarded
+// ranges read unspecified data.
+func (f *File) Discard(off, n int64) error {
+	return nil
+}
+
+// WriteZeroes implements Zeroer.WriteZeroes by writing zeros.
+func (f *File) WriteZeroes(off, n int64, unmap bool) error {
+	return writeZeroes(f.f, off, n)
+}
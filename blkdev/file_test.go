@@ -0,0 +1,68 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package blkdev
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, make([]byte, diskSize), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &Device{Backend: f}
+	t.Cleanup(func() { dev.Close() })
+	g := newGuest(t, dev, FeatureFlush|FeatureDiscard|FeatureWriteZeroes)
+
+	data := pattern(4*SectorSize, 1)
+	g.mustDo(typeOut, 10, [][]byte{data}, 0)
+	g.mustDo(typeFlush, 0, nil, 0)
+	g.mustDo(typeWriteZeroes, 11, [][]byte{segment(11, 1, 0)}, 0)
+	g.mustDo(typeWriteZeroes, 0, [][]byte{segment(12, 1, rangeUnmap)}, 0)
+	g.mustDo(typeDiscard, 0, [][]byte{segment(40, 8, 0)}, 0)
+
+	want := append([]byte(nil), data...)
+	copy(want[SectorSize:], make([]byte, 2*SectorSize))
+	if got := g.mustDo(typeIn, 10, nil, 4*SectorSize); !bytes.Equal(got, want) {
+		t.Fatal("read content differs")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != diskSize || !bytes.Equal(b[10*SectorSize:14*SectorSize], want) {
+		t.Fatal("file content differs")
+	}
+}
+
+func TestFileReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, pattern(diskSize, 1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if f.Size() != diskSize {
+		t.Fatalf("size %d", f.Size())
+	}
+	if _, err := f.WriteAt(make([]byte, SectorSize), 0); err == nil {
+		t.Fatal("write to a read-only file")
+	}
+	b := make([]byte, SectorSize)
+	if _, err := f.ReadAt(b, 2*SectorSize); err != nil || b[0] != 3 {
+		t.Fatalf("read %d, %v", b[0], err)
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package qcow2 implements a virtio-blk backend over QCOW2 images.
+//
+// An Image reads and writes version 2 and 3 images: guest clusters are mapped
+// by a two-level table of L1 and L2 entries, allocated on first write at the
+// end of the file, and counted in the refcount table. Clusters never written
+// read from the backing file, raw or QCOW2, or as zeros; version 3 zero
+// clusters read as zeros whatever the backing file.
+//
+// Metadata is written through: the refcount of a new cluster before the
+// entry mapping it, and the entry unmapping a cluster before its refcount,
+// so an interrupted update leaks a cluster rather than corrupting the image.
+// Freed clusters are not reused. Compressed clusters, internal snapshots,
+// external data files and extended L2 entries are not supported; images
+// with snapshots open read-only.
+package qcow2
@@ -0,0 +1,174 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Magic is the magic number of the QCOW2 header: "QFI\xfb".
+const Magic = 0x514649fb
+
+// list of header sizes.
+const (
+	headerSizeV2 = 72
+	headerSizeV3 = 104
+)
+
+// list of incompatible feature bits.
+const (
+	incompatDirty    = 1 << 0
+	incompatCorrupt  = 1 << 1
+	incompatDataFile = 1 << 2
+	incompatCompress = 1 << 3
+	incompatExtL2    = 1 << 4
+)
+
+// list of L1 and L2 entry bits.
+const (
+	entryZero       = 1 << 0  // L2: the cluster reads as zeros
+	entryCompressed = 1 << 62 // L2: the cluster is compressed
+	entryCopied     = 1 << 63 // the refcount of the cluster is 1
+
+	offsetMask = 0x00fffffffffffe00 // bits 9 to 55
+)
+
+// list of table size limits, those of qemu: larger tables are rejected
+// rather than read into memory.
+const (
+	maxL1TableSize       = 32 << 20 // QCOW_MAX_L1_SIZE
+	maxRefcountTableSize = 8 << 20  // QCOW_MAX_REFTABLE_SIZE
+)
+
+var (
+	// ErrMagic is returned by Open for a file without the QCOW2 magic.
+	ErrMagic = errors.New("qcow2: not a QCOW2 image")
+
+	// ErrUnsupported is returned by Open for an image using an unsupported
+	// feature.
+	ErrUnsupported = errors.New("qcow2: unsupported image")
+
+	// ErrCorrupt is returned for metadata pointing outside the image or
+	// breaking the layout rules.
+	ErrCorrupt = errors.New("qcow2: corrupt image")
+)
+
+// header is the QCOW2 header, of version 2 or 3.
+type header struct {
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+
+	// version 3.
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+}
+
+// decodeHeader decodes and validates the header at the start of b.
+func decodeHeader(b []byte) (*header, error) {
+	be := binary.BigEndian
+	if len(b) < headerSizeV2 || be.Uint32(b) != Magic {
+		return nil, ErrMagic
+	}
+	h := &header{
+		Version:               be.Uint32(b[4:]),
+		BackingFileOffset:     be.Uint64(b[8:]),
+		BackingFileSize:       be.Uint32(b[16:]),
+		ClusterBits:           be.Uint32(b[20:]),
+		Size:                  be.Uint64(b[24:]),
+		CryptMethod:           be.Uint32(b[32:]),
+		L1Size:                be.Uint32(b[36:]),
+		L1TableOffset:         be.Uint64(b[40:]),
+		RefcountTableOffset:   be.Uint64(b[48:]),
+		RefcountTableClusters: be.Uint32(b[56:]),
+		NbSnapshots:           be.Uint32(b[60:]),
+		SnapshotsOffset:       be.Uint64(b[64:]),
+		RefcountOrder:         4,
+		HeaderLength:          headerSizeV2,
+	}
+	switch h.Version {
+	case 2:
+	case 3:
+		if len(b) < headerSizeV3 {
+			return nil, ErrCorrupt
+		}
+		h.IncompatibleFeatures = be.Uint64(b[72:])
+		h.CompatibleFeatures = be.Uint64(b[80:])
+		h.AutoclearFeatures = be.Uint64(b[88:])
+		h.RefcountOrder = be.Uint32(b[96:])
+		h.HeaderLength = be.Uint32(b[100:])
+	default:
+		return nil, fmt.Errorf("%w: version %d", ErrUnsupported, h.Version)
+	}
+
+	switch {
+	case h.ClusterBits < 9 || h.ClusterBits > 21:
+		return nil, fmt.Errorf("%w: cluster bits %d", ErrCorrupt, h.ClusterBits)
+	case h.CryptMethod != 0:
+		return nil, fmt.Errorf("%w: encryption", ErrUnsupported)
+	case h.RefcountOrder > 6:
+		return nil, fmt.Errorf("%w: refcount order %d", ErrCorrupt, h.RefcountOrder)
+	case h.IncompatibleFeatures&^(incompatDirty|incompatCorrupt) != 0:
+		return nil, fmt.Errorf("%w: incompatible features %#x", ErrUnsupported, h.IncompatibleFeatures)
+	case h.Version == 3 && h.HeaderLength < headerSizeV3:
+		return nil, fmt.Errorf("%w: header length %d", ErrCorrupt, h.HeaderLength)
+	}
+	if uint64(h.L1Size)*8 > maxL1TableSize {
+		return nil, fmt.Errorf("%w: L1 table of %d entries", ErrCorrupt, h.L1Size)
+	}
+	if uint64(h.RefcountTableClusters)<<h.ClusterBits > maxRefcountTableSize {
+		return nil, fmt.Errorf("%w: refcount table of %d clusters", ErrCorrupt, h.RefcountTableClusters)
+	}
+	mask := uint64(1)<<h.ClusterBits - 1
+	if h.L1TableOffset&mask != 0 || h.RefcountTableOffset&mask != 0 {
+		return nil, fmt.Errorf("%w: unaligned table", ErrCorrupt)
+	}
+	// each L2 table maps clusterSize/8 clusters.
+	l2Bits := h.ClusterBits - 3
+	if need := (h.Size + 1<<(h.ClusterBits+l2Bits) - 1) >> (h.ClusterBits + l2Bits); uint64(h.L1Size) < need {
+		return nil, fmt.Errorf("%w: L1 table of %d entries for %d bytes", ErrCorrupt, h.L1Size, h.Size)
+	}
+
+	return h, nil
+}
+
+// encode encodes h in version 3, with the header length of 104 bytes.
+func (h *header) encode() []byte {
+	b := make([]byte, headerSizeV3)
+	be := binary.BigEndian
+	be.PutUint32(b[0:], Magic)
+	be.PutUint32(b[4:], h.Version)
+	be.PutUint64(b[8:], h.BackingFileOffset)
+	be.PutUint32(b[16:], h.BackingFileSize)
+	be.PutUint32(b[20:], h.ClusterBits)
+	be.PutUint64(b[24:], h.Size)
+	be.PutUint32(b[32:], h.CryptMethod)
+	be.PutUint32(b[36:], h.L1Size)
+	be.PutUint64(b[40:], h.L1TableOffset)
+	be.PutUint64(b[48:], h.RefcountTableOffset)
+	be.PutUint32(b[56:], h.RefcountTableClusters)
+	be.PutUint32(b[60:], h.NbSnapshots)
+	be.PutUint64(b[64:], h.SnapshotsOffset)
+	be.PutUint64(b[72:], h.IncompatibleFeatures)
+	be.PutUint64(b[80:], h.CompatibleFeatures)
+	be.PutUint64(b[88:], h.AutoclearFeatures)
+	be.PutUint32(b[96:], h.RefcountOrder)
+	be.PutUint32(b[100:], headerSizeV3)
+
+	return b
+}
@@ -0,0 +1,655 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-hypervisor/virtio/blkdev"
+)
+
+const (
+	// defaultClusterBits is the cluster size of the images created: 64 KiB.
+	defaultClusterBits = 16
+
+	// maxBackingFileSize is the longest backing file name.
+	maxBackingFileSize = 1023
+
+	// maxCachedL2 is the number of L2 tables kept in memory.
+	maxCachedL2 = 64
+
+	// maxBackingDepth is the longest chain of backing files below an
+	// image, which stops an image naming itself as its backing file.
+	maxBackingDepth = 16
+)
+
+var (
+	// ErrReadOnly is returned for a write to an image opened read-only.
+	ErrReadOnly = errors.New("qcow2: read-only image")
+
+	// ErrFull is returned when the refcount table of an image cannot count
+	// a new cluster.
+	ErrFull = errors.New("qcow2: refcount table full")
+)
+
+// Image is a QCOW2 image. Its methods may be called concurrently and are
+// serialized.
+type Image struct {
+	mu       sync.Mutex
+	f        *os.File
+	h        *header
+	readOnly bool
+	backing  blkdev.Backend
+	name     string // of the backing file
+
+	clusterBits uint32
+	clusterSize int64
+	l2Bits      uint32
+	l1          []uint64
+	refTable    []uint64
+	l2Cache     map[uint64][]uint64
+	end         int64 // where the next cluster is allocated
+	buf         []byte
+}
+
+var (
+	_ blkdev.Backend   = (*Image)(nil)
+	_ blkdev.Discarder = (*Image)(nil)
+	_ blkdev.Zeroer    = (*Image)(nil)
+)
+
+// Open opens the image at path, read-only if readOnly. Its backing file is
+// opened read-only, as a QCOW2 image or as a raw image, relative to the
+// directory of path unless absolute.
+func Open(path string, readOnly bool) (*Image, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: %w", err)
+	}
+	img, err := open(f, filepath.Dir(path), readOnly, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// open opens the image f, with its backing file relative to dir. depth is
+// the number of images above f in the backing chain.
+func open(f *os.File, dir string, readOnly bool, depth int) (*Image, error) {
+	b := make([]byte, headerSizeV3)
+	n, err := f.ReadAt(b, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("qcow2: %w", err)
+	}
+	h, err := decodeHeader(b[:n])
+	if err != nil {
+		return nil, err
+	}
+	if !readOnly && (h.NbSnapshots != 0 || h.IncompatibleFeatures != 0) {
+		return nil, fmt.Errorf("%w: snapshots or dirty refcounts, open read-only", ErrUnsupported)
+	}
+
+	img := &Image{
+		f:           f,
+		h:           h,
+		readOnly:    readOnly,
+		clusterBits: h.ClusterBits,
+		clusterSize: 1 << h.ClusterBits,
+		l2Bits:      h.ClusterBits - 3,
+		l2Cache:     make(map[uint64][]uint64),
+	}
+	if img.l1, err = img.readTable(h.L1TableOffset, int(h.L1Size)); err != nil {
+		return nil, err
+	}
+	n = int(uint64(h.RefcountTableClusters) << h.ClusterBits / 8)
+	if img.refTable, err = img.readTable(h.RefcountTableOffset, n); err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: %w", err)
+	}
+	img.end = img.align(fi.Size())
+
+	if h.BackingFileOffset != 0 {
+		if err := img.openBacking(dir, depth); err != nil {
+			return nil, err
+		}
+	}
+
+	return img, nil
+}
+
+// openBacking opens the backing file of the image relative to dir, the image
+// being at depth in the backing chain.
+func (img *Image) openBacking(dir string, depth int) error {
+	if img.h.BackingFileSize > maxBackingFileSize {
+		return fmt.Errorf("%w: backing file name of %d bytes", ErrCorrupt, img.h.BackingFileSize)
+	}
+	if depth == maxBackingDepth {
+		return fmt.Errorf("%w: backing chain of more than %d files", ErrCorrupt, maxBackingDepth)
+	}
+	name := make([]byte, img.h.BackingFileSize)
+	if _, err := img.f.ReadAt(name, int64(img.h.BackingFileOffset)); err != nil {
+		return fmt.Errorf("qcow2: backing file name: %w", err)
+	}
+	img.name = string(name)
+	path := img.name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	var magic [4]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("qcow2: backing file: %w", err)
+	}
+	var backing blkdev.Backend
+	if _, rerr := f.ReadAt(magic[:], 0); rerr == nil && binary.BigEndian.Uint32(magic[:]) == Magic {
+		backing, err = open(f, filepath.Dir(path), true, depth+1)
+	} else {
+		backing, err = blkdev.NewFile(f)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	img.backing = backing
+
+	return nil
+}
+
+// Create creates an image of size bytes at path with 64 KiB clusters, and
+// opens it. The name of the backing file is stored as given, and may be
+// empty.
+func Create(path string, size int64, backing string) (*Image, error) {
+	if len(backing) > maxBackingFileSize {
+		return nil, fmt.Errorf("qcow2: backing file name of %d bytes", len(backing))
+	}
+	const cb = defaultClusterBits
+	cs := int64(1) << cb
+	l1Size := (size + 1<<(2*cb-3) - 1) >> (2*cb - 3)
+	if size < 0 || 8*l1Size > maxL1TableSize {
+		return nil, fmt.Errorf("qcow2: image of %d bytes", size)
+	}
+	l1Clusters := (8*l1Size + cs - 1) / cs
+	if l1Clusters == 0 {
+		l1Clusters = 1
+	}
+
+	// cluster 0 is the header, 1 the refcount table, 2 its only block, and
+	// the L1 table follows.
+	h := &header{
+		Version:               3,
+		ClusterBits:           cb,
+		Size:                  uint64(size),
+		L1Size:                uint32(l1Size),
+		L1TableOffset:         uint64(3 * cs),
+		RefcountTableOffset:   uint64(cs),
+		RefcountTableClusters: 1,
+		RefcountOrder:         4,
+		HeaderLength:          headerSizeV3,
+	}
+	if backing != "" {
+		// after the end of the header extensions.
+		h.BackingFileOffset, h.BackingFileSize = headerSizeV3+8, uint32(len(backing))
+	}
+	meta := make([]byte, (3+l1Clusters)*cs)
+	copy(meta, h.encode())
+	copy(meta[headerSizeV3+8:], backing)
+	binary.BigEndian.PutUint64(meta[cs:], uint64(2*cs))
+	for i := int64(0); i < 3+l1Clusters; i++ {
+		binary.BigEndian.PutUint16(meta[2*cs+2*i:], 1)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: %w", err)
+	}
+	if _, err := f.WriteAt(meta, 0); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("qcow2: %w", err)
+	}
+	img, err := open(f, filepath.Dir(path), false, 0)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// BackingFile returns the name of the backing file, empty if none.
+func (img *Image) BackingFile() string {
+	return img.name
+}
+
+// Size implements blkdev.Backend.Size.
+func (img *Image) Size() int64 {
+	return int64(img.h.Size)
+}
+
+// Flush implements blkdev.Backend.Flush.
+func (img *Image) Flush() error {
+	if img.readOnly {
+		return nil
+	}
+	if err := img.f.Sync(); err != nil {
+		return fmt.Errorf("qcow2: %w", err)
+	}
+
+	return nil
+}
+
+// Close implements blkdev.Backend.Close, closing the backing file too.
+func (img *Image) Close() error {
+	err := img.f.Close()
+	if img.backing != nil {
+		if berr := img.backing.Close(); err == nil {
+			err = berr
+		}
+	}
+
+	return err
+}
+
+// ReadAt implements blkdev.Backend.ReadAt.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	if !img.inRange(off, int64(len(p))) {
+		return 0, blkdev.ErrRange
+	}
+	n := 0
+	for n < len(p) {
+		q := img.piece(p[n:], off+int64(n))
+		if err := img.readCluster(q, off+int64(n)); err != nil {
+			return n, err
+		}
+		n += len(q)
+	}
+
+	return n, nil
+}
+
+// WriteAt implements blkdev.Backend.WriteAt.
+func (img *Image) WriteAt(p []byte, off int64) (int, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	if img.readOnly {
+		return 0, ErrReadOnly
+	}
+	if !img.inRange(off, int64(len(p))) {
+		return 0, blkdev.ErrRange
+	}
+	n := 0
+	for n < len(p) {
+		q := img.piece(p[n:], off+int64(n))
+		if err := img.writeCluster(q, off+int64(n)); err != nil {
+			return n, err
+		}
+		n += len(q)
+	}
+
+	return n, nil
+}
+
+// WriteZeroes implements blkdev.Zeroer.WriteZeroes. Whole clusters become
+// zero clusters, keeping their allocation unless unmap; the others are
+// written. Version 2 images have no zero clusters.
+func (img *Image) WriteZeroes(off, n int64, unmap bool) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if !img.inRange(off, n) {
+		return blkdev.ErrRange
+	}
+	for n > 0 {
+		m := img.clusterSize - off&(img.clusterSize-1)
+		if m > n {
+			m = n
+		}
+		var err error
+		if m == img.clusterSize && img.h.Version >= 3 {
+			err = img.zeroCluster(uint64(off)>>img.clusterBits, unmap)
+		} else {
+			err = img.writeCluster(make([]byte, m), off)
+		}
+		if err != nil {
+			return err
+		}
+		off, n = off+m, n-m
+	}
+
+	return nil
+}
+
+// Discard implements blkdev.Discarder.Discard. The whole clusters of the
+// range become unallocated zero clusters; the rest is kept.
+func (img *Image) Discard(off, n int64) error {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if !img.inRange(off, n) {
+		return blkdev.ErrRange
+	}
+	if img.h.Version < 3 {
+		return nil
+	}
+	first := uint64(img.align(off)) >> img.clusterBits
+	last := uint64(off+n) >> img.clusterBits
+	if off+n == int64(img.h.Size) {
+		// the last cluster may be partial.
+		last = uint64(img.align(off+n)) >> img.clusterBits
+	}
+	for g := first; g < last; g++ {
+		if err := img.zeroCluster(g, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inRange reports whether the n bytes at off are within the image.
+func (img *Image) inRange(off, n int64) bool {
+	return off >= 0 && n >= 0 && off+n >= off && uint64(off+n) <= img.h.Size
+}
+
+// align rounds off up to a cluster.
+func (img *Image) align(off int64) int64 {
+	return (off + img.clusterSize - 1) &^ (img.clusterSize - 1)
+}
+
+// piece returns the start of p within the cluster of off.
+func (img *Image) piece(p []byte, off int64) []byte {
+	if m := img.clusterSize - off&(img.clusterSize-1); int64(len(p)) > m {
+		return p[:m]
+	}
+
+	return p
+}
+
+// cluster returns the cluster buffer of the image.
+func (img *Image) cluster() []byte {
+	if img.buf == nil {
+		img.buf = make([]byte, img.clusterSize)
+	}
+
+	return img.buf
+}
+
+// isZero reports whether the L2 entry e is a zero cluster.
+func (img *Image) isZero(e uint64) bool {
+	return img.h.Version >= 3 && e&entryZero != 0
+}
+
+// readCluster reads p at off, within a cluster.
+func (img *Image) readCluster(p []byte, off int64) error {
+	e, err := img.l2Entry(uint64(off) >> img.clusterBits)
+	if err != nil {
+		return err
+	}
+	host := e & offsetMask
+	switch {
+	case e&entryCompressed != 0:
+		return fmt.Errorf("%w: compressed cluster", ErrUnsupported)
+	case img.isZero(e):
+		zero(p)
+	case host == 0:
+		return img.readBacking(p, off)
+	default:
+		// a cluster beyond the end of the file reads as zeros.
+		n, err := img.f.ReadAt(p, int64(host)+off&(img.clusterSize-1))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("qcow2: %w", err)
+		}
+		zero(p[n:])
+	}
+
+	return nil
+}
+
+// readBacking reads p at off from the backing file, as zeros beyond its end.
+func (img *Image) readBacking(p []byte, off int64) error {
+	n := 0
+	if img.backing != nil && off < img.backing.Size() {
+		n = len(p)
+		if m := img.backing.Size() - off; int64(n) > m {
+			n = int(m)
+		}
+		if k, err := img.backing.ReadAt(p[:n], off); k < n {
+			return fmt.Errorf("qcow2: backing file: %w", err)
+		}
+	}
+	zero(p[n:])
+
+	return nil
+}
+
+// writeCluster writes p at off, within a cluster. A cluster written for the
+// first time is allocated with the rest of its content from the backing file,
+// as is a zero cluster with zeros.
+func (img *Image) writeCluster(p []byte, off int64) error {
+	g := uint64(off) >> img.clusterBits
+	l2, err := img.ensureL2(g >> img.l2Bits)
+	if err != nil {
+		return err
+	}
+	t, err := img.l2Table(l2)
+	if err != nil {
+		return err
+	}
+	i := g & (1<<img.l2Bits - 1)
+	e := t[i]
+	host := e & offsetMask
+	in := off & (img.clusterSize - 1)
+	switch {
+	case e&entryCompressed != 0:
+		return fmt.Errorf("%w: compressed cluster", ErrUnsupported)
+	case host != 0 && !img.isZero(e):
+		if _, err := img.f.WriteAt(p, int64(host)+in); err != nil {
+			return fmt.Errorf("qcow2: %w", err)
+		}
+		return nil
+	}
+
+	zeroed := img.isZero(e)
+	if host == 0 {
+		if host, err = img.alloc(); err != nil {
+			return err
+		}
+	}
+	buf := img.cluster()
+	if int64(len(p)) < img.clusterSize {
+		if zeroed {
+			zero(buf)
+		} else if err := img.readBacking(buf, off-in); err != nil {
+			return err
+		}
+	}
+	copy(buf[in:], p)
+	if _, err := img.f.WriteAt(buf, int64(host)); err != nil {
+		return fmt.Errorf("qcow2: %w", err)
+	}
+
+	return img.setL2Entry(l2, i, host|entryCopied)
+}
+
+// zeroCluster makes the guest cluster g a zero cluster, freeing its host
+// cluster if unmap.
+func (img *Image) zeroCluster(g uint64, unmap bool) error {
+	l1i := g >> img.l2Bits
+	if l1i >= uint64(len(img.l1)) {
+		return ErrCorrupt
+	}
+	if img.l1[l1i]&offsetMask == 0 && img.backing == nil {
+		// unallocated clusters already read as zeros.
+		return nil
+	}
+	l2, err := img.ensureL2(l1i)
+	if err != nil {
+		return err
+	}
+	t, err := img.l2Table(l2)
+	if err != nil {
+		return err
+	}
+	i := g & (1<<img.l2Bits - 1)
+	e := t[i]
+	host := e & offsetMask
+	if e&entryCompressed != 0 {
+		return fmt.Errorf("%w: compressed cluster", ErrUnsupported)
+	}
+
+	if host == 0 || unmap {
+		if err := img.setL2Entry(l2, i, entryZero); err != nil {
+			return err
+		}
+		if host != 0 {
+			return img.setRefcount(host, 0)
+		}
+		return nil
+	}
+
+	return img.setL2Entry(l2, i, host|entryZero|entryCopied)
+}
+
+// l2Entry returns the L2 entry of the guest cluster g, 0 if its L2 table is
+// not allocated.
+func (img *Image) l2Entry(g uint64) (uint64, error) {
+	l1i := g >> img.l2Bits
+	if l1i >= uint64(len(img.l1)) {
+		return 0, ErrCorrupt
+	}
+	l2 := img.l1[l1i] & offsetMask
+	if l2 == 0 {
+		return 0, nil
+	}
+	t, err := img.l2Table(l2)
+	if err != nil {
+		return 0, err
+	}
+
+	return t[g&(1<<img.l2Bits-1)], nil
+}
+
+// ensureL2 returns the L2 table of the L1 entry l1i, allocating it.
+func (img *Image) ensureL2(l1i uint64) (uint64, error) {
+	if l1i >= uint64(len(img.l1)) {
+		return 0, ErrCorrupt
+	}
+	if l2 := img.l1[l1i] & offsetMask; l2 != 0 {
+		return l2, nil
+	}
+
+	l2, err := img.alloc()
+	if err != nil {
+		return 0, err
+	}
+	buf := img.cluster()
+	zero(buf)
+	if _, err := img.f.WriteAt(buf, int64(l2)); err != nil {
+		return 0, fmt.Errorf("qcow2: %w", err)
+	}
+	img.cache(l2, make([]uint64, img.clusterSize/8))
+	if err := img.writeEntry(img.h.L1TableOffset, l1i, l2|entryCopied); err != nil {
+		return 0, err
+	}
+	img.l1[l1i] = l2 | entryCopied
+
+	return l2, nil
+}
+
+// l2Table returns the L2 table at off.
+func (img *Image) l2Table(off uint64) ([]uint64, error) {
+	if t, ok := img.l2Cache[off]; ok {
+		return t, nil
+	}
+	t, err := img.readTable(off, int(img.clusterSize/8))
+	if err != nil {
+		return nil, err
+	}
+	img.cache(off, t)
+
+	return t, nil
+}
+
+// cache caches the L2 table t at off, dropping the cache when full.
+func (img *Image) cache(off uint64, t []uint64) {
+	if len(img.l2Cache) >= maxCachedL2 {
+		img.l2Cache = make(map[uint64][]uint64)
+	}
+	img.l2Cache[off] = t
+}
+
+// setL2Entry sets the entry i of the L2 table at off to e.
+func (img *Image) setL2Entry(off, i, e uint64) error {
+	t, err := img.l2Table(off)
+	if err != nil {
+		return err
+	}
+	if err := img.writeEntry(off, i, e); err != nil {
+		return err
+	}
+	t[i] = e
+
+	return nil
+}
+
+// readTable reads the n big-endian entries of the table at off.
+func (img *Image) readTable(off uint64, n int) ([]uint64, error) {
+	b := make([]byte, 8*n)
+	if k, err := img.f.ReadAt(b, int64(off)); k < len(b) {
+		return nil, fmt.Errorf("%w: table at %#x: %v", ErrCorrupt, off, err)
+	}
+	t := make([]uint64, n)
+	for i := range t {
+		t[i] = binary.BigEndian.Uint64(b[8*i:])
+		if t[i]&entryCompressed == 0 && t[i]&offsetMask&uint64(img.clusterSize-1) != 0 {
+			return nil, fmt.Errorf("%w: unaligned entry %#x at %#x", ErrCorrupt, t[i], off)
+		}
+	}
+
+	return t, nil
+}
+
+// writeEntry writes the entry i of the table at off.
+func (img *Image) writeEntry(off, i, e uint64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], e)
+	if _, err := img.f.WriteAt(b[:], int64(off+8*i)); err != nil {
+		return fmt.Errorf("qcow2: %w", err)
+	}
+
+	return nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
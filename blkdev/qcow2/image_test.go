@@ -0,0 +1,531 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// builder lays out an image following the specification, independently of
+// the package: the header in cluster 0, the refcount table in cluster 1, its
+// first block in cluster 2, the L1 table from cluster 3, then the L2 tables
+// and data clusters in the order they are added.
+type builder struct {
+	cb, version, refOrder uint32
+	size                  uint64
+	backing               string
+	incompat              uint64
+	snapshots             uint32
+
+	img  []byte
+	l1   uint64 // offset of the L1 table
+	l1n  uint64 // entries of the L1 table
+	next uint64 // next free cluster
+}
+
+func newBuilder(cb, version, refOrder uint32, size uint64) *builder {
+	b := &builder{cb: cb, version: version, refOrder: refOrder, size: size}
+	cs := b.cs()
+	b.l1n = (size + cs*(cs/8) - 1) / (cs * (cs / 8))
+	b.l1 = 3 * cs
+	b.next = b.l1 + (8*b.l1n+cs-1)/cs*cs
+	if b.l1n == 0 {
+		b.next += cs
+	}
+	b.img = make([]byte, b.next)
+
+	return b
+}
+
+func (b *builder) cs() uint64 {
+	return 1 << b.cb
+}
+
+func (b *builder) alloc() uint64 {
+	off := b.next
+	b.next += b.cs()
+	b.img = append(b.img, make([]byte, b.cs())...)
+
+	return off
+}
+
+// l2 returns the offset of the entry of the guest cluster g in its L2
+// table, allocating the table.
+func (b *builder) l2(g uint64) uint64 {
+	be := binary.BigEndian
+	l1i, l2i := g/(b.cs()/8), g%(b.cs()/8)
+	e := be.Uint64(b.img[b.l1+8*l1i:]) & offsetMask
+	if e == 0 {
+		e = b.alloc()
+		be.PutUint64(b.img[b.l1+8*l1i:], e|entryCopied)
+	}
+
+	return e + 8*l2i
+}
+
+// data maps the guest cluster g to a new cluster of content c.
+func (b *builder) data(g uint64, c []byte) uint64 {
+	at := b.l2(g)
+	off := b.alloc()
+	copy(b.img[off:off+b.cs()], c)
+	binary.BigEndian.PutUint64(b.img[at:], off|entryCopied)
+
+	return off
+}
+
+// zero makes the guest cluster g a zero cluster, preallocated with the
+// content c if not nil.
+func (b *builder) zero(g uint64, c []byte) {
+	e := uint64(entryZero)
+	if c != nil {
+		e |= b.data(g, c) | entryCopied
+	}
+	binary.BigEndian.PutUint64(b.img[b.l2(g):], e)
+}
+
+// write counts the clusters and writes the image to path.
+func (b *builder) write(t *testing.T, path string) {
+	t.Helper()
+
+	be := binary.BigEndian
+	cs := b.cs()
+	be.PutUint32(b.img[0:], Magic)
+	be.PutUint32(b.img[4:], b.version)
+	be.PutUint32(b.img[20:], b.cb)
+	be.PutUint64(b.img[24:], b.size)
+	be.PutUint32(b.img[36:], uint32(b.l1n))
+	be.PutUint64(b.img[40:], b.l1)
+	be.PutUint64(b.img[48:], cs)
+	be.PutUint32(b.img[56:], 1)
+	be.PutUint32(b.img[60:], b.snapshots)
+	end := uint64(72)
+	if b.version == 3 {
+		be.PutUint64(b.img[72:], b.incompat)
+		be.PutUint32(b.img[96:], b.refOrder)
+		be.PutUint32(b.img[100:], 104)
+		end = 104 + 8 // and the end of the header extensions
+	}
+	if b.backing != "" {
+		be.PutUint64(b.img[8:], end)
+		be.PutUint32(b.img[16:], uint32(len(b.backing)))
+		copy(b.img[end:], b.backing)
+	}
+
+	// every cluster is used once; a single refcount block is enough for
+	// the images of the tests.
+	bits := uint64(1) << b.refOrder
+	if n := b.next / cs; n > cs*8/bits {
+		t.Fatalf("%d clusters for one refcount block", n)
+	}
+	be.PutUint64(b.img[cs:], 2*cs)
+	for i := uint64(0); i < b.next/cs; i++ {
+		putRefcount(b.img[2*cs:3*cs], bits, i, 1)
+	}
+	if err := os.WriteFile(path, b.img, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func putRefcount(block []byte, bits, i, v uint64) {
+	if bits < 8 {
+		block[i*bits/8] |= byte(v << (i * bits % 8))
+		return
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	copy(block[i*bits/8:(i+1)*bits/8], b[8-bits/8:])
+}
+
+func getRefcount(block []byte, bits, i uint64) uint64 {
+	if bits < 8 {
+		return uint64(block[i*bits/8]>>(i*bits%8)) & (1<<bits - 1)
+	}
+	var v uint64
+	for _, c := range block[i*bits/8 : (i+1)*bits/8] {
+		v = v<<8 | uint64(c)
+	}
+
+	return v
+}
+
+// check checks the refcounts of the image at path against the clusters
+// referenced by its metadata, as qemu-img check does.
+func check(t *testing.T, path string) {
+	t.Helper()
+
+	img, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := binary.BigEndian
+	cb := be.Uint32(img[20:])
+	cs := uint64(1) << cb
+	bits := uint64(16)
+	if be.Uint32(img[4:]) == 3 {
+		bits = 1 << be.Uint32(img[96:])
+	}
+	clusters := (uint64(len(img)) + cs - 1) / cs
+	refs := make([]uint64, clusters)
+	use := func(off, n uint64) {
+		for c := off / cs; c < (off+n+cs-1)/cs; c++ {
+			if c >= clusters {
+				t.Fatalf("cluster %d beyond the end of the image", c)
+			}
+			refs[c]++
+		}
+	}
+
+	use(0, cs)
+	l1, l1n := be.Uint64(img[40:]), uint64(be.Uint32(img[36:]))
+	use(l1, 8*l1n)
+	rt, rtc := be.Uint64(img[48:]), uint64(be.Uint32(img[56:]))
+	use(rt, rtc*cs)
+	for i := uint64(0); i < rtc*cs/8; i++ {
+		if e := be.Uint64(img[rt+8*i:]); e != 0 {
+			use(e, cs)
+		}
+	}
+	for i := uint64(0); i < l1n; i++ {
+		l2 := be.Uint64(img[l1+8*i:]) & offsetMask
+		if l2 == 0 {
+			continue
+		}
+		use(l2, cs)
+		for j := uint64(0); j < cs/8; j++ {
+			if e := be.Uint64(img[l2+8*j:]) & offsetMask; e != 0 {
+				use(e, cs)
+			}
+		}
+	}
+
+	perBlock := cs * 8 / bits
+	for c := uint64(0); c < clusters; c++ {
+		var got uint64
+		if block := be.Uint64(img[rt+8*(c/perBlock):]); block != 0 {
+			got = getRefcount(img[block:block+cs], bits, c%perBlock)
+		}
+		if got != refs[c] {
+			t.Errorf("cluster %d: refcount %d, referenced %d times", c, got, refs[c])
+		}
+	}
+}
+
+// fill returns a cluster of cs bytes of seed.
+func fill(cs uint64, seed byte) []byte {
+	return bytes.Repeat([]byte{seed}, int(cs))
+}
+
+// layout is an image of 8 clusters over a backing file of 6 clusters, and
+// the expected content of the guest: cluster 0 is data, 1 unallocated over
+// the backing file, 2 a zero cluster, 3 a preallocated zero cluster, 4 data,
+// 5 unallocated over the backing file, and 6 and 7 beyond the backing file.
+func layout(t *testing.T, dir string, cb, version, refOrder uint32) (string, []byte) {
+	t.Helper()
+
+	b := newBuilder(cb, version, refOrder, 8<<cb)
+	cs := b.cs()
+	backing := make([]byte, 6*cs)
+	rand.New(rand.NewSource(1)).Read(backing)
+	if err := os.WriteFile(filepath.Join(dir, "base.raw"), backing, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b.backing = "base.raw"
+
+	want := make([]byte, 8*cs)
+	copy(want, backing)
+	b.data(0, fill(cs, 1))
+	copy(want, fill(cs, 1))
+	b.data(4, fill(cs, 4))
+	copy(want[4*cs:], fill(cs, 4))
+	if version == 3 {
+		b.zero(2, nil)
+		b.zero(3, fill(cs, 3))
+		copy(want[2*cs:4*cs], make([]byte, 2*cs))
+	}
+	path := filepath.Join(dir, "disk.qcow2")
+	b.write(t, path)
+
+	return path, want
+}
+
+// formats are the cluster sizes, versions and refcount widths tested.
+var formats = []struct {
+	cb, version, refOrder uint32
+}{
+	{9, 3, 0},
+	{12, 3, 2},
+	{12, 3, 3},
+	{16, 3, 4},
+	{12, 3, 5},
+	{12, 3, 6},
+	{16, 2, 4},
+}
+
+func TestRead(t *testing.T) {
+	for _, f := range formats {
+		t.Run(fmt.Sprintf("%d-v%d-%d", 1<<f.cb, f.version, 1<<f.refOrder), func(t *testing.T) {
+			path, want := layout(t, t.TempDir(), f.cb, f.version, f.refOrder)
+			img, err := Open(path, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close()
+
+			if img.Size() != int64(len(want)) || img.BackingFile() != "base.raw" {
+				t.Fatalf("size %d, backing file %q", img.Size(), img.BackingFile())
+			}
+			got := make([]byte, len(want))
+			if _, err := img.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatal("content differs")
+			}
+			// an unaligned read spanning clusters.
+			cs := 1 << f.cb
+			if _, err := img.ReadAt(got[:2*cs], int64(cs/2)); err != nil || !bytes.Equal(got[:2*cs], want[cs/2:cs/2+2*cs]) {
+				t.Fatalf("unaligned read: %v", err)
+			}
+			if _, err := img.WriteAt(got[:1], 0); !errors.Is(err, ErrReadOnly) {
+				t.Fatalf("write to a read-only image: %v", err)
+			}
+			if _, err := img.ReadAt(got[:1], int64(len(want))); err == nil {
+				t.Fatal("read beyond the end")
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	for _, f := range formats {
+		t.Run(fmt.Sprintf("%d-v%d-%d", 1<<f.cb, f.version, 1<<f.refOrder), func(t *testing.T) {
+			path, want := layout(t, t.TempDir(), f.cb, f.version, f.refOrder)
+			img, err := Open(path, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cs := 1 << f.cb
+
+			// a piece in each cluster but the last, then whole clusters.
+			r := rand.New(rand.NewSource(2))
+			for g := 0; g < 7; g++ {
+				p := make([]byte, cs/4)
+				r.Read(p)
+				off := g*cs + cs/3
+				if _, err := img.WriteAt(p, int64(off)); err != nil {
+					t.Fatalf("cluster %d: %v", g, err)
+				}
+				copy(want[off:], p)
+			}
+			p := make([]byte, 2*cs)
+			r.Read(p)
+			if _, err := img.WriteAt(p, int64(6*cs)); err != nil {
+				t.Fatal(err)
+			}
+			copy(want[6*cs:], p)
+			if err := img.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if err := img.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			check(t, path)
+			img, err = Open(path, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close()
+			got := make([]byte, len(want))
+			if _, err := img.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatal("content differs after reopening")
+			}
+		})
+	}
+}
+
+func TestWriteZeroes(t *testing.T) {
+	for _, unmap := range []bool{false, true} {
+		t.Run(fmt.Sprint(unmap), func(t *testing.T) {
+			path, want := layout(t, t.TempDir(), 12, 3, 4)
+			img, err := Open(path, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close()
+			cs := int64(4096)
+
+			// clusters 0 to 5 and a piece of 6.
+			if err := img.WriteZeroes(cs/2, 6*cs, unmap); err != nil {
+				t.Fatal(err)
+			}
+			copy(want[cs/2:], make([]byte, 6*cs))
+			got := make([]byte, len(want))
+			if _, err := img.ReadAt(got, 0); err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("content differs: %v", err)
+			}
+
+			// the mapping of a data cluster is kept unless unmap.
+			if e, _ := img.l2Entry(4); (e&offsetMask == 0) != unmap || e&entryZero == 0 {
+				t.Fatalf("entry of cluster 4 %#x", e)
+			}
+			check(t, path)
+		})
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	path, want := layout(t, t.TempDir(), 12, 3, 4)
+	img, err := Open(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	cs := int64(4096)
+
+	// only the whole clusters 1 to 4 are discarded.
+	if err := img.Discard(cs/2, 5*cs); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[cs:], make([]byte, 4*cs))
+	got := make([]byte, len(want))
+	if _, err := img.ReadAt(got, 0); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("content differs: %v", err)
+	}
+	check(t, path)
+
+	// freed clusters are not reused.
+	before := img.end
+	if _, err := img.WriteAt(make([]byte, 1), 4*cs); err != nil {
+		t.Fatal(err)
+	}
+	if img.end != before+cs {
+		t.Fatalf("end %d, want %d", img.end, before+cs)
+	}
+	check(t, path)
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	const size = 3<<20 + 1000
+
+	base, err := Create(filepath.Join(dir, "base.qcow2"), size, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, size)
+	rand.New(rand.NewSource(3)).Read(want[1<<20 : 2<<20])
+	if _, err := base.WriteAt(want[1<<20:2<<20], 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	// the last partial cluster.
+	copy(want[size-10:], "0123456789")
+	if _, err := base.WriteAt(want[size-10:], size-10); err != nil {
+		t.Fatal(err)
+	}
+	if err := base.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(t, filepath.Join(dir, "base.qcow2"))
+
+	if _, err := Create(filepath.Join(dir, "base.qcow2"), size, ""); err == nil {
+		t.Fatal("created over an image")
+	}
+	overlay, err := Create(filepath.Join(dir, "overlay.qcow2"), size, "base.qcow2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer overlay.Close()
+	copy(want[(1<<20)-100:], "across the first backing cluster")
+	if _, err := overlay.WriteAt(want[(1<<20)-100:(1<<20)-68], (1<<20)-100); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, size)
+	if _, err := overlay.ReadAt(got, 0); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("content differs: %v", err)
+	}
+	check(t, filepath.Join(dir, "overlay.qcow2"))
+}
+
+func TestFull(t *testing.T) {
+	// 512-byte clusters with 64-bit refcounts: the refcount table of one
+	// cluster counts 64 blocks of 64 clusters, 2 MiB.
+	b := newBuilder(9, 3, 6, 4<<20)
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	b.write(t, path)
+	img, err := Open(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	p := make([]byte, 512)
+	for off := int64(0); off < 4<<20; off += 512 {
+		if _, err = img.WriteAt(p, off); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrFull) {
+		t.Fatalf("error %v, want %v", err, ErrFull)
+	}
+	check(t, path)
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		edit     func(b *builder)
+		raw      func(img []byte) // edits the written image
+		readOnly bool
+		err      error
+	}{
+		{"magic", nil, func(img []byte) { copy(img, "not an image") }, true, ErrMagic},
+		{"version", func(b *builder) { b.version = 4 }, nil, true, ErrUnsupported},
+		{"cluster bits", nil, func(img []byte) { img[23] = 30 }, true, ErrCorrupt},
+		{"feature", func(b *builder) { b.incompat = incompatExtL2 }, nil, true, ErrUnsupported},
+		{"dirty", func(b *builder) { b.incompat = incompatDirty }, nil, false, ErrUnsupported},
+		{"snapshots", func(b *builder) { b.snapshots = 1 }, nil, false, ErrUnsupported},
+		{"dirty read-only", func(b *builder) { b.incompat = incompatDirty }, nil, true, nil},
+		{"snapshots read-only", func(b *builder) { b.snapshots = 1 }, nil, true, nil},
+		{"backing file", func(b *builder) { b.backing = "missing.raw" }, nil, true, os.ErrNotExist},
+		{"L1 table", nil, func(img []byte) { binary.BigEndian.PutUint32(img[36:], 1<<30) }, true, ErrCorrupt},
+		{"refcount table", nil, func(img []byte) { binary.BigEndian.PutUint32(img[56:], 1<<20) }, true, ErrCorrupt},
+		{"backing loop", func(b *builder) { b.backing = "backing loop" }, nil, true, ErrCorrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBuilder(12, 3, 4, 1<<20)
+			path := filepath.Join(dir, tt.name)
+			if tt.edit != nil {
+				tt.edit(b)
+			}
+			b.write(t, path)
+			if tt.raw != nil {
+				tt.raw(b.img)
+				if err := os.WriteFile(path, b.img, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			img, err := Open(path, tt.readOnly)
+			if err == nil {
+				img.Close()
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
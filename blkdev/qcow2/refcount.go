@@ -0,0 +1,116 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// alloc allocates a cluster at the end of the image with a refcount of 1.
+// The cluster is not written.
+func (img *Image) alloc() (uint64, error) {
+	off := uint64(img.end)
+	img.end += img.clusterSize
+	if err := img.setRefcount(off, 1); err != nil {
+		return 0, err
+	}
+
+	return off, nil
+}
+
+// refcountEntry returns the block index and the entry index in the block of
+// the refcount of the host cluster at off.
+func (img *Image) refcountEntry(off uint64) (uint64, uint64) {
+	bits := uint64(1) << img.h.RefcountOrder
+	perBlock := uint64(img.clusterSize) * 8 / bits
+	i := off >> img.clusterBits
+
+	return i / perBlock, i % perBlock
+}
+
+// refcount returns the refcount of the host cluster at off.
+func (img *Image) refcount(off uint64) (uint64, error) {
+	block, i := img.refcountEntry(off)
+	if block >= uint64(len(img.refTable)) || img.refTable[block] == 0 {
+		return 0, nil
+	}
+
+	return img.refcountAt(img.refTable[block], i)
+}
+
+// refcountAt returns the entry i of the refcount block at off. Entries of
+// less than a byte are packed from the least significant bit.
+func (img *Image) refcountAt(off, i uint64) (uint64, error) {
+	bits := uint64(1) << img.h.RefcountOrder
+	var b [8]byte
+	n := (bits + 7) / 8
+	if _, err := img.f.ReadAt(b[:n], int64(off+i*bits/8)); err != nil {
+		return 0, fmt.Errorf("qcow2: refcount block: %w", err)
+	}
+	if bits < 8 {
+		return uint64(b[0]>>(i*bits%8)) & (1<<bits - 1), nil
+	}
+
+	var v uint64
+	for _, c := range b[:n] {
+		v = v<<8 | uint64(c)
+	}
+
+	return v, nil
+}
+
+// setRefcount sets the refcount of the host cluster at off to v, allocating
+// the refcount block.
+func (img *Image) setRefcount(off, v uint64) error {
+	bits := uint64(1) << img.h.RefcountOrder
+	if bits < 64 && v >= 1<<bits {
+		return fmt.Errorf("qcow2: refcount %d overflows %d bits", v, bits)
+	}
+	block, i := img.refcountEntry(off)
+	if block >= uint64(len(img.refTable)) {
+		return ErrFull
+	}
+	if img.refTable[block] == 0 {
+		if err := img.newRefcountBlock(block); err != nil {
+			return err
+		}
+	}
+	blockOff := img.refTable[block]
+
+	var b [8]byte
+	n := (bits + 7) / 8
+	at := int64(blockOff + i*bits/8)
+	if bits < 8 {
+		if _, err := img.f.ReadAt(b[:1], at); err != nil {
+			return fmt.Errorf("qcow2: refcount block: %w", err)
+		}
+		shift := i * bits % 8
+		b[0] = b[0]&^byte((1<<bits-1)<<shift) | byte(v<<shift)
+	} else {
+		binary.BigEndian.PutUint64(b[:], v)
+		copy(b[:], b[8-n:])
+	}
+	if _, err := img.f.WriteAt(b[:n], at); err != nil {
+		return fmt.Errorf("qcow2: refcount block: %w", err)
+	}
+
+	return nil
+}
+
+// newRefcountBlock allocates the refcount block block at the end of the
+// image, counting the block itself.
+func (img *Image) newRefcountBlock(block uint64) error {
+	off := uint64(img.end)
+	img.end += img.clusterSize
+	if _, err := img.f.WriteAt(make([]byte, img.clusterSize), int64(off)); err != nil {
+		return fmt.Errorf("qcow2: %w", err)
+	}
+	if err := img.writeEntry(img.h.RefcountTableOffset, block, off); err != nil {
+		return err
+	}
+	img.refTable[block] = off
+
+	return img.setRefcount(off, 1)
+}
@@ -0,0 +1,323 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package blkdev
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// list of request types.
+const (
+	typeIn          = 0  // VIRTIO_BLK_T_IN
+	typeOut         = 1  // VIRTIO_BLK_T_OUT
+	typeFlush       = 4  // VIRTIO_BLK_T_FLUSH
+	typeGetID       = 8  // VIRTIO_BLK_T_GET_ID
+	typeDiscard     = 11 // VIRTIO_BLK_T_DISCARD
+	typeWriteZeroes = 13 // VIRTIO_BLK_T_WRITE_ZEROES
+)
+
+// list of request statuses.
+const (
+	statusOK     = 0 // VIRTIO_BLK_S_OK
+	statusIOErr  = 1 // VIRTIO_BLK_S_IOERR
+	statusUnsupp = 2 // VIRTIO_BLK_S_UNSUPP
+)
+
+const (
+	// headerSize is the size of struct virtio_blk_outhdr.
+	headerSize = 16
+
+	// rangeSize is the size of struct virtio_blk_discard_write_zeroes, and
+	// rangeUnmap its unmap flag.
+	rangeSize  = 16
+	rangeUnmap = 1 << 0
+
+	// chunkSize is the largest piece of data moved at once between a chain
+	// and the backend.
+	chunkSize = 1 << 20
+)
+
+// worker serves the requests of a queue.
+type worker struct {
+	d        *Device
+	features virtio.Features
+	buf      []byte
+
+	// with an engine, the operations to submit, the requests completed and
+	// the number in flight.
+	batch     []*Op
+	completed chan *request
+	inflight  int
+}
+
+// request is a request run by the engine.
+type request struct {
+	c    *virtio.DescriptorChain
+	op   Op
+	want int    // bytes transferred on success
+	pad  uint64 // zeros written before the status
+	n    int
+	err  error
+}
+
+// buffer returns the buffer of the worker, grown to n bytes.
+func (w *worker) buffer(n int) []byte {
+	if cap(w.buf) < n {
+		w.buf = make([]byte, n)
+	}
+
+	return w.buf[:n]
+}
+
+// handle serves the request of c, whose last writable byte is the status. A
+// chain without writable byte is returned untouched. It reports whether the
+// request was queued for the engine, to be returned once completed.
+func (w *worker) handle(c *virtio.DescriptorChain) bool {
+	in := c.WritableLen()
+	if in == 0 {
+		return false
+	}
+	var h [headerSize]byte
+	if _, err := io.ReadFull(c, h[:]); err != nil {
+		w.finish(c, in-1, statusIOErr)
+		return false
+	}
+	typ := binary.LittleEndian.Uint32(h[0:])
+	sector := binary.LittleEndian.Uint64(h[8:])
+
+	switch typ {
+	case typeIn:
+		n := in - 1
+		if !w.inRange(sector, n) {
+			w.finish(c, n, statusIOErr)
+			return false
+		}
+		if w.queue(c, OpRead, sector, n, 0) {
+			return true
+		}
+		done, status := w.read(c, sector, n)
+		w.finish(c, n-done, status)
+	case typeOut:
+		n := c.ReadableLen() - headerSize
+		if w.d.ReadOnly || !w.inRange(sector, n) {
+			w.finish(c, in-1, statusIOErr)
+			return false
+		}
+		if w.queue(c, OpWrite, sector, n, in-1) {
+			return true
+		}
+		w.finish(c, in-1, w.write(c, sector, n))
+	case typeFlush:
+		if w.queue(c, OpFlush, 0, 0, in-1) {
+			return true
+		}
+		status := uint8(statusOK)
+		if err := w.d.Backend.Flush(); err != nil {
+			status = statusIOErr
+		}
+		w.finish(c, in-1, status)
+	case typeGetID:
+		id := w.buffer(IDSize)
+		for i := range id {
+			id[i] = 0
+		}
+		copy(id, w.d.ID)
+		if in-1 < IDSize {
+			id = id[:in-1]
+		}
+		c.Write(id)
+		w.finish(c, in-1-uint64(len(id)), statusOK)
+	case typeDiscard, typeWriteZeroes:
+		w.finish(c, in-1, w.ranges(c, typ))
+	default:
+		w.finish(c, in-1, statusUnsupp)
+	}
+
+	return false
+}
+
+// queue queues the operation typ on the n bytes at sector for the engine,
+// straight between c and the backend, with pad zeros before the status. It
+// reports whether it did: without engine, or if the buffers of c are not
+// guest memory, the request is served synchronously.
+func (w *worker) queue(c *virtio.DescriptorChain, typ OpType, sector, n, pad uint64) bool {
+	if w.d.Engine == nil {
+		return false
+	}
+	var (
+		bufs [][]byte
+		err  error
+	)
+	switch typ {
+	case OpRead:
+		bufs, err = c.WriteSlices(n)
+	case OpWrite:
+		bufs, err = c.ReadSlices(n)
+	}
+	if err != nil {
+		return false
+	}
+
+	r := &request{c: c, want: int(n), pad: pad}
+	r.op = Op{Type: typ, Off: int64(sector * SectorSize), Bufs: bufs}
+	r.op.Done = func(n int, err error) {
+		r.n, r.err = n, err
+		w.completed <- r
+	}
+	w.batch = append(w.batch, &r.op)
+
+	return true
+}
+
+// submit submits the operations queued to the engine.
+func (w *worker) submit() {
+	if len(w.batch) == 0 {
+		return
+	}
+	w.inflight += len(w.batch)
+	w.d.Engine.Submit(w.batch)
+	for i := range w.batch {
+		w.batch[i] = nil
+	}
+	w.batch = w.batch[:0]
+}
+
+// complete finishes the request r run by the engine.
+func (w *worker) complete(r *request) {
+	w.inflight--
+	status := uint8(statusOK)
+	if r.err != nil || r.n != r.want {
+		status = statusIOErr
+	}
+	w.finish(r.c, r.pad, status)
+}
+
+// wait waits for the requests in flight, which are dropped.
+func (w *worker) wait() {
+	for ; w.inflight > 0; w.inflight-- {
+		<-w.completed
+	}
+}
+
+// finish writes n zeros then the status s.
+func (w *worker) finish(c *virtio.DescriptorChain, n uint64, s uint8) {
+	for n > 0 {
+		m := n
+		if m > chunkSize {
+			m = chunkSize
+		}
+		b := w.buffer(int(m))
+		for i := range b {
+			b[i] = 0
+		}
+		c.Write(b)
+		n -= m
+	}
+	c.Write([]byte{s})
+}
+
+// inRange reports whether the n bytes at sector are whole sectors of the
+// disk.
+func (w *worker) inRange(sector, n uint64) bool {
+	capacity := w.d.capacity()
+
+	return n%SectorSize == 0 && sector <= capacity && n/SectorSize <= capacity-sector
+}
+
+// read writes the n bytes at sector to c, and returns the bytes written and
+// the status.
+func (w *worker) read(c *virtio.DescriptorChain, sector, n uint64) (uint64, uint8) {
+	off := int64(sector * SectorSize)
+	var done uint64
+	for done < n {
+		m := n - done
+		if m > chunkSize {
+			m = chunkSize
+		}
+		b := w.buffer(int(m))
+		// a read may return io.EOF along with the last bytes of a file.
+		if k, _ := w.d.Backend.ReadAt(b, off); k < len(b) {
+			return done, statusIOErr
+		}
+		c.Write(b)
+		off, done = off+int64(m), done+m
+	}
+
+	return done, statusOK
+}
+
+// write writes the n bytes of c to sector, and returns the status.
+func (w *worker) write(c *virtio.DescriptorChain, sector, n uint64) uint8 {
+	off := int64(sector * SectorSize)
+	for n > 0 {
+		m := n
+		if m > chunkSize {
+			m = chunkSize
+		}
+		b := w.buffer(int(m))
+		if _, err := io.ReadFull(c, b); err != nil {
+			return statusIOErr
+		}
+		if _, err := w.d.Backend.WriteAt(b, off); err != nil {
+			return statusIOErr
+		}
+		off, n = off+int64(m), n-m
+	}
+
+	return statusOK
+}
+
+// ranges runs the discard or write zeroes request typ with the segments of
+// c, and returns the status.
+func (w *worker) ranges(c *virtio.DescriptorChain, typ uint32) uint8 {
+	discarder, _ := w.d.Backend.(Discarder)
+	switch {
+	case typ == typeDiscard && (!w.features.Has(FeatureDiscard) || discarder == nil):
+		return statusUnsupp
+	case typ == typeWriteZeroes && !w.features.Has(FeatureWriteZeroes):
+		return statusUnsupp
+	case w.d.ReadOnly:
+		return statusIOErr
+	}
+
+	n := c.ReadableLen() - headerSize
+	if n == 0 || n%rangeSize != 0 || n/rangeSize > maxRangeSegs {
+		return statusUnsupp
+	}
+	b := w.buffer(int(n))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return statusIOErr
+	}
+
+	le := binary.LittleEndian
+	for ; len(b) > 0; b = b[rangeSize:] {
+		sector, sectors, flags := le.Uint64(b), le.Uint32(b[8:]), le.Uint32(b[12:])
+		// the unmap flag is reserved for discard.
+		if flags&^rangeUnmap != 0 || typ == typeDiscard && flags != 0 || sectors > maxRangeSectors {
+			return statusUnsupp
+		}
+		if !w.inRange(sector, uint64(sectors)*SectorSize) {
+			return statusIOErr
+		}
+
+		off, size := int64(sector*SectorSize), int64(sectors)*SectorSize
+		var err error
+		switch z, ok := w.d.Backend.(Zeroer); {
+		case typ == typeDiscard:
+			err = discarder.Discard(off, size)
+		case ok:
+			err = z.WriteZeroes(off, size, flags&rangeUnmap != 0)
+		default:
+			err = writeZeroes(w.d.Backend, off, size)
+		}
+		if err != nil {
+			return statusIOErr
+		}
+	}
+
+	return statusOK
+}
@@ -0,0 +1,375 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package blkdev
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// list of io_uring constants, from linux/io_uring.h.
+const (
+	uringOffSQRing = 0          // IORING_OFF_SQ_RING
+	uringOffCQRing = 0x8000000  // IORING_OFF_CQ_RING
+	uringOffSQEs   = 0x10000000 // IORING_OFF_SQES
+
+	uringOpNop    = 0 // IORING_OP_NOP
+	uringOpReadv  = 1 // IORING_OP_READV
+	uringOpWritev = 2 // IORING_OP_WRITEV
+	uringOpFsync  = 3 // IORING_OP_FSYNC
+
+	uringFsyncDatasync  = 1 << 0 // IORING_FSYNC_DATASYNC
+	uringEnterGetEvents = 1 << 0 // IORING_ENTER_GETEVENTS
+)
+
+const (
+	// defaultURingEntries is the default size of the submission queue.
+	defaultURingEntries = queueSize
+
+	// closeTag is the user data of the operation waking up the completion
+	// goroutine on Close.
+	closeTag = ^uint64(0)
+)
+
+// uringParams is struct io_uring_params.
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFD         uint32
+	resv         [3]uint32
+	sqOff        uringSQOffsets
+	cqOff        uringCQOffsets
+}
+
+// uringSQOffsets is struct io_sqring_offsets, the offsets of the fields of the
+// submission queue in its mapping.
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries uint32
+	flags, dropped, array, resv1      uint32
+	resv2                             uint64
+}
+
+// uringCQOffsets is struct io_cqring_offsets, the offsets of the fields of the
+// completion queue in its mapping.
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries uint32
+	overflow, cqes, flags, resv1      uint32
+	resv2                             uint64
+}
+
+// uringSQE is struct io_uring_sqe.
+type uringSQE struct {
+	opcode   uint8
+	flags    uint8
+	ioprio   uint16
+	fd       int32
+	off      uint64
+	addr     uint64
+	len      uint32
+	opFlags  uint32
+	userData uint64
+	pad      [3]uint64
+}
+
+// uringCQE is struct io_uring_cqe.
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is an Engine over io_uring. Each operation in flight owns a slot,
+// which is its submission queue entry and its user data; the last entry is
+// kept for Close.
+type uring struct {
+	fd   int   // of the io_uring
+	file int32 // descriptor of the backend
+
+	sqRing, cqRing, sqeMem []byte
+
+	sqTail  *uint32
+	sqHead  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []uringSQE
+	cqHead  *uint32
+	cqTail  *uint32
+	cqMask  uint32
+	cqes    []uringCQE
+
+	mu     sync.Mutex // serializes the submissions
+	tail   uint32     // next submission queue tail
+	slotMu sync.Mutex // guards the operations of the slots
+	slots  []uringSlot
+	free   chan uint32 // free slots, bounding the operations in flight
+	closed bool
+	done   chan struct{} // closed when the completion goroutine returns
+}
+
+// uringSlot is an operation in flight.
+type uringSlot struct {
+	op  *Op
+	iov []unix.Iovec
+}
+
+var _ Engine = (*uring)(nil)
+
+// NewURing returns an Engine running the operations on f with io_uring,
+// with a submission queue of entries, 256 if zero. One entry is kept for
+// Close. f must stay open until the engine is closed. The error wraps
+// ErrNoURing if the kernel does not support io_uring.
+func NewURing(f *File, entries int) (Engine, error) {
+	switch {
+	case entries <= 0:
+		entries = defaultURingEntries
+	case entries < 2:
+		entries = 2
+	}
+	var p uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("%w: %v", ErrNoURing, os.NewSyscallError("io_uring_setup", errno))
+	}
+
+	r := &uring{fd: int(fd), file: int32(f.f.Fd()), done: make(chan struct{})}
+	if err := r.mmap(&p); err != nil {
+		r.unmap()
+		return nil, err
+	}
+
+	n := p.sqEntries - 1
+	r.slots = make([]uringSlot, n)
+	r.free = make(chan uint32, n)
+	for i := uint32(0); i < n; i++ {
+		r.free <- i
+	}
+	r.tail = atomic.LoadUint32(r.sqTail)
+	go r.complete()
+
+	return r, nil
+}
+
+// mmap maps the rings of the parameters p.
+func (r *uring) mmap(p *uringParams) error {
+	var err error
+	mapRing := func(off int64, size uint32) []byte {
+		if err != nil {
+			return nil
+		}
+		var b []byte
+		b, err = unix.Mmap(r.fd, off, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		if err != nil {
+			err = fmt.Errorf("blkdev: map io_uring: %w", os.NewSyscallError("mmap", err))
+		}
+		return b
+	}
+	r.sqRing = mapRing(uringOffSQRing, p.sqOff.array+4*p.sqEntries)
+	r.cqRing = mapRing(uringOffCQRing, p.cqOff.cqes+uint32(unsafe.Sizeof(uringCQE{}))*p.cqEntries)
+	r.sqeMem = mapRing(uringOffSQEs, uint32(unsafe.Sizeof(uringSQE{}))*p.sqEntries)
+	if err != nil {
+		return err
+	}
+
+	word := func(b []byte, off uint32) *uint32 {
+		return (*uint32)(unsafe.Pointer(&b[off]))
+	}
+	r.sqHead, r.sqTail = word(r.sqRing, p.sqOff.head), word(r.sqRing, p.sqOff.tail)
+	r.sqMask = *word(r.sqRing, p.sqOff.ringMask)
+	r.sqArray = unsafe.Slice(word(r.sqRing, p.sqOff.array), p.sqEntries)
+	r.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	r.cqHead, r.cqTail = word(r.cqRing, p.cqOff.head), word(r.cqRing, p.cqOff.tail)
+	r.cqMask = *word(r.cqRing, p.cqOff.ringMask)
+	r.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+
+	return nil
+}
+
+// unmap releases the rings and the io_uring.
+func (r *uring) unmap() {
+	for _, b := range [][]byte{r.sqRing, r.cqRing, r.sqeMem} {
+		if b != nil {
+			unix.Munmap(b)
+		}
+	}
+	unix.Close(r.fd)
+}
+
+// Submit implements Engine.Submit. The operations are submitted with a single
+// system call, unless more than the submission queue are in flight: Submit
+// then waits for completions.
+func (r *uring) Submit(ops []*Op) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n uint32
+	for _, op := range ops {
+		var slot uint32
+		select {
+		case slot = <-r.free:
+		default:
+			// submit the operations prepared to wait for a completion.
+			r.enter(n)
+			n = 0
+			slot = <-r.free
+		}
+		r.prepare(slot, op)
+		n++
+	}
+	r.enter(n)
+}
+
+// prepare fills the submission queue entry of slot for op, and adds it to
+// the queue.
+func (r *uring) prepare(slot uint32, op *Op) {
+	r.slotMu.Lock()
+	s := &r.slots[slot]
+	s.op, s.iov = op, s.iov[:0]
+	r.slotMu.Unlock()
+	for _, b := range op.Bufs {
+		if len(b) == 0 {
+			continue
+		}
+		iov := unix.Iovec{Base: &b[0]}
+		iov.SetLen(len(b))
+		s.iov = append(s.iov, iov)
+	}
+
+	sqe := uringSQE{fd: r.file, off: uint64(op.Off), userData: uint64(slot)}
+	switch op.Type {
+	case OpRead, OpWrite:
+		sqe.opcode = uringOpReadv
+		if op.Type == OpWrite {
+			sqe.opcode = uringOpWritev
+		}
+		if len(s.iov) > 0 {
+			sqe.addr = uint64(uintptr(unsafe.Pointer(&s.iov[0])))
+		}
+		sqe.len = uint32(len(s.iov))
+	case OpFlush:
+		sqe.opcode, sqe.opFlags = uringOpFsync, uringFsyncDatasync
+	}
+	r.push(slot, sqe)
+}
+
+// push adds sqe at the entry i to the submission queue.
+func (r *uring) push(i uint32, sqe uringSQE) {
+	r.sqes[i] = sqe
+	r.sqArray[r.tail&r.sqMask] = i
+	r.tail++
+}
+
+// enter publishes the queue tail and submits the last n entries. On failure
+// the entries not taken by the kernel are completed with the error, and
+// returned.
+func (r *uring) enter(n uint32) error {
+	atomic.StoreUint32(r.sqTail, r.tail)
+	for n > 0 {
+		k, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(n), 0, 0, 0, 0)
+		switch errno {
+		case 0:
+			n -= uint32(k)
+			continue
+		case unix.EINTR, unix.EAGAIN, unix.EBUSY:
+			// out of resources until some operations complete.
+			runtime.Gosched()
+			continue
+		}
+
+		// the kernel only reads the queue in io_uring_enter, and no
+		// submission races with this one: the entries left can be taken
+		// back.
+		err := os.NewSyscallError("io_uring_enter", errno)
+		head := atomic.LoadUint32(r.sqHead)
+		for i := head; i != r.tail; i++ {
+			if slot := r.sqArray[i&r.sqMask]; int(slot) < len(r.slots) {
+				r.release(slot).Done(0, err)
+			}
+		}
+		r.tail = head
+		atomic.StoreUint32(r.sqTail, head)
+		return err
+	}
+
+	return nil
+}
+
+// release frees slot and returns its operation.
+func (r *uring) release(slot uint32) *Op {
+	r.slotMu.Lock()
+	s := &r.slots[slot]
+	op := s.op
+	s.op = nil
+	r.slotMu.Unlock()
+	r.free <- slot
+
+	return op
+}
+
+// Close implements Engine.Close.
+func (r *uring) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.push(uint32(len(r.slots)), uringSQE{opcode: uringOpNop, userData: closeTag})
+	err := r.enter(1)
+	r.mu.Unlock()
+	if err != nil {
+		// the completion goroutine cannot be woken up: the rings leak.
+		return fmt.Errorf("blkdev: close io_uring: %w", err)
+	}
+
+	<-r.done
+	r.unmap()
+
+	return nil
+}
+
+// complete runs the completions until the engine is closed and no operation
+// is in flight.
+func (r *uring) complete() {
+	defer close(r.done)
+
+	closing := false
+	for {
+		head, tail := atomic.LoadUint32(r.cqHead), atomic.LoadUint32(r.cqTail)
+		for ; head != tail; head++ {
+			cqe := r.cqes[head&r.cqMask]
+			atomic.StoreUint32(r.cqHead, head+1)
+			if cqe.userData == closeTag {
+				closing = true
+				continue
+			}
+
+			op := r.release(uint32(cqe.userData))
+			if cqe.res < 0 {
+				op.Done(0, fmt.Errorf("blkdev: %w", unix.Errno(-cqe.res)))
+			} else {
+				op.Done(int(cqe.res), nil)
+			}
+		}
+		if closing && len(r.free) == cap(r.free) {
+			return
+		}
+
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), 0, 1, uringEnterGetEvents, 0, 0)
+		if errno != 0 && errno != unix.EINTR {
+			runtime.Gosched()
+		}
+	}
+}
@@ -0,0 +1,11 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package blkdev
+
+// NewURing returns ErrNoURing: io_uring is specific to Linux.
+func NewURing(f *File, entries int) (Engine, error) {
+	return nil, ErrNoURing
+}
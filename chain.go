@@ -0,0 +1,288 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DefaultMaxChainLen is the default limit of descriptors in a chain, counting
+// the descriptors of indirect tables.
+const DefaultMaxChainLen = 1024
+
+// DescriptorChain is a chain of buffers taken from a queue by the device.
+//
+// Read reads the device-readable buffers in order and Write writes the
+// device-writable ones; the bytes written are returned to the driver in the
+// used ring when the chain is pushed back.
+type DescriptorChain struct {
+	// ID is the head descriptor index of a split queue chain or the buffer
+	// ID of a packed queue chain.
+	ID uint16
+
+	// Readable are the device-readable buffers, with indirect tables resolved.
+	Readable []Descriptor
+
+	// Writable are the device-writable buffers, with indirect tables resolved.
+	Writable []Descriptor
+
+	mem     GuestMemory
+	r, w    chainCursor
+	written uint32
+}
+
+// chainCursor is a position in a list of buffers.
+type chainCursor struct {
+	i   int    // buffer index
+	off uint32 // offset in the buffer
+}
+
+// newChain resolves the indirect tables of descs and splits them into the
+// readable and writable buffers. The descriptors of an indirect table are
+// linked by Next in a split queue and sequential in a packed one.
+func newChain(mem GuestMemory, id uint16, descs []Descriptor, maxLen int, packed bool) (*DescriptorChain, error) {
+	if maxLen <= 0 {
+		maxLen = DefaultMaxChainLen
+	}
+
+	c := &DescriptorChain{ID: id, mem: mem}
+	n := 0
+	add := func(d Descriptor) error {
+		if n++; n > maxLen {
+			return fmt.Errorf("%w: chain %d exceeds %d descriptors", ErrInvalidQueue, id, maxLen)
+		}
+		if d.Flags&DescFlagWrite != 0 {
+			c.Writable = append(c.Writable, d)
+			return nil
+		}
+		if len(c.Writable) > 0 {
+			return fmt.Errorf("%w: chain %d has a device-readable buffer after a device-writable one", ErrInvalidQueue, id)
+		}
+		c.Readable = append(c.Readable, d)
+		return nil
+	}
+
+	for i, d := range descs {
+		if d.Flags&DescFlagIndirect == 0 {
+			if err := add(d); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// an indirect descriptor is the only one of its chain in a split
+		// queue, and the last one in a packed queue.
+		if d.Flags&DescFlagNext != 0 || (!packed && len(descs) > 1) || i != len(descs)-1 {
+			return nil, fmt.Errorf("%w: chain %d mixes indirect and direct descriptors", ErrInvalidQueue, id)
+		}
+		table, err := readIndirect(mem, d, maxLen)
+		if err != nil {
+			return nil, fmt.Errorf("chain %d: %w", id, err)
+		}
+		if err := walkIndirect(table, packed, add); err != nil {
+			return nil, fmt.Errorf("chain %d: %w", id, err)
+		}
+	}
+
+	return c, nil
+}
+
+// readIndirect reads the indirect table of d, of at most maxLen descriptors.
+// The length comes from the guest and is checked before allocating.
+func readIndirect(mem GuestMemory, d Descriptor, maxLen int) ([]Descriptor, error) {
+	if d.Len == 0 || d.Len%descSize != 0 {
+		return nil, fmt.Errorf("%w: indirect table of %d bytes", ErrInvalidQueue, d.Len)
+	}
+	if d.Len/descSize > uint32(maxLen) {
+		return nil, fmt.Errorf("%w: indirect table exceeds %d descriptors", ErrInvalidQueue, maxLen)
+	}
+
+	b := make([]byte, d.Len)
+	if _, err := mem.ReadAt(b, d.Addr); err != nil {
+		return nil, err
+	}
+
+	table := make([]Descriptor, d.Len/descSize)
+	for i := range table {
+		e := b[descSize*i:]
+		table[i] = Descriptor{
+			Addr:  binary.LittleEndian.Uint64(e),
+			Len:   binary.LittleEndian.Uint32(e[8:]),
+			Flags: binary.LittleEndian.Uint16(e[12:]),
+			Next:  binary.LittleEndian.Uint16(e[14:]),
+		}
+	}
+
+	return table, nil
+}
+
+// walkIndirect calls add for the descriptors of an indirect table in chain
+// order. A split table is followed from its first entry and a loop is detected
+// by visiting more entries than the table has.
+func walkIndirect(table []Descriptor, packed bool, add func(Descriptor) error) error {
+	for i, visited := 0, 0; ; visited++ {
+		if visited == len(table) {
+			if packed {
+				return nil
+			}
+			return fmt.Errorf("%w: indirect table loops", ErrInvalidQueue)
+		}
+
+		d := table[i]
+		if d.Flags&DescFlagIndirect != 0 {
+			return fmt.Errorf("%w: nested indirect table", ErrInvalidQueue)
+		}
+		if err := add(d); err != nil {
+			return err
+		}
+
+		if packed {
+			i++
+			continue
+		}
+		if d.Flags&DescFlagNext == 0 {
+			return nil
+		}
+		if int(d.Next) >= len(table) {
+			return fmt.Errorf("%w: indirect descriptor %d out of range", ErrInvalidQueue, d.Next)
+		}
+		i = int(d.Next)
+	}
+}
+
+// ReadableLen returns the total length of the device-readable buffers.
+func (c *DescriptorChain) ReadableLen() uint64 {
+	return totalLen(c.Readable)
+}
+
+// WritableLen returns the total length of the device-writable buffers.
+func (c *DescriptorChain) WritableLen() uint64 {
+	return totalLen(c.Writable)
+}
+
+func totalLen(descs []Descriptor) uint64 {
+	var n uint64
+	for _, d := range descs {
+		n += uint64(d.Len)
+	}
+
+	return n
+}
+
+// Read reads from the device-readable buffers. It returns io.EOF once they
+// are consumed.
+func (c *DescriptorChain) Read(p []byte) (int, error) {
+	n, err := c.copy(p, c.Readable, &c.r, false)
+	if err == nil && n == 0 && len(p) > 0 {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// Write writes to the device-writable buffers. It returns io.ErrShortWrite if
+// they are too small for p.
+func (c *DescriptorChain) Write(p []byte) (int, error) {
+	n, err := c.copy(p, c.Writable, &c.w, true)
+	c.written += uint32(n)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+
+	return n, err
+}
+
+// Written returns the number of bytes written, the length reported to the
+// driver in the used ring.
+func (c *DescriptorChain) Written() uint32 {
+	return c.written
+}
+
+// ReadSlices returns the host memory of the next n bytes of the
+// device-readable buffers and moves past them, for I/O straight from guest
+// memory. The position is unchanged on error.
+func (c *DescriptorChain) ReadSlices(n uint64) ([][]byte, error) {
+	return c.slices(n, c.Readable, &c.r)
+}
+
+// WriteSlices returns the host memory of the next n bytes of the
+// device-writable buffers and moves past them, for I/O straight into guest
+// memory. The n bytes count as written. The position is unchanged on error.
+func (c *DescriptorChain) WriteSlices(n uint64) ([][]byte, error) {
+	s, err := c.slices(n, c.Writable, &c.w)
+	if err == nil {
+		c.written += uint32(n)
+	}
+
+	return s, err
+}
+
+// slices returns the host memory of the next n bytes of descs from the cursor
+// cur.
+func (c *DescriptorChain) slices(n uint64, descs []Descriptor, cur *chainCursor) ([][]byte, error) {
+	var s [][]byte
+	next := *cur
+	for n > 0 {
+		if next.i == len(descs) {
+			return nil, io.ErrShortBuffer
+		}
+		d := descs[next.i]
+		if next.off == d.Len {
+			next.i, next.off = next.i+1, 0
+			continue
+		}
+
+		m := uint64(d.Len - next.off)
+		if n < m {
+			m = n
+		}
+		// a buffer may span regions of the memory.
+		b, err := c.mem.Translate(d.Addr+uint64(next.off), m)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, b)
+		n -= uint64(len(b))
+		next.off += uint32(len(b))
+	}
+	*cur = next
+
+	return s, nil
+}
+
+// copy copies between p and descs from the cursor cur.
+func (c *DescriptorChain) copy(p []byte, descs []Descriptor, cur *chainCursor, write bool) (int, error) {
+	var n int
+	for n < len(p) && cur.i < len(descs) {
+		d := descs[cur.i]
+		if cur.off == d.Len {
+			cur.i, cur.off = cur.i+1, 0
+			continue
+		}
+
+		m := len(p) - n
+		if left := int(d.Len - cur.off); left < m {
+			m = left
+		}
+
+		var (
+			k   int
+			err error
+		)
+		if write {
+			k, err = c.mem.WriteAt(p[n:n+m], d.Addr+uint64(cur.off))
+		} else {
+			k, err = c.mem.ReadAt(p[n:n+m], d.Addr+uint64(cur.off))
+		}
+		n += k
+		cur.off += uint32(k)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,236 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// putTable writes an indirect descriptor table at off of mem.
+func putTable(mem []byte, off uint64, table []Descriptor) {
+	for i, d := range table {
+		b := mem[off+descSize*uint64(i):]
+		binary.LittleEndian.PutUint64(b, d.Addr)
+		binary.LittleEndian.PutUint32(b[8:], d.Len)
+		binary.LittleEndian.PutUint16(b[12:], d.Flags)
+		binary.LittleEndian.PutUint16(b[14:], d.Next)
+	}
+}
+
+func TestDescriptorChain(t *testing.T) {
+	mem, drv, dev, bufs := newTestSplit(t)
+
+	copy(mem[bufs:], "hello, ")
+	copy(mem[bufs+64:], "world")
+	head, err := drv.Add([]Buffer{
+		{Addr: bufs, Len: 7},
+		{Addr: bufs + 64, Len: 5},
+		{Addr: bufs + 128, Len: 4, Writable: true},
+		{Addr: bufs + 192, Len: 4, Writable: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drv.Kick()
+
+	c, ok, err := dev.PopChain()
+	if err != nil || !ok {
+		t.Fatalf("PopChain = %v, %v", ok, err)
+	}
+	if c.ID != head || c.ReadableLen() != 12 || c.WritableLen() != 8 {
+		t.Fatalf("chain %d with %d readable and %d writable bytes", c.ID, c.ReadableLen(), c.WritableLen())
+	}
+
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "hello, world" {
+		t.Fatalf("ReadAll = %q, %v", got, err)
+	}
+
+	if n, err := c.Write([]byte("HELLO")); n != 5 || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if n, err := c.Write([]byte("WORLD")); n != 3 || !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("Write = %d, %v, want 3, %v", n, err, io.ErrShortWrite)
+	}
+	if !bytes.Equal(mem[bufs+128:bufs+132], []byte("HELL")) || !bytes.Equal(mem[bufs+192:bufs+196], []byte("OWOR")) {
+		t.Fatal("Write did not fill the writable buffers in order")
+	}
+
+	if err := dev.PushChain(c); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok, err := drv.Reap(); err != nil || !ok || e.Len != 8 {
+		t.Fatalf("Reap = %+v, %v, %v, want 8 bytes written", e, ok, err)
+	}
+}
+
+func TestDescriptorChainSlices(t *testing.T) {
+	mem, drv, dev, bufs := newTestSplit(t)
+
+	copy(mem[bufs:], "hello, ")
+	copy(mem[bufs+64:], "world")
+	if _, err := drv.Add([]Buffer{
+		{Addr: bufs, Len: 7},
+		{Addr: bufs + 64, Len: 5},
+		{Addr: bufs + 128, Len: 4, Writable: true},
+		{Addr: bufs + 192, Len: 4, Writable: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	drv.Kick()
+	c, ok, err := dev.PopChain()
+	if err != nil || !ok {
+		t.Fatalf("PopChain = %v, %v", ok, err)
+	}
+
+	var h [2]byte
+	if _, err := io.ReadFull(c, h[:]); err != nil {
+		t.Fatal(err)
+	}
+	s, err := c.ReadSlices(8)
+	if err != nil || len(s) != 2 || string(s[0]) != "llo, " || string(s[1]) != "wor" {
+		t.Fatalf("ReadSlices = %q, %v", s, err)
+	}
+	if _, err := c.ReadSlices(3); !errors.Is(err, io.ErrShortBuffer) {
+		t.Fatalf("ReadSlices beyond the buffers: %v", err)
+	}
+	if got, _ := io.ReadAll(c); string(got) != "ld" {
+		t.Fatalf("ReadAll = %q after a failed ReadSlices", got)
+	}
+
+	s, err = c.WriteSlices(6)
+	if err != nil || len(s) != 2 || len(s[0]) != 4 || len(s[1]) != 2 {
+		t.Fatalf("WriteSlices = %q, %v", s, err)
+	}
+	copy(s[0], "HELL")
+	copy(s[1], "O,")
+	if _, err := c.Write([]byte(" W")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mem[bufs+128:bufs+132], []byte("HELL")) || !bytes.Equal(mem[bufs+192:bufs+196], []byte("O, W")) {
+		t.Fatal("the slices are not the writable buffers")
+	}
+	if c.Written() != 8 {
+		t.Fatalf("%d bytes written", c.Written())
+	}
+}
+
+func TestDescriptorChainIndirect(t *testing.T) {
+	mem, drv, dev, bufs := newTestSplit(t)
+
+	// the table links its entries out of order: 0 -> 2 -> 1.
+	table := bufs + 1024
+	putTable(mem, table, []Descriptor{
+		{Addr: bufs, Len: 3, Flags: DescFlagNext, Next: 2},
+		{Addr: bufs + 128, Len: 16, Flags: DescFlagWrite},
+		{Addr: bufs + 64, Len: 3, Flags: DescFlagNext, Next: 1},
+	})
+	copy(mem[bufs:], "abc")
+	copy(mem[bufs+64:], "def")
+
+	head, err := drv.Add([]Buffer{{Addr: table, Len: 3 * descSize}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drv.putDesc(head, Descriptor{Addr: table, Len: 3 * descSize, Flags: DescFlagIndirect})
+	drv.Kick()
+
+	c, ok, err := dev.PopChain()
+	if err != nil || !ok {
+		t.Fatalf("PopChain = %v, %v", ok, err)
+	}
+	if got, _ := io.ReadAll(c); string(got) != "abcdef" {
+		t.Fatalf("ReadAll = %q", got)
+	}
+	if len(c.Writable) != 1 || c.WritableLen() != 16 {
+		t.Fatalf("writable buffers %+v", c.Writable)
+	}
+
+	// a packed indirect table is sequential.
+	c, err = newChain(drv.mem, 7, []Descriptor{{Addr: table, Len: 2 * descSize, Flags: DescFlagIndirect}}, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Readable) != 1 || len(c.Writable) != 1 || c.ID != 7 {
+		t.Fatalf("packed chain %+v", c)
+	}
+}
+
+func TestDescriptorChainInvalid(t *testing.T) {
+	mem, drv, _, bufs := newTestSplit(t)
+
+	table := bufs + 1024
+	indirect := func(n int) []Descriptor {
+		return []Descriptor{{Addr: table, Len: uint32(n) * descSize, Flags: DescFlagIndirect}}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		table  []Descriptor
+		descs  []Descriptor
+		maxLen int
+		packed bool
+	}{
+		{
+			name:  "readable after writable",
+			descs: []Descriptor{{Flags: DescFlagWrite | DescFlagNext}, {}},
+		},
+		{
+			name:   "too long",
+			descs:  make([]Descriptor, 5),
+			maxLen: 4,
+		},
+		{
+			name:  "indirect with next",
+			descs: []Descriptor{{Addr: table, Len: descSize, Flags: DescFlagIndirect | DescFlagNext}, {}},
+		},
+		{
+			name:  "indirect after direct",
+			descs: append([]Descriptor{{Flags: DescFlagNext}}, indirect(1)...),
+		},
+		{
+			name:  "indirect table size",
+			descs: []Descriptor{{Addr: table, Len: descSize + 1, Flags: DescFlagIndirect}},
+		},
+		{
+			name:  "indirect table out of memory",
+			descs: []Descriptor{{Addr: uint64(len(mem)) - descSize/2, Len: descSize, Flags: DescFlagIndirect}},
+		},
+		{
+			name:  "indirect loop",
+			table: []Descriptor{{Flags: DescFlagNext, Next: 1}, {Flags: DescFlagNext, Next: 0}},
+			descs: indirect(2),
+		},
+		{
+			name:  "indirect next out of range",
+			table: []Descriptor{{Flags: DescFlagNext, Next: 5}},
+			descs: indirect(1),
+		},
+		{
+			name:  "nested indirect",
+			table: []Descriptor{{Addr: table, Len: descSize, Flags: DescFlagIndirect}},
+			descs: indirect(1),
+		},
+		{
+			name:   "indirect too long",
+			table:  make([]Descriptor, 8),
+			descs:  indirect(8),
+			maxLen: 4,
+			packed: true,
+		},
+		{
+			name:  "huge indirect table",
+			descs: []Descriptor{{Addr: table, Len: 1<<32 - descSize, Flags: DescFlagIndirect}},
+		},
+	} {
+		putTable(mem, table, tt.table)
+		if _, err := newChain(drv.mem, 0, tt.descs, tt.maxLen, tt.packed); !errors.Is(err, ErrInvalidQueue) && !errors.Is(err, ErrOutOfBounds) {
+			t.Errorf("%s: newChain = %v, want an error", tt.name, err)
+		}
+	}
+}
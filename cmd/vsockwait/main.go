@@ -0,0 +1,98 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build darwin || linux
+
+// Command vsockwait waits until a guest vsock port accepts connections.
+//
+// Usage:
+//
+//	vsockwait [flags] <cid> <port>
+//
+// It exits 0 once the port is ready and reports the timing on stderr, or exits
+// non-zero when the timeout expires or a permanent error occurs.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-hypervisor/virtio/vsock"
+)
+
+var (
+	flagTimeout  = flag.Duration("timeout", time.Minute, "overall time to wait for the port")
+	flagAttempt  = flag.Duration("attempt-timeout", 2*time.Second, "timeout of a single attempt")
+	flagInterval = flag.Duration("interval", 100*time.Millisecond, "initial delay between attempts")
+	flagMaxDelay = flag.Duration("max-interval", 5*time.Second, "maximum delay between attempts")
+	flagBanner   = flag.String("banner", "", "expect the peer to send this banner first")
+	flagSend     = flag.String("send", "", "send this request once connected")
+	flagExpect   = flag.String("expect", "", "expect this response to the request sent by -send")
+	flagQuiet    = flag.Bool("q", false, "do not report timing")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <cid> <port>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cid, err := parseUint32(flag.Arg(0))
+	if err != nil {
+		fatalf("invalid cid %q: %v", flag.Arg(0), err)
+	}
+	port, err := parseUint32(flag.Arg(1))
+	if err != nil {
+		fatalf("invalid port %q: %v", flag.Arg(1), err)
+	}
+
+	p := &vsock.Prober{
+		Backoff: vsock.Backoff{
+			Min:    *flagInterval,
+			Max:    *flagMaxDelay,
+			Factor: 2,
+			Jitter: 0.1,
+		},
+		AttemptTimeout: *flagAttempt,
+		Banner:         []byte(*flagBanner),
+		Request:        []byte(*flagSend),
+		Response:       []byte(*flagExpect),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *flagTimeout)
+	defer cancel()
+
+	res, err := p.Wait(ctx, cid, port)
+	if err != nil {
+		fatalf("%08x.%08x not ready after %d attempts: %v", cid, port, res.Attempts, err)
+	}
+
+	if !*flagQuiet {
+		fmt.Fprintf(os.Stderr, "%08x.%08x ready after %v (%d attempts, connect %v)\n", cid, port, res.Elapsed.Round(time.Millisecond), res.Attempts, res.Connect.Round(time.Microsecond))
+	}
+}
+
+// parseUint32 parses s as a decimal or 0x-prefixed hexadecimal uint32.
+func parseUint32(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(v), nil
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "vsockwait: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build darwin || linux
+
+// Command vsockxfer copies files and directory trees over vsock.
+//
+// Usage:
+//
+//	vsockxfer serve [flags]
+//	vsockxfer push [flags] <cid> <port> <src> <dst>
+//	vsockxfer pull [flags] <cid> <port> <src> <dst>
+//
+// serve runs in the guest and resolves remote paths below -root; a leading
+// slash of a remote path is ignored. push and pull reconnect and resume an
+// interrupted transfer from the last verified chunk until -timeout expires.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-hypervisor/virtio/vsock"
+	"github.com/go-hypervisor/virtio/vsock/xfer"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "serve":
+		serve(args)
+	case "push", "pull":
+		transfer(cmd, args)
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage:\n")
+	fmt.Fprintf(os.Stderr, "\t%s serve [flags]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\t%s push [flags] <cid> <port> <src> <dst>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\t%s pull [flags] <cid> <port> <src> <dst>\n", os.Args[0])
+	os.Exit(2)
+}
+
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	port := fs.Uint("port", 1234, "vsock port to listen on")
+	root := fs.String("root", "/", "directory remote paths are resolved in")
+	owner := fs.Bool("owner", os.Geteuid() == 0, "preserve the numeric owner of pushed files")
+	fs.Parse(args)
+
+	ln, err := vsock.Listen(vsock.VMAddrCIDAny, uint32(*port))
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer ln.Close()
+
+	srv := &xfer.Server{
+		Root:     *root,
+		Receiver: xfer.Receiver{PreserveOwner: *owner},
+	}
+	log.Printf("serving %s on port %d", *root, *port)
+	fatalf("%v", srv.Serve(ln))
+}
+
+func transfer(cmd string, args []string) {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	timeout := fs.Duration("timeout", 10*time.Minute, "overall time to retry the transfer")
+	chunk := fs.Int("chunk", xfer.DefaultChunkSize, "size of a verified chunk")
+	owner := fs.Bool("owner", false, "preserve the numeric owner of pulled files")
+	verbose := fs.Bool("v", false, "report every transferred entry")
+	fs.Parse(args)
+
+	if fs.NArg() != 4 {
+		usage()
+	}
+	cid, err := parseUint32(fs.Arg(0))
+	if err != nil {
+		fatalf("invalid cid %q: %v", fs.Arg(0), err)
+	}
+	port, err := parseUint32(fs.Arg(1))
+	if err != nil {
+		fatalf("invalid port %q: %v", fs.Arg(1), err)
+	}
+	src, dst := fs.Arg(2), fs.Arg(3)
+	if cmd == "push" {
+		dst = remotePath(dst)
+	} else {
+		src = remotePath(src)
+	}
+
+	var progress xfer.Progress
+	if *verbose {
+		progress = func(e *xfer.Entry, skipped int64) {
+			if skipped > 0 {
+				log.Printf("%s (%d bytes resumed)", e.Path, skipped)
+				return
+			}
+			log.Print(e.Path)
+		}
+	}
+
+	s := &xfer.Sender{ChunkSize: *chunk, Progress: progress}
+	r := &xfer.Receiver{PreserveOwner: *owner, Progress: progress}
+
+	run := func(conn io.ReadWriter) error {
+		if cmd == "push" {
+			return s.Push(conn, src, dst)
+		}
+		return r.Pull(conn, src, dst)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	var backoff vsock.Backoff
+	for attempt := 0; ; attempt++ {
+		err := once(ctx, cid, port, run)
+		if err == nil {
+			return
+		}
+		if !retriable(err) || ctx.Err() != nil {
+			fatalf("%s: %v", cmd, err)
+		}
+
+		log.Printf("%s interrupted, resuming: %v", cmd, err)
+		select {
+		case <-ctx.Done():
+			fatalf("%s: %v", cmd, err)
+		case <-time.After(backoff.Duration(attempt)):
+		}
+	}
+}
+
+// once connects and runs a single transfer attempt.
+func once(ctx context.Context, cid, port uint32, run func(io.ReadWriter) error) error {
+	conn, err := vsock.DialRetry(ctx, cid, port, vsock.Backoff{})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return run(conn)
+}
+
+// retriable reports whether a failed attempt can be resumed on a new
+// connection. Errors reported by the peer and local file errors are final.
+func retriable(err error) bool {
+	var rerr xfer.RemoteError
+	if errors.As(err, &rerr) {
+		return false
+	}
+
+	return vsock.IsTemporary(err) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, os.ErrClosed) || errors.Is(err, xfer.ErrChecksum)
+}
+
+// remotePath returns p relative to the server root.
+func remotePath(p string) string {
+	if p = strings.TrimLeft(p, "/"); p == "" {
+		return "."
+	}
+
+	return p
+}
+
+// parseUint32 parses s as a decimal or 0x-prefixed hexadecimal uint32.
+func parseUint32(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(v), nil
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "vsockxfer: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package consoledev
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// list of control events.
+const (
+	eventDeviceReady = 0 // VIRTIO_CONSOLE_DEVICE_READY
+	eventPortAdd     = 1 // VIRTIO_CONSOLE_DEVICE_ADD
+	eventPortRemove  = 2 // VIRTIO_CONSOLE_DEVICE_REMOVE
+	eventPortReady   = 3 // VIRTIO_CONSOLE_PORT_READY
+	eventConsolePort = 4 // VIRTIO_CONSOLE_CONSOLE_PORT
+	eventResize      = 5 // VIRTIO_CONSOLE_RESIZE
+	eventPortOpen    = 6 // VIRTIO_CONSOLE_PORT_OPEN
+	eventPortName    = 7 // VIRTIO_CONSOLE_PORT_NAME
+)
+
+// controlSize is the size of struct virtio_console_control.
+const controlSize = 8
+
+// message returns struct virtio_console_control.
+func message(id uint32, event, value uint16) []byte {
+	b := make([]byte, controlSize)
+	binary.LittleEndian.PutUint32(b[0:], id)
+	binary.LittleEndian.PutUint16(b[4:], event)
+	binary.LittleEndian.PutUint16(b[6:], value)
+
+	return b
+}
+
+// resizeMessage returns the RESIZE message of the port i. The size follows as
+// rows then cols, the order of the Linux driver, which the specification
+// lists the other way round.
+func resizeMessage(i int, cols, rows uint16) []byte {
+	b := append(message(uint32(i), eventResize, 0), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint16(b[controlSize:], rows)
+	binary.LittleEndian.PutUint16(b[controlSize+2:], cols)
+
+	return b
+}
+
+// send queues the message b for the control rx queue. d.mu must be held.
+func (d *Device) send(b []byte) {
+	d.pending = append(d.pending, b)
+	select {
+	case d.kick <- struct{}{}:
+	default:
+	}
+}
+
+// controlRx writes the messages sent to the control rx queue q until done is
+// closed, one per chain.
+func (d *Device) controlRx(q *virtio.Queue, irq virtio.Interrupter, kick <-chan struct{}, done <-chan struct{}) {
+	defer d.wg.Done()
+
+	for {
+		d.mu.Lock()
+		msgs := d.pending
+		d.pending = nil
+		d.mu.Unlock()
+
+		for _, b := range msgs {
+			c, err := pop(q, done)
+			if err != nil {
+				<-done
+				return
+			}
+			if c == nil {
+				return
+			}
+			c.Write(b)
+			if err := q.PushChain(c); err != nil {
+				<-done
+				return
+			}
+			if q.NeedsNotification() {
+				irq.InterruptQueue(q.Index())
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-kick:
+		}
+	}
+}
+
+// controlTx handles the messages of the driver on the control tx queue q
+// until done is closed.
+func (d *Device) controlTx(q *virtio.Queue, irq virtio.Interrupter, done <-chan struct{}) {
+	defer d.wg.Done()
+
+	q.Serve(irq, done, func(c *virtio.DescriptorChain) bool {
+		d.control(c)
+		return true
+	})
+}
+
+// control handles the message of the driver in c. Messages for unknown ports
+// are ignored.
+func (d *Device) control(c *virtio.DescriptorChain) {
+	var b [controlSize]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		return
+	}
+	id := binary.LittleEndian.Uint32(b[0:])
+	event := binary.LittleEndian.Uint16(b[4:])
+	value := binary.LittleEndian.Uint16(b[6:])
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if event == eventDeviceReady {
+		// a driver failing to set up the device goes on without ports, and
+		// the ports are added once per activation.
+		if value == 1 && !d.ready {
+			d.ready = true
+			for _, p := range d.ports {
+				d.send(message(p.id, eventPortAdd, 1))
+			}
+		}
+		return
+	}
+	if id >= uint32(len(d.ports)) {
+		return
+	}
+	p := d.ports[id]
+
+	switch event {
+	case eventPortReady:
+		if value != 1 || p.ready {
+			return
+		}
+		p.ready = true
+		if d.Ports[id].Console {
+			d.send(message(id, eventConsolePort, 1))
+			if p.cols != 0 || p.rows != 0 {
+				d.send(resizeMessage(int(id), p.cols, p.rows))
+			}
+		}
+		if name := d.Ports[id].Name; name != "" {
+			d.send(append(message(id, eventPortName, 1), name...))
+		}
+		if p.hostOpen {
+			d.send(message(id, eventPortOpen, 1))
+		}
+	case eventPortOpen:
+		p.guestOpen = value == 1
+		select {
+		case p.kick <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package consoledev
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// list of device feature bits.
+const (
+	FeatureSize       virtio.Features = 1 << 0 // VIRTIO_CONSOLE_F_SIZE
+	FeatureMultiport  virtio.Features = 1 << 1 // VIRTIO_CONSOLE_F_MULTIPORT
+	FeatureEmergWrite virtio.Features = 1 << 2 // VIRTIO_CONSOLE_F_EMERG_WRITE
+)
+
+// list of queue indices. The queues of the port i > 0 follow the control
+// queues, at 2i+2 and 2i+3.
+const (
+	rxQueue = iota
+	txQueue
+	controlRxQueue
+	controlTxQueue
+)
+
+const (
+	// queueSize is the maximum size of the queues.
+	queueSize = 256
+
+	// configSize is the size of struct virtio_console_config, and
+	// emergWrOff the offset of its emerg_wr field.
+	configSize = 12
+	emergWrOff = 8
+
+	// readSize is the largest piece of data read from a backend, or
+	// written to it, at once.
+	readSize = 4096
+)
+
+var (
+	// ErrNoBackend is returned by Activate for a device without port, or
+	// with a port without backend.
+	ErrNoBackend = errors.New("consoledev: port without backend")
+
+	// ErrQueues is returned by Activate when the driver did not enable the
+	// queues of the first port, or the control queues with
+	// FeatureMultiport.
+	ErrQueues = errors.New("consoledev: the queues of port 0 and the control queues are required")
+)
+
+func init() {
+	virtio.Register(virtio.DeviceConsole, func() virtio.Device { return &Device{} })
+}
+
+// Port is a port of the device.
+type Port struct {
+	// Backend is the host end of the port. It is read from the first
+	// activation of the device until Close, which closes it.
+	Backend io.ReadWriteCloser
+
+	// Name names the port to the guest with FeatureMultiport, as
+	// /dev/virtio-ports/Name, e.g. "org.qemu.guest_agent.0".
+	Name string
+
+	// Console makes the port a console of the guest with
+	// FeatureMultiport. Without it the first port is the only console.
+	Console bool
+
+	// Cols and Rows are the initial size of a console, changed by Resize.
+	// The size of the first port is offered with FeatureSize if set.
+	Cols, Rows uint16
+}
+
+// Device is a virtio-console device. Its fields are set before the device is
+// activated.
+type Device struct {
+	// Ports are the ports of the device, offered with FeatureMultiport if
+	// more than one or if the first is named. Only the first port is used
+	// otherwise.
+	Ports []Port
+
+	mu       sync.Mutex
+	features virtio.Features
+	irq      virtio.Interrupter
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	// state of the ports, from the first activation, the messages waiting
+	// for the control rx queue, and whether the driver sent DEVICE_READY
+	// since the activation.
+	ports   []*port
+	pending [][]byte
+	kick    chan struct{}
+	ready   bool
+
+	readOnce sync.Once
+	closed   chan struct{}
+	readers  sync.WaitGroup
+}
+
+var _ virtio.Device = (*Device)(nil)
+
+// DeviceID implements virtio.Device.DeviceID.
+func (d *Device) DeviceID() virtio.DeviceID {
+	return virtio.DeviceConsole
+}
+
+// multiport reports whether the device offers FeatureMultiport.
+func (d *Device) multiport() bool {
+	return len(d.Ports) > 1 || len(d.Ports) == 1 && d.Ports[0].Name != ""
+}
+
+// Features implements virtio.Device.Features.
+func (d *Device) Features() virtio.Features {
+	f := FeatureEmergWrite | virtio.FeatureIndirectDesc | virtio.FeatureEventIdx | virtio.FeatureRingPacked
+	if d.multiport() {
+		f |= FeatureMultiport
+	}
+	if len(d.Ports) > 0 && (d.Ports[0].Cols != 0 || d.Ports[0].Rows != 0) {
+		f |= FeatureSize
+	}
+
+	return f
+}
+
+// AckFeatures implements virtio.Device.AckFeatures.
+func (d *Device) AckFeatures(f virtio.Features) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.features = f
+}
+
+// QueueMaxSizes implements virtio.Device.QueueMaxSizes.
+func (d *Device) QueueMaxSizes() []uint16 {
+	n := 2
+	if d.multiport() {
+		n = 2 * (len(d.Ports) + 1)
+	}
+	sizes := make([]uint16, n)
+	for i := range sizes {
+		sizes[i] = queueSize
+	}
+
+	return sizes
+}
+
+// portQueues returns the indices of the rx and tx queues of the port i.
+func portQueues(i int) (rx, tx int) {
+	if i == 0 {
+		return rxQueue, txQueue
+	}
+
+	return 2*i + 2, 2*i + 3
+}
+
+// size returns the size of the port i. d.mu must be held.
+func (d *Device) size(i int) (cols, rows uint16) {
+	if i < len(d.ports) {
+		return d.ports[i].cols, d.ports[i].rows
+	}
+
+	return d.Ports[i].Cols, d.Ports[i].Rows
+}
+
+// config returns struct virtio_console_config.
+func (d *Device) config() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var b [configSize]byte
+	if len(d.Ports) == 0 {
+		return b[:]
+	}
+	cols, rows := d.size(0)
+	le := binary.LittleEndian
+	le.PutUint16(b[0:], cols)
+	le.PutUint16(b[2:], rows)
+	le.PutUint32(b[4:], uint32(len(d.Ports)))
+
+	return b[:]
+}
+
+// ReadConfig implements virtio.Device.ReadConfig.
+func (d *Device) ReadConfig(off uint64, p []byte) {
+	config := d.config()
+	for i := range p {
+		p[i] = 0
+	}
+	if off < uint64(len(config)) {
+		copy(p, config[off:])
+	}
+}
+
+// WriteConfig implements virtio.Device.WriteConfig. A write to emerg_wr with
+// FeatureEmergWrite writes its character to the first port, whether the
+// device is active or not.
+func (d *Device) WriteConfig(off uint64, p []byte) {
+	d.mu.Lock()
+	ok := d.features.Has(FeatureEmergWrite)
+	d.mu.Unlock()
+	if !ok || off != emergWrOff || len(p) == 0 || len(d.Ports) == 0 || d.Ports[0].Backend == nil {
+		return
+	}
+
+	_, _ = d.Ports[0].Backend.Write(p[:1])
+}
+
+// Activate implements virtio.Device.Activate.
+func (d *Device) Activate(mem virtio.GuestMemory, queues []*virtio.Queue, irq virtio.Interrupter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.Ports) == 0 {
+		return ErrNoBackend
+	}
+	for _, p := range d.Ports {
+		if p.Backend == nil {
+			return ErrNoBackend
+		}
+	}
+	multiport := d.features.Has(FeatureMultiport)
+	if queues[rxQueue] == nil || queues[txQueue] == nil ||
+		multiport && (queues[controlRxQueue] == nil || queues[controlTxQueue] == nil) {
+		return ErrQueues
+	}
+	d.readOnce.Do(d.startReaders)
+
+	d.irq = irq
+	d.done = make(chan struct{})
+	d.pending, d.kick, d.ready = nil, make(chan struct{}, 1), false
+	n := 1
+	if multiport {
+		n = len(d.Ports)
+	}
+	for i, p := range d.ports {
+		p.ready, p.guestOpen = false, !multiport
+		p.kick = make(chan struct{}, 1)
+		if i >= n {
+			continue
+		}
+		rx, tx := portQueues(i)
+		if queues[rx] != nil {
+			d.wg.Add(1)
+			go d.receive(p, queues[rx], irq, d.done)
+		}
+		if queues[tx] != nil {
+			d.wg.Add(1)
+			go d.transmit(p, queues[tx], irq, d.done)
+		}
+	}
+	if multiport {
+		d.wg.Add(2)
+		go d.controlRx(queues[controlRxQueue], irq, d.kick, d.done)
+		go d.controlTx(queues[controlTxQueue], irq, d.done)
+	}
+
+	return nil
+}
+
+// Reset implements virtio.Device.Reset.
+func (d *Device) Reset() {
+	d.mu.Lock()
+	done := d.done
+	d.irq, d.done = nil, nil
+	d.features = 0
+	d.pending = nil
+	d.mu.Unlock()
+
+	if done != nil {
+		close(done)
+		d.wg.Wait()
+	}
+}
+
+// Close resets the device and closes the backends of its ports.
+func (d *Device) Close() error {
+	d.Reset()
+	var err error
+	for _, p := range d.Ports {
+		if p.Backend == nil {
+			continue
+		}
+		if cerr := p.Backend.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	d.mu.Lock()
+	closed := d.closed
+	d.closed = nil
+	d.mu.Unlock()
+	if closed != nil {
+		close(closed)
+		d.readers.Wait()
+	}
+
+	return err
+}
+
+// Resize sets the size of the console port i, notifying the driver: through
+// the configuration space for the first port without FeatureMultiport, and
+// with a RESIZE message for a console port with it.
+func (d *Device) Resize(i int, cols, rows uint16) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if i < 0 || i >= len(d.Ports) {
+		return
+	}
+	if i < len(d.ports) {
+		d.ports[i].cols, d.ports[i].rows = cols, rows
+	} else {
+		d.Ports[i].Cols, d.Ports[i].Rows = cols, rows
+	}
+	if d.irq == nil {
+		return
+	}
+
+	switch {
+	case d.features.Has(FeatureMultiport):
+		if d.Ports[i].Console && d.ports[i].ready {
+			d.send(resizeMessage(i, cols, rows))
+		}
+	case i == 0 && d.features.Has(FeatureSize):
+		d.irq.InterruptConfig()
+	}
+}
+
+// Open reports whether the guest has the port i open: with FeatureMultiport
+// once the driver sent PORT_OPEN, otherwise while the device is active.
+func (d *Device) Open(i int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.irq != nil && i >= 0 && i < len(d.ports) && d.ports[i].guestOpen
+}
@@ -0,0 +1,335 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package consoledev
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-hypervisor/virtio"
+	"github.com/go-hypervisor/virtio/driver"
+	"github.com/go-hypervisor/virtio/driver/drivertest"
+)
+
+// guest is the driver side of a device over a loopback, with hosts the other
+// ends of the pipes of its ports.
+type guest struct {
+	t       *testing.T
+	ctx     context.Context
+	l       *driver.Loopback
+	rxs     []*driver.Queue
+	txs     []*driver.Queue
+	ctrlRx  *driver.Queue
+	ctrlTx  *driver.Queue
+	ctrl    []*driver.Request // control rx buffers posted, in order
+	hosts   []net.Conn
+	configs chan struct{}
+}
+
+// newGuest returns the guest of a device with the ports, whose backends are
+// set to pipes.
+func newGuest(t *testing.T, ports []Port, features virtio.Features) (*guest, *Device) {
+	t.Helper()
+
+	g := &guest{t: t, configs: make(chan struct{}, 16)}
+	for i := range ports {
+		dev, host := net.Pipe()
+		ports[i].Backend = dev
+		g.hosts = append(g.hosts, host)
+		t.Cleanup(func() { host.Close() })
+	}
+	dev := &Device{Ports: ports}
+	t.Cleanup(func() { dev.Close() })
+
+	n := 1
+	var queues []int
+	if features.Has(FeatureMultiport) {
+		n = len(ports)
+		queues = append(queues, controlRxQueue, controlTxQueue)
+	}
+	for i := 0; i < n; i++ {
+		rx, tx := portQueues(i)
+		queues = append(queues, rx, tx)
+	}
+	dg := drivertest.New(t, dev, drivertest.Config{
+		Features: features,
+		Queues:   queues,
+		Config:   func() { g.configs <- struct{}{} },
+	})
+	g.ctx, g.l = dg.Ctx, dg.Loopback
+	for i := 0; i < n; i++ {
+		rx, tx := portQueues(i)
+		g.rxs, g.txs = append(g.rxs, dg.Queues[rx]), append(g.txs, dg.Queues[tx])
+	}
+	if features.Has(FeatureMultiport) {
+		g.ctrlRx, g.ctrlTx = dg.Queues[controlRxQueue], dg.Queues[controlTxQueue]
+		for i := 0; i < 8; i++ {
+			g.postControl()
+		}
+	}
+
+	return g, dev
+}
+
+// post makes a buffer of size bytes available to q.
+func (g *guest) post(q *driver.Queue, size int) *driver.Request {
+	g.t.Helper()
+
+	r := &driver.Request{In: [][]byte{make([]byte, size)}}
+	if err := q.Submit(r); err != nil {
+		g.t.Fatal(err)
+	}
+
+	return r
+}
+
+func (g *guest) postControl() {
+	g.t.Helper()
+
+	g.ctrl = append(g.ctrl, g.post(g.ctrlRx, 64))
+}
+
+// wait returns the bytes written to r.
+func (g *guest) wait(r *driver.Request) []byte {
+	g.t.Helper()
+
+	if err := r.Wait(g.ctx); err != nil {
+		g.t.Fatal(err)
+	}
+
+	return r.In[0][:r.Written]
+}
+
+// receive returns the next control message of the device, and posts a new
+// buffer.
+func (g *guest) receive() (id uint32, event, value uint16, extra []byte) {
+	g.t.Helper()
+
+	b := g.wait(g.ctrl[0])
+	g.ctrl = g.ctrl[1:]
+	g.postControl()
+	if len(b) < controlSize {
+		g.t.Fatalf("control message of %d bytes", len(b))
+	}
+	le := binary.LittleEndian
+
+	return le.Uint32(b), le.Uint16(b[4:]), le.Uint16(b[6:]), b[controlSize:]
+}
+
+// expect checks the next control message of the device.
+func (g *guest) expect(id uint32, event, value uint16, extra []byte) {
+	g.t.Helper()
+
+	gid, gevent, gvalue, gextra := g.receive()
+	if gid != id || gevent != event || gvalue != value || !bytes.Equal(gextra, extra) {
+		g.t.Fatalf("message %d %d %d %q, want %d %d %d %q", gid, gevent, gvalue, gextra, id, event, value, extra)
+	}
+}
+
+// control sends a control message to the device.
+func (g *guest) control(id uint32, event, value uint16) {
+	g.t.Helper()
+
+	if err := g.ctrlTx.Do(g.ctx, &driver.Request{Out: [][]byte{message(id, event, value)}}); err != nil {
+		g.t.Fatal(err)
+	}
+}
+
+// write writes b to the port i.
+func (g *guest) write(i int, b []byte) {
+	g.t.Helper()
+
+	r := &driver.Request{Out: [][]byte{b}}
+	if err := g.txs[i].Submit(r); err != nil {
+		g.t.Fatal(err)
+	}
+	got := make([]byte, len(b))
+	if _, err := io.ReadFull(g.hosts[i], got); err != nil || !bytes.Equal(got, b) {
+		g.t.Fatalf("host read %q, %v", got, err)
+	}
+	if err := r.Wait(g.ctx); err != nil {
+		g.t.Fatal(err)
+	}
+}
+
+// read checks that the host data b reaches the port i, in buffers of size
+// bytes.
+func (g *guest) read(i int, b []byte, size int) {
+	g.t.Helper()
+
+	var rs []*driver.Request
+	for n := 0; n < len(b); n += size {
+		rs = append(rs, g.post(g.rxs[i], size))
+	}
+	if _, err := g.hosts[i].Write(b); err != nil {
+		g.t.Fatal(err)
+	}
+	var got []byte
+	for _, r := range rs {
+		got = append(got, g.wait(r)...)
+	}
+	if !bytes.Equal(got, b) {
+		g.t.Fatalf("guest read %q, want %q", got, b)
+	}
+}
+
+func TestSinglePort(t *testing.T) {
+	g, dev := newGuest(t, []Port{{Cols: 80, Rows: 25}}, FeatureSize|FeatureEmergWrite)
+	if f := dev.Features(); f.Has(FeatureMultiport) || !f.Has(FeatureSize) {
+		t.Fatalf("features %v", f)
+	}
+
+	b := make([]byte, configSize)
+	g.l.ReadConfig(0, b)
+	le := binary.LittleEndian
+	if le.Uint16(b[0:]) != 80 || le.Uint16(b[2:]) != 25 || le.Uint32(b[4:]) != 1 {
+		t.Fatalf("config % x", b)
+	}
+
+	g.write(0, []byte("hello"))
+	g.write(0, bytes.Repeat([]byte("long line "), readSize))
+	g.read(0, []byte("a console line longer than a buffer"), 8)
+	if !dev.Open(0) {
+		t.Fatal("port closed")
+	}
+
+	dev.Resize(0, 132, 43)
+	select {
+	case <-g.configs:
+	case <-g.ctx.Done():
+		t.Fatal("no configuration change")
+	}
+	g.l.ReadConfig(0, b)
+	if le.Uint16(b[0:]) != 132 || le.Uint16(b[2:]) != 43 {
+		t.Fatalf("config % x after resize", b)
+	}
+
+	// the emergency write bypasses the queues.
+	done := make(chan []byte)
+	go func() {
+		b := make([]byte, 1)
+		io.ReadFull(g.hosts[0], b)
+		done <- b
+	}()
+	g.l.WriteConfig(emergWrOff, []byte{'!', 0, 0, 0})
+	if b := <-done; b[0] != '!' {
+		t.Fatalf("emergency write %q", b)
+	}
+}
+
+func TestMultiport(t *testing.T) {
+	ports := []Port{
+		{Console: true, Cols: 100, Rows: 40},
+		{Name: "org.qemu.guest_agent.0"},
+	}
+	g, dev := newGuest(t, ports, FeatureMultiport)
+	if f := dev.Features(); !f.Has(FeatureMultiport) || !f.Has(FeatureSize) {
+		t.Fatalf("features %v", f)
+	}
+	b := make([]byte, configSize)
+	g.l.ReadConfig(0, b)
+	if n := binary.LittleEndian.Uint32(b[4:]); n != 2 {
+		t.Fatalf("max_nr_ports %d", n)
+	}
+
+	g.control(0, eventDeviceReady, 1)
+	g.expect(0, eventPortAdd, 1, nil)
+	g.expect(1, eventPortAdd, 1, nil)
+
+	// the ports are added once: repeats queue no messages.
+	for i := 0; i < 100; i++ {
+		g.control(0, eventDeviceReady, 1)
+	}
+	dev.mu.Lock()
+	n := len(dev.pending)
+	dev.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d messages pending after repeated DEVICE_READY", n)
+	}
+
+	g.control(0, eventPortReady, 1)
+	g.expect(0, eventConsolePort, 1, nil)
+	g.expect(0, eventResize, 0, []byte{40, 0, 100, 0})
+	g.expect(0, eventPortOpen, 1, nil)
+	g.control(1, eventPortReady, 1)
+	g.expect(1, eventPortName, 1, []byte("org.qemu.guest_agent.0"))
+	g.expect(1, eventPortOpen, 1, nil)
+
+	// the data of the host waits until the guest opens the port.
+	r := g.post(g.rxs[1], 64)
+	written := make(chan error)
+	go func() {
+		_, err := g.hosts[1].Write([]byte(`{"execute":"guest-ping"}`))
+		written <- err
+	}()
+	select {
+	case <-r.Done():
+		t.Fatal("data received by a closed port")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if dev.Open(1) {
+		t.Fatal("port open")
+	}
+	g.control(1, eventPortOpen, 1)
+	if got := g.wait(r); string(got) != `{"execute":"guest-ping"}` || <-written != nil {
+		t.Fatalf("guest read %q", got)
+	}
+	if !dev.Open(1) {
+		t.Fatal("port closed")
+	}
+	g.write(1, []byte(`{"return":{}}`))
+
+	g.control(0, eventPortOpen, 1)
+	g.read(0, []byte("login: "), 64)
+	dev.Resize(0, 200, 50)
+	g.expect(0, eventResize, 0, []byte{50, 0, 200, 0})
+
+	// unknown ports and events are ignored.
+	g.control(7, eventPortReady, 1)
+	g.control(0, 99, 1)
+
+	g.hosts[1].Close()
+	g.expect(1, eventPortOpen, 0, nil)
+}
+
+func TestQueues(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		ports   []Port
+		queues  int
+		wantErr bool
+	}{
+		{"no port", nil, 2, true},
+		{"no backend", []Port{{}}, 2, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := &Device{Ports: tt.ports}
+			queues := make([]*virtio.Queue, tt.queues)
+			if err := dev.Activate(nil, queues, nil); (err != nil) != tt.wantErr {
+				t.Fatalf("Activate: %v", err)
+			}
+		})
+	}
+
+	ports := []Port{{Backend: nopBackend{}}, {Backend: nopBackend{}}}
+	dev := &Device{Ports: ports}
+	if n := len(dev.QueueMaxSizes()); n != 6 {
+		t.Fatalf("%d queues", n)
+	}
+	dev.AckFeatures(FeatureMultiport)
+	if err := dev.Activate(nil, make([]*virtio.Queue, 6), nil); err != ErrQueues {
+		t.Fatalf("Activate without queues: %v", err)
+	}
+}
+
+type nopBackend struct{}
+
+func (nopBackend) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (nopBackend) Write(p []byte) (int, error) { return len(p), nil }
+func (nopBackend) Close() error                { return nil }
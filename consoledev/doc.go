@@ -0,0 +1,14 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package consoledev implements the device side of virtio-console.
+//
+// A Device carries the byte streams of its ports between the guest and
+// io.ReadWriteCloser backends: a pty, a Unix socket or a file. Without
+// FeatureMultiport the device has a single port, the console of the guest,
+// sized through the configuration space. With it, the control queues add the
+// ports to the driver, name them for /dev/virtio-ports, mark the consoles,
+// resize them, and report the ports opened on either side; the data of the
+// host waits until the guest opens a port, so a named port can carry the
+// channel of the QEMU guest agent.
+package consoledev
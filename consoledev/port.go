@@ -0,0 +1,161 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package consoledev
+
+import (
+	"io"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// port is the state of a port.
+type port struct {
+	id      uint32
+	backend io.ReadWriteCloser
+	data    chan []byte // read from the backend
+
+	// guarded by Device.mu. ready and guestOpen are reset by Activate, and
+	// kick wakes up the rx goroutine when guestOpen changes.
+	cols, rows uint16
+	hostOpen   bool
+	ready      bool
+	guestOpen  bool
+	kick       chan struct{}
+}
+
+// startReaders starts reading the backends of the ports. d.mu must be held.
+func (d *Device) startReaders() {
+	d.closed = make(chan struct{})
+	for i, pc := range d.Ports {
+		p := &port{
+			id:       uint32(i),
+			backend:  pc.Backend,
+			data:     make(chan []byte),
+			cols:     pc.Cols,
+			rows:     pc.Rows,
+			hostOpen: true,
+		}
+		d.ports = append(d.ports, p)
+		d.readers.Add(1)
+		go d.read(p, d.closed)
+	}
+}
+
+// read sends the data of the backend of p to p.data until the backend fails
+// or closed is closed.
+func (d *Device) read(p *port, closed <-chan struct{}) {
+	defer d.readers.Done()
+
+	b := make([]byte, readSize)
+	for {
+		n, err := p.backend.Read(b)
+		if n > 0 {
+			select {
+			case p.data <- append([]byte(nil), b[:n]...):
+			case <-closed:
+				return
+			}
+		}
+		if err != nil {
+			d.hostClosed(p)
+			return
+		}
+	}
+}
+
+// hostClosed reports to the driver that the backend of p is closed.
+func (d *Device) hostClosed(p *port) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p.hostOpen = false
+	if d.irq != nil && d.features.Has(FeatureMultiport) && p.ready {
+		d.send(message(p.id, eventPortOpen, 0))
+	}
+}
+
+// receive writes the data of the backend of p to the rx queue q until done is
+// closed. With FeatureMultiport the data waits until the guest opens the
+// port.
+func (d *Device) receive(p *port, q *virtio.Queue, irq virtio.Interrupter, done <-chan struct{}) {
+	defer d.wg.Done()
+
+	for {
+		d.mu.Lock()
+		data := p.data
+		if !p.guestOpen {
+			data = nil
+		}
+		d.mu.Unlock()
+
+		select {
+		case <-done:
+			return
+		case <-p.kick:
+		case b := <-data:
+			if err := deliver(q, irq, b, done); err != nil {
+				<-done
+				return
+			}
+		}
+	}
+}
+
+// deliver writes b to the chains of q, waiting for chains until done is
+// closed.
+func deliver(q *virtio.Queue, irq virtio.Interrupter, b []byte, done <-chan struct{}) error {
+	for len(b) > 0 {
+		c, err := pop(q, done)
+		if err != nil || c == nil {
+			return err
+		}
+		n, _ := c.Write(b)
+		b = b[n:]
+		if err := q.PushChain(c); err != nil {
+			return err
+		}
+		if q.NeedsNotification() {
+			irq.InterruptQueue(q.Index())
+		}
+	}
+
+	return nil
+}
+
+// pop pops a chain of q, waiting for one until done is closed. It returns nil
+// once done is closed.
+func pop(q *virtio.Queue, done <-chan struct{}) (*virtio.DescriptorChain, error) {
+	for {
+		c, ok, err := q.PopChain()
+		if err != nil || ok {
+			return c, err
+		}
+		q.EnableNotifications()
+		if c, ok, err = q.PopChain(); err != nil || ok {
+			q.DisableNotifications()
+			return c, err
+		}
+
+		select {
+		case <-done:
+			return nil, nil
+		case <-q.Notified():
+		}
+	}
+}
+
+// transmit writes the data of the tx queue q to the backend of p until done
+// is closed.
+func (d *Device) transmit(p *port, q *virtio.Queue, irq virtio.Interrupter, done <-chan struct{}) {
+	defer d.wg.Done()
+
+	// the chains are copied through buf, hiding any ReadFrom of the
+	// backend, and the data is dropped once the backend fails.
+	buf := make([]byte, readSize)
+	w := struct{ io.Writer }{p.backend}
+	q.Serve(irq, done, func(c *virtio.DescriptorChain) bool {
+		_, _ = io.CopyBuffer(w, c, buf)
+		return true
+	})
+}
@@ -0,0 +1,210 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import "fmt"
+
+// DeviceID is the virtio device type.
+type DeviceID uint32
+
+// list of DeviceID.
+const (
+	DeviceNull    DeviceID = 0
+	DeviceNet     DeviceID = 1
+	DeviceBlock   DeviceID = 2
+	DeviceConsole DeviceID = 3
+	DeviceEntropy DeviceID = 4
+	DeviceBalloon DeviceID = 5
+	DeviceVsock   DeviceID = 19
+)
+
+var deviceNames = map[DeviceID]string{
+	DeviceNull:    "null",
+	DeviceNet:     "net",
+	DeviceBlock:   "block",
+	DeviceConsole: "console",
+	DeviceEntropy: "entropy",
+	DeviceBalloon: "balloon",
+	DeviceVsock:   "vsock",
+}
+
+// String returns the name of the device type.
+func (id DeviceID) String() string {
+	if name, ok := deviceNames[id]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("device %d", uint32(id))
+}
+
+// Device is a virtio device model, driven by a transport.
+type Device interface {
+	// DeviceID returns the device type.
+	DeviceID() DeviceID
+
+	// Features returns the features offered by the device, including the
+	// transport features it supports.
+	Features() Features
+
+	// AckFeatures is called with the negotiated features when the driver
+	// sets FEATURES_OK.
+	AckFeatures(f Features)
+
+	// QueueMaxSizes returns the maximum size of each queue of the device.
+	QueueMaxSizes() []uint16
+
+	// ReadConfig reads the device configuration space at off into p.
+	ReadConfig(off uint64, p []byte)
+
+	// WriteConfig writes p to the device configuration space at off.
+	WriteConfig(off uint64, p []byte)
+
+	// Activate starts the device with the queues the driver set up, once the
+	// driver sets DRIVER_OK. A queue the driver did not enable is nil. The
+	// device sends interrupts through irq.
+	Activate(mem GuestMemory, queues []*Queue, irq Interrupter) error
+
+	// Reset stops the device and returns it to its initial state. The queues
+	// and irq passed to Activate must not be used afterwards.
+	Reset()
+}
+
+// Interrupter sends notifications from the device to the driver. It is
+// implemented by the transports.
+type Interrupter interface {
+	// InterruptQueue sends a used buffer notification for the queue index.
+	InterruptQueue(index int)
+
+	// InterruptConfig sends a configuration change notification.
+	InterruptConfig()
+}
+
+// DeviceQueue is the device side of a split or packed queue.
+type DeviceQueue interface {
+	PopChain() (*DescriptorChain, bool, error)
+	PushChain(c *DescriptorChain) error
+	NeedsNotification() bool
+	EnableNotifications()
+	DisableNotifications()
+}
+
+var (
+	_ DeviceQueue = (*SplitQueue)(nil)
+	_ DeviceQueue = (*PackedQueue)(nil)
+)
+
+// Queue is a queue handed to a device on activation.
+type Queue struct {
+	DeviceQueue
+
+	index  int
+	notify chan struct{}
+}
+
+// NewQueue returns the queue index of a device, over ring.
+func NewQueue(index int, ring DeviceQueue) *Queue {
+	return &Queue{
+		DeviceQueue: ring,
+		index:       index,
+		notify:      make(chan struct{}, 1),
+	}
+}
+
+// NewDeviceQueue returns the device side of the queue set up by the driver at
+// the guest addresses desc, driver and device: a PackedQueue if the features
+// include FeatureRingPacked, a SplitQueue otherwise. driver is the available
+// ring or driver area, device the used ring or device area.
+func NewDeviceQueue(mem GuestMemory, features Features, size uint16, desc, driver, device uint64) (DeviceQueue, error) {
+	if features.Has(FeatureRingPacked) {
+		q, err := NewPackedQueue(mem, size, desc, driver, device)
+		if err != nil {
+			return nil, err
+		}
+		q.EventIdx = features.Has(FeatureEventIdx)
+		return q, nil
+	}
+
+	q, err := NewSplitQueue(mem, size, desc, driver, device)
+	if err != nil {
+		return nil, err
+	}
+	q.EventIdx = features.Has(FeatureEventIdx)
+
+	return q, nil
+}
+
+// Index returns the index of the queue in its device.
+func (q *Queue) Index() int {
+	return q.index
+}
+
+// Notify records an available buffer notification from the driver. It is
+// called by the transport and never blocks.
+func (q *Queue) Notify() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Notified returns a channel receiving a value after one or more driver
+// notifications.
+func (q *Queue) Notified() <-chan struct{} {
+	return q.notify
+}
+
+// Drain passes the chains of q to handle with notifications disabled, then
+// enables them and checks again for chains added in between. The chains
+// handle returns true for are pushed back, with a used buffer notification
+// through irq when the driver asks for one; handle keeps the others and
+// pushes them later.
+func (q *Queue) Drain(irq Interrupter, handle func(c *DescriptorChain) bool) error {
+	q.DisableNotifications()
+	for {
+		c, ok, err := q.PopChain()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			q.EnableNotifications()
+			if c, ok, err = q.PopChain(); err != nil || !ok {
+				return err
+			}
+			q.DisableNotifications()
+		}
+
+		if !handle(c) {
+			continue
+		}
+		if err := q.PushChain(c); err != nil {
+			return err
+		}
+		if q.NeedsNotification() {
+			irq.InterruptQueue(q.index)
+		}
+	}
+}
+
+// Serve drains q with handle, then again after each driver notification,
+// until done is closed.
+func (q *Queue) Serve(irq Interrupter, done <-chan struct{}, handle func(c *DescriptorChain) bool) {
+	for {
+		if err := q.Drain(irq, handle); err != nil {
+			// a broken queue is left alone until the driver resets.
+			<-done
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		case <-q.notify:
+		}
+	}
+}
+
+// String implements fmt.Stringer.
+func (q *Queue) String() string {
+	return fmt.Sprintf("queue %d", q.index)
+}
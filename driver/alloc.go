@@ -0,0 +1,114 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// ErrNoMemory is returned by Allocator.Alloc when no free range is large
+// enough.
+var ErrNoMemory = errors.New("driver: out of DMA memory")
+
+// span is a free range of memory.
+type span struct {
+	addr, size uint64
+}
+
+// Allocator hands out ranges of a memory area visible to the device, for the
+// rings and the buffers of the requests. It is safe for concurrent use.
+type Allocator struct {
+	mem  virtio.GuestMemory
+	mu   sync.Mutex
+	free []span // sorted by address, never adjacent
+}
+
+// NewAllocator returns an allocator of the size bytes at base of mem.
+func NewAllocator(mem virtio.GuestMemory, base, size uint64) *Allocator {
+	return &Allocator{
+		mem:  mem,
+		free: []span{{base, size}},
+	}
+}
+
+// Alloc returns the address of a zeroed range of size bytes aligned to align,
+// a power of two.
+func (a *Allocator) Alloc(size, align uint64) (uint64, error) {
+	if size == 0 {
+		size = 1
+	}
+	if align == 0 || align&(align-1) != 0 {
+		return 0, fmt.Errorf("driver: alignment %d is not a power of two", align)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, s := range a.free {
+		addr := (s.addr + align - 1) &^ (align - 1)
+		if addr < s.addr || addr-s.addr > s.size || size > s.size-(addr-s.addr) {
+			continue
+		}
+
+		// keep the unaligned head and the tail free.
+		var rest []span
+		if addr > s.addr {
+			rest = append(rest, span{s.addr, addr - s.addr})
+		}
+		if end, sEnd := addr+size, s.addr+s.size; end < sEnd {
+			rest = append(rest, span{end, sEnd - end})
+		}
+		a.free = append(a.free[:i], append(rest, a.free[i+1:]...)...)
+
+		if _, err := a.mem.WriteAt(make([]byte, size), addr); err != nil {
+			return 0, err
+		}
+		return addr, nil
+	}
+
+	return 0, fmt.Errorf("%w: %d bytes", ErrNoMemory, size)
+}
+
+// Free returns the range of size bytes at addr, obtained from Alloc.
+func (a *Allocator) Free(addr, size uint64) {
+	if size == 0 {
+		size = 1
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	i := sort.Search(len(a.free), func(i int) bool { return a.free[i].addr > addr })
+	a.free = append(a.free, span{})
+	copy(a.free[i+1:], a.free[i:])
+	a.free[i] = span{addr, size}
+
+	// merge with the next and the previous ranges.
+	if i+1 < len(a.free) && addr+size == a.free[i+1].addr {
+		a.free[i].size += a.free[i+1].size
+		a.free = append(a.free[:i+1], a.free[i+2:]...)
+	}
+	if i > 0 && a.free[i-1].addr+a.free[i-1].size == addr {
+		a.free[i-1].size += a.free[i].size
+		a.free = append(a.free[:i], a.free[i+1:]...)
+	}
+}
+
+// Available returns the number of free bytes.
+func (a *Allocator) Available() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var n uint64
+	for _, s := range a.free {
+		n += s.size
+	}
+
+	return n
+}
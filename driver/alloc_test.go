@@ -0,0 +1,55 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driver
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+func TestAllocator(t *testing.T) {
+	data := make([]byte, 0x1000)
+	for i := range data {
+		data[i] = 0xff
+	}
+	mem, err := virtio.NewMemory(&virtio.Region{GuestAddr: 0x1000, Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(mem, 0x1000, 0x1000)
+
+	x, err := a.Alloc(10, 1)
+	if err != nil || x != 0x1000 {
+		t.Fatalf("Alloc = %#x, %v", x, err)
+	}
+	y, err := a.Alloc(0x100, 0x100)
+	if err != nil || y != 0x1100 {
+		t.Fatalf("aligned Alloc = %#x, %v", y, err)
+	}
+	for _, b := range data[0x100:0x200] {
+		if b != 0 {
+			t.Fatal("allocated memory not zeroed")
+		}
+	}
+	if _, err := a.Alloc(0x1000, 1); !errors.Is(err, ErrNoMemory) {
+		t.Fatalf("Alloc = %v, want %v", err, ErrNoMemory)
+	}
+	if _, err := a.Alloc(8, 3); err == nil {
+		t.Fatal("Alloc with a bad alignment succeeded")
+	}
+
+	// the gap before y is reused, and freeing everything merges the ranges.
+	z, err := a.Alloc(8, 8)
+	if err != nil || z != 0x1010 {
+		t.Fatalf("Alloc = %#x, %v, want the gap", z, err)
+	}
+	a.Free(y, 0x100)
+	a.Free(x, 10)
+	a.Free(z, 8)
+	if n := a.Available(); n != 0x1000 || len(a.free) != 1 {
+		t.Fatalf("%#x bytes free in %d ranges", n, len(a.free))
+	}
+}
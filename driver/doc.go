@@ -0,0 +1,11 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package driver implements the driver side of virtio in user space.
+//
+// A Driver negotiates the features of a device through a Transport, sets up
+// its queues in memory shared with the device, handed out by an Allocator,
+// and submits requests made of device-readable and device-writable buffers.
+// MMIO drives a virtio-mmio register window, and Loopback pairs a driver with
+// an in-process virtio.Device, for tests and tools.
+package driver
@@ -0,0 +1,476 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+var (
+	// ErrFeatures is returned by Driver.Init when the device rejects the
+	// features or does not offer VERSION_1.
+	ErrFeatures = errors.New("driver: feature negotiation failed")
+
+	// ErrNeedsReset is returned when the device sets NEEDS_RESET.
+	ErrNeedsReset = errors.New("driver: device needs reset")
+
+	// ErrReset is returned by Request.Wait for requests pending when the
+	// driver resets the device.
+	ErrReset = errors.New("driver: device reset")
+)
+
+// resetTimeout bounds the wait for the device to reset in Init and
+// Loopback.Close.
+const resetTimeout = 5 * time.Second
+
+// Transport is the driver side of a virtio transport.
+type Transport interface {
+	DeviceID() virtio.DeviceID
+	DeviceFeatures() virtio.Features
+	SetDriverFeatures(f virtio.Features)
+	Status() virtio.Status
+	SetStatus(s virtio.Status)
+
+	// NumQueues returns the number of queues of the device.
+	NumQueues() int
+
+	// QueueMaxSize returns the maximum size of the queue index, 0 if it does
+	// not exist.
+	QueueMaxSize(index int) uint16
+
+	// EnableQueue sets up and enables the queue index with the rings at the
+	// given addresses.
+	EnableQueue(index int, size uint16, desc, driver, device uint64) error
+
+	// Notify sends an available buffer notification for the queue index.
+	Notify(index int)
+
+	// AckInterrupt acknowledges a pending interrupt and reports whether it
+	// includes a configuration change.
+	AckInterrupt() (config bool)
+
+	ConfigGeneration() uint32
+	ReadConfig(off uint64, p []byte)
+	WriteConfig(off uint64, p []byte)
+}
+
+// ring is the driver side of a split or packed queue.
+type ring interface {
+	NumFree() int
+	Add(bufs []virtio.Buffer) (uint16, error)
+	Kick()
+	Reap() (virtio.UsedElem, bool, error)
+	EnableInterrupts()
+}
+
+var (
+	_ ring = (*virtio.SplitQueue)(nil)
+	_ ring = (*virtio.PackedQueue)(nil)
+)
+
+// Driver drives a device through its transport, with the rings and buffers
+// in memory shared with the device.
+type Driver struct {
+	tr       Transport
+	mem      virtio.GuestMemory
+	alloc    *Allocator
+	features virtio.Features
+	status   virtio.Status
+
+	mu     sync.Mutex
+	queues []*Queue
+}
+
+// New returns a driver of the device behind tr. The rings and buffers are
+// allocated from alloc, in mem.
+func New(tr Transport, mem virtio.GuestMemory, alloc *Allocator) *Driver {
+	return &Driver{tr: tr, mem: mem, alloc: alloc}
+}
+
+// DeviceID returns the device type.
+func (d *Driver) DeviceID() virtio.DeviceID {
+	return d.tr.DeviceID()
+}
+
+// Features returns the negotiated features.
+func (d *Driver) Features() virtio.Features {
+	return d.features
+}
+
+// Init resets the device and negotiates the features of want it offers, with
+// VERSION_1. The queues are then set up with SetupQueue, and the device
+// started with Start.
+func (d *Driver) Init(want virtio.Features) error {
+	ctx, cancel := context.WithTimeout(context.Background(), resetTimeout)
+	defer cancel()
+	if err := d.Reset(ctx); err != nil {
+		return err
+	}
+
+	d.setStatus(virtio.StatusAcknowledge)
+	d.setStatus(virtio.StatusDriver)
+	offered := d.tr.DeviceFeatures()
+	if !offered.Has(virtio.FeatureVersion1) {
+		d.fail()
+		return fmt.Errorf("%w: legacy device", ErrFeatures)
+	}
+	d.features = offered & (want | virtio.FeatureVersion1)
+	d.tr.SetDriverFeatures(d.features)
+
+	d.setStatus(virtio.StatusFeaturesOK)
+	if d.tr.Status()&virtio.StatusFeaturesOK == 0 {
+		d.fail()
+		return fmt.Errorf("%w: device rejected %v", ErrFeatures, d.features)
+	}
+
+	return nil
+}
+
+func (d *Driver) setStatus(s virtio.Status) {
+	d.status |= s
+	d.tr.SetStatus(d.status)
+}
+
+// fail sets FAILED after an error of the driver.
+func (d *Driver) fail() {
+	d.setStatus(virtio.StatusFailed)
+}
+
+// NumQueues returns the number of queues of the device.
+func (d *Driver) NumQueues() int {
+	return d.tr.NumQueues()
+}
+
+// SetupQueue allocates and enables the queue index of size descriptors, or
+// of its maximum size if size is 0 or larger. The queue is a packed queue if
+// FeatureRingPacked was negotiated.
+func (d *Driver) SetupQueue(index int, size uint16) (*Queue, error) {
+	max := d.tr.QueueMaxSize(index)
+	if max == 0 {
+		return nil, fmt.Errorf("driver: queue %d does not exist", index)
+	}
+	if size == 0 || size > max {
+		size = max
+	}
+
+	packed := d.features.Has(virtio.FeatureRingPacked)
+	var driver, device, total uint64
+	if packed {
+		driver, device, total = virtio.PackedLayout(size)
+	} else {
+		// a split queue size is a power of two.
+		for size&(size-1) != 0 {
+			size &= size - 1
+		}
+		driver, device, total = virtio.SplitLayout(size)
+	}
+	base, err := d.alloc.Alloc(total, 4096)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		d:       d,
+		index:   index,
+		base:    base,
+		total:   total,
+		pending: map[uint16]*Request{},
+	}
+	notify := func() { d.tr.Notify(index) }
+	eventIdx := d.features.Has(virtio.FeatureEventIdx)
+	if packed {
+		r, err := virtio.NewPackedQueue(d.mem, size, base, base+driver, base+device)
+		if err != nil {
+			d.alloc.Free(base, total)
+			return nil, err
+		}
+		r.EventIdx, r.Notify = eventIdx, notify
+		q.ring = r
+	} else {
+		r, err := virtio.NewSplitQueue(d.mem, size, base, base+driver, base+device)
+		if err != nil {
+			d.alloc.Free(base, total)
+			return nil, err
+		}
+		r.EventIdx, r.Notify = eventIdx, notify
+		q.ring = r
+	}
+
+	if err := d.tr.EnableQueue(index, size, base, base+driver, base+device); err != nil {
+		d.alloc.Free(base, total)
+		return nil, err
+	}
+	d.mu.Lock()
+	d.queues = append(d.queues, q)
+	d.mu.Unlock()
+
+	return q, nil
+}
+
+// Start sets DRIVER_OK once the queues are set up.
+func (d *Driver) Start() error {
+	d.setStatus(virtio.StatusDriverOK)
+	if s := d.tr.Status(); s&virtio.StatusNeedsReset != 0 || s&virtio.StatusDriverOK == 0 {
+		return fmt.Errorf("%w: status %v", ErrNeedsReset, s)
+	}
+
+	return nil
+}
+
+// Reset resets the device and frees the queues. Pending requests fail with
+// ErrReset. It returns an error if ctx is done before the device completes
+// the reset, leaving the queues to the device.
+func (d *Driver) Reset(ctx context.Context) error {
+	// the device may take time to reset: poll it, yielding first, then
+	// sleeping up to a millisecond.
+	d.tr.SetStatus(0)
+	for wait := time.Duration(0); d.tr.Status() != 0; {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("driver: device reset: %w", err)
+		}
+		if wait == 0 {
+			runtime.Gosched()
+			wait = time.Microsecond
+			continue
+		}
+		time.Sleep(wait)
+		if wait < time.Millisecond {
+			wait *= 2
+		}
+	}
+	d.status = 0
+	d.features = 0
+
+	d.mu.Lock()
+	queues := d.queues
+	d.queues = nil
+	d.mu.Unlock()
+	for _, q := range queues {
+		q.reset()
+	}
+
+	return nil
+}
+
+// Interrupt handles an interrupt of the device: it acknowledges it and
+// completes the requests of all queues. It reports a configuration change.
+func (d *Driver) Interrupt() (config bool, err error) {
+	config = d.tr.AckInterrupt()
+
+	d.mu.Lock()
+	queues := d.queues
+	d.mu.Unlock()
+	for _, q := range queues {
+		if _, perr := q.Poll(); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	if d.tr.Status()&virtio.StatusNeedsReset != 0 {
+		return config, ErrNeedsReset
+	}
+
+	return config, err
+}
+
+// ReadConfig reads the device configuration space at off into p,
+// consistently across the fields of several accesses.
+func (d *Driver) ReadConfig(off uint64, p []byte) {
+	for {
+		gen := d.tr.ConfigGeneration()
+		d.tr.ReadConfig(off, p)
+		if d.tr.ConfigGeneration() == gen {
+			return
+		}
+	}
+}
+
+// WriteConfig writes p to the device configuration space at off.
+func (d *Driver) WriteConfig(off uint64, p []byte) {
+	d.tr.WriteConfig(off, p)
+}
+
+// Request is a request submitted to a queue: the device reads Out and writes
+// In.
+type Request struct {
+	// Out are the device-readable buffers.
+	Out [][]byte
+
+	// In are the device-writable buffers, filled on completion.
+	In [][]byte
+
+	// Written is the number of bytes written by the device to In.
+	Written uint32
+
+	bufs []virtio.Buffer
+	done chan struct{}
+	err  error
+}
+
+// Wait waits until the request is completed or ctx is done.
+func (r *Request) Wait(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done returns a channel closed once the request is completed.
+func (r *Request) Done() <-chan struct{} {
+	return r.done
+}
+
+// Queue is a queue set up by the driver. It is safe for concurrent use.
+type Queue struct {
+	d     *Driver
+	index int
+	base  uint64
+	total uint64
+
+	mu      sync.Mutex
+	ring    ring
+	pending map[uint16]*Request
+}
+
+// Index returns the index of the queue.
+func (q *Queue) Index() int {
+	return q.index
+}
+
+// Submit copies the Out buffers of r to DMA memory and makes the request
+// available to the device. It returns virtio.ErrQueueFull if the queue has
+// not enough free descriptors.
+func (q *Queue) Submit(r *Request) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.ring == nil {
+		return ErrReset
+	}
+	if q.ring.NumFree() < len(r.Out)+len(r.In) {
+		return virtio.ErrQueueFull
+	}
+
+	r.bufs = r.bufs[:0]
+	r.done = make(chan struct{})
+	r.Written, r.err = 0, nil
+	for i, b := range append(append([][]byte(nil), r.Out...), r.In...) {
+		addr, err := q.d.alloc.Alloc(uint64(len(b)), 8)
+		if err != nil {
+			q.free(r)
+			return err
+		}
+		writable := i >= len(r.Out)
+		r.bufs = append(r.bufs, virtio.Buffer{Addr: addr, Len: uint32(len(b)), Writable: writable})
+		if !writable {
+			if _, err := q.d.mem.WriteAt(b, addr); err != nil {
+				q.free(r)
+				return err
+			}
+		}
+	}
+
+	id, err := q.ring.Add(r.bufs)
+	if err != nil {
+		q.free(r)
+		return err
+	}
+	q.pending[id] = r
+	q.ring.Kick()
+
+	return nil
+}
+
+// Do submits r and waits for its completion.
+func (q *Queue) Do(ctx context.Context, r *Request) error {
+	if err := q.Submit(r); err != nil {
+		return err
+	}
+
+	return r.Wait(ctx)
+}
+
+// Poll completes the requests used by the device, copying the bytes written
+// to their In buffers, and returns their number. It then asks the device for
+// an interrupt on the next completion.
+func (q *Queue) Poll() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for rearmed := false; q.ring != nil; {
+		e, ok, err := q.ring.Reap()
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			// check again for completions racing with the re-arm.
+			if rearmed {
+				break
+			}
+			q.ring.EnableInterrupts()
+			rearmed = true
+			continue
+		}
+		rearmed = false
+		r, ok := q.pending[uint16(e.ID)]
+		if !ok {
+			return n, fmt.Errorf("driver: queue %d: device used unknown buffer %d", q.index, e.ID)
+		}
+		delete(q.pending, uint16(e.ID))
+
+		r.Written = e.Len
+		left := e.Len
+		for i, b := range r.In {
+			if left == 0 {
+				break
+			}
+			m := uint32(len(b))
+			if m > left {
+				m = left
+			}
+			if _, err := q.d.mem.ReadAt(b[:m], r.bufs[len(r.Out)+i].Addr); err != nil && r.err == nil {
+				r.err = err
+			}
+			left -= m
+		}
+		q.free(r)
+		close(r.done)
+		n++
+	}
+
+	return n, nil
+}
+
+// free returns the DMA buffers of r. q.mu must be held.
+func (q *Queue) free(r *Request) {
+	for _, b := range r.bufs {
+		q.d.alloc.Free(b.Addr, uint64(b.Len))
+	}
+	r.bufs = r.bufs[:0]
+}
+
+// reset fails the pending requests and frees the rings, after the device was
+// reset.
+func (q *Queue) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for id, r := range q.pending {
+		r.err = ErrReset
+		q.free(r)
+		close(r.done)
+		delete(q.pending, id)
+	}
+	q.ring = nil
+	q.d.alloc.Free(q.base, q.total)
+}
@@ -0,0 +1,299 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// echoDevice writes the bytes read from each chain back into it, reversed.
+// Its configuration space is 4 bytes; writing it raises a configuration
+// change.
+type echoDevice struct {
+	mu     sync.Mutex
+	config [4]byte
+	irq    virtio.Interrupter
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func (d *echoDevice) DeviceID() virtio.DeviceID { return virtio.DeviceConsole }
+func (d *echoDevice) Features() virtio.Features {
+	return virtio.FeatureEventIdx | virtio.FeatureRingPacked
+}
+func (d *echoDevice) AckFeatures(f virtio.Features) {}
+func (d *echoDevice) QueueMaxSizes() []uint16       { return []uint16{8} }
+
+func (d *echoDevice) ReadConfig(off uint64, p []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	copy(p, d.config[off:])
+}
+
+func (d *echoDevice) WriteConfig(off uint64, p []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	copy(d.config[off:], p)
+	if d.irq != nil {
+		d.irq.InterruptConfig()
+	}
+}
+
+func (d *echoDevice) Activate(mem virtio.GuestMemory, queues []*virtio.Queue, irq virtio.Interrupter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.irq, d.done = irq, make(chan struct{})
+	d.wg.Add(1)
+	go d.serve(queues[0], d.done)
+	return nil
+}
+
+func (d *echoDevice) serve(q *virtio.Queue, done chan struct{}) {
+	defer d.wg.Done()
+
+	for {
+		// drain the queue, then ask for notifications and check again.
+		for rearmed := false; ; {
+			c, ok, err := q.PopChain()
+			if err != nil {
+				<-done
+				return
+			}
+			if !ok {
+				if rearmed {
+					break
+				}
+				q.EnableNotifications()
+				rearmed = true
+				continue
+			}
+			rearmed = false
+
+			b, _ := io.ReadAll(c)
+			for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+				b[i], b[j] = b[j], b[i]
+			}
+			c.Write(b)
+			if err := q.PushChain(c); err != nil {
+				<-done
+				return
+			}
+			if q.NeedsNotification() {
+				d.irq.InterruptQueue(q.Index())
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-q.Notified():
+		}
+	}
+}
+
+func (d *echoDevice) Reset() {
+	d.mu.Lock()
+	done := d.done
+	d.irq, d.done = nil, nil
+	d.mu.Unlock()
+
+	if done != nil {
+		close(done)
+		d.wg.Wait()
+	}
+}
+
+func newTestLoopback(t *testing.T, dev virtio.Device) *Loopback {
+	t.Helper()
+
+	l, err := NewLoopback(dev, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	return l
+}
+
+func TestLoopback(t *testing.T) {
+	for _, want := range []virtio.Features{0, virtio.FeatureEventIdx, virtio.FeatureRingPacked, virtio.FeatureRingPacked | virtio.FeatureEventIdx} {
+		t.Run(fmt.Sprint(want), func(t *testing.T) {
+			l := newTestLoopback(t, &echoDevice{})
+			configs := make(chan struct{}, 1)
+			l.Config = func() { configs <- struct{}{} }
+
+			if err := l.Init(want); err != nil {
+				t.Fatal(err)
+			}
+			if l.Features() != want|virtio.FeatureVersion1 || l.DeviceID() != virtio.DeviceConsole || l.NumQueues() != 1 {
+				t.Fatalf("device %v with %d queues, features %v", l.DeviceID(), l.NumQueues(), l.Features())
+			}
+			q, err := l.SetupQueue(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := l.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			// more requests in flight than the queue holds, waiting for the
+			// oldest when it is full.
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var inflight []*Request
+			for i := 0; i < 50; i++ {
+				r := &Request{
+					Out: [][]byte{[]byte("hello, "), []byte(fmt.Sprintf("world %02d", i))},
+					In:  [][]byte{make([]byte, 4), make([]byte, 16)},
+				}
+				for {
+					err := q.Submit(r)
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, virtio.ErrQueueFull) {
+						t.Fatal(err)
+					}
+					if err := inflight[0].Wait(ctx); err != nil {
+						t.Fatal(err)
+					}
+					inflight = inflight[1:]
+				}
+				inflight = append(inflight, r)
+			}
+			for _, r := range inflight {
+				if err := r.Wait(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			last := inflight[len(inflight)-1]
+			if got := append(last.In[0], last.In[1][:last.Written-4]...); string(got) != "94 dlrow ,olleh" {
+				t.Fatalf("request completed with %q", got)
+			}
+
+			// configuration space and change notification.
+			l.WriteConfig(0, []byte("abcd"))
+			select {
+			case <-configs:
+			case <-ctx.Done():
+				t.Fatal("no configuration change interrupt")
+			}
+			p := make([]byte, 4)
+			l.ReadConfig(0, p)
+			if string(p) != "abcd" {
+				t.Fatalf("config %q", p)
+			}
+		})
+	}
+}
+
+func TestLoopbackReset(t *testing.T) {
+	l := newTestLoopback(t, &virtio.NullDevice{QueueSize: 16})
+	free := l.alloc.Available()
+
+	for round := 0; round < 3; round++ {
+		if err := l.Init(virtio.FeatureEventIdx); err != nil {
+			t.Fatal(err)
+		}
+		q, err := l.SetupQueue(0, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// requests pending before DRIVER_OK fail with the reset.
+		pending := &Request{Out: [][]byte{[]byte("x")}}
+		if err := q.Submit(pending); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Reset(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := pending.Wait(context.Background()); !errors.Is(err, ErrReset) {
+			t.Fatalf("pending request: %v, want %v", err, ErrReset)
+		}
+		if err := q.Submit(pending); !errors.Is(err, ErrReset) {
+			t.Fatalf("Submit after reset: %v, want %v", err, ErrReset)
+		}
+
+		if err := l.Init(0); err != nil {
+			t.Fatal(err)
+		}
+		if q, err = l.SetupQueue(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Start(); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = q.Do(ctx, &Request{Out: [][]byte{bytes.Repeat([]byte("x"), 100)}, In: [][]byte{make([]byte, 8)}})
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Reset(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := l.alloc.Available(); n != free {
+		t.Fatalf("%d bytes leaked", free-n)
+	}
+}
+
+func TestInitErrors(t *testing.T) {
+	l := newTestLoopback(t, &virtio.NullDevice{})
+
+	if err := l.Init(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.SetupQueue(1, 0); err == nil {
+		t.Fatal("SetupQueue of a missing queue succeeded")
+	}
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMMIO(registers{}); err == nil {
+		t.Fatal("NewMMIO accepted a window without the magic value")
+	}
+}
+
+// stuck is a transport whose device never completes a reset.
+type stuck struct {
+	Transport
+}
+
+func (stuck) Status() virtio.Status { return virtio.StatusAcknowledge }
+
+func TestResetTimeout(t *testing.T) {
+	l := newTestLoopback(t, &virtio.NullDevice{})
+	d := New(stuck{l.tr}, l.mem, l.alloc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := d.Reset(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Reset = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// registers is a register window reading as zeros.
+type registers struct{}
+
+func (registers) Read(off uint64, p []byte) error {
+	for i := range p {
+		p[i] = 0
+	}
+	return nil
+}
+
+func (registers) Write(off uint64, p []byte) error { return nil }
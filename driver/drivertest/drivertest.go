@@ -0,0 +1,116 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package drivertest drives the devices under test over a driver.Loopback.
+package drivertest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-hypervisor/virtio"
+	"github.com/go-hypervisor/virtio/driver"
+)
+
+// list of defaults of Config.
+const (
+	defaultMemory    = 1 << 20
+	defaultQueueSize = 16
+	defaultTimeout   = 10 * time.Second
+)
+
+// Config configures the guest of a device.
+type Config struct {
+	// Features are the features the driver asks for.
+	Features virtio.Features
+
+	// Queues are the indices of the queues set up by the driver.
+	Queues []int
+
+	// QueueSize is the size of the queues, 16 if zero.
+	QueueSize uint16
+
+	// Memory is the size of the memory shared with the device, 1 MiB if
+	// zero.
+	Memory uint64
+
+	// Config, if non-nil, is called on configuration change interrupts.
+	Config func()
+}
+
+// Guest is the driver side of a device over a loopback, started with the
+// queues of its Config.
+type Guest struct {
+	*driver.Loopback
+
+	// Ctx bounds the requests of the test, and is canceled once it ends.
+	Ctx context.Context
+
+	// Queues are the queues set up, by index, nil for the others.
+	Queues []*driver.Queue
+
+	t testing.TB
+}
+
+// New returns the guest of dev with c, closed once the test ends. It fails
+// the test if the driver cannot start the device.
+func New(t testing.TB, dev virtio.Device, c Config) *Guest {
+	t.Helper()
+
+	if c.Memory == 0 {
+		c.Memory = defaultMemory
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = defaultQueueSize
+	}
+
+	l, err := driver.NewLoopback(dev, c.Memory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	t.Cleanup(cancel)
+	l.Config = c.Config
+
+	g := &Guest{Loopback: l, Ctx: ctx, t: t}
+	if err := l.Init(c.Features); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range c.Queues {
+		q, err := l.SetupQueue(i, c.QueueSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for len(g.Queues) <= i {
+			g.Queues = append(g.Queues, nil)
+		}
+		g.Queues[i] = q
+	}
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	return g
+}
+
+// Do submits r to the queue i and waits for its completion, failing the test
+// on error.
+func (g *Guest) Do(i int, r *driver.Request) {
+	g.t.Helper()
+
+	if err := g.Queues[i].Do(g.Ctx, r); err != nil {
+		g.t.Fatal(err)
+	}
+}
+
+// Range returns the indices from 0 to n-1, the queues of most devices.
+func Range(n int) []int {
+	queues := make([]int, n)
+	for i := range queues {
+		queues[i] = i
+	}
+
+	return queues
+}
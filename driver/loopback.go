@@ -0,0 +1,100 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driver
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-hypervisor/virtio"
+	"github.com/go-hypervisor/virtio/mmio"
+)
+
+// Loopback pairs a Driver with an in-process device behind an mmio.Transport,
+// over memory shared by both, and delivers the interrupts of the device to
+// the driver.
+type Loopback struct {
+	*Driver
+
+	// Memory is the memory shared by the driver and the device.
+	Memory *virtio.Memory
+
+	// Transport is the device side of the transport.
+	Transport *mmio.Transport
+
+	// Config, if non-nil, is called on configuration change interrupts. It
+	// is set before the driver is initialized.
+	Config func()
+
+	irq  chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewLoopback returns the loopback of dev with size bytes of shared memory.
+// The caller initializes the driver and closes the loopback when done.
+func NewLoopback(dev virtio.Device, size uint64) (*Loopback, error) {
+	mem, err := virtio.NewMemory(&virtio.Region{Data: make([]byte, size)})
+	if err != nil {
+		return nil, err
+	}
+
+	tr := mmio.New(mem, dev)
+	m, err := NewMMIO(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Loopback{
+		Driver:    New(m, mem, NewAllocator(mem, 0, size)),
+		Memory:    mem,
+		Transport: tr,
+		irq:       make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	// the interrupt line is raised with the transport locked, so the
+	// interrupts are handled by another goroutine.
+	tr.IRQ = func(level bool) {
+		if !level {
+			return
+		}
+		select {
+		case l.irq <- struct{}{}:
+		default:
+		}
+	}
+
+	l.wg.Add(1)
+	go l.interrupts()
+
+	return l, nil
+}
+
+func (l *Loopback) interrupts() {
+	defer l.wg.Done()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-l.irq:
+		}
+
+		config, _ := l.Interrupt()
+		if config && l.Config != nil {
+			l.Config()
+		}
+	}
+}
+
+// Close resets the device and stops the delivery of interrupts.
+func (l *Loopback) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), resetTimeout)
+	defer cancel()
+	err := l.Reset(ctx)
+	close(l.done)
+	l.wg.Wait()
+
+	return err
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package driver
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/go-hypervisor/virtio"
+	"github.com/go-hypervisor/virtio/mmio"
+)
+
+// Registers is a virtio-mmio register window, such as an mmio.Transport or
+// the mapping of a device exported to user space.
+type Registers interface {
+	Read(off uint64, p []byte) error
+	Write(off uint64, p []byte) error
+}
+
+var _ Registers = (*mmio.Transport)(nil)
+
+// MMIO is the driver side of the virtio-mmio transport.
+//
+// Like a kernel driver, it ignores the errors of register accesses and
+// detects failures by reading the registers back.
+type MMIO struct {
+	regs Registers
+}
+
+var _ Transport = (*MMIO)(nil)
+
+// NewMMIO returns the transport of the version 2 register window regs.
+func NewMMIO(regs Registers) (*MMIO, error) {
+	m := &MMIO{regs: regs}
+	if v := m.read(mmio.RegMagicValue); v != mmio.MagicValue {
+		return nil, fmt.Errorf("driver: bad MMIO magic value %#x", v)
+	}
+	if v := m.read(mmio.RegVersion); v != mmio.Version {
+		return nil, fmt.Errorf("driver: unsupported MMIO version %d", v)
+	}
+
+	return m, nil
+}
+
+func (m *MMIO) read(off uint64) uint32 {
+	var p [4]byte
+	_ = m.regs.Read(off, p[:])
+
+	return binary.LittleEndian.Uint32(p[:])
+}
+
+func (m *MMIO) write(off uint64, v uint32) {
+	var p [4]byte
+	binary.LittleEndian.PutUint32(p[:], v)
+	_ = m.regs.Write(off, p[:])
+}
+
+// DeviceID implements Transport.DeviceID.
+func (m *MMIO) DeviceID() virtio.DeviceID {
+	return virtio.DeviceID(m.read(mmio.RegDeviceID))
+}
+
+// DeviceFeatures implements Transport.DeviceFeatures.
+func (m *MMIO) DeviceFeatures() virtio.Features {
+	var f virtio.Features
+	for sel := uint32(0); sel < 2; sel++ {
+		m.write(mmio.RegDeviceFeaturesSel, sel)
+		f = f.WithWord(sel, m.read(mmio.RegDeviceFeatures))
+	}
+
+	return f
+}
+
+// SetDriverFeatures implements Transport.SetDriverFeatures.
+func (m *MMIO) SetDriverFeatures(f virtio.Features) {
+	for sel := uint32(0); sel < 2; sel++ {
+		m.write(mmio.RegDriverFeaturesSel, sel)
+		m.write(mmio.RegDriverFeatures, f.Word(sel))
+	}
+}
+
+// Status implements Transport.Status.
+func (m *MMIO) Status() virtio.Status {
+	return virtio.Status(m.read(mmio.RegStatus))
+}
+
+// SetStatus implements Transport.SetStatus.
+func (m *MMIO) SetStatus(s virtio.Status) {
+	m.write(mmio.RegStatus, uint32(s))
+}
+
+// NumQueues implements Transport.NumQueues. The queues are probed until one
+// has a zero maximum size.
+func (m *MMIO) NumQueues() int {
+	n := 0
+	for m.QueueMaxSize(n) != 0 {
+		n++
+	}
+
+	return n
+}
+
+// QueueMaxSize implements Transport.QueueMaxSize.
+func (m *MMIO) QueueMaxSize(index int) uint16 {
+	m.write(mmio.RegQueueSel, uint32(index))
+
+	return uint16(m.read(mmio.RegQueueNumMax))
+}
+
+// EnableQueue implements Transport.EnableQueue.
+func (m *MMIO) EnableQueue(index int, size uint16, desc, driver, device uint64) error {
+	m.write(mmio.RegQueueSel, uint32(index))
+	m.write(mmio.RegQueueNum, uint32(size))
+	for _, r := range []struct {
+		low  uint64
+		addr uint64
+	}{
+		{mmio.RegQueueDescLow, desc},
+		{mmio.RegQueueDriverLow, driver},
+		{mmio.RegQueueDeviceLow, device},
+	} {
+		m.write(r.low, uint32(r.addr))
+		m.write(r.low+4, uint32(r.addr>>32))
+	}
+	m.write(mmio.RegQueueReady, 1)
+
+	if m.read(mmio.RegQueueReady) != 1 {
+		return fmt.Errorf("driver: device refused queue %d", index)
+	}
+
+	return nil
+}
+
+// Notify implements Transport.Notify.
+func (m *MMIO) Notify(index int) {
+	m.write(mmio.RegQueueNotify, uint32(index))
+}
+
+// AckInterrupt implements Transport.AckInterrupt.
+func (m *MMIO) AckInterrupt() (config bool) {
+	v := m.read(mmio.RegInterruptStatus)
+	if v != 0 {
+		m.write(mmio.RegInterruptACK, v)
+	}
+
+	return v&mmio.InterruptConfigChange != 0
+}
+
+// ConfigGeneration implements Transport.ConfigGeneration.
+func (m *MMIO) ConfigGeneration() uint32 {
+	return m.read(mmio.RegConfigGeneration)
+}
+
+// ReadConfig implements Transport.ReadConfig.
+func (m *MMIO) ReadConfig(off uint64, p []byte) {
+	_ = m.regs.Read(mmio.RegConfig+off, p)
+}
+
+// WriteConfig implements Transport.WriteConfig.
+func (m *MMIO) WriteConfig(off uint64, p []byte) {
+	_ = m.regs.Write(mmio.RegConfig+off, p)
+}
@@ -0,0 +1,11 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+// needEvent reports whether the event index event was crossed by moving an
+// index from old to new, like vring_need_event of the virtio specification.
+// All arithmetic wraps at 16 bits.
+func needEvent(event, new, old uint16) bool {
+	return new-event-1 < new-old
+}
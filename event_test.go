@@ -0,0 +1,210 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"fmt"
+	"testing"
+)
+
+// notifyQueue is the API shared by SplitQueue and PackedQueue.
+type notifyQueue interface {
+	Add(bufs []Buffer) (uint16, error)
+	Kick()
+	Reap() (UsedElem, bool, error)
+	PopChain() (*DescriptorChain, bool, error)
+	PushChain(c *DescriptorChain) error
+	NeedsNotification() bool
+	EnableInterrupts()
+	DisableInterrupts()
+	EnableNotifications()
+	DisableNotifications()
+}
+
+// newNotifyPair returns the driver and device sides of a split or packed queue
+// of size descriptors, and counts the notifications of the driver in kicks.
+func newNotifyPair(tb testing.TB, packed, eventIdx bool, size uint16, kicks *int) (drv, dev notifyQueue) {
+	tb.Helper()
+
+	if packed {
+		driver, device, total := PackedLayout(size)
+		mem := newTestMemory(tb, make([]byte, total))
+		d, err := NewPackedQueue(mem, size, 0, driver, device)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		v, err := NewPackedQueue(mem, size, 0, driver, device)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		d.EventIdx, v.EventIdx = eventIdx, eventIdx
+		d.Notify = func() { *kicks++ }
+		return d, v
+	}
+
+	avail, used, total := SplitLayout(size)
+	mem := newTestMemory(tb, make([]byte, total))
+	d, err := NewSplitQueue(mem, size, 0, avail, used)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	v, err := NewSplitQueue(mem, size, 0, avail, used)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	d.EventIdx, v.EventIdx = eventIdx, eventIdx
+	d.Notify = func() { *kicks++ }
+	return d, v
+}
+
+func TestNeedEvent(t *testing.T) {
+	for _, tt := range []struct {
+		event, new, old uint16
+		want            bool
+	}{
+		{0, 1, 0, true},
+		{0, 2, 1, false},
+		{1, 2, 0, true},
+		{5, 5, 0, false},
+		{0xffff, 1, 0xfffe, true},
+		{0xfffe, 1, 0xffff, false},
+	} {
+		if got := needEvent(tt.event, tt.new, tt.old); got != tt.want {
+			t.Errorf("needEvent(%d, %d, %d) = %v, want %v", tt.event, tt.new, tt.old, got, tt.want)
+		}
+	}
+}
+
+func TestNotificationSuppression(t *testing.T) {
+	for _, packed := range []bool{false, true} {
+		for _, eventIdx := range []bool{false, true} {
+			t.Run(fmt.Sprintf("packed=%v/event_idx=%v", packed, eventIdx), func(t *testing.T) {
+				var kicks int
+				drv, dev := newNotifyPair(t, packed, eventIdx, 8, &kicks)
+				add := func() {
+					if _, err := drv.Add([]Buffer{{}}); err != nil {
+						t.Fatal(err)
+					}
+					drv.Kick()
+				}
+
+				// the device asks for notifications, then is busy with the first chain.
+				dev.EnableNotifications()
+				add()
+				if !eventIdx {
+					dev.DisableNotifications()
+				}
+				add()
+				add()
+				if kicks != 1 {
+					t.Fatalf("%d notifications while the device is busy, want 1", kicks)
+				}
+
+				var chains []*DescriptorChain
+				for {
+					c, ok, err := dev.PopChain()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !ok {
+						break
+					}
+					chains = append(chains, c)
+				}
+				dev.EnableNotifications()
+				add()
+				if kicks != 2 {
+					t.Fatalf("%d notifications after the device re-enabled them, want 2", kicks)
+				}
+
+				// the driver asks for an interrupt, then is busy with the first chain.
+				drv.EnableInterrupts()
+				interrupts := 0
+				for _, c := range chains {
+					if err := dev.PushChain(c); err != nil {
+						t.Fatal(err)
+					}
+					if dev.NeedsNotification() {
+						interrupts++
+						if !eventIdx {
+							drv.DisableInterrupts()
+						}
+					}
+				}
+				if interrupts != 1 {
+					t.Fatalf("%d interrupts while the driver is busy, want 1", interrupts)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkNotifications adds batches of chains with a kick per chain and
+// reports the notifications and interrupts per chain. Without suppression each
+// chain costs one of each; with it, one per batch.
+func BenchmarkNotifications(b *testing.B) {
+	const batch = 32
+
+	for _, packed := range []bool{false, true} {
+		for _, mode := range []string{"none", "flags", "event_idx"} {
+			b.Run(fmt.Sprintf("packed=%v/%s", packed, mode), func(b *testing.B) {
+				var kicks int
+				drv, dev := newNotifyPair(b, packed, mode == "event_idx", 256, &kicks)
+				suppress := mode == "flags"
+
+				interrupts := 0
+				bufs := []Buffer{{Len: 64}, {Len: 64, Writable: true}}
+				for i := 0; i < b.N; i += batch {
+					// the device sleeps until notified, and with flags disables
+					// notifications as soon as it wakes up.
+					dev.EnableNotifications()
+					drv.EnableInterrupts()
+					for j := 0; j < batch; j++ {
+						before := kicks
+						if _, err := drv.Add(bufs); err != nil {
+							b.Fatal(err)
+						}
+						drv.Kick()
+						if suppress && kicks != before {
+							dev.DisableNotifications()
+						}
+					}
+
+					for {
+						c, ok, err := dev.PopChain()
+						if err != nil {
+							b.Fatal(err)
+						}
+						if !ok {
+							break
+						}
+						if err := dev.PushChain(c); err != nil {
+							b.Fatal(err)
+						}
+						if dev.NeedsNotification() {
+							interrupts++
+							if suppress {
+								drv.DisableInterrupts()
+							}
+						}
+					}
+
+					for {
+						_, ok, err := drv.Reap()
+						if err != nil {
+							b.Fatal(err)
+						}
+						if !ok {
+							break
+						}
+					}
+				}
+
+				n := float64((b.N + batch - 1) / batch * batch)
+				b.ReportMetric(float64(kicks)/n, "kicks/chain")
+				b.ReportMetric(float64(interrupts)/n, "irqs/chain")
+			})
+		}
+	}
+}
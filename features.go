@@ -0,0 +1,92 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// Features is a set of virtio feature bits.
+type Features uint64
+
+// list of transport feature bits shared by all devices.
+const (
+	FeatureIndirectDesc     Features = 1 << 28 // VIRTIO_F_INDIRECT_DESC
+	FeatureEventIdx         Features = 1 << 29 // VIRTIO_F_EVENT_IDX
+	FeatureVersion1         Features = 1 << 32 // VIRTIO_F_VERSION_1
+	FeatureAccessPlatform   Features = 1 << 33 // VIRTIO_F_ACCESS_PLATFORM
+	FeatureRingPacked       Features = 1 << 34 // VIRTIO_F_RING_PACKED
+	FeatureInOrder          Features = 1 << 35 // VIRTIO_F_IN_ORDER
+	FeatureOrderPlatform    Features = 1 << 36 // VIRTIO_F_ORDER_PLATFORM
+	FeatureSRIOV            Features = 1 << 37 // VIRTIO_F_SR_IOV
+	FeatureNotificationData Features = 1 << 38 // VIRTIO_F_NOTIFICATION_DATA
+	FeatureRingReset        Features = 1 << 40 // VIRTIO_F_RING_RESET
+)
+
+// featureNames are the names of the transport feature bits.
+var featureNames = map[Features]string{
+	FeatureIndirectDesc:     "INDIRECT_DESC",
+	FeatureEventIdx:         "EVENT_IDX",
+	FeatureVersion1:         "VERSION_1",
+	FeatureAccessPlatform:   "ACCESS_PLATFORM",
+	FeatureRingPacked:       "RING_PACKED",
+	FeatureInOrder:          "IN_ORDER",
+	FeatureOrderPlatform:    "ORDER_PLATFORM",
+	FeatureSRIOV:            "SR_IOV",
+	FeatureNotificationData: "NOTIFICATION_DATA",
+	FeatureRingReset:        "RING_RESET",
+}
+
+// Has reports whether all features of want are in f.
+func (f Features) Has(want Features) bool {
+	return f&want == want
+}
+
+// IsSubset reports whether every feature of f is in of.
+func (f Features) IsSubset(of Features) bool {
+	return f&^of == 0
+}
+
+// Word returns the 32-bit word sel of f, as exposed through the feature select
+// registers of the transports.
+func (f Features) Word(sel uint32) uint32 {
+	if sel > 1 {
+		return 0
+	}
+
+	return uint32(f >> (32 * sel))
+}
+
+// WithWord returns f with the 32-bit word sel replaced by v. Words beyond the
+// 64 supported feature bits are ignored.
+func (f Features) WithWord(sel, v uint32) Features {
+	if sel > 1 {
+		return f
+	}
+
+	shift := 32 * sel
+	return f&^(0xffffffff<<shift) | Features(v)<<shift
+}
+
+// String returns the names of the transport features of f and the numbers of
+// the other bits.
+func (f Features) String() string {
+	if f == 0 {
+		return "0"
+	}
+
+	var names []string
+	for rest := f; rest != 0; rest &= rest - 1 {
+		bit := Features(1) << bits.TrailingZeros64(uint64(rest))
+		if name, ok := featureNames[bit]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("bit%d", bits.TrailingZeros64(uint64(bit))))
+		}
+	}
+
+	return strings.Join(names, "|")
+}
@@ -0,0 +1,34 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import "testing"
+
+func TestFeatures(t *testing.T) {
+	f := FeatureVersion1 | FeatureEventIdx | 1
+
+	if !f.Has(FeatureVersion1|FeatureEventIdx) || f.Has(FeatureRingPacked) {
+		t.Fatalf("Has is wrong for %v", f)
+	}
+	if !FeatureVersion1.IsSubset(f) || (f | FeatureRingReset).IsSubset(f) {
+		t.Fatalf("IsSubset is wrong for %v", f)
+	}
+
+	if lo, hi := f.Word(0), f.Word(1); lo != 1<<29|1 || hi != 1 {
+		t.Fatalf("Word = %#x, %#x", lo, hi)
+	}
+	if f.Word(2) != 0 {
+		t.Fatal("Word(2) is not zero")
+	}
+
+	var g Features
+	g = g.WithWord(0, f.Word(0)).WithWord(1, f.Word(1)).WithWord(2, 0xffffffff)
+	if g != f {
+		t.Fatalf("WithWord = %v, want %v", g, f)
+	}
+
+	if got, want := f.String(), "bit0|EVENT_IDX|VERSION_1"; got != want {
+		t.Fatalf("String = %q, want %q", got, want)
+	}
+}
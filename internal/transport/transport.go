@@ -0,0 +1,187 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package transport implements the device state shared by the virtio
+// transports: feature negotiation, queue setup, device status and activation.
+package transport
+
+import (
+	"fmt"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// Queue is the driver setup of a queue.
+type Queue struct {
+	Max                  uint16
+	Num                  uint16
+	Ready                bool
+	Desc, Driver, Device uint64
+
+	ring virtio.DeviceQueue
+}
+
+// State is the state of a device behind a transport. It is not safe for
+// concurrent use; the transports serialize the register accesses of a device.
+type State struct {
+	Dev    virtio.Device
+	Mem    virtio.GuestMemory
+	Status *virtio.DeviceStatus
+
+	DeviceFeaturesSel uint32
+	DriverFeaturesSel uint32
+	QueueSel          uint32
+	Queues            []Queue
+
+	active []*virtio.Queue
+}
+
+// New returns the state of dev, whose queues are in mem. VERSION_1 is offered
+// in addition to the features of the device.
+func New(mem virtio.GuestMemory, dev virtio.Device) *State {
+	s := &State{
+		Dev:    dev,
+		Mem:    mem,
+		Status: virtio.NewDeviceStatus(dev.Features() | virtio.FeatureVersion1),
+	}
+	s.resetQueues()
+
+	return s
+}
+
+// resetQueues returns the queues to their reset state, with the maximum size.
+func (s *State) resetQueues() {
+	sizes := s.Dev.QueueMaxSizes()
+	s.Queues = make([]Queue, len(sizes))
+	for i, max := range sizes {
+		s.Queues[i] = Queue{Max: max, Num: max}
+	}
+	s.active = nil
+}
+
+// DeviceFeatures returns the selected word of the offered features.
+func (s *State) DeviceFeatures() uint32 {
+	return s.Status.Offered().Word(s.DeviceFeaturesSel)
+}
+
+// DriverFeatures returns the selected word of the driver features.
+func (s *State) DriverFeatures() uint32 {
+	return s.Status.DriverFeatures().Word(s.DriverFeaturesSel)
+}
+
+// SetDriverFeatures writes the selected word of the driver features.
+func (s *State) SetDriverFeatures(v uint32) error {
+	return s.Status.SetDriverFeatures(s.Status.DriverFeatures().WithWord(s.DriverFeaturesSel, v))
+}
+
+// Queue returns the selected queue, or nil if QueueSel is out of range.
+func (s *State) Queue() *Queue {
+	if s.QueueSel >= uint32(len(s.Queues)) {
+		return nil
+	}
+
+	return &s.Queues[s.QueueSel]
+}
+
+// SetQueue applies set to the selected queue, which must not be ready.
+func (s *State) SetQueue(set func(q *Queue) error) error {
+	q := s.Queue()
+	if q == nil {
+		return fmt.Errorf("queue %d does not exist", s.QueueSel)
+	}
+	if q.Ready {
+		return fmt.Errorf("queue %d is ready", s.QueueSel)
+	}
+
+	return set(q)
+}
+
+// SetQueueNum sets the size of the selected queue.
+func (s *State) SetQueueNum(v uint32) error {
+	return s.SetQueue(func(q *Queue) error {
+		if v == 0 || v > uint32(q.Max) {
+			return fmt.Errorf("queue %d size %d not in [1, %d]", s.QueueSel, v, q.Max)
+		}
+		q.Num = uint16(v)
+		return nil
+	})
+}
+
+// SetQueueReady enables or disables the selected queue. The rings are checked
+// when it is enabled, after the features are negotiated.
+func (s *State) SetQueueReady(ready bool) error {
+	q := s.Queue()
+	if q == nil {
+		return fmt.Errorf("queue %d does not exist", s.QueueSel)
+	}
+	if !ready {
+		q.Ready, q.ring = false, nil
+		return nil
+	}
+	if q.Ready {
+		return nil
+	}
+	if s.Status.Status()&virtio.StatusFeaturesOK == 0 {
+		return fmt.Errorf("queue %d enabled before FEATURES_OK", s.QueueSel)
+	}
+
+	ring, err := virtio.NewDeviceQueue(s.Mem, s.Status.Negotiated(), q.Num, q.Desc, q.Driver, q.Device)
+	if err != nil {
+		return fmt.Errorf("queue %d: %w", s.QueueSel, err)
+	}
+	q.Ready, q.ring = true, ring
+
+	return nil
+}
+
+// Notify forwards a driver notification to the queue index of an active
+// device. Notifications for other queues are ignored.
+func (s *State) Notify(index int) {
+	if index >= 0 && index < len(s.active) && s.active[index] != nil {
+		s.active[index].Notify()
+	}
+}
+
+// SetStatus applies a write of the device status, resetting the device on 0
+// and activating it on DRIVER_OK. A device failing to start is set to
+// NEEDS_RESET and a configuration change is sent through irq.
+func (s *State) SetStatus(v virtio.Status, irq virtio.Interrupter) error {
+	if v == 0 {
+		s.Reset()
+		return nil
+	}
+
+	old := s.Status.Status()
+	if err := s.Status.Set(v); err != nil {
+		return err
+	}
+	if v&^old&virtio.StatusFeaturesOK != 0 {
+		s.Dev.AckFeatures(s.Status.Negotiated())
+	}
+	if v&^old&virtio.StatusDriverOK == 0 {
+		return nil
+	}
+
+	active := make([]*virtio.Queue, len(s.Queues))
+	for i, q := range s.Queues {
+		if q.Ready {
+			active[i] = virtio.NewQueue(i, q.ring)
+		}
+	}
+	if err := s.Dev.Activate(s.Mem, active, irq); err != nil {
+		s.Status.SetNeedsReset()
+		irq.InterruptConfig()
+		return fmt.Errorf("%v: activate: %w", s.Dev.DeviceID(), err)
+	}
+	s.active = active
+
+	return nil
+}
+
+// Reset resets the device, the status, the selectors and the queues.
+func (s *State) Reset() {
+	s.Dev.Reset()
+	s.Status.Reset()
+	s.DeviceFeaturesSel, s.DriverFeaturesSel, s.QueueSel = 0, 0, 0
+	s.resetQueues()
+}
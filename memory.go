@@ -0,0 +1,327 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// ErrOutOfBounds is returned for guest addresses which are not backed by memory.
+var ErrOutOfBounds = errors.New("virtio: guest address out of bounds")
+
+// GuestMemory translates guest physical addresses to host memory.
+//
+// Addresses come from the guest and must be treated as untrusted: every method
+// checks its bounds and returns an error wrapping ErrOutOfBounds instead of
+// panicking.
+type GuestMemory interface {
+	// Translate returns the host memory at the guest address addr, up to n
+	// bytes. The slice is shorter than n if the range continues in another
+	// region.
+	Translate(addr, n uint64) ([]byte, error)
+
+	// ReadAt reads len(p) bytes at the guest address addr.
+	ReadAt(p []byte, addr uint64) (int, error)
+
+	// WriteAt writes len(p) bytes at the guest address addr.
+	WriteAt(p []byte, addr uint64) (int, error)
+}
+
+// Region is a contiguous range of guest memory backed by host memory.
+type Region struct {
+	// GuestAddr is the guest physical address of the first byte of Data.
+	GuestAddr uint64
+
+	// Data is the host memory of the region.
+	Data []byte
+
+	// File, if non-nil, is the file mapped at Data, which can be passed to
+	// another process to share the region, e.g. a vhost-user backend.
+	File *os.File
+
+	// mapped is set for regions created by MapRegion.
+	mapped bool
+}
+
+// end returns the guest address after the region.
+func (r *Region) end() uint64 {
+	return r.GuestAddr + uint64(len(r.Data))
+}
+
+// Memory is a GuestMemory over a table of non-overlapping regions.
+type Memory struct {
+	regions []*Region // sorted by GuestAddr
+}
+
+var _ GuestMemory = (*Memory)(nil)
+
+// NewMemory returns the guest memory made of regions.
+func NewMemory(regions ...*Region) (*Memory, error) {
+	rs := append([]*Region(nil), regions...)
+	sort.Slice(rs, func(i, j int) bool { return rs[i].GuestAddr < rs[j].GuestAddr })
+
+	for i, r := range rs {
+		if len(r.Data) == 0 {
+			return nil, fmt.Errorf("virtio: empty region at %#x", r.GuestAddr)
+		}
+		if r.end()-1 < r.GuestAddr {
+			return nil, fmt.Errorf("virtio: region at %#x overflows the address space", r.GuestAddr)
+		}
+		if r.GuestAddr%4 != 0 || !aligned(r.Data) {
+			return nil, fmt.Errorf("virtio: region at %#x is not 4-byte aligned", r.GuestAddr)
+		}
+		if i > 0 && rs[i-1].end() > r.GuestAddr {
+			return nil, fmt.Errorf("virtio: region at %#x overlaps region at %#x", r.GuestAddr, rs[i-1].GuestAddr)
+		}
+	}
+
+	return &Memory{regions: rs}, nil
+}
+
+// Regions returns the regions of the memory, sorted by guest address.
+func (m *Memory) Regions() []*Region {
+	return m.regions
+}
+
+// Close unmaps the regions created by MapRegion.
+func (m *Memory) Close() error {
+	var err error
+	for _, r := range m.regions {
+		if !r.mapped {
+			continue
+		}
+		if uerr := r.Unmap(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+
+	return err
+}
+
+// region returns the region containing addr.
+func (m *Memory) region(addr uint64) *Region {
+	i := sort.Search(len(m.regions), func(i int) bool { return m.regions[i].end() > addr })
+	if i == len(m.regions) || m.regions[i].GuestAddr > addr {
+		return nil
+	}
+
+	return m.regions[i]
+}
+
+// Translate implements GuestMemory.Translate.
+func (m *Memory) Translate(addr, n uint64) ([]byte, error) {
+	r := m.region(addr)
+	if r == nil {
+		return nil, fmt.Errorf("%w: %#x", ErrOutOfBounds, addr)
+	}
+
+	b := r.Data[addr-r.GuestAddr:]
+	if uint64(len(b)) > n {
+		b = b[:n]
+	}
+
+	return b, nil
+}
+
+// ReadAt implements GuestMemory.ReadAt.
+func (m *Memory) ReadAt(p []byte, addr uint64) (int, error) {
+	return m.copy(p, addr, false)
+}
+
+// WriteAt implements GuestMemory.WriteAt.
+func (m *Memory) WriteAt(p []byte, addr uint64) (int, error) {
+	return m.copy(p, addr, true)
+}
+
+// copy copies between p and the guest memory at addr, across regions.
+func (m *Memory) copy(p []byte, addr uint64, write bool) (int, error) {
+	if addr+uint64(len(p)) < addr {
+		return 0, fmt.Errorf("%w: %#x+%d overflows", ErrOutOfBounds, addr, len(p))
+	}
+
+	var done int
+	for done < len(p) {
+		b, err := m.Translate(addr+uint64(done), uint64(len(p)-done))
+		if err != nil {
+			return done, err
+		}
+		if write {
+			done += copy(b, p[done:])
+		} else {
+			done += copy(p[done:], b)
+		}
+	}
+
+	return done, nil
+}
+
+// Discard releases the host memory of the n bytes at the guest address addr,
+// e.g. pages the guest gave back to a balloon. The range reads as zeros
+// afterwards on Linux and in regions over a slice, which are cleared; its
+// content is undefined on darwin.
+func (m *Memory) Discard(addr, n uint64) error {
+	if addr+n < addr {
+		return fmt.Errorf("%w: %#x+%d overflows", ErrOutOfBounds, addr, n)
+	}
+
+	for n > 0 {
+		b, err := m.Translate(addr, n)
+		if err != nil {
+			return err
+		}
+		r := m.region(addr)
+		if r.mapped {
+			err = r.discard(b)
+		} else {
+			for i := range b {
+				b[i] = 0
+			}
+		}
+		if err != nil {
+			return err
+		}
+		addr += uint64(len(b))
+		n -= uint64(len(b))
+	}
+
+	return nil
+}
+
+// Slice returns the host memory of the n bytes at the guest address addr,
+// which must be contiguous in a single region.
+func Slice(m GuestMemory, addr, n uint64) ([]byte, error) {
+	if addr+n < addr {
+		return nil, fmt.Errorf("%w: %#x+%d overflows", ErrOutOfBounds, addr, n)
+	}
+
+	b, err := m.Translate(addr, n)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(b)) != n {
+		return nil, fmt.Errorf("%w: %#x+%d is not contiguous", ErrOutOfBounds, addr, n)
+	}
+
+	return b, nil
+}
+
+// ReadUint16 reads the little-endian virtio field at addr.
+func ReadUint16(m GuestMemory, addr uint64) (uint16, error) {
+	var b [2]byte
+	if _, err := m.ReadAt(b[:], addr); err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint16(b[:]), nil
+}
+
+// ReadUint32 reads the little-endian virtio field at addr.
+func ReadUint32(m GuestMemory, addr uint64) (uint32, error) {
+	var b [4]byte
+	if _, err := m.ReadAt(b[:], addr); err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint32(b[:]), nil
+}
+
+// ReadUint64 reads the little-endian virtio field at addr.
+func ReadUint64(m GuestMemory, addr uint64) (uint64, error) {
+	var b [8]byte
+	if _, err := m.ReadAt(b[:], addr); err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint64(b[:]), nil
+}
+
+// WriteUint16 writes v as the little-endian virtio field at addr.
+func WriteUint16(m GuestMemory, addr uint64, v uint16) error {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	_, err := m.WriteAt(b[:], addr)
+
+	return err
+}
+
+// WriteUint32 writes v as the little-endian virtio field at addr.
+func WriteUint32(m GuestMemory, addr uint64, v uint32) error {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	_, err := m.WriteAt(b[:], addr)
+
+	return err
+}
+
+// WriteUint64 writes v as the little-endian virtio field at addr.
+func WriteUint64(m GuestMemory, addr uint64, v uint64) error {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	_, err := m.WriteAt(b[:], addr)
+
+	return err
+}
+
+// SGIterator iterates over the host memory segments of the buffers of a
+// descriptor chain. A buffer spanning several regions yields one segment per
+// region.
+type SGIterator struct {
+	mem   GuestMemory
+	descs []Descriptor
+	addr  uint64 // guest address of the rest of the current buffer
+	left  uint64 // bytes left in the current buffer
+	seg   []byte
+	err   error
+}
+
+// NewSGIterator returns an iterator over the buffers of descs.
+func NewSGIterator(mem GuestMemory, descs []Descriptor) *SGIterator {
+	return &SGIterator{mem: mem, descs: descs}
+}
+
+// Next advances to the next segment. It returns false at the end of the
+// buffers or on an error, which is then returned by Err.
+func (it *SGIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	for it.left == 0 {
+		if len(it.descs) == 0 {
+			return false
+		}
+		d := it.descs[0]
+		it.descs = it.descs[1:]
+		if d.Addr+uint64(d.Len) < d.Addr {
+			it.err = fmt.Errorf("%w: buffer %#x+%d overflows", ErrOutOfBounds, d.Addr, d.Len)
+			return false
+		}
+		it.addr, it.left = d.Addr, uint64(d.Len)
+	}
+
+	seg, err := it.mem.Translate(it.addr, it.left)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.seg = seg
+	it.addr += uint64(len(seg))
+	it.left -= uint64(len(seg))
+
+	return true
+}
+
+// Segment returns the current segment.
+func (it *SGIterator) Segment() []byte {
+	return it.seg
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *SGIterator) Err() error {
+	return it.err
+}
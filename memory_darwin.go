@@ -0,0 +1,21 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build darwin
+
+package virtio
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// discardAdvice releases pages of guest memory, leaving their content
+// undefined.
+const discardAdvice = unix.MADV_FREE_REUSABLE
+
+// memoryFile returns nil: darwin has no memfd, guest memory is anonymous.
+func memoryFile(size int) (*os.File, error) {
+	return nil, nil
+}
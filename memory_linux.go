@@ -0,0 +1,32 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package virtio
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// discardAdvice releases pages of guest memory. MADV_DONTNEED would only
+// drop the mapping of the shared memfd pages, MADV_REMOVE frees them.
+const discardAdvice = unix.MADV_REMOVE
+
+// memoryFile returns a memfd of size bytes to back guest memory.
+func memoryFile(size int) (*os.File, error) {
+	fd, err := unix.MemfdCreate("virtio-guest-memory", unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("memfd_create", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "virtio-guest-memory")
+	if err := f.Truncate(int64(size)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
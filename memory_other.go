@@ -0,0 +1,30 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !darwin && !linux
+
+package virtio
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// MapRegion is not supported on this platform; use a Region over a slice.
+func MapRegion(addr uint64, size int) (*Region, error) {
+	return nil, fmt.Errorf("virtio: MapRegion is not supported on %s", runtime.GOOS)
+}
+
+// Unmap releases a region created by MapRegion.
+func (r *Region) Unmap() error {
+	return fmt.Errorf("virtio: region at %#x was not mapped by MapRegion", r.GuestAddr)
+}
+
+// discard clears b: there are no mapped regions on this platform.
+func (r *Region) discard(b []byte) error {
+	for i := range b {
+		b[i] = 0
+	}
+
+	return nil
+}
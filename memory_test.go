@@ -0,0 +1,200 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// newTestMemory returns the guest memory of a single region at address 0.
+func newTestMemory(t testing.TB, data []byte) *Memory {
+	t.Helper()
+
+	m, err := NewMemory(&Region{Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestNewMemory(t *testing.T) {
+	for _, regions := range [][]*Region{
+		{{GuestAddr: 0x1000}},
+		{{GuestAddr: 0x1002, Data: make([]byte, 16)}},
+		{{GuestAddr: 0x1000, Data: make([]byte, 0x1000)}, {GuestAddr: 0x1ff0, Data: make([]byte, 16)}},
+		{{GuestAddr: 1<<64 - 8, Data: make([]byte, 16)}},
+	} {
+		if _, err := NewMemory(regions...); err == nil {
+			t.Errorf("NewMemory(%v) succeeded", regions)
+		}
+	}
+}
+
+func TestMemoryAccess(t *testing.T) {
+	// two adjacent regions and a separate one, out of order.
+	low, high, far := make([]byte, 0x1000), make([]byte, 0x1000), make([]byte, 0x100)
+	m, err := NewMemory(
+		&Region{GuestAddr: 0x10000, Data: far},
+		&Region{GuestAddr: 0x2000, Data: high},
+		&Region{GuestAddr: 0x1000, Data: low},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a write across the boundary of the adjacent regions.
+	data := []byte("0123456789")
+	if n, err := m.WriteAt(data, 0x1ffb); n != len(data) || err != nil {
+		t.Fatalf("WriteAt = %d, %v", n, err)
+	}
+	if !bytes.Equal(low[0xffb:], data[:5]) || !bytes.Equal(high[:5], data[5:]) {
+		t.Fatal("WriteAt did not write both regions")
+	}
+	got := make([]byte, len(data))
+	if n, err := m.ReadAt(got, 0x1ffb); n != len(data) || err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("ReadAt = %d, %v, %q", n, err, got)
+	}
+
+	if _, err := Slice(m, 0x1ffb, 10); !errors.Is(err, ErrOutOfBounds) {
+		t.Fatalf("Slice across regions = %v, want %v", err, ErrOutOfBounds)
+	}
+	if b, err := Slice(m, 0x2000, 5); err != nil || !bytes.Equal(b, data[5:]) {
+		t.Fatalf("Slice = %q, %v", b, err)
+	}
+
+	if err := WriteUint32(m, 0x10010, 0xdeadbeef); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ReadUint16(m, 0x10010); err != nil || v != 0xbeef {
+		t.Fatalf("ReadUint16 = %#x, %v", v, err)
+	}
+	if v, err := ReadUint64(m, 0x10010); err != nil || v != 0xdeadbeef {
+		t.Fatalf("ReadUint64 = %#x, %v", v, err)
+	}
+
+	// malicious addresses: holes, the end of a region, overflow.
+	for _, tt := range []struct {
+		addr uint64
+		n    int
+	}{
+		{0, 1},
+		{0x3000, 1},
+		{0x2ffc, 8},
+		{0x100fc, 8},
+		{1<<64 - 4, 8},
+	} {
+		if _, err := m.ReadAt(make([]byte, tt.n), tt.addr); !errors.Is(err, ErrOutOfBounds) {
+			t.Errorf("ReadAt(%d, %#x) = %v, want %v", tt.n, tt.addr, err, ErrOutOfBounds)
+		}
+		if _, err := m.WriteAt(make([]byte, tt.n), tt.addr); !errors.Is(err, ErrOutOfBounds) {
+			t.Errorf("WriteAt(%d, %#x) = %v, want %v", tt.n, tt.addr, err, ErrOutOfBounds)
+		}
+	}
+}
+
+func TestSGIterator(t *testing.T) {
+	low, high := make([]byte, 0x1000), make([]byte, 0x1000)
+	m, err := NewMemory(&Region{GuestAddr: 0, Data: low}, &Region{GuestAddr: 0x1000, Data: high})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	it := NewSGIterator(m, []Descriptor{
+		{Addr: 0x10, Len: 4},
+		{Addr: 0, Len: 0},
+		{Addr: 0xff0, Len: 0x20}, // spans both regions
+	})
+	var lens []int
+	for it.Next() {
+		lens = append(lens, len(it.Segment()))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(lens) != 3 || lens[0] != 4 || lens[1] != 0x10 || lens[2] != 0x10 {
+		t.Fatalf("segment lengths %v, want [4 16 16]", lens)
+	}
+
+	for _, d := range []Descriptor{{Addr: 0x1ff0, Len: 0x20}, {Addr: 1<<64 - 1, Len: 2}} {
+		it = NewSGIterator(m, []Descriptor{d})
+		for it.Next() {
+		}
+		if !errors.Is(it.Err(), ErrOutOfBounds) {
+			t.Errorf("iterating %+v: %v, want %v", d, it.Err(), ErrOutOfBounds)
+		}
+	}
+}
+
+func TestMapRegion(t *testing.T) {
+	r, err := MapRegion(0x100000, 1<<20)
+	if err != nil {
+		t.Skipf("MapRegion: %v", err)
+	}
+	m, err := NewMemory(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if err := WriteUint64(m, 0x100000+1<<20-8, 42); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ReadUint64(m, 0x100000+1<<20-8); err != nil || v != 42 {
+		t.Fatalf("ReadUint64 = %d, %v", v, err)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	const size = 1 << 20
+	regions := map[string]func() (*Region, error){
+		"slice": func() (*Region, error) { return &Region{GuestAddr: 0x100000, Data: make([]byte, size)}, nil },
+		"mapped": func() (*Region, error) {
+			if runtime.GOOS != "linux" {
+				return nil, fmt.Errorf("discarded memory is undefined on %s", runtime.GOOS)
+			}
+			return MapRegion(0x100000, size)
+		},
+	}
+	for name, region := range regions {
+		t.Run(name, func(t *testing.T) {
+			r, err := region()
+			if err != nil {
+				t.Skip(err)
+			}
+			m, err := NewMemory(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			for i := range r.Data {
+				r.Data[i] = 0xff
+			}
+
+			// the range covers whole pages and parts of others.
+			off, n := uint64(100), uint64(3*os.Getpagesize()+200)
+			if err := m.Discard(0x100000+off, n); err != nil {
+				t.Fatal(err)
+			}
+			for i, b := range r.Data {
+				want := byte(0xff)
+				if uint64(i) >= off && uint64(i) < off+n {
+					want = 0
+				}
+				if b != want {
+					t.Fatalf("byte %d = %#x, want %#x", i, b, want)
+				}
+			}
+
+			if err := m.Discard(0x100000+size-10, 20); !errors.Is(err, ErrOutOfBounds) {
+				t.Fatalf("Discard past the memory: %v", err)
+			}
+		})
+	}
+}
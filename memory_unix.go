@@ -0,0 +1,88 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build darwin || linux
+
+package virtio
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// MapRegion maps size bytes of zeroed shared memory for the guest address
+// addr. On Linux the memory is backed by a memfd, available as Region.File.
+// The region is released by Unmap or by closing the Memory it belongs to.
+func MapRegion(addr uint64, size int) (*Region, error) {
+	f, err := memoryFile(size)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, flags := -1, unix.MAP_SHARED|unix.MAP_ANON
+	if f != nil {
+		fd, flags = int(f.Fd()), unix.MAP_SHARED
+	}
+
+	data, err := unix.Mmap(fd, 0, size, unix.PROT_READ|unix.PROT_WRITE, flags)
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, fmt.Errorf("map guest memory at %#x: %w", addr, os.NewSyscallError("mmap", err))
+	}
+
+	return &Region{
+		GuestAddr: addr,
+		Data:      data,
+		File:      f,
+		mapped:    true,
+	}, nil
+}
+
+// Unmap releases a region created by MapRegion.
+func (r *Region) Unmap() error {
+	if !r.mapped {
+		return fmt.Errorf("virtio: region at %#x was not mapped by MapRegion", r.GuestAddr)
+	}
+
+	err := unix.Munmap(r.Data)
+	if r.File != nil {
+		if cerr := r.File.Close(); err == nil {
+			err = cerr
+		}
+	}
+	r.Data, r.File, r.mapped = nil, nil, false
+
+	return err
+}
+
+// discard releases the pages of the region within b and clears the bytes of
+// b around them.
+func (r *Region) discard(b []byte) error {
+	page := uintptr(os.Getpagesize())
+	start := uintptr(unsafe.Pointer(&b[0]))
+	first := int((start+page-1)&^(page-1) - start)
+	last := int((start+uintptr(len(b)))&^(page-1) - start)
+	if first >= last {
+		first, last = len(b), len(b)
+	}
+	for i := range b[:first] {
+		b[i] = 0
+	}
+	for i := range b[last:] {
+		b[last+i] = 0
+	}
+	if first == last {
+		return nil
+	}
+
+	if err := unix.Madvise(b[first:last], discardAdvice); err != nil {
+		return fmt.Errorf("discard guest memory at %#x: %w", r.GuestAddr, os.NewSyscallError("madvise", err))
+	}
+
+	return nil
+}
@@ -0,0 +1,12 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package mmio implements the device side of the virtio over MMIO transport,
+// version 2 of the register layout.
+//
+// A Transport decodes the register accesses of the driver, trapped by the
+// VMM, and dispatches them to a virtio.Device: feature negotiation, queue
+// setup and device status go through the transport, configuration space
+// accesses go to the device, and the device is activated once the driver sets
+// DRIVER_OK.
+package mmio
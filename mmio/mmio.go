@@ -0,0 +1,273 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mmio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/go-hypervisor/virtio"
+	"github.com/go-hypervisor/virtio/internal/transport"
+)
+
+// list of register offsets.
+const (
+	RegMagicValue        = 0x000
+	RegVersion           = 0x004
+	RegDeviceID          = 0x008
+	RegVendorID          = 0x00c
+	RegDeviceFeatures    = 0x010
+	RegDeviceFeaturesSel = 0x014
+	RegDriverFeatures    = 0x020
+	RegDriverFeaturesSel = 0x024
+	RegQueueSel          = 0x030
+	RegQueueNumMax       = 0x034
+	RegQueueNum          = 0x038
+	RegQueueReady        = 0x044
+	RegQueueNotify       = 0x050
+	RegInterruptStatus   = 0x060
+	RegInterruptACK      = 0x064
+	RegStatus            = 0x070
+	RegQueueDescLow      = 0x080
+	RegQueueDescHigh     = 0x084
+	RegQueueDriverLow    = 0x090
+	RegQueueDriverHigh   = 0x094
+	RegQueueDeviceLow    = 0x0a0
+	RegQueueDeviceHigh   = 0x0a4
+	RegConfigGeneration  = 0x0fc
+	RegConfig            = 0x100
+)
+
+const (
+	// MagicValue is the value of the MagicValue register, "virt".
+	MagicValue = 0x74726976
+
+	// Version is the version of the register layout.
+	Version = 2
+)
+
+// list of InterruptStatus bits.
+const (
+	InterruptUsedBuffer   = 1 << 0
+	InterruptConfigChange = 1 << 1
+)
+
+// ErrInvalidAccess is returned for accesses to unknown registers, of the wrong
+// size, or writes to read-only registers.
+var ErrInvalidAccess = errors.New("mmio: invalid register access")
+
+// Transport is the MMIO register window of a device.
+type Transport struct {
+	// VendorID is the value of the VendorID register.
+	VendorID uint32
+
+	// IRQ, if non-nil, is called with the new level of the interrupt line
+	// when InterruptStatus changes between zero and non-zero.
+	IRQ func(level bool)
+
+	mu    sync.Mutex
+	state *transport.State
+
+	// interrupts are sent by the device outside of register accesses.
+	irqMu      sync.Mutex
+	interrupts uint32
+	generation uint32
+}
+
+var _ virtio.Interrupter = (*Transport)(nil)
+
+// New returns the transport of dev, whose queues are in mem. The transport
+// offers VERSION_1 in addition to the features of the device.
+func New(mem virtio.GuestMemory, dev virtio.Device) *Transport {
+	return &Transport{state: transport.New(mem, dev)}
+}
+
+// Read handles a read of len(p) bytes at the offset off of the register
+// window. Registers are read with 32-bit aligned accesses; the configuration
+// space at RegConfig with any size. p is zeroed on error.
+func (t *Transport) Read(off uint64, p []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if off >= RegConfig {
+		t.state.Dev.ReadConfig(off-RegConfig, p)
+		return nil
+	}
+
+	for i := range p {
+		p[i] = 0
+	}
+	if len(p) != 4 || off%4 != 0 {
+		return fmt.Errorf("%w: %d byte read at %#x", ErrInvalidAccess, len(p), off)
+	}
+
+	v, err := t.read(off)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(p, v)
+
+	return nil
+}
+
+func (t *Transport) read(off uint64) (uint32, error) {
+	switch off {
+	case RegMagicValue:
+		return MagicValue, nil
+	case RegVersion:
+		return Version, nil
+	case RegDeviceID:
+		return uint32(t.state.Dev.DeviceID()), nil
+	case RegVendorID:
+		return t.VendorID, nil
+	case RegDeviceFeatures:
+		return t.state.DeviceFeatures(), nil
+	case RegQueueNumMax:
+		if q := t.state.Queue(); q != nil {
+			return uint32(q.Max), nil
+		}
+		return 0, nil
+	case RegQueueReady:
+		if q := t.state.Queue(); q != nil && q.Ready {
+			return 1, nil
+		}
+		return 0, nil
+	case RegInterruptStatus:
+		t.irqMu.Lock()
+		defer t.irqMu.Unlock()
+		return t.interrupts, nil
+	case RegStatus:
+		return uint32(t.state.Status.Status()), nil
+	case RegConfigGeneration:
+		t.irqMu.Lock()
+		defer t.irqMu.Unlock()
+		return t.generation, nil
+	}
+
+	return 0, fmt.Errorf("%w: read of register %#x", ErrInvalidAccess, off)
+}
+
+// Write handles a write of p at the offset off of the register window, with
+// the same access rules as Read.
+func (t *Transport) Write(off uint64, p []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if off >= RegConfig {
+		t.state.Dev.WriteConfig(off-RegConfig, p)
+		return nil
+	}
+	if len(p) != 4 || off%4 != 0 {
+		return fmt.Errorf("%w: %d byte write at %#x", ErrInvalidAccess, len(p), off)
+	}
+
+	return t.write(off, binary.LittleEndian.Uint32(p))
+}
+
+func (t *Transport) write(off uint64, v uint32) error {
+	s := t.state
+	switch off {
+	case RegDeviceFeaturesSel:
+		s.DeviceFeaturesSel = v
+		return nil
+	case RegDriverFeatures:
+		return s.SetDriverFeatures(v)
+	case RegDriverFeaturesSel:
+		s.DriverFeaturesSel = v
+		return nil
+	case RegQueueSel:
+		s.QueueSel = v
+		return nil
+	case RegQueueNum:
+		return wrap(s.SetQueueNum(v))
+	case RegQueueReady:
+		return wrap(s.SetQueueReady(v != 0))
+	case RegQueueNotify:
+		// with VIRTIO_F_NOTIFICATION_DATA the high half holds the ring
+		// position, which the device finds in the ring anyway.
+		s.Notify(int(v & 0xffff))
+		return nil
+	case RegInterruptACK:
+		t.irqMu.Lock()
+		defer t.irqMu.Unlock()
+		t.setInterrupts(t.interrupts &^ v)
+		return nil
+	case RegStatus:
+		if v == 0 {
+			t.reset()
+			return nil
+		}
+		return wrap(s.SetStatus(virtio.Status(v), t))
+	case RegQueueDescLow:
+		return wrap(s.SetQueue(func(q *transport.Queue) error { q.Desc = setLow(q.Desc, v); return nil }))
+	case RegQueueDescHigh:
+		return wrap(s.SetQueue(func(q *transport.Queue) error { q.Desc = setHigh(q.Desc, v); return nil }))
+	case RegQueueDriverLow:
+		return wrap(s.SetQueue(func(q *transport.Queue) error { q.Driver = setLow(q.Driver, v); return nil }))
+	case RegQueueDriverHigh:
+		return wrap(s.SetQueue(func(q *transport.Queue) error { q.Driver = setHigh(q.Driver, v); return nil }))
+	case RegQueueDeviceLow:
+		return wrap(s.SetQueue(func(q *transport.Queue) error { q.Device = setLow(q.Device, v); return nil }))
+	case RegQueueDeviceHigh:
+		return wrap(s.SetQueue(func(q *transport.Queue) error { q.Device = setHigh(q.Device, v); return nil }))
+	}
+
+	return fmt.Errorf("%w: write of register %#x", ErrInvalidAccess, off)
+}
+
+func setLow(addr uint64, v uint32) uint64 {
+	return addr&^0xffffffff | uint64(v)
+}
+
+func setHigh(addr uint64, v uint32) uint64 {
+	return addr&0xffffffff | uint64(v)<<32
+}
+
+// wrap prefixes the errors of the device state with the package name.
+func wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return fmt.Errorf("mmio: %w", err)
+}
+
+// reset resets the device and the transport registers.
+func (t *Transport) reset() {
+	t.state.Reset()
+
+	t.irqMu.Lock()
+	t.setInterrupts(0)
+	t.irqMu.Unlock()
+}
+
+// setInterrupts sets InterruptStatus and the level of the interrupt line.
+// irqMu must be held.
+func (t *Transport) setInterrupts(v uint32) {
+	old := t.interrupts
+	t.interrupts = v
+	if t.IRQ != nil && (old == 0) != (v == 0) {
+		t.IRQ(v != 0)
+	}
+}
+
+// InterruptQueue implements virtio.Interrupter.InterruptQueue.
+func (t *Transport) InterruptQueue(index int) {
+	t.irqMu.Lock()
+	defer t.irqMu.Unlock()
+
+	t.setInterrupts(t.interrupts | InterruptUsedBuffer)
+}
+
+// InterruptConfig implements virtio.Interrupter.InterruptConfig. It also
+// bumps ConfigGeneration.
+func (t *Transport) InterruptConfig() {
+	t.irqMu.Lock()
+	defer t.irqMu.Unlock()
+
+	t.generation++
+	t.setInterrupts(t.interrupts | InterruptConfigChange)
+}
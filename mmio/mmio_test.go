@@ -0,0 +1,339 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package mmio
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// testDevice is an entropy-like device with one queue and 8 bytes of
+// configuration space.
+type testDevice struct {
+	config   [8]byte
+	acked    virtio.Features
+	queues   []*virtio.Queue
+	irq      virtio.Interrupter
+	resets   int
+	activate error
+}
+
+func (d *testDevice) DeviceID() virtio.DeviceID       { return virtio.DeviceEntropy }
+func (d *testDevice) Features() virtio.Features       { return virtio.FeatureEventIdx | 1 }
+func (d *testDevice) AckFeatures(f virtio.Features)   { d.acked = f }
+func (d *testDevice) QueueMaxSizes() []uint16         { return []uint16{16} }
+func (d *testDevice) ReadConfig(off uint64, p []byte) { copy(p, d.config[off:]) }
+func (d *testDevice) WriteConfig(off uint64, p []byte) {
+	copy(d.config[off:], p)
+}
+
+func (d *testDevice) Activate(mem virtio.GuestMemory, queues []*virtio.Queue, irq virtio.Interrupter) error {
+	if d.activate != nil {
+		return d.activate
+	}
+	d.queues, d.irq = queues, irq
+	return nil
+}
+
+func (d *testDevice) Reset() {
+	d.queues, d.irq = nil, nil
+	d.resets++
+}
+
+// testDriver drives the registers of a transport.
+type testDriver struct {
+	t  *testing.T
+	tr *Transport
+}
+
+func (d testDriver) read(off uint64) uint32 {
+	d.t.Helper()
+
+	p := make([]byte, 4)
+	if err := d.tr.Read(off, p); err != nil {
+		d.t.Fatal(err)
+	}
+
+	return binary.LittleEndian.Uint32(p)
+}
+
+func (d testDriver) write(off uint64, v uint32) error {
+	p := make([]byte, 4)
+	binary.LittleEndian.PutUint32(p, v)
+
+	return d.tr.Write(off, p)
+}
+
+func (d testDriver) mustWrite(off uint64, v uint32) {
+	d.t.Helper()
+
+	if err := d.write(off, v); err != nil {
+		d.t.Fatal(err)
+	}
+}
+
+// newTestTransport returns a transport over 64KiB of guest memory.
+func newTestTransport(t *testing.T) (*Transport, *testDevice, virtio.GuestMemory, testDriver) {
+	t.Helper()
+
+	mem, err := virtio.NewMemory(&virtio.Region{Data: make([]byte, 1<<16)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &testDevice{}
+	tr := New(mem, dev)
+
+	return tr, dev, mem, testDriver{t: t, tr: tr}
+}
+
+// driverOK is the device status once the driver is initialized.
+const driverOK = virtio.StatusAcknowledge | virtio.StatusDriver | virtio.StatusFeaturesOK | virtio.StatusDriverOK
+
+// setup runs the driver initialization up to DRIVER_OK, excluded, accepting
+// the features with VERSION_1, with the split queue 0 of 16 descriptors at 0,
+// and returns the driver side of the queue.
+func (d testDriver) setup(mem virtio.GuestMemory, features virtio.Features) *virtio.SplitQueue {
+	d.t.Helper()
+
+	d.mustWrite(RegStatus, uint32(virtio.StatusAcknowledge))
+	d.mustWrite(RegStatus, uint32(virtio.StatusAcknowledge|virtio.StatusDriver))
+
+	d.mustWrite(RegDeviceFeaturesSel, 1)
+	if got := d.read(RegDeviceFeatures); got&1 == 0 {
+		d.t.Fatalf("device features word 1 = %#x, want VERSION_1", got)
+	}
+	features |= virtio.FeatureVersion1
+	for sel := uint32(0); sel < 2; sel++ {
+		d.mustWrite(RegDriverFeaturesSel, sel)
+		d.mustWrite(RegDriverFeatures, features.Word(sel))
+	}
+	d.mustWrite(RegStatus, uint32(virtio.StatusAcknowledge|virtio.StatusDriver|virtio.StatusFeaturesOK))
+	if virtio.Status(d.read(RegStatus))&virtio.StatusFeaturesOK == 0 {
+		d.t.Fatal("FEATURES_OK not set")
+	}
+
+	// the driver allocates zeroed rings.
+	const size = 16
+	avail, used, total := virtio.SplitLayout(size)
+	if _, err := mem.WriteAt(make([]byte, total), 0); err != nil {
+		d.t.Fatal(err)
+	}
+	d.mustWrite(RegQueueSel, 0)
+	if got := d.read(RegQueueNumMax); got != size {
+		d.t.Fatalf("QueueNumMax = %d", got)
+	}
+	d.mustWrite(RegQueueNum, size)
+	d.mustWrite(RegQueueDescLow, 0)
+	d.mustWrite(RegQueueDescHigh, 0)
+	d.mustWrite(RegQueueDriverLow, uint32(avail))
+	d.mustWrite(RegQueueDriverHigh, 0)
+	d.mustWrite(RegQueueDeviceLow, uint32(used))
+	d.mustWrite(RegQueueDeviceHigh, 0)
+	d.mustWrite(RegQueueReady, 1)
+
+	q, err := virtio.NewSplitQueue(mem, size, 0, avail, used)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+
+	return q
+}
+
+func TestTransport(t *testing.T) {
+	tr, dev, mem, drv := newTestTransport(t)
+	var level bool
+	tr.IRQ = func(l bool) { level = l }
+
+	for _, r := range []struct {
+		off  uint64
+		want uint32
+	}{
+		{RegMagicValue, MagicValue},
+		{RegVersion, Version},
+		{RegDeviceID, uint32(virtio.DeviceEntropy)},
+		{RegStatus, 0},
+	} {
+		if got := drv.read(r.off); got != r.want {
+			t.Errorf("register %#x = %#x, want %#x", r.off, got, r.want)
+		}
+	}
+
+	q := drv.setup(mem, 1)
+	drv.mustWrite(RegStatus, uint32(driverOK))
+	if dev.acked != virtio.FeatureVersion1|1 {
+		t.Fatalf("device acked features %v", dev.acked)
+	}
+	if len(dev.queues) != 1 || dev.queues[0] == nil {
+		t.Fatalf("device activated with queues %v", dev.queues)
+	}
+
+	// a buffer and a notification from the driver.
+	if _, err := q.Add([]virtio.Buffer{{Addr: 0x8000, Len: 4, Writable: true}}); err != nil {
+		t.Fatal(err)
+	}
+	q.Notify = func() { drv.mustWrite(RegQueueNotify, 0) }
+	q.Kick()
+	select {
+	case <-dev.queues[0].Notified():
+	default:
+		t.Fatal("queue not notified")
+	}
+
+	c, ok, err := dev.queues[0].PopChain()
+	if err != nil || !ok {
+		t.Fatalf("PopChain = %v, %v", ok, err)
+	}
+	if _, err := c.Write([]byte("rand")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.queues[0].PushChain(c); err != nil {
+		t.Fatal(err)
+	}
+	dev.irq.InterruptQueue(0)
+	if !level || drv.read(RegInterruptStatus) != InterruptUsedBuffer {
+		t.Fatalf("used buffer interrupt not raised")
+	}
+	drv.mustWrite(RegInterruptACK, InterruptUsedBuffer)
+	if level || drv.read(RegInterruptStatus) != 0 {
+		t.Fatalf("interrupt not acknowledged")
+	}
+	if e, ok, err := q.Reap(); err != nil || !ok || e.Len != 4 {
+		t.Fatalf("Reap = %+v, %v, %v", e, ok, err)
+	}
+
+	// configuration space and generation.
+	if err := tr.Write(RegConfig+2, []byte{0xab, 0xcd}); err != nil {
+		t.Fatal(err)
+	}
+	if got := drv.read(RegConfig); got != 0xcdab0000 {
+		t.Fatalf("config = %#x", got)
+	}
+	gen := drv.read(RegConfigGeneration)
+	dev.irq.InterruptConfig()
+	if drv.read(RegConfigGeneration) == gen || drv.read(RegInterruptStatus) != InterruptConfigChange {
+		t.Fatal("config change not signalled")
+	}
+
+	// reset.
+	drv.mustWrite(RegStatus, 0)
+	if dev.resets != 1 || dev.queues != nil || drv.read(RegStatus) != 0 || drv.read(RegQueueReady) != 0 || level {
+		t.Fatalf("device not reset")
+	}
+	drv.mustWrite(RegQueueNotify, 0)
+}
+
+func TestTransportActivateError(t *testing.T) {
+	_, dev, mem, drv := newTestTransport(t)
+	dev.activate = errors.New("no entropy")
+
+	drv.setup(mem, 1)
+	if err := drv.write(RegStatus, uint32(driverOK)); !errors.Is(err, dev.activate) {
+		t.Fatalf("DRIVER_OK = %v, want %v", err, dev.activate)
+	}
+	if virtio.Status(drv.read(RegStatus))&virtio.StatusNeedsReset == 0 || drv.read(RegInterruptStatus) != InterruptConfigChange {
+		t.Fatal("NEEDS_RESET not signalled")
+	}
+}
+
+func TestTransportInvalid(t *testing.T) {
+	tr, _, _, drv := newTestTransport(t)
+
+	for _, tt := range []struct {
+		name string
+		err  error
+	}{
+		{"read size", tr.Read(RegMagicValue, make([]byte, 2))},
+		{"unaligned read", tr.Read(RegMagicValue+2, make([]byte, 4))},
+		{"unknown register", tr.Read(0x0f0, make([]byte, 4))},
+		{"read-only register", drv.write(RegMagicValue, 0)},
+	} {
+		if !errors.Is(tt.err, ErrInvalidAccess) {
+			t.Errorf("%s: %v, want %v", tt.name, tt.err, ErrInvalidAccess)
+		}
+	}
+
+	drv.mustWrite(RegStatus, uint32(virtio.StatusAcknowledge|virtio.StatusDriver))
+	if err := drv.write(RegQueueReady, 1); err == nil {
+		t.Error("queue enabled before FEATURES_OK")
+	}
+	if err := drv.write(RegQueueNum, 32); err == nil {
+		t.Error("queue size above QueueNumMax accepted")
+	}
+	drv.mustWrite(RegQueueSel, 1)
+	if got := drv.read(RegQueueNumMax); got != 0 {
+		t.Errorf("QueueNumMax of a missing queue = %d", got)
+	}
+
+	// FEATURES_OK without VERSION_1 is not set.
+	if err := drv.write(RegStatus, uint32(virtio.StatusAcknowledge|virtio.StatusDriver|virtio.StatusFeaturesOK)); !errors.Is(err, virtio.ErrInvalidStatus) {
+		t.Errorf("FEATURES_OK = %v, want %v", err, virtio.ErrInvalidStatus)
+	}
+	if virtio.Status(drv.read(RegStatus))&virtio.StatusFeaturesOK != 0 {
+		t.Error("FEATURES_OK set without VERSION_1")
+	}
+}
+
+func TestTransportNullDevice(t *testing.T) {
+	dev, err := virtio.NewDevice(virtio.DeviceNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.(*virtio.NullDevice).QueueSize = 16
+	mem, err := virtio.NewMemory(&virtio.Region{Data: make([]byte, 1<<16)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := New(mem, dev)
+	drv := testDriver{t: t, tr: tr}
+
+	irqs := make(chan bool, 1)
+	tr.IRQ = func(level bool) {
+		if level {
+			select {
+			case irqs <- true:
+			default:
+			}
+		}
+	}
+
+	// two rounds, the first reset with chains in flight.
+	for round := 0; round < 2; round++ {
+		q := drv.setup(mem, 0)
+		drv.mustWrite(RegStatus, uint32(driverOK))
+		q.Notify = func() { drv.mustWrite(RegQueueNotify, 0) }
+
+		for i := 0; i < 4; i++ {
+			if _, err := q.Add([]virtio.Buffer{{Addr: 0x8000, Len: 16}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		q.Kick()
+		if round == 0 {
+			drv.mustWrite(RegStatus, 0)
+			continue
+		}
+
+		for reaped := 0; reaped < 4; {
+			_, ok, err := q.Reap()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok {
+				reaped++
+				continue
+			}
+			select {
+			case <-irqs:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("%d of 4 chains completed", reaped)
+			}
+			drv.mustWrite(RegInterruptACK, drv.read(RegInterruptStatus))
+		}
+		drv.mustWrite(RegStatus, 0)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netdev
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// Backend moves frames between a device and the host network. Each frame
+// starts with a virtio_net_hdr_v1: Read reads one frame into p, blocking
+// until one is available, and Write writes one. Close unblocks Read.
+type Backend interface {
+	Read(p []byte) (int, error)
+	Write(p []byte) (int, error)
+	Close() error
+}
+
+// Offloader is implemented by backends handling the offloads of the frame
+// headers. The device offers the offload features only with such a backend.
+type Offloader interface {
+	// SetOffload is called with the negotiated features, once the driver
+	// accepted them. The GUEST features tell which offloads the frames read
+	// from the backend may use.
+	SetOffload(f virtio.Features) error
+}
+
+// ErrPipeClosed is returned by the operations on a closed Pipe.
+var ErrPipeClosed = errors.New("netdev: pipe closed")
+
+// Pipe is an end of an in-memory pair of backends: the frames written to an
+// end are read from the other. It supports offloads, which it does not
+// check.
+type Pipe struct {
+	r, w chan []byte
+	done chan struct{}
+	once *sync.Once
+
+	mu      sync.Mutex
+	offload virtio.Features
+}
+
+var (
+	_ Backend   = (*Pipe)(nil)
+	_ Offloader = (*Pipe)(nil)
+)
+
+// NewPipe returns the ends of a pipe, which buffers up to n frames in each
+// direction. Closing an end closes both.
+func NewPipe(n int) (*Pipe, *Pipe) {
+	ab, ba := make(chan []byte, n), make(chan []byte, n)
+	done, once := make(chan struct{}), new(sync.Once)
+
+	return &Pipe{r: ba, w: ab, done: done, once: once},
+		&Pipe{r: ab, w: ba, done: done, once: once}
+}
+
+// Read implements Backend.Read. A frame larger than p is truncated.
+func (p *Pipe) Read(b []byte) (int, error) {
+	select {
+	case f := <-p.r:
+		return copy(b, f), nil
+	case <-p.done:
+		return 0, ErrPipeClosed
+	}
+}
+
+// Write implements Backend.Write. It blocks while the other end has n frames
+// to read.
+func (p *Pipe) Write(b []byte) (int, error) {
+	f := append([]byte(nil), b...)
+	select {
+	case p.w <- f:
+		return len(b), nil
+	case <-p.done:
+		return 0, ErrPipeClosed
+	}
+}
+
+// Close implements Backend.Close.
+func (p *Pipe) Close() error {
+	p.once.Do(func() { close(p.done) })
+
+	return nil
+}
+
+// SetOffload implements Offloader.SetOffload.
+func (p *Pipe) SetOffload(f virtio.Features) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.offload = f
+
+	return nil
+}
+
+// Offload returns the features last passed to SetOffload.
+func (p *Pipe) Offload() virtio.Features {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.offload
+}
@@ -0,0 +1,313 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netdev
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// list of control classes and commands.
+const (
+	ctrlRx           = 0 // VIRTIO_NET_CTRL_RX
+	ctrlRxPromisc    = 0 // VIRTIO_NET_CTRL_RX_PROMISC
+	ctrlRxAllMulti   = 1 // VIRTIO_NET_CTRL_RX_ALLMULTI
+	ctrlRxAllUni     = 2 // VIRTIO_NET_CTRL_RX_ALLUNI
+	ctrlRxNoMulti    = 3 // VIRTIO_NET_CTRL_RX_NOMULTI
+	ctrlRxNoUni      = 4 // VIRTIO_NET_CTRL_RX_NOUNI
+	ctrlRxNoBcast    = 5 // VIRTIO_NET_CTRL_RX_NOBCAST
+	ctrlMAC          = 1 // VIRTIO_NET_CTRL_MAC
+	ctrlMACTableSet  = 0 // VIRTIO_NET_CTRL_MAC_TABLE_SET
+	ctrlMACAddrSet   = 1 // VIRTIO_NET_CTRL_MAC_ADDR_SET
+	ctrlVLAN         = 2 // VIRTIO_NET_CTRL_VLAN
+	ctrlVLANAdd      = 0 // VIRTIO_NET_CTRL_VLAN_ADD
+	ctrlVLANDel      = 1 // VIRTIO_NET_CTRL_VLAN_DEL
+	ctrlAnnounce     = 3 // VIRTIO_NET_CTRL_ANNOUNCE
+	ctrlAnnounceAck  = 0 // VIRTIO_NET_CTRL_ANNOUNCE_ACK
+	ctrlMQ           = 4 // VIRTIO_NET_CTRL_MQ
+	ctrlMQPairsSet   = 0 // VIRTIO_NET_CTRL_MQ_VQ_PAIRS_SET
+	ctrlMQRSSConfig  = 1 // VIRTIO_NET_CTRL_MQ_RSS_CONFIG
+	ctrlMQHashConfig = 2 // VIRTIO_NET_CTRL_MQ_HASH_CONFIG
+)
+
+// list of control acks.
+const (
+	ctrlOK  = 0 // VIRTIO_NET_OK
+	ctrlErr = 1 // VIRTIO_NET_ERR
+)
+
+const (
+	// macTableEntries is the size of the unicast and multicast tables.
+	// Larger tables accept all the addresses of their kind.
+	macTableEntries = 64
+
+	// maxFlows bounds the flows remembered for automatic receive steering.
+	maxFlows = 4096
+
+	// maxControlSize bounds the commands of the driver, the largest being
+	// a MAC table command of up to maxControlMACs addresses per table.
+	// Longer commands fail.
+	maxControlSize = 2 + 2*(4+6*maxControlMACs)
+	maxControlMACs = 1024
+)
+
+// filter is the rx mode and the MAC and VLAN filters set by the driver.
+type filter struct {
+	promisc, allMulti, allUni        bool
+	noMulti, noUni, noBcast          bool
+	uni, multi                       [][6]byte
+	uniOverflow, multiOverflow, vlan bool
+	vlans                            [4096 / 64]uint64
+}
+
+// newFilter returns the filter after a reset: promiscuous until the driver
+// sets the rx mode, and dropping all tagged frames if vlan until the driver
+// adds their VLAN.
+func newFilter(vlan bool) filter {
+	return filter{promisc: true, vlan: vlan}
+}
+
+// accept reports whether the Ethernet frame eth passes the filter of a device
+// with address mac.
+func (f *filter) accept(eth, mac []byte) bool {
+	if f.promisc {
+		return true
+	}
+	if len(eth) < 14 {
+		return false
+	}
+	if f.vlan && binary.BigEndian.Uint16(eth[12:]) == etherTypeVLAN {
+		if len(eth) < 16 {
+			return false
+		}
+		vid := binary.BigEndian.Uint16(eth[14:]) & 0xfff
+		if f.vlans[vid/64]&(1<<(vid%64)) == 0 {
+			return false
+		}
+	}
+
+	var dst [6]byte
+	copy(dst[:], eth)
+	switch {
+	case dst == [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}:
+		return !f.noBcast
+	case dst[0]&1 != 0:
+		return !f.noMulti && (f.allMulti || f.multiOverflow || contains(f.multi, dst))
+	default:
+		return !f.noUni && (f.allUni || f.uniOverflow || bytes.Equal(dst[:], mac) || contains(f.uni, dst))
+	}
+}
+
+func contains(table [][6]byte, addr [6]byte) bool {
+	for _, a := range table {
+		if a == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseMACTable parses struct virtio_net_ctrl_mac at the start of b, and
+// returns the rest of b.
+func parseMACTable(b []byte) (table [][6]byte, overflow bool, rest []byte, ok bool) {
+	if len(b) < 4 {
+		return nil, false, nil, false
+	}
+	n := binary.LittleEndian.Uint32(b)
+	if uint64(len(b)-4) < 6*uint64(n) {
+		return nil, false, nil, false
+	}
+	if n > macTableEntries {
+		return nil, true, b[4+6*n:], true
+	}
+	for i := uint32(0); i < n; i++ {
+		var a [6]byte
+		copy(a[:], b[4+6*i:])
+		table = append(table, a)
+	}
+
+	return table, false, b[4+6*n:], true
+}
+
+// control handles the commands of the control queue q until done is closed.
+// The commands are read into buf, and those larger answered with an error.
+func (d *Device) control(q *virtio.Queue, irq virtio.Interrupter, done <-chan struct{}) {
+	defer d.wg.Done()
+
+	buf := make([]byte, maxControlSize)
+	q.Serve(irq, done, func(c *virtio.DescriptorChain) bool {
+		ack := byte(ctrlErr)
+		if n := c.ReadableLen(); n >= 2 && n <= uint64(len(buf)) {
+			b := buf[:n]
+			if _, err := io.ReadFull(c, b); err == nil {
+				d.mu.Lock()
+				ack = d.command(b[0], b[1], b[2:])
+				d.mu.Unlock()
+			}
+		}
+		c.Write([]byte{ack})
+
+		return true
+	})
+}
+
+// command runs the command cmd of class with its data b, and returns its
+// ack. d.mu must be held.
+func (d *Device) command(class, cmd uint8, b []byte) uint8 {
+	f := d.features
+	ok := false
+	switch class {
+	case ctrlRx:
+		ok = d.rxMode(cmd, b)
+	case ctrlMAC:
+		switch {
+		case cmd == ctrlMACTableSet && f.Has(FeatureCtrlRx):
+			uni, uo, rest, ok1 := parseMACTable(b)
+			multi, mo, rest, ok2 := parseMACTable(rest)
+			if ok = ok1 && ok2 && len(rest) == 0; ok {
+				d.filter.uni, d.filter.uniOverflow = uni, uo
+				d.filter.multi, d.filter.multiOverflow = multi, mo
+			}
+		case cmd == ctrlMACAddrSet && f.Has(FeatureCtrlMACAddr):
+			if ok = len(b) == 6; ok {
+				d.addr = append(d.addr[:0], b...)
+			}
+		}
+	case ctrlVLAN:
+		if !f.Has(FeatureCtrlVLAN) || len(b) != 2 {
+			break
+		}
+		vid := binary.LittleEndian.Uint16(b)
+		if vid >= 4096 {
+			break
+		}
+		switch cmd {
+		case ctrlVLANAdd:
+			d.filter.vlans[vid/64] |= 1 << (vid % 64)
+			ok = true
+		case ctrlVLANDel:
+			d.filter.vlans[vid/64] &^= 1 << (vid % 64)
+			ok = true
+		}
+	case ctrlAnnounce:
+		if ok = cmd == ctrlAnnounceAck && f.Has(FeatureGuestAnnounce); ok {
+			d.announce = false
+		}
+	case ctrlMQ:
+		ok = d.mq(cmd, b)
+	}
+	if !ok {
+		return ctrlErr
+	}
+
+	return ctrlOK
+}
+
+// rxMode sets the rx mode cmd to the boolean b. d.mu must be held.
+func (d *Device) rxMode(cmd uint8, b []byte) bool {
+	if len(b) != 1 {
+		return false
+	}
+	if !d.features.Has(FeatureCtrlRx) || cmd > ctrlRxAllMulti && !d.features.Has(FeatureCtrlRxExtra) {
+		return false
+	}
+
+	on := b[0] != 0
+	switch cmd {
+	case ctrlRxPromisc:
+		d.filter.promisc = on
+	case ctrlRxAllMulti:
+		d.filter.allMulti = on
+	case ctrlRxAllUni:
+		d.filter.allUni = on
+	case ctrlRxNoMulti:
+		d.filter.noMulti = on
+	case ctrlRxNoUni:
+		d.filter.noUni = on
+	case ctrlRxNoBcast:
+		d.filter.noBcast = on
+	default:
+		return false
+	}
+
+	return true
+}
+
+// mq runs the multiqueue command cmd. d.mu must be held.
+func (d *Device) mq(cmd uint8, b []byte) bool {
+	switch {
+	case cmd == ctrlMQPairsSet && d.features.Has(FeatureMQ):
+		if len(b) != 2 {
+			return false
+		}
+		n := int(binary.LittleEndian.Uint16(b))
+		if !d.pairsEnabled(n) {
+			return false
+		}
+		// setting the queue pairs turns receive side scaling off.
+		d.pairs, d.flows = n, nil
+		d.rss.enabled, d.rss.table = false, nil
+
+		return true
+	case cmd == ctrlMQRSSConfig && d.features.Has(FeatureRSS):
+		r, ok := parseRSS(b, true)
+		if !ok {
+			return false
+		}
+		for _, k := range append(r.table, r.unclassified) {
+			if !d.pairsEnabled(int(k) + 1) {
+				return false
+			}
+		}
+		// max_tx_vq follows the indirection table.
+		n := int(binary.LittleEndian.Uint16(b[8+2*len(r.table):]))
+		if !d.pairsEnabled(n) {
+			return false
+		}
+		d.rss, d.pairs, d.flows = r, n, nil
+
+		return true
+	case cmd == ctrlMQHashConfig && d.features.Has(FeatureHashReport):
+		r, ok := parseRSS(b, false)
+		if ok {
+			d.rss = r
+		}
+
+		return ok
+	}
+
+	return false
+}
+
+// pairsEnabled reports whether the first n queue pairs are enabled. d.mu must
+// be held.
+func (d *Device) pairsEnabled(n int) bool {
+	if n < 1 || n > len(d.rxs) {
+		return false
+	}
+	for _, r := range d.rxs[:n] {
+		if r == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Announce asks the driver to announce the device on the network, after a
+// migration for example, if it negotiated FeatureGuestAnnounce.
+func (d *Device) Announce() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.irq == nil || !d.features.Has(FeatureGuestAnnounce) {
+		return
+	}
+	d.announce = true
+	d.irq.InterruptConfig()
+}
@@ -0,0 +1,276 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netdev
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/go-hypervisor/virtio/driver"
+)
+
+var (
+	other     = net.HardwareAddr{0x52, 0x54, 0x00, 0xab, 0xcd, 0xef}
+	multicast = net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0x01}
+	broadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+)
+
+// command sends the command cmd of class with data, and returns its ack.
+func (g *guest) command(class, cmd uint8, data ...[]byte) uint8 {
+	g.t.Helper()
+
+	ack := []byte{0xff}
+	r := &driver.Request{Out: append([][]byte{{class, cmd}}, data...), In: [][]byte{ack}}
+	if err := g.ctrl.Do(g.ctx, r); err != nil {
+		g.t.Fatal(err)
+	}
+
+	return ack[0]
+}
+
+// mustCommand sends a command expected to succeed.
+func (g *guest) mustCommand(class, cmd uint8, data ...[]byte) {
+	g.t.Helper()
+
+	if ack := g.command(class, cmd, data...); ack != ctrlOK {
+		g.t.Fatalf("command %d.%d: ack %d", class, cmd, ack)
+	}
+}
+
+// expect checks that the frames sent by the host with the marker of accept
+// reach the driver, and the others not.
+func (g *guest) expect(frames [][]byte, accept []bool) {
+	g.t.Helper()
+
+	for i, eth := range frames {
+		f := append(make([]byte, HeaderSize), eth...)
+		f[len(f)-1] = byte(i)
+		g.host.Write(f)
+	}
+	// a broadcast frame marks the end of the frames.
+	end := append(make([]byte, HeaderSize), ipFrame(broadcast, "10.0.0.1", "10.0.0.2", protoUDP, 1, 2)...)
+	end[len(end)-1] = 0xff
+	g.host.Write(end)
+
+	var got []byte
+	for {
+		f := g.wait(g.post(1, 256)[0])
+		if f[len(f)-1] == 0xff {
+			break
+		}
+		got = append(got, f[len(f)-1])
+	}
+	var want []byte
+	for i, ok := range accept {
+		if ok {
+			want = append(want, byte(i))
+		}
+	}
+	if !bytes.Equal(got, want) {
+		g.t.Fatalf("received frames %v, want %v", got, want)
+	}
+}
+
+func addrFrame(dst net.HardwareAddr) []byte {
+	return ipFrame(dst, "10.0.0.1", "10.0.0.2", protoUDP, 1, 2)
+}
+
+func TestRxMode(t *testing.T) {
+	g, _ := newGuest(t, FeatureMAC|FeatureCtrlVQ|FeatureCtrlRx|FeatureCtrlRxExtra)
+	frames := [][]byte{addrFrame(mac), addrFrame(other), addrFrame(multicast), addrFrame(broadcast)}
+
+	// the device is promiscuous until the driver sets the rx mode.
+	g.expect(frames, []bool{true, true, true, true})
+
+	g.mustCommand(ctrlRx, ctrlRxPromisc, []byte{0})
+	g.expect(frames, []bool{true, false, false, true})
+
+	g.mustCommand(ctrlRx, ctrlRxAllMulti, []byte{1})
+	g.mustCommand(ctrlRx, ctrlRxAllUni, []byte{1})
+	g.expect(frames, []bool{true, true, true, true})
+
+	g.mustCommand(ctrlRx, ctrlRxAllMulti, []byte{0})
+	g.mustCommand(ctrlRx, ctrlRxAllUni, []byte{0})
+	uni := append(appendLE32(nil, 1), other...)
+	multi := append(appendLE32(nil, 1), multicast...)
+	g.mustCommand(ctrlMAC, ctrlMACTableSet, uni, multi)
+	g.expect(frames, []bool{true, true, true, true})
+
+	g.mustCommand(ctrlRx, ctrlRxNoUni, []byte{1})
+	g.mustCommand(ctrlRx, ctrlRxNoMulti, []byte{1})
+	g.expect(frames, []bool{false, false, false, true})
+
+	// nobcast also drops the broadcast marker of expect, so check it last
+	// with the unicast frames back.
+	g.mustCommand(ctrlRx, ctrlRxNoUni, []byte{0})
+	g.mustCommand(ctrlRx, ctrlRxNoBcast, []byte{1})
+	g.host.Write(append(make([]byte, HeaderSize), addrFrame(broadcast)...))
+	g.host.Write(append(make([]byte, HeaderSize), addrFrame(mac)...))
+	if f := g.wait(g.post(1, 256)[0]); !bytes.Equal(f[HeaderSize:HeaderSize+6], mac) {
+		t.Fatalf("received frame to %v", net.HardwareAddr(f[HeaderSize:HeaderSize+6]))
+	}
+
+	for _, c := range []struct {
+		class, cmd uint8
+		data       []byte
+	}{
+		{ctrlRx, 6, []byte{1}},                 // unknown mode
+		{ctrlRx, ctrlRxPromisc, []byte{1, 1}},  // long data
+		{ctrlMAC, ctrlMACAddrSet, other},       // without FeatureCtrlMACAddr
+		{ctrlMAC, ctrlMACTableSet, uni},        // no multicast table
+		{ctrlVLAN, ctrlVLANAdd, []byte{1, 0}},  // without FeatureCtrlVLAN
+		{ctrlAnnounce, ctrlAnnounceAck, nil},   // without FeatureGuestAnnounce
+		{ctrlMQ, ctrlMQPairsSet, []byte{1, 0}}, // without FeatureMQ
+	} {
+		if ack := g.command(c.class, c.cmd, c.data); ack != ctrlErr {
+			t.Errorf("command %d.%d: ack %d", c.class, c.cmd, ack)
+		}
+	}
+
+	// a command too large for the device fails, a smaller one overflows
+	// the table.
+	huge := append(appendLE32(nil, 2*maxControlMACs+1), make([]byte, 6*(2*maxControlMACs+1))...)
+	if ack := g.command(ctrlMAC, ctrlMACTableSet, huge, multi); ack != ctrlErr {
+		t.Errorf("command of %d bytes: ack %d", 2+len(huge)+len(multi), ack)
+	}
+	large := append(appendLE32(nil, maxControlMACs), make([]byte, 6*maxControlMACs)...)
+	g.mustCommand(ctrlMAC, ctrlMACTableSet, large, multi)
+}
+
+func TestMACAddr(t *testing.T) {
+	g, _ := newGuest(t, FeatureMAC|FeatureCtrlVQ|FeatureCtrlRx|FeatureCtrlMACAddr)
+
+	g.mustCommand(ctrlMAC, ctrlMACAddrSet, other)
+	b := make([]byte, 6)
+	g.l.ReadConfig(0, b)
+	if !bytes.Equal(b, other) {
+		t.Fatalf("config address %v", net.HardwareAddr(b))
+	}
+	g.mustCommand(ctrlRx, ctrlRxPromisc, []byte{0})
+	g.expect([][]byte{addrFrame(mac), addrFrame(other)}, []bool{false, true})
+}
+
+func TestVLAN(t *testing.T) {
+	g, _ := newGuest(t, FeatureCtrlVQ|FeatureCtrlRx|FeatureCtrlVLAN)
+	tagged := func(vid uint16) []byte {
+		eth := addrFrame(mac)
+		tag := appendBE16(appendBE16(nil, etherTypeVLAN), vid)
+		return append(append(append([]byte(nil), eth[:12]...), tag...), eth[12:]...)
+	}
+	frames := [][]byte{addrFrame(mac), tagged(10), tagged(20)}
+
+	g.mustCommand(ctrlRx, ctrlRxPromisc, []byte{0})
+	g.expect(frames, []bool{true, false, false})
+
+	g.mustCommand(ctrlVLAN, ctrlVLANAdd, appendLE16(nil, 10))
+	g.mustCommand(ctrlVLAN, ctrlVLANAdd, appendLE16(nil, 20))
+	g.mustCommand(ctrlVLAN, ctrlVLANDel, appendLE16(nil, 20))
+	g.expect(frames, []bool{true, true, false})
+
+	if ack := g.command(ctrlVLAN, ctrlVLANAdd, appendLE16(nil, 4096)); ack != ctrlErr {
+		t.Fatalf("VLAN 4096: ack %d", ack)
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	g, dev := newGuest(t, FeatureStatus|FeatureCtrlVQ|FeatureGuestAnnounce)
+	configs := make(chan struct{}, 1)
+	g.l.Config = func() {
+		select {
+		case configs <- struct{}{}:
+		default:
+		}
+	}
+
+	dev.Announce()
+	select {
+	case <-configs:
+	case <-g.ctx.Done():
+		t.Fatal("no configuration change interrupt")
+	}
+	b := make([]byte, 2)
+	g.l.ReadConfig(6, b)
+	if s := binary.LittleEndian.Uint16(b); s != StatusLinkUp|StatusAnnounce {
+		t.Fatalf("status %#x", s)
+	}
+
+	g.mustCommand(ctrlAnnounce, ctrlAnnounceAck)
+	g.l.ReadConfig(6, b)
+	if s := binary.LittleEndian.Uint16(b); s != StatusLinkUp {
+		t.Fatalf("status %#x after the ack", s)
+	}
+}
+
+// rssConfig returns struct virtio_net_rss_config sending all the frames to
+// the queue pair k.
+func rssConfig(types uint32, k uint16, pairs uint16) []byte {
+	b := appendLE32(nil, types)
+	b = appendLE16(b, 1) // indirection_table_mask
+	b = appendLE16(b, 0) // unclassified_queue
+	b = appendLE16(appendLE16(b, k), k)
+	b = appendLE16(b, pairs)
+
+	return append(append(b, byte(len(rssKey))), rssKey...)
+}
+
+func TestMultiqueue(t *testing.T) {
+	g, _ := newGuestPairs(t, FeatureCtrlVQ|FeatureMQ|FeatureRSS|FeatureHashReport, 2)
+	v := rssTests[0]
+	eth := ipFrame(mac, v.src, v.dst, protoTCP, v.sport, v.dport)
+	f := append(make([]byte, HeaderSize), eth...)
+
+	b := make([]byte, 2)
+	g.l.ReadConfig(8, b)
+	if n := binary.LittleEndian.Uint16(b); n != 2 {
+		t.Fatalf("max_virtqueue_pairs %d", n)
+	}
+	if ack := g.command(ctrlMQ, ctrlMQPairsSet, appendLE16(nil, 3)); ack != ctrlErr {
+		t.Fatalf("3 pairs: ack %d", ack)
+	}
+	g.mustCommand(ctrlMQ, ctrlMQPairsSet, appendLE16(nil, 2))
+
+	// automatic steering follows the queue pair of the flow sent last.
+	reply := ipFrame(other, v.dst, v.src, protoTCP, v.dport, v.sport)
+	tx := append(make([]byte, HashHeaderSize), reply...)
+	if err := g.txs[1].Do(g.ctx, &driver.Request{Out: [][]byte{tx}}); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, maxFrameSize)
+	if n, _ := g.host.Read(got); !bytes.Equal(got[:n], append(make([]byte, HeaderSize), reply...)) {
+		t.Fatalf("host read % x", got[:n])
+	}
+	g.host.Write(f)
+	r := g.wait(g.postTo(g.rxs[1], 1, 256)[0])
+	if !bytes.Equal(r[HashHeaderSize:], eth) {
+		t.Fatalf("received % x", r)
+	}
+	le := binary.LittleEndian
+	if report := le.Uint16(r[HeaderSize+4:]); report != HashReportNone {
+		t.Fatalf("hash report %d without hash types", report)
+	}
+
+	// receive side scaling sends the flow to the queue pair of its hash.
+	g.mustCommand(ctrlMQ, ctrlMQRSSConfig, rssConfig(HashTypeTCPv4, 0, 2))
+	g.host.Write(f)
+	r = g.wait(g.postTo(g.rxs[0], 1, 256)[0])
+	if h, report := le.Uint32(r[HeaderSize:]), le.Uint16(r[HeaderSize+4:]); h != v.tcp || report != HashReportTCPv4 {
+		t.Fatalf("hash %#08x report %d", h, report)
+	}
+
+	// frames without a hash go to the unclassified queue, here 1.
+	cfg := rssConfig(HashTypeIPv6, 0, 2)
+	binary.LittleEndian.PutUint16(cfg[6:], 1)
+	g.mustCommand(ctrlMQ, ctrlMQRSSConfig, cfg)
+	g.host.Write(f)
+	r = g.wait(g.postTo(g.rxs[1], 1, 256)[0])
+	if report := le.Uint16(r[HeaderSize+4:]); report != HashReportNone {
+		t.Fatalf("hash report %d", report)
+	}
+
+	if ack := g.command(ctrlMQ, ctrlMQRSSConfig, rssConfig(HashTypeTCPv4, 2, 2)); ack != ctrlErr {
+		t.Fatalf("steering to queue pair 2: ack %d", ack)
+	}
+}
@@ -0,0 +1,560 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netdev
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// list of queue indices of the first queue pair. The queues of the pair k are
+// at 2k and 2k+1, followed by the control queue, which is at 2 without
+// FeatureMQ.
+const (
+	rxQueue = iota
+	txQueue
+)
+
+const (
+	// queueSize is the maximum size of the queues.
+	queueSize = 256
+
+	// maxQueuePairs is the largest number of queue pairs.
+	maxQueuePairs = 0x8000
+
+	// rxBacklog is the number of frames steered to an rx queue waiting for
+	// its chains.
+	rxBacklog = 16
+
+	// maxFrameSize is the largest frame read from a backend or the driver:
+	// a 64 KiB segmentation offload frame with its Ethernet and VLAN
+	// headers. The driver may add the hash fields of its header.
+	maxFrameSize = HeaderSize + 18 + 65535
+)
+
+// list of status bits of the configuration space.
+const (
+	StatusLinkUp   = 1 << 0 // VIRTIO_NET_S_LINK_UP
+	StatusAnnounce = 1 << 1 // VIRTIO_NET_S_ANNOUNCE
+)
+
+var (
+	// ErrNoBackend is returned by Activate for a device without backend.
+	ErrNoBackend = errors.New("netdev: no backend")
+
+	// ErrQueues is returned by Activate when the driver did not enable the
+	// rx and tx queues.
+	ErrQueues = errors.New("netdev: rx and tx queues are required")
+)
+
+func init() {
+	virtio.Register(virtio.DeviceNet, func() virtio.Device { return &Device{} })
+}
+
+// Device is a virtio-net device. Its fields are set before the device is
+// activated.
+//
+// The frames of the backend are read from the first activation until Close.
+// Frames read while the device is reset wait for the next activation.
+//
+// With several queue pairs, the frames of the backend go to the rx queue
+// picked by receive side scaling once the driver configures it, and otherwise
+// to the rx queue paired with the tx queue that last sent a frame of their
+// flow.
+type Device struct {
+	// Backend moves the frames to and from the host network.
+	Backend Backend
+
+	// MAC is the address of the device, offered with FeatureMAC if set.
+	// Otherwise the driver picks an address.
+	MAC net.HardwareAddr
+
+	// MTU is the maximum MTU the driver should use, offered with FeatureMTU
+	// if set.
+	MTU uint16
+
+	// QueuePairs is the maximum number of queue pairs, offered with
+	// FeatureMQ if more than 1. Zero means 1.
+	QueuePairs int
+
+	mu         sync.Mutex
+	features   virtio.Features
+	offloadErr error
+	linkDown   bool
+	announce   bool
+	addr       net.HardwareAddr
+	irq        virtio.Interrupter
+	done       chan struct{}
+	wg         sync.WaitGroup
+
+	// state of the queue pairs and of the control queue since activation.
+	rxs    []*rx
+	pairs  int
+	filter filter
+	rss    rss
+	flows  map[flowKey]int
+
+	readOnce sync.Once
+	frames   chan []byte
+	closed   chan struct{}
+	readDone chan struct{}
+}
+
+var _ virtio.Device = (*Device)(nil)
+
+// DeviceID implements virtio.Device.DeviceID.
+func (d *Device) DeviceID() virtio.DeviceID {
+	return virtio.DeviceNet
+}
+
+// Features implements virtio.Device.Features.
+func (d *Device) Features() virtio.Features {
+	f := FeatureMergeRxBuffer | FeatureStatus | ctrlFeatures |
+		virtio.FeatureIndirectDesc | virtio.FeatureEventIdx | virtio.FeatureRingPacked
+	if len(d.MAC) == 6 {
+		f |= FeatureMAC
+	}
+	if d.MTU != 0 {
+		f |= FeatureMTU
+	}
+	if d.maxPairs() > 1 {
+		f |= FeatureMQ
+	}
+	if _, ok := d.Backend.(Offloader); ok {
+		f |= offloadFeatures
+	}
+
+	return f
+}
+
+// AckFeatures implements virtio.Device.AckFeatures. The offloads are passed
+// to the backend.
+func (d *Device) AckFeatures(f virtio.Features) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.features, d.offloadErr = f, nil
+	if o, ok := d.Backend.(Offloader); ok {
+		d.offloadErr = o.SetOffload(f & offloadFeatures)
+	}
+}
+
+// maxPairs returns the maximum number of queue pairs.
+func (d *Device) maxPairs() int {
+	switch {
+	case d.QueuePairs < 1:
+		return 1
+	case d.QueuePairs > maxQueuePairs:
+		return maxQueuePairs
+	}
+
+	return d.QueuePairs
+}
+
+// QueueMaxSizes implements virtio.Device.QueueMaxSizes: the queue pairs and
+// the control queue.
+func (d *Device) QueueMaxSizes() []uint16 {
+	sizes := make([]uint16, 2*d.maxPairs()+1)
+	for i := range sizes {
+		sizes[i] = queueSize
+	}
+
+	return sizes
+}
+
+// config returns the configuration space. d.mu must be held.
+func (d *Device) config() []byte {
+	var b [24]byte
+	le := binary.LittleEndian
+	copy(b[0:6], d.MAC)
+	if d.addr != nil {
+		copy(b[0:6], d.addr)
+	}
+	var status uint16
+	if !d.linkDown {
+		status |= StatusLinkUp
+	}
+	if d.announce {
+		status |= StatusAnnounce
+	}
+	le.PutUint16(b[6:], status)
+	le.PutUint16(b[8:], uint16(d.maxPairs()))
+	le.PutUint16(b[10:], d.MTU)
+	// speed and duplex at 12 and 16 are left unknown.
+	b[17] = rssMaxKeySize
+	le.PutUint16(b[18:], rssMaxTableLen)
+	le.PutUint32(b[20:], supportedHashTypes)
+
+	return b[:]
+}
+
+// ReadConfig implements virtio.Device.ReadConfig.
+func (d *Device) ReadConfig(off uint64, p []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	config := d.config()
+	for i := range p {
+		p[i] = 0
+	}
+	if off < uint64(len(config)) {
+		copy(p, config[off:])
+	}
+}
+
+// WriteConfig implements virtio.Device.WriteConfig. The configuration space is
+// read-only.
+func (d *Device) WriteConfig(off uint64, p []byte) {}
+
+// SetLink sets the link status, notifying the driver of a change.
+func (d *Device) SetLink(up bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.linkDown == !up {
+		return
+	}
+	d.linkDown = !up
+	if d.irq != nil {
+		d.irq.InterruptConfig()
+	}
+}
+
+// Activate implements virtio.Device.Activate.
+func (d *Device) Activate(mem virtio.GuestMemory, queues []*virtio.Queue, irq virtio.Interrupter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case d.Backend == nil:
+		return ErrNoBackend
+	case d.offloadErr != nil:
+		return fmt.Errorf("netdev: offload: %w", d.offloadErr)
+	case queues[rxQueue] == nil || queues[txQueue] == nil:
+		return ErrQueues
+	}
+	pairs, ctrl := 1, 2
+	if d.features.Has(FeatureMQ) {
+		pairs = d.maxPairs()
+		ctrl = 2 * pairs
+	}
+	d.readOnce.Do(func() {
+		d.frames = make(chan []byte)
+		d.closed = make(chan struct{})
+		d.readDone = make(chan struct{})
+		go d.read(d.frames, d.closed, d.readDone)
+	})
+
+	d.irq = irq
+	d.done = make(chan struct{})
+	d.pairs, d.rss, d.flows = 1, rss{}, nil
+	d.filter = newFilter(d.features.Has(FeatureCtrlVLAN))
+	hdrLen := HeaderSize
+	if d.features.Has(FeatureHashReport) {
+		hdrLen = HashHeaderSize
+	}
+
+	// a pair is usable only if the driver enabled both of its queues.
+	d.rxs = make([]*rx, pairs)
+	for k := range d.rxs {
+		rq, tq := queues[2*k], queues[2*k+1]
+		if rq == nil || tq == nil {
+			continue
+		}
+		d.rxs[k] = &rx{
+			q:         rq,
+			irq:       irq,
+			mergeable: d.features.Has(FeatureMergeRxBuffer),
+			frames:    make(chan []byte, rxBacklog),
+		}
+		d.wg.Add(2)
+		go d.receive(d.rxs[k], d.done)
+		go d.transmit(tq, k, hdrLen, irq, d.done)
+	}
+	d.wg.Add(1)
+	go d.dispatch(d.rxs, hdrLen, d.done)
+	if d.features.Has(FeatureCtrlVQ) && queues[ctrl] != nil {
+		d.wg.Add(1)
+		go d.control(queues[ctrl], irq, d.done)
+	}
+
+	return nil
+}
+
+// Reset implements virtio.Device.Reset.
+func (d *Device) Reset() {
+	d.mu.Lock()
+	done := d.done
+	d.irq, d.done = nil, nil
+	d.features, d.offloadErr = 0, nil
+	d.announce, d.addr = false, nil
+	d.rxs = nil
+	d.mu.Unlock()
+
+	if done != nil {
+		close(done)
+		d.wg.Wait()
+	}
+}
+
+// Close resets the device and closes its backend.
+func (d *Device) Close() error {
+	d.Reset()
+	if d.Backend == nil {
+		return nil
+	}
+	err := d.Backend.Close()
+
+	d.mu.Lock()
+	closed, readDone := d.closed, d.readDone
+	d.closed, d.readDone = nil, nil
+	d.mu.Unlock()
+	if closed != nil {
+		close(closed)
+		<-readDone
+	}
+
+	return err
+}
+
+// read sends the frames of the backend to frames until it is closed.
+func (d *Device) read(frames chan<- []byte, closed <-chan struct{}, readDone chan<- struct{}) {
+	defer close(readDone)
+
+	b := make([]byte, maxFrameSize)
+	for {
+		n, err := d.Backend.Read(b)
+		if err != nil {
+			return
+		}
+		if n < HeaderSize {
+			continue
+		}
+
+		select {
+		case frames <- append([]byte(nil), b[:n]...):
+		case <-closed:
+			return
+		}
+	}
+}
+
+// dispatch steers the frames of the backend accepted by the filter to the rx
+// queues rxs until done is closed. The frames get the header of hdrLen bytes
+// of the driver.
+func (d *Device) dispatch(rxs []*rx, hdrLen int, done <-chan struct{}) {
+	defer d.wg.Done()
+
+	for {
+		var f []byte
+		select {
+		case <-done:
+			return
+		case f = <-d.frames:
+		}
+
+		d.mu.Lock()
+		f, k, ok := d.steer(f, hdrLen)
+		d.mu.Unlock()
+		if !ok {
+			continue
+		}
+		if k >= len(rxs) || rxs[k] == nil {
+			k = 0
+		}
+		select {
+		case <-done:
+			return
+		case rxs[k].frames <- f:
+		}
+	}
+}
+
+// steer filters the frame f of the backend, and returns it with a header of
+// hdrLen bytes and the queue pair receiving it. d.mu must be held.
+func (d *Device) steer(f []byte, hdrLen int) ([]byte, int, bool) {
+	eth := f[HeaderSize:]
+	mac := []byte(d.MAC)
+	if d.addr != nil {
+		mac = d.addr
+	}
+	if !d.filter.accept(eth, mac) {
+		return nil, 0, false
+	}
+
+	fl, ok := parseFlow(eth)
+	var hash uint32
+	var report uint16
+	if ok && d.rss.hashTypes != 0 {
+		hash, report = fl.hash(d.rss.key, d.rss.hashTypes)
+	}
+	k := 0
+	switch {
+	case d.rss.enabled && report != HashReportNone:
+		k = int(d.rss.table[hash&uint32(len(d.rss.table)-1)])
+	case d.rss.enabled:
+		k = int(d.rss.unclassified)
+	case ok && d.pairs > 1:
+		k = d.flows[fl.key()]
+	}
+
+	if hdrLen == HashHeaderSize {
+		g := make([]byte, HashHeaderSize+len(eth))
+		copy(g, f[:HeaderSize])
+		binary.LittleEndian.PutUint32(g[HeaderSize:], hash)
+		binary.LittleEndian.PutUint16(g[HeaderSize+4:], report)
+		copy(g[HashHeaderSize:], eth)
+		f = g
+	}
+
+	return f, k, true
+}
+
+// learn remembers that the flow of the Ethernet frame eth was sent by the
+// queue pair k, for automatic receive steering. d.mu must be held.
+func (d *Device) learn(eth []byte, k int) {
+	if d.pairs <= 1 || d.rss.enabled {
+		return
+	}
+	fl, ok := parseFlow(eth)
+	if !ok {
+		return
+	}
+	if d.flows == nil || len(d.flows) >= maxFlows {
+		d.flows = make(map[flowKey]int)
+	}
+	d.flows[fl.key()] = k
+}
+
+// receive writes the frames steered to the rx queue of r until done is
+// closed.
+func (d *Device) receive(r *rx, done <-chan struct{}) {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case <-done:
+			return
+		case f := <-r.frames:
+			if err := r.deliver(f, done); err != nil {
+				<-done
+				return
+			}
+		}
+	}
+}
+
+// transmit writes the frames of the tx queue q of the pair k to the backend
+// until done is closed. The frames have the header of hdrLen bytes of the
+// driver. They are read into buf, and those larger dropped, like those the
+// backend fails to write.
+func (d *Device) transmit(q *virtio.Queue, k, hdrLen int, irq virtio.Interrupter, done <-chan struct{}) {
+	defer d.wg.Done()
+
+	buf := make([]byte, maxFrameSize-HeaderSize+hdrLen)
+	q.Serve(irq, done, func(c *virtio.DescriptorChain) bool {
+		if n := c.ReadableLen(); n >= uint64(hdrLen) && n <= uint64(len(buf)) {
+			f := buf[:n]
+			if _, err := io.ReadFull(c, f); err == nil {
+				// the backend takes the header without the hash fields.
+				f = append(f[:HeaderSize], f[hdrLen:]...)
+				d.mu.Lock()
+				d.learn(f[HeaderSize:], k)
+				d.mu.Unlock()
+				_, _ = d.Backend.Write(f)
+			}
+		}
+
+		return true
+	})
+}
+
+// rx is the state of an rx queue: the chains popped for the frames to come.
+type rx struct {
+	q         *virtio.Queue
+	irq       virtio.Interrupter
+	mergeable bool
+	frames    chan []byte
+	chains    []*virtio.DescriptorChain
+}
+
+// deliver writes the frame f to the chains of the queue, waiting for chains
+// until done is closed. With mergeable buffers the frame spans as many chains
+// as needed, otherwise a frame larger than the next chain is dropped.
+func (r *rx) deliver(f []byte, done <-chan struct{}) error {
+	n := 0
+	for need := uint64(len(f)); ; {
+		if !r.mergeable && len(r.chains) > 0 {
+			if r.chains[0].WritableLen() < need {
+				return nil
+			}
+			n = 1
+			break
+		}
+		var room uint64
+		for n = 0; n < len(r.chains) && room < need; n++ {
+			room += r.chains[n].WritableLen()
+		}
+		if r.mergeable && room >= need {
+			break
+		}
+		if ok, err := r.pop(done); err != nil || !ok {
+			return err
+		}
+	}
+
+	h, _ := DecodeHeader(f)
+	h.NumBuffers = uint16(n)
+	h.Encode(f)
+	for _, c := range r.chains[:n] {
+		m := uint64(len(f))
+		if w := c.WritableLen(); m > w {
+			m = w
+		}
+		c.Write(f[:m])
+		f = f[m:]
+		if err := r.q.PushChain(c); err != nil {
+			return err
+		}
+	}
+	r.chains = r.chains[n:]
+	if r.q.NeedsNotification() {
+		r.irq.InterruptQueue(r.q.Index())
+	}
+
+	return nil
+}
+
+// pop pops a chain of the queue, waiting for one until done is closed. It
+// reports whether it got one.
+func (r *rx) pop(done <-chan struct{}) (bool, error) {
+	for {
+		c, ok, err := r.q.PopChain()
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			r.q.EnableNotifications()
+			if c, ok, err = r.q.PopChain(); err != nil {
+				return false, err
+			}
+		}
+		if ok {
+			r.chains = append(r.chains, c)
+			return true, nil
+		}
+
+		select {
+		case <-done:
+			return false, nil
+		case <-r.q.Notified():
+		}
+	}
+}
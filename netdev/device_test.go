@@ -0,0 +1,230 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netdev
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/go-hypervisor/virtio"
+	"github.com/go-hypervisor/virtio/driver"
+	"github.com/go-hypervisor/virtio/driver/drivertest"
+)
+
+var mac = net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+
+// guest is the driver side of a device over a loopback, with host the other
+// end of the pipe of the device. rx and tx are the queues of the first pair.
+type guest struct {
+	t        *testing.T
+	ctx      context.Context
+	l        *driver.Loopback
+	rx, tx   *driver.Queue
+	rxs, txs []*driver.Queue
+	ctrl     *driver.Queue
+	host     *Pipe
+}
+
+func newGuest(t *testing.T, features virtio.Features) (*guest, *Device) {
+	t.Helper()
+
+	return newGuestPairs(t, features, 1)
+}
+
+// newGuestPairs returns a guest of a device with the given queue pairs,
+// all of them enabled with FeatureMQ. The control queue is enabled with
+// FeatureCtrlVQ.
+func newGuestPairs(t *testing.T, features virtio.Features, pairs int) (*guest, *Device) {
+	t.Helper()
+
+	backend, host := NewPipe(16)
+	dev := &Device{Backend: backend, MAC: mac, MTU: 1500, QueuePairs: pairs}
+	t.Cleanup(func() { dev.Close() })
+
+	n, ctrl := 1, 2
+	if features.Has(FeatureMQ) {
+		n, ctrl = pairs, 2*pairs
+	}
+	queues := drivertest.Range(2 * n)
+	if features.Has(FeatureCtrlVQ) {
+		queues = append(queues, ctrl)
+	}
+	dg := drivertest.New(t, dev, drivertest.Config{Features: features, Queues: queues})
+
+	g := &guest{t: t, ctx: dg.Ctx, l: dg.Loopback, host: host}
+	for k := 0; k < n; k++ {
+		g.rxs, g.txs = append(g.rxs, dg.Queues[2*k]), append(g.txs, dg.Queues[2*k+1])
+	}
+	g.rx, g.tx = g.rxs[0], g.txs[0]
+	if features.Has(FeatureCtrlVQ) {
+		g.ctrl = dg.Queues[ctrl]
+	}
+
+	return g, dev
+}
+
+// post makes n rx buffers of size bytes available.
+func (g *guest) post(n, size int) []*driver.Request {
+	g.t.Helper()
+
+	return g.postTo(g.rx, n, size)
+}
+
+// postTo makes n buffers of size bytes available to the rx queue q.
+func (g *guest) postTo(q *driver.Queue, n, size int) []*driver.Request {
+	g.t.Helper()
+
+	var reqs []*driver.Request
+	for i := 0; i < n; i++ {
+		r := &driver.Request{In: [][]byte{make([]byte, size)}}
+		if err := q.Submit(r); err != nil {
+			g.t.Fatal(err)
+		}
+		reqs = append(reqs, r)
+	}
+
+	return reqs
+}
+
+func (g *guest) wait(r *driver.Request) []byte {
+	g.t.Helper()
+
+	if err := r.Wait(g.ctx); err != nil {
+		g.t.Fatal(err)
+	}
+
+	return r.In[0][:r.Written]
+}
+
+// frame returns a frame of n bytes with the header h.
+func frame(h Header, n int) []byte {
+	f := make([]byte, HeaderSize+n)
+	h.Encode(f)
+	for i := HeaderSize; i < len(f); i++ {
+		f[i] = byte(i)
+	}
+
+	return f
+}
+
+func TestTransmit(t *testing.T) {
+	g, _ := newGuest(t, 0)
+
+	for i := 0; i < 20; i++ {
+		f := frame(Header{}, 60+i)
+		if err := g.tx.Do(g.ctx, &driver.Request{Out: [][]byte{f[:HeaderSize], f[HeaderSize:]}}); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, maxFrameSize)
+		n, err := g.host.Read(b)
+		if err != nil || !bytes.Equal(b[:n], f) {
+			t.Fatalf("host read %d bytes, %v", n, err)
+		}
+	}
+
+	// a frame larger than the device takes is dropped.
+	big := frame(Header{}, maxFrameSize)
+	if err := g.tx.Do(g.ctx, &driver.Request{Out: [][]byte{big}}); err != nil {
+		t.Fatal(err)
+	}
+	f := frame(Header{}, 60)
+	if err := g.tx.Do(g.ctx, &driver.Request{Out: [][]byte{f}}); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len(big))
+	if n, err := g.host.Read(b); err != nil || !bytes.Equal(b[:n], f) {
+		t.Fatalf("host read %d bytes after a large frame, %v", n, err)
+	}
+}
+
+func TestReceive(t *testing.T) {
+	for _, features := range []virtio.Features{0, virtio.FeatureEventIdx | virtio.FeatureRingPacked} {
+		t.Run(fmt.Sprint(features), func(t *testing.T) {
+			g, _ := newGuest(t, features)
+
+			// without mergeable buffers, a frame larger than the buffer is
+			// dropped.
+			reqs := g.post(2, HeaderSize+100)
+			big, small := frame(Header{}, 200), frame(Header{}, 100)
+			g.host.Write(big)
+			g.host.Write(small)
+			got := g.wait(reqs[0])
+			h, _ := DecodeHeader(got)
+			if h.NumBuffers != 1 || !bytes.Equal(got[HeaderSize:], small[HeaderSize:]) {
+				t.Fatalf("received %v with %d bytes", h, len(got))
+			}
+
+			// the buffer skipped by the dropped frame takes the next one.
+			g.host.Write(small)
+			if got := g.wait(reqs[1]); len(got) != len(small) {
+				t.Fatalf("received %d bytes", len(got))
+			}
+		})
+	}
+}
+
+func TestReceiveMergeable(t *testing.T) {
+	g, _ := newGuest(t, FeatureMergeRxBuffer)
+
+	f := frame(Header{Flags: FlagDataValid}, 1000)
+	g.host.Write(f)
+	reqs := g.post(4, 256)
+	var got []byte
+	for _, r := range reqs {
+		got = append(got, g.wait(r)...)
+	}
+	h, _ := DecodeHeader(got)
+	if h.NumBuffers != 4 || h.Flags != FlagDataValid || !bytes.Equal(got[HeaderSize:], f[HeaderSize:]) {
+		t.Fatalf("received %v with %d bytes", h, len(got))
+	}
+
+	// the next frame starts in a new buffer.
+	g.host.Write(frame(Header{}, 10))
+	if got := g.wait(g.post(1, 256)[0]); len(got) != HeaderSize+10 {
+		t.Fatalf("received %d bytes", len(got))
+	}
+}
+
+func TestConfig(t *testing.T) {
+	g, dev := newGuest(t, FeatureMAC|FeatureMTU|FeatureStatus|FeatureGuestCsum|FeatureGuestTSO4|FeatureHostTSO4)
+	configs := make(chan struct{}, 1)
+	g.l.Config = func() {
+		select {
+		case configs <- struct{}{}:
+		default:
+		}
+	}
+
+	if f := dev.Backend.(*Pipe).Offload(); f != FeatureGuestCsum|FeatureGuestTSO4|FeatureHostTSO4 {
+		t.Fatalf("backend offloads %v", f)
+	}
+	b := make([]byte, 12)
+	g.l.ReadConfig(0, b)
+	le := binary.LittleEndian
+	if !bytes.Equal(b[:6], mac) || le.Uint16(b[6:]) != StatusLinkUp || le.Uint16(b[8:]) != 1 || le.Uint16(b[10:]) != 1500 {
+		t.Fatalf("config % x", b)
+	}
+
+	dev.SetLink(false)
+	select {
+	case <-configs:
+	case <-g.ctx.Done():
+		t.Fatal("no configuration change interrupt")
+	}
+	g.l.ReadConfig(6, b[:2])
+	if s := le.Uint16(b); s != 0 {
+		t.Fatalf("status %#x with the link down", s)
+	}
+}
+
+func TestNoOffload(t *testing.T) {
+	dev := &Device{Backend: struct{ Backend }{}}
+	if f := dev.Features(); f&offloadFeatures != 0 || f.Has(FeatureMAC) || f.Has(FeatureMTU) {
+		t.Fatalf("features %v", f)
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package netdev implements the device side of virtio-net.
+//
+// A Device moves the Ethernet frames of the rx and tx queues to and from a
+// Backend: a TAP interface on Linux, or an in-memory Pipe for tests. Frames
+// cross the backend with their virtio_net_hdr_v1, so checksum and
+// segmentation offloads negotiated by the driver pass through to a backend
+// supporting them.
+//
+// The control queue filters the received frames by MAC address, rx mode and
+// VLAN, and spreads them over several queue pairs with receive side scaling:
+// the Toeplitz hash of their flow picks the rx queue in the indirection table
+// of the driver, and is reported in their header with FeatureHashReport.
+package netdev
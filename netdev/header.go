@@ -0,0 +1,111 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netdev
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// list of device feature bits.
+const (
+	FeatureCsum          virtio.Features = 1 << 0  // VIRTIO_NET_F_CSUM
+	FeatureGuestCsum     virtio.Features = 1 << 1  // VIRTIO_NET_F_GUEST_CSUM
+	FeatureMTU           virtio.Features = 1 << 3  // VIRTIO_NET_F_MTU
+	FeatureMAC           virtio.Features = 1 << 5  // VIRTIO_NET_F_MAC
+	FeatureGuestTSO4     virtio.Features = 1 << 7  // VIRTIO_NET_F_GUEST_TSO4
+	FeatureGuestTSO6     virtio.Features = 1 << 8  // VIRTIO_NET_F_GUEST_TSO6
+	FeatureGuestECN      virtio.Features = 1 << 9  // VIRTIO_NET_F_GUEST_ECN
+	FeatureHostTSO4      virtio.Features = 1 << 11 // VIRTIO_NET_F_HOST_TSO4
+	FeatureHostTSO6      virtio.Features = 1 << 12 // VIRTIO_NET_F_HOST_TSO6
+	FeatureHostECN       virtio.Features = 1 << 13 // VIRTIO_NET_F_HOST_ECN
+	FeatureMergeRxBuffer virtio.Features = 1 << 15 // VIRTIO_NET_F_MRG_RXBUF
+	FeatureStatus        virtio.Features = 1 << 16 // VIRTIO_NET_F_STATUS
+	FeatureCtrlVQ        virtio.Features = 1 << 17 // VIRTIO_NET_F_CTRL_VQ
+	FeatureCtrlRx        virtio.Features = 1 << 18 // VIRTIO_NET_F_CTRL_RX
+	FeatureCtrlVLAN      virtio.Features = 1 << 19 // VIRTIO_NET_F_CTRL_VLAN
+	FeatureCtrlRxExtra   virtio.Features = 1 << 20 // VIRTIO_NET_F_CTRL_RX_EXTRA
+	FeatureGuestAnnounce virtio.Features = 1 << 21 // VIRTIO_NET_F_GUEST_ANNOUNCE
+	FeatureMQ            virtio.Features = 1 << 22 // VIRTIO_NET_F_MQ
+	FeatureCtrlMACAddr   virtio.Features = 1 << 23 // VIRTIO_NET_F_CTRL_MAC_ADDR
+	FeatureHashReport    virtio.Features = 1 << 57 // VIRTIO_NET_F_HASH_REPORT
+	FeatureRSS           virtio.Features = 1 << 60 // VIRTIO_NET_F_RSS
+)
+
+// ctrlFeatures are the features of the control queue.
+const ctrlFeatures = FeatureCtrlVQ | FeatureCtrlRx | FeatureCtrlVLAN | FeatureCtrlRxExtra |
+	FeatureGuestAnnounce | FeatureCtrlMACAddr | FeatureHashReport | FeatureRSS
+
+// offloadFeatures are the offloads offered with a backend implementing
+// Offloader.
+const offloadFeatures = FeatureCsum | FeatureGuestCsum |
+	FeatureGuestTSO4 | FeatureGuestTSO6 | FeatureGuestECN |
+	FeatureHostTSO4 | FeatureHostTSO6 | FeatureHostECN
+
+// HeaderSize is the size of struct virtio_net_hdr_v1.
+const HeaderSize = 12
+
+// list of header flags.
+const (
+	FlagNeedsCsum = 1 << 0 // VIRTIO_NET_HDR_F_NEEDS_CSUM
+	FlagDataValid = 1 << 1 // VIRTIO_NET_HDR_F_DATA_VALID
+	FlagRSCInfo   = 1 << 2 // VIRTIO_NET_HDR_F_RSC_INFO
+)
+
+// list of GSO types.
+const (
+	GSONone  = 0    // VIRTIO_NET_HDR_GSO_NONE
+	GSOTCPv4 = 1    // VIRTIO_NET_HDR_GSO_TCPV4
+	GSOUDP   = 3    // VIRTIO_NET_HDR_GSO_UDP
+	GSOTCPv6 = 4    // VIRTIO_NET_HDR_GSO_TCPV6
+	GSOUDPL4 = 5    // VIRTIO_NET_HDR_GSO_UDP_L4
+	GSOECN   = 0x80 // VIRTIO_NET_HDR_GSO_ECN
+)
+
+// ErrShortHeader is returned when decoding fewer bytes than a header.
+var ErrShortHeader = errors.New("netdev: short header")
+
+// Header is struct virtio_net_hdr_v1, which precedes every frame.
+type Header struct {
+	Flags      uint8
+	GSOType    uint8
+	HdrLen     uint16
+	GSOSize    uint16
+	CsumStart  uint16
+	CsumOffset uint16
+	NumBuffers uint16
+}
+
+// Encode encodes h in the first HeaderSize bytes of b. It panics if b is
+// shorter.
+func (h *Header) Encode(b []byte) {
+	_ = b[HeaderSize-1]
+	le := binary.LittleEndian
+	b[0], b[1] = h.Flags, h.GSOType
+	le.PutUint16(b[2:], h.HdrLen)
+	le.PutUint16(b[4:], h.GSOSize)
+	le.PutUint16(b[6:], h.CsumStart)
+	le.PutUint16(b[8:], h.CsumOffset)
+	le.PutUint16(b[10:], h.NumBuffers)
+}
+
+// DecodeHeader decodes the header at the start of b.
+func DecodeHeader(b []byte) (Header, error) {
+	if len(b) < HeaderSize {
+		return Header{}, ErrShortHeader
+	}
+
+	le := binary.LittleEndian
+	return Header{
+		Flags:      b[0],
+		GSOType:    b[1],
+		HdrLen:     le.Uint16(b[2:]),
+		GSOSize:    le.Uint16(b[4:]),
+		CsumStart:  le.Uint16(b[6:]),
+		CsumOffset: le.Uint16(b[8:]),
+		NumBuffers: le.Uint16(b[10:]),
+	}, nil
+}
@@ -0,0 +1,234 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netdev
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// HashHeaderSize is the size of struct virtio_net_hdr_v1_hash, the header of
+// the frames of the guest once FeatureHashReport is negotiated.
+const HashHeaderSize = HeaderSize + 8
+
+// list of hash types, the bits of the supported and enabled hash types.
+const (
+	HashTypeIPv4  = 1 << 0 // VIRTIO_NET_RSS_HASH_TYPE_IPv4
+	HashTypeTCPv4 = 1 << 1 // VIRTIO_NET_RSS_HASH_TYPE_TCPv4
+	HashTypeUDPv4 = 1 << 2 // VIRTIO_NET_RSS_HASH_TYPE_UDPv4
+	HashTypeIPv6  = 1 << 3 // VIRTIO_NET_RSS_HASH_TYPE_IPv6
+	HashTypeTCPv6 = 1 << 4 // VIRTIO_NET_RSS_HASH_TYPE_TCPv6
+	HashTypeUDPv6 = 1 << 5 // VIRTIO_NET_RSS_HASH_TYPE_UDPv6
+)
+
+// supportedHashTypes are the hash types of the device; the IPv6 extension
+// headers are not parsed.
+const supportedHashTypes = HashTypeIPv4 | HashTypeTCPv4 | HashTypeUDPv4 |
+	HashTypeIPv6 | HashTypeTCPv6 | HashTypeUDPv6
+
+// list of hash report types.
+const (
+	HashReportNone  = 0 // VIRTIO_NET_HASH_REPORT_NONE
+	HashReportIPv4  = 1 // VIRTIO_NET_HASH_REPORT_IPv4
+	HashReportTCPv4 = 2 // VIRTIO_NET_HASH_REPORT_TCPv4
+	HashReportUDPv4 = 3 // VIRTIO_NET_HASH_REPORT_UDPv4
+	HashReportIPv6  = 4 // VIRTIO_NET_HASH_REPORT_IPv6
+	HashReportTCPv6 = 5 // VIRTIO_NET_HASH_REPORT_TCPv6
+	HashReportUDPv6 = 6 // VIRTIO_NET_HASH_REPORT_UDPv6
+)
+
+const (
+	// rssMaxKeySize is the longest hash key, enough for the 36 bytes of
+	// a TCP/IPv6 flow.
+	rssMaxKeySize = 40
+
+	// rssMaxTableLen is the longest indirection table.
+	rssMaxTableLen = 128
+)
+
+// Toeplitz returns the Toeplitz hash of input with key, which must be at
+// least 4 bytes longer than input.
+func Toeplitz(key, input []byte) uint32 {
+	var h uint32
+	v := binary.BigEndian.Uint32(key)
+	for i, b := range input {
+		for bit := 7; bit >= 0; bit-- {
+			if b&(1<<bit) != 0 {
+				h ^= v
+			}
+			v <<= 1
+			if key[i+4]&(1<<bit) != 0 {
+				v |= 1
+			}
+		}
+	}
+
+	return h
+}
+
+// list of the fields of the frames parsed for hashing.
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// flow is the addresses and ports of a frame.
+type flow struct {
+	v6         bool
+	proto      uint8
+	src, dst   []byte
+	sport, dpt []byte // nil unless proto is TCP or UDP
+}
+
+// parseFlow parses the IP flow of the Ethernet frame eth.
+func parseFlow(eth []byte) (flow, bool) {
+	if len(eth) < 14 {
+		return flow{}, false
+	}
+	typ, l3 := binary.BigEndian.Uint16(eth[12:]), eth[14:]
+	if typ == etherTypeVLAN {
+		if len(eth) < 18 {
+			return flow{}, false
+		}
+		typ, l3 = binary.BigEndian.Uint16(eth[16:]), eth[18:]
+	}
+
+	var f flow
+	var l4 []byte
+	switch typ {
+	case etherTypeIPv4:
+		if len(l3) < 20 || l3[0]>>4 != 4 {
+			return flow{}, false
+		}
+		ihl := int(l3[0]&0xf) * 4
+		if ihl < 20 || len(l3) < ihl {
+			return flow{}, false
+		}
+		f.proto, f.src, f.dst = l3[9], l3[12:16], l3[16:20]
+		// fragments other than the first have no ports, and the first
+		// would hash differently from the others.
+		if binary.BigEndian.Uint16(l3[6:])&0x3fff == 0 {
+			l4 = l3[ihl:]
+		}
+	case etherTypeIPv6:
+		if len(l3) < 40 || l3[0]>>4 != 6 {
+			return flow{}, false
+		}
+		f.v6, f.proto, f.src, f.dst = true, l3[6], l3[8:24], l3[24:40]
+		l4 = l3[40:]
+	default:
+		return flow{}, false
+	}
+	if (f.proto == protoTCP || f.proto == protoUDP) && len(l4) >= 4 {
+		f.sport, f.dpt = l4[0:2], l4[2:4]
+	}
+
+	return f, true
+}
+
+// hash returns the hash of f for the enabled hash types with key, and its
+// report type.
+func (f *flow) hash(key []byte, types uint32) (uint32, uint16) {
+	var ip, tcp, udp uint32
+	var rip, rtcp, rudp uint16
+	if f.v6 {
+		ip, tcp, udp = HashTypeIPv6, HashTypeTCPv6, HashTypeUDPv6
+		rip, rtcp, rudp = HashReportIPv6, HashReportTCPv6, HashReportUDPv6
+	} else {
+		ip, tcp, udp = HashTypeIPv4, HashTypeTCPv4, HashTypeUDPv4
+		rip, rtcp, rudp = HashReportIPv4, HashReportTCPv4, HashReportUDPv4
+	}
+
+	input := make([]byte, 0, 36)
+	input = append(append(input, f.src...), f.dst...)
+	switch {
+	case f.sport != nil && f.proto == protoTCP && types&tcp != 0:
+		return Toeplitz(key, append(append(input, f.sport...), f.dpt...)), rtcp
+	case f.sport != nil && f.proto == protoUDP && types&udp != 0:
+		return Toeplitz(key, append(append(input, f.sport...), f.dpt...)), rudp
+	case types&ip != 0:
+		return Toeplitz(key, input), rip
+	}
+
+	return 0, HashReportNone
+}
+
+// flowKey identifies the flow of a frame in both directions.
+type flowKey struct {
+	a, b   [16]byte
+	pa, pb uint16
+	proto  uint8
+}
+
+// key returns the key of f, the same for the frames of both directions.
+func (f *flow) key() flowKey {
+	k := flowKey{proto: f.proto}
+	copy(k.a[:], f.src)
+	copy(k.b[:], f.dst)
+	if f.sport != nil {
+		k.pa, k.pb = binary.BigEndian.Uint16(f.sport), binary.BigEndian.Uint16(f.dpt)
+	}
+	if c := bytes.Compare(k.a[:], k.b[:]); c > 0 || c == 0 && k.pa > k.pb {
+		k.a, k.b, k.pa, k.pb = k.b, k.a, k.pb, k.pa
+	}
+
+	return k
+}
+
+// rss is the receive side scaling and hash reporting configuration set by
+// the driver.
+type rss struct {
+	enabled      bool // steering, as opposed to hash reporting only
+	hashTypes    uint32
+	table        []uint16
+	unclassified uint16
+	key          []byte
+}
+
+// parseRSS parses struct virtio_net_rss_config, or struct
+// virtio_net_hash_config with the indirection table fields reserved if not
+// steer.
+func parseRSS(b []byte, steer bool) (rss, bool) {
+	le := binary.LittleEndian
+	// the hash types are followed by 8 reserved bytes, or by the table mask
+	// and the unclassified queue.
+	if len(b) < 4+4 || !steer && len(b) < 4+8 {
+		return rss{}, false
+	}
+	r := rss{enabled: steer, hashTypes: le.Uint32(b)}
+	if r.hashTypes&^supportedHashTypes != 0 {
+		return rss{}, false
+	}
+
+	if !steer {
+		b = b[4+8:]
+	} else {
+		mask := int(le.Uint16(b[4:]))
+		r.unclassified = le.Uint16(b[6:])
+		n := mask + 1
+		if n&mask != 0 || n > rssMaxTableLen || len(b) < 8+2*n+2 {
+			return rss{}, false
+		}
+		for i := 0; i < n; i++ {
+			r.table = append(r.table, le.Uint16(b[8+2*i:]))
+		}
+		// max_tx_vq follows the table.
+		b = b[8+2*n+2:]
+	}
+
+	if len(b) < 1 || int(b[0]) > rssMaxKeySize || len(b) < 1+int(b[0]) {
+		return rss{}, false
+	}
+	r.key = append([]byte(nil), b[1:1+b[0]]...)
+	if r.hashTypes != 0 && len(r.key) < rssMaxKeySize {
+		// the hash of a TCP/IPv6 flow needs the longest key.
+		r.key = append(r.key, make([]byte, rssMaxKeySize-len(r.key))...)
+	}
+
+	return r, true
+}
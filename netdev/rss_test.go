@@ -0,0 +1,197 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netdev
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// rssKey is the key of the RSS hash verification suite of Microsoft.
+var rssKey = []byte{
+	0x6d, 0x5a, 0x56, 0xda, 0x25, 0x5b, 0x0e, 0xc2,
+	0x41, 0x67, 0x25, 0x3d, 0x43, 0xa3, 0x8f, 0xb0,
+	0xd0, 0xca, 0x2b, 0xcb, 0xae, 0x7b, 0x30, 0xb4,
+	0x77, 0xcb, 0x2d, 0xa3, 0x80, 0x30, 0xf2, 0x0c,
+	0x6a, 0x42, 0xb7, 0x3b, 0xbe, 0xac, 0x01, 0xfa,
+}
+
+// rssTests are the vectors of the RSS hash verification suite.
+var rssTests = []struct {
+	src, dst     string
+	sport, dport uint16
+	ip, tcp      uint32
+}{
+	{"66.9.149.187", "161.142.100.80", 2794, 1766, 0x323e8fc2, 0x51ccc178},
+	{"199.92.111.2", "65.69.140.83", 14230, 4739, 0xd718262a, 0xc626b0ea},
+	{"24.19.198.95", "12.22.207.184", 12898, 38024, 0xd2d0a5de, 0x5c2b394a},
+	{"38.27.205.30", "209.142.163.6", 48228, 2217, 0x82989176, 0xafc7327f},
+	{"153.39.163.191", "202.188.127.2", 44251, 1303, 0x5d1809c5, 0x10e828a2},
+	{"3ffe:2501:200:1fff::7", "3ffe:2501:200:3::1", 2794, 1766, 0x2cc18cd5, 0x40207d3d},
+	{"3ffe:501:8::260:97ff:fe40:efab", "ff02::1", 14230, 4739, 0x0f0c461c, 0xdde51bbf},
+	{"3ffe:1900:4545:3:200:f8ff:fe21:67cf", "fe80::200:f8ff:fe21:67cf", 44251, 38024, 0x4b61e985, 0x02d1feef},
+}
+
+func TestToeplitz(t *testing.T) {
+	for _, tt := range rssTests {
+		src, dst := ipBytes(tt.src), ipBytes(tt.dst)
+		input := append(append([]byte(nil), src...), dst...)
+		if h := Toeplitz(rssKey, input); h != tt.ip {
+			t.Errorf("%s > %s: hash %#08x, want %#08x", tt.src, tt.dst, h, tt.ip)
+		}
+		input = appendBE16(input, tt.sport)
+		input = appendBE16(input, tt.dport)
+		if h := Toeplitz(rssKey, input); h != tt.tcp {
+			t.Errorf("%s:%d > %s:%d: hash %#08x, want %#08x", tt.src, tt.sport, tt.dst, tt.dport, h, tt.tcp)
+		}
+	}
+}
+
+func TestFlowHash(t *testing.T) {
+	tests := []struct {
+		name   string
+		proto  uint8
+		types  uint32
+		tcp    bool // whether the ports are hashed
+		report [2]uint16
+	}{
+		{"tcp", protoTCP, supportedHashTypes, true, [2]uint16{HashReportTCPv4, HashReportTCPv6}},
+		{"tcp ip only", protoTCP, HashTypeIPv4 | HashTypeIPv6, false, [2]uint16{HashReportIPv4, HashReportIPv6}},
+		{"udp", protoUDP, supportedHashTypes, true, [2]uint16{HashReportUDPv4, HashReportUDPv6}},
+		{"udp tcp only", protoUDP, HashTypeTCPv4 | HashTypeTCPv6, false, [2]uint16{HashReportNone, HashReportNone}},
+		{"icmp", 1, supportedHashTypes, false, [2]uint16{HashReportIPv4, HashReportIPv6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, v := range rssTests {
+				eth := ipFrame(mac, v.src, v.dst, tt.proto, v.sport, v.dport)
+				fl, ok := parseFlow(eth)
+				if !ok {
+					t.Fatalf("%s > %s: not parsed", v.src, v.dst)
+				}
+				h, report := fl.hash(rssKey, tt.types)
+				want, wantReport := v.ip, tt.report[0]
+				if fl.v6 {
+					wantReport = tt.report[1]
+				}
+				if tt.tcp {
+					want = v.tcp
+				}
+				if wantReport == HashReportNone {
+					want = 0
+				}
+				if h != want || report != wantReport {
+					t.Errorf("%s > %s: hash %#08x report %d, want %#08x report %d", v.src, v.dst, h, report, want, wantReport)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRSS(t *testing.T) {
+	b := appendLE32(nil, HashTypeTCPv4)
+	b = appendLE16(b, 3) // indirection_table_mask
+	b = appendLE16(b, 1) // unclassified_queue
+	for _, k := range []uint16{0, 1, 1, 0} {
+		b = appendLE16(b, k)
+	}
+	b = appendLE16(b, 2) // max_tx_vq
+	b = append(append(b, byte(len(rssKey))), rssKey...)
+
+	r, ok := parseRSS(b, true)
+	if !ok || !r.enabled || r.hashTypes != HashTypeTCPv4 || len(r.table) != 4 || r.table[1] != 1 || r.unclassified != 1 || len(r.key) != len(rssKey) {
+		t.Fatalf("parsed %+v, %v", r, ok)
+	}
+
+	for _, bad := range [][]byte{
+		b[:len(b)-1],
+		appendLE32(append([]byte(nil), b[4:]...), 1<<31), // unsupported hash type
+	} {
+		if _, ok := parseRSS(bad, true); ok {
+			t.Errorf("parsed % x", bad)
+		}
+	}
+	mask := append([]byte(nil), b...)
+	binary.LittleEndian.PutUint16(mask[4:], 2) // the table length must be a power of two
+	if _, ok := parseRSS(mask, true); ok {
+		t.Errorf("parsed mask 2")
+	}
+}
+
+func TestParseRSSTruncated(t *testing.T) {
+	hash := append(appendLE32(nil, HashTypeTCPv4), make([]byte, 8)...) // reserved
+	hash = append(append(hash, byte(len(rssKey))), rssKey...)
+	steer := appendLE32(nil, HashTypeTCPv4)
+	steer = appendLE16(steer, 0) // indirection_table_mask
+	steer = appendLE16(steer, 0) // unclassified_queue
+	steer = appendLE16(steer, 0) // indirection_table
+	steer = appendLE16(steer, 1) // max_tx_vq
+	steer = append(append(steer, byte(len(rssKey))), rssKey...)
+
+	for _, tt := range []struct {
+		name  string
+		b     []byte
+		steer bool
+	}{
+		{"hash config", hash, false},
+		{"rss config", steer, true},
+	} {
+		if _, ok := parseRSS(tt.b, tt.steer); !ok {
+			t.Fatalf("%s: not parsed", tt.name)
+		}
+		for n := 0; n < len(tt.b); n++ {
+			if _, ok := parseRSS(tt.b[:n], tt.steer); ok {
+				t.Errorf("%s: parsed %d of %d bytes", tt.name, n, len(tt.b))
+			}
+		}
+	}
+}
+
+func ipBytes(s string) []byte {
+	ip := net.ParseIP(s)
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+
+	return ip
+}
+
+// ipFrame returns an Ethernet frame to dst of an IP packet of proto, with
+// ports for TCP and UDP.
+func ipFrame(dst net.HardwareAddr, src, dstIP string, proto uint8, sport, dport uint16) []byte {
+	eth := append(append([]byte(nil), dst...), 0x02, 0, 0, 0, 0, 1)
+	s, d := ipBytes(src), ipBytes(dstIP)
+	if len(s) == 4 {
+		eth = appendBE16(eth, etherTypeIPv4)
+		ip := make([]byte, 20)
+		ip[0], ip[8], ip[9] = 0x45, 64, proto
+		copy(ip[12:], s)
+		copy(ip[16:], d)
+		eth = append(eth, ip...)
+	} else {
+		eth = appendBE16(eth, etherTypeIPv6)
+		ip := make([]byte, 40)
+		ip[0], ip[6], ip[7] = 0x60, proto, 64
+		copy(ip[8:], s)
+		copy(ip[24:], d)
+		eth = append(eth, ip...)
+	}
+	eth = appendBE16(eth, sport)
+	eth = appendBE16(eth, dport)
+
+	return append(eth, make([]byte, 16)...)
+}
+
+func appendBE16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendLE16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendLE32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
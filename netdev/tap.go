@@ -0,0 +1,39 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netdev
+
+import "os"
+
+// TAP is a backend over a TAP interface exchanging frames with their
+// virtio_net_hdr_v1.
+type TAP struct {
+	f    *os.File
+	name string
+}
+
+var (
+	_ Backend   = (*TAP)(nil)
+	_ Offloader = (*TAP)(nil)
+)
+
+// Name returns the name of the interface.
+func (t *TAP) Name() string {
+	return t.name
+}
+
+// Read implements Backend.Read.
+func (t *TAP) Read(p []byte) (int, error) {
+	return t.f.Read(p)
+}
+
+// Write implements Backend.Write.
+func (t *TAP) Write(p []byte) (int, error) {
+	return t.f.Write(p)
+}
+
+// Close implements Backend.Close. The interface is deleted unless it is
+// persistent.
+func (t *TAP) Close() error {
+	return t.f.Close()
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package netdev
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// list of TUNSETOFFLOAD flags.
+const (
+	tunCsum   = 0x01 // TUN_F_CSUM
+	tunTSO4   = 0x02 // TUN_F_TSO4
+	tunTSO6   = 0x04 // TUN_F_TSO6
+	tunTSOECN = 0x08 // TUN_F_TSO_ECN
+)
+
+// OpenTAP opens the TAP interface name, creating it if it does not exist. An
+// empty name lets the kernel pick one. It needs CAP_NET_ADMIN.
+func OpenTAP(name string) (*TAP, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("netdev: open /dev/net/tun: %w", err)
+	}
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("netdev: %w", err)
+	}
+	ifr.SetUint16(unix.IFF_TAP | unix.IFF_NO_PI | unix.IFF_VNET_HDR)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("netdev: TUNSETIFF %q: %w", name, err)
+	}
+	if err := unix.IoctlSetPointerInt(fd, unix.TUNSETVNETHDRSZ, HeaderSize); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("netdev: TUNSETVNETHDRSZ: %w", err)
+	}
+
+	// the descriptor is non-blocking for the runtime poller, which lets
+	// Close interrupt a Read.
+	return &TAP{f: os.NewFile(uintptr(fd), "/dev/net/tun"), name: ifr.Name()}, nil
+}
+
+// SetOffload implements Offloader.SetOffload: the kernel passes segmentation
+// offload frames only if the driver accepts them.
+func (t *TAP) SetOffload(f virtio.Features) error {
+	var flags int
+	if f.Has(FeatureGuestCsum) {
+		flags |= tunCsum
+		if f.Has(FeatureGuestTSO4) {
+			flags |= tunTSO4
+		}
+		if f.Has(FeatureGuestTSO6) {
+			flags |= tunTSO6
+		}
+		if flags&(tunTSO4|tunTSO6) != 0 && f.Has(FeatureGuestECN) {
+			flags |= tunTSOECN
+		}
+	}
+
+	c, err := t.f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = unix.IoctlSetInt(int(fd), unix.TUNSETOFFLOAD, flags)
+	}); err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("netdev: TUNSETOFFLOAD: %w", serr)
+	}
+
+	return nil
+}
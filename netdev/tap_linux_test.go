@@ -0,0 +1,32 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package netdev
+
+import "testing"
+
+func TestTAP(t *testing.T) {
+	tap, err := OpenTAP("")
+	if err != nil {
+		t.Skipf("no TAP interface: %v", err)
+	}
+	defer tap.Close()
+
+	if tap.Name() == "" {
+		t.Fatal("TAP interface without name")
+	}
+	if err := tap.SetOffload(FeatureGuestCsum | FeatureGuestTSO4 | FeatureGuestTSO6); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close interrupts a pending Read.
+	done := make(chan error)
+	go func() {
+		_, err := tap.Read(make([]byte, maxFrameSize))
+		done <- err
+	}()
+	tap.Close()
+	if err := <-done; err == nil {
+		t.Fatal("Read succeeded on a closed interface")
+	}
+}
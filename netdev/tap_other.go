@@ -0,0 +1,23 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package netdev
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// OpenTAP is not supported on this platform.
+func OpenTAP(name string) (*TAP, error) {
+	return nil, fmt.Errorf("netdev: TAP is not supported on %s", runtime.GOOS)
+}
+
+// SetOffload implements Offloader.SetOffload.
+func (t *TAP) SetOffload(f virtio.Features) error {
+	return fmt.Errorf("netdev: TAP is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,234 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingIRQ counts the interrupts sent by a device.
+type countingIRQ struct {
+	queue, config int64
+}
+
+func (c *countingIRQ) InterruptQueue(index int) { atomic.AddInt64(&c.queue, 1) }
+func (c *countingIRQ) InterruptConfig()         { atomic.AddInt64(&c.config, 1) }
+
+// newActiveQueue returns the driver side of a queue of 64 descriptors and the
+// device side as handed to a device; the driver notifications go to the
+// device queue.
+func newActiveQueue(t *testing.T, packed bool) (notifyQueue, *Queue) {
+	t.Helper()
+
+	const size = 64
+	var (
+		features       Features
+		driver, device uint64
+		total          uint64
+	)
+	if packed {
+		features = FeatureRingPacked
+		driver, device, total = PackedLayout(size)
+	} else {
+		driver, device, total = SplitLayout(size)
+	}
+	mem := newTestMemory(t, make([]byte, total))
+
+	ring, err := NewDeviceQueue(mem, features, size, 0, driver, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewQueue(0, ring)
+
+	var drv notifyQueue
+	if packed {
+		d, err := NewPackedQueue(mem, size, 0, driver, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Notify = q.Notify
+		drv = d
+	} else {
+		d, err := NewSplitQueue(mem, size, 0, driver, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Notify = q.Notify
+		drv = d
+	}
+
+	return drv, q
+}
+
+// complete adds n chains to drv, more than the queue holds, and waits until
+// the device completed them.
+func complete(t *testing.T, drv notifyQueue, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for added, reaped := 0, 0; reaped < n; {
+		for ; added < n; added++ {
+			_, err := drv.Add([]Buffer{{Len: 8}})
+			if errors.Is(err, ErrQueueFull) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		drv.Kick()
+
+		_, ok, err := drv.Reap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			reaped++
+			continue
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d chains completed", reaped, n)
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	ids := Devices()
+	if len(ids) == 0 || ids[0] != DeviceNull {
+		t.Fatalf("Devices() = %v, want the null device", ids)
+	}
+
+	dev, err := NewDevice(DeviceNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dev.(*NullDevice); !ok || dev.DeviceID() != DeviceNull {
+		t.Fatalf("NewDevice(%v) = %T", DeviceNull, dev)
+	}
+	if _, err := NewDevice(42); !errors.Is(err, ErrUnknownDevice) {
+		t.Fatalf("NewDevice(42) = %v, want %v", err, ErrUnknownDevice)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Register did not panic on a duplicate ID")
+		}
+	}()
+	Register(DeviceNull, func() Device { return &NullDevice{} })
+}
+
+func TestNullDeviceConfig(t *testing.T) {
+	d := &NullDevice{Config: []byte{1, 2, 3, 4}}
+
+	d.WriteConfig(2, []byte{5, 6, 7})
+	p := make([]byte, 6)
+	d.ReadConfig(0, p)
+	if string(p) != "\x01\x02\x05\x06\x00\x00" {
+		t.Fatalf("config %v", p)
+	}
+	if sizes := d.QueueMaxSizes(); len(sizes) != 1 || sizes[0] != 256 {
+		t.Fatalf("QueueMaxSizes() = %v", sizes)
+	}
+}
+
+func TestNullDeviceLifecycle(t *testing.T) {
+	for _, packed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("packed=%v", packed), func(t *testing.T) {
+			d := &NullDevice{}
+			var irq countingIRQ
+
+			// activate, reset and activate again on new rings, as after a
+			// driver reload.
+			for round := 1; round <= 2; round++ {
+				drv, q := newActiveQueue(t, packed)
+				drv.EnableInterrupts()
+				if err := d.Activate(nil, []*Queue{q}, &irq); err != nil {
+					t.Fatal(err)
+				}
+				complete(t, drv, 100)
+				d.Reset()
+
+				if got := d.Completed(); got != uint64(100*round) {
+					t.Fatalf("round %d: %d chains completed", round, got)
+				}
+			}
+			if atomic.LoadInt64(&irq.queue) == 0 {
+				t.Fatal("no interrupts")
+			}
+
+			// a reset before activation or twice is harmless.
+			d.Reset()
+			d.Reset()
+		})
+	}
+}
+
+func TestNullDeviceResetDuringIO(t *testing.T) {
+	for _, packed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("packed=%v", packed), func(t *testing.T) {
+			d := &NullDevice{Queues: 2}
+			var irq countingIRQ
+
+			drv0, q0 := newActiveQueue(t, packed)
+			drv1, q1 := newActiveQueue(t, packed)
+			if err := d.Activate(nil, []*Queue{q0, nil, q1}, &irq); err != nil {
+				t.Fatal(err)
+			}
+
+			// the drivers keep the queues full while the device is reset.
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for _, drv := range []notifyQueue{drv0, drv1} {
+				wg.Add(1)
+				go func(drv notifyQueue) {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						if _, err := drv.Add([]Buffer{{Len: 8}}); err == nil {
+							drv.Kick()
+						}
+						for {
+							if _, ok, _ := drv.Reap(); !ok {
+								break
+							}
+						}
+						runtime.Gosched()
+					}
+				}(drv)
+			}
+
+			for d.Completed() < 200 {
+				runtime.Gosched()
+			}
+			d.Reset()
+			completed := d.Completed()
+			close(stop)
+			wg.Wait()
+
+			// no chain is completed once Reset returned.
+			time.Sleep(10 * time.Millisecond)
+			if got := d.Completed(); got != completed {
+				t.Fatalf("%d chains completed after reset", got-completed)
+			}
+
+			drv, q := newActiveQueue(t, packed)
+			if err := d.Activate(nil, []*Queue{q}, &irq); err != nil {
+				t.Fatal(err)
+			}
+			complete(t, drv, 10)
+			d.Reset()
+		})
+	}
+}
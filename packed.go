@@ -0,0 +1,487 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// list of pvirtq_desc flags, in addition to the virtq_desc flags.
+const (
+	DescFlagAvail = 1 << 7  // matches the avail wrap counter when the driver made the descriptor available
+	DescFlagUsed  = 1 << 15 // matches the used wrap counter when the device used the descriptor
+)
+
+// list of pvirtq_event_suppress flags.
+const (
+	EventFlagEnable  = 0 // events are enabled
+	EventFlagDisable = 1 // events are disabled
+	EventFlagDesc    = 2 // an event is wanted for the descriptor at OffWrap (VIRTIO_F_EVENT_IDX)
+)
+
+// EventSuppression is a pvirtq_event_suppress structure, written by one side
+// of a packed queue to control the notifications it receives from the other.
+type EventSuppression struct {
+	// OffWrap is the descriptor ring offset in bits 0-14 and the wrap counter
+	// in bit 15, used with EventFlagDesc.
+	OffWrap uint16
+
+	// Flags is one of the EventFlag constants.
+	Flags uint16
+}
+
+// PackedLayout returns the offsets of the driver and device event suppression
+// areas and the total size of a packed queue of size descriptors laid out
+// contiguously.
+func PackedLayout(size uint16) (driver, device, total uint64) {
+	driver = descSize * uint64(size)
+	device = driver + 4
+
+	return driver, device, device + 4
+}
+
+// PackedQueue is a virtio 1.1 packed virtqueue (VIRTIO_F_RING_PACKED) over
+// guest memory.
+//
+// As with SplitQueue, the driver and the device each use their own PackedQueue
+// over the same memory. The driver makes buffers available with Add, notifies
+// the device with Kick and reaps them with Reap; the device takes chains with
+// Pop and returns them with Push, in any order. Descriptor ring slots are
+// reused in ring order, buffer IDs as their chains are used.
+type PackedQueue struct {
+	mem    GuestMemory
+	size   uint16
+	desc   []byte // descriptor ring
+	driver []byte // driver event suppression area
+	device []byte // device event suppression area
+
+	// MaxChainLen limits the descriptors of a chain returned by PopChain,
+	// counting the ones of indirect tables. Zero means DefaultMaxChainLen.
+	MaxChainLen int
+
+	// EventIdx enables VIRTIO_F_EVENT_IDX notification suppression with
+	// EventFlagDesc. Both sides must agree on it, as negotiated.
+	EventIdx bool
+
+	// Notify, if non-nil, is called by Kick when the device needs a notification.
+	Notify func()
+
+	// driver state.
+	numFree   int      // free descriptor ring slots
+	ids       []uint16 // stack of free buffer IDs
+	idLen     []uint16 // number of descriptors of each in-flight buffer ID, 0 if not in flight
+	added     uint16   // descriptors made available since the last notification check
+	driverSet bool     // driver state initialized
+
+	// position and wrap counter of the next descriptor made available by the
+	// driver, or consumed by the device.
+	availIdx  uint16
+	availWrap bool
+
+	// position and wrap counter of the next used descriptor written by the
+	// device, or reaped by the driver.
+	usedIdx  uint16
+	usedWrap bool
+
+	// device state.
+	popped []uint16 // number of descriptors of each popped buffer ID, 0 if not popped
+	pushed uint16   // descriptors used since the last notification check
+}
+
+// NewPackedQueue returns a packed queue of size descriptors whose descriptor
+// ring and driver and device event suppression areas are at the guest
+// addresses desc, driver and device of mem. The ring and the areas must be
+// zeroed when the queue is set up.
+func NewPackedQueue(mem GuestMemory, size uint16, desc, driver, device uint64) (*PackedQueue, error) {
+	if size == 0 || size > MaxQueueSize {
+		return nil, fmt.Errorf("%w: size %d is not between 1 and %d", ErrInvalidQueue, size, MaxQueueSize)
+	}
+	if desc%16 != 0 || driver%4 != 0 || device%4 != 0 {
+		return nil, fmt.Errorf("%w: misaligned rings (desc %#x, driver %#x, device %#x)", ErrInvalidQueue, desc, driver, device)
+	}
+
+	q := &PackedQueue{
+		mem:       mem,
+		size:      size,
+		availWrap: true,
+		usedWrap:  true,
+		popped:    make([]uint16, size),
+	}
+
+	for _, r := range []struct {
+		name      string
+		b         *[]byte
+		addr, len uint64
+	}{
+		{"descriptor ring", &q.desc, desc, descSize * uint64(size)},
+		{"driver area", &q.driver, driver, 4},
+		{"device area", &q.device, device, 4},
+	} {
+		b, err := Slice(mem, r.addr, r.len)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidQueue, r.name, err)
+		}
+		if !aligned(b) {
+			return nil, fmt.Errorf("%w: %s is not 4-byte aligned in host memory", ErrInvalidQueue, r.name)
+		}
+		*r.b = b
+	}
+
+	return q, nil
+}
+
+// Size returns the number of descriptors of the queue.
+func (q *PackedQueue) Size() uint16 {
+	return q.size
+}
+
+// initDriver sets up the driver state on first use.
+func (q *PackedQueue) initDriver() {
+	if q.driverSet {
+		return
+	}
+
+	q.numFree = int(q.size)
+	q.ids = make([]uint16, q.size)
+	for i := range q.ids {
+		q.ids[i] = q.size - 1 - uint16(i)
+	}
+	q.idLen = make([]uint16, q.size)
+	q.driverSet = true
+}
+
+// NumFree returns the number of free descriptors on the driver side.
+func (q *PackedQueue) NumFree() int {
+	q.initDriver()
+	return q.numFree
+}
+
+// advance moves the position idx with wrap counter wrap forward by n slots.
+func (q *PackedQueue) advance(idx *uint16, wrap *bool, n uint16) {
+	if next := uint32(*idx) + uint32(n); next >= uint32(q.size) {
+		*idx = uint16(next - uint32(q.size))
+		*wrap = !*wrap
+	} else {
+		*idx = uint16(next)
+	}
+}
+
+// availFlags returns the AVAIL and USED flags which make a descriptor
+// available under the wrap counter wrap.
+func availFlags(wrap bool) uint16 {
+	if wrap {
+		return DescFlagAvail
+	}
+	return DescFlagUsed
+}
+
+// usedFlags returns the AVAIL and USED flags which mark a descriptor used
+// under the wrap counter wrap.
+func usedFlags(wrap bool) uint16 {
+	if wrap {
+		return DescFlagAvail | DescFlagUsed
+	}
+	return 0
+}
+
+// descOff returns the offset of the descriptor ring slot i.
+func (q *PackedQueue) descOff(i uint16) uint64 {
+	return descSize * uint64(i)
+}
+
+// idFlags returns the buffer ID and flags of the descriptor ring slot i.
+//
+// The ID and flags share the last word of a descriptor, which is always
+// accessed atomically: it publishes the descriptor to the other side.
+func (q *PackedQueue) idFlags(i uint16) (id, flags uint16) {
+	w := load32(q.desc, q.descOff(i)+12)
+	return uint16(w), uint16(w >> 16)
+}
+
+// setIDFlags publishes the buffer ID and flags of the descriptor ring slot i.
+func (q *PackedQueue) setIDFlags(i, id, flags uint16) {
+	store32(q.desc, q.descOff(i)+12, uint32(id)|uint32(flags)<<16)
+}
+
+// Add places bufs in the next free descriptor ring slots and makes them
+// available to the device. It returns the buffer ID of the chain.
+func (q *PackedQueue) Add(bufs []Buffer) (uint16, error) {
+	q.initDriver()
+
+	if len(bufs) == 0 {
+		return 0, fmt.Errorf("%w: empty chain", ErrInvalidQueue)
+	}
+	if len(bufs) > q.numFree {
+		return 0, ErrQueueFull
+	}
+	for i := 1; i < len(bufs); i++ {
+		if bufs[i-1].Writable && !bufs[i].Writable {
+			return 0, fmt.Errorf("%w: device-readable buffer after a device-writable one", ErrInvalidQueue)
+		}
+	}
+
+	id := q.ids[len(q.ids)-1]
+	q.ids = q.ids[:len(q.ids)-1]
+	q.idLen[id] = uint16(len(bufs))
+	q.numFree -= len(bufs)
+	q.added += uint16(len(bufs))
+
+	head, headFlags := q.availIdx, uint16(0)
+	for i, b := range bufs {
+		flags := availFlags(q.availWrap)
+		if b.Writable {
+			flags |= DescFlagWrite
+		}
+		if i < len(bufs)-1 {
+			flags |= DescFlagNext
+		}
+
+		off := q.descOff(q.availIdx)
+		binary.LittleEndian.PutUint64(q.desc[off:], b.Addr)
+		binary.LittleEndian.PutUint32(q.desc[off+8:], b.Len)
+		if i == 0 {
+			headFlags = flags
+		} else {
+			q.setIDFlags(q.availIdx, id, flags)
+		}
+		q.advance(&q.availIdx, &q.availWrap, 1)
+	}
+
+	// the head is made available last, publishing the whole chain at once.
+	q.setIDFlags(head, id, headFlags)
+
+	return id, nil
+}
+
+// SetDriverEvent writes the driver event suppression area, which controls the
+// used buffer notifications sent by the device.
+func (q *PackedQueue) SetDriverEvent(e EventSuppression) {
+	store32(q.driver, 0, uint32(e.OffWrap)|uint32(e.Flags)<<16)
+}
+
+// DeviceEvent reads the device event suppression area.
+func (q *PackedQueue) DeviceEvent() EventSuppression {
+	w := load32(q.device, 0)
+	return EventSuppression{OffWrap: uint16(w), Flags: uint16(w >> 16)}
+}
+
+// Kick notifies the device of the chains added since the last Kick if
+// NeedsNotification.
+func (q *PackedQueue) Kick() {
+	if q.NeedsNotification() && q.Notify != nil {
+		q.Notify()
+	}
+}
+
+// Reap returns the next chain used by the device and frees its descriptors.
+// ok is false if no used chain is pending.
+func (q *PackedQueue) Reap() (e UsedElem, ok bool, err error) {
+	q.initDriver()
+
+	id, flags := q.idFlags(q.usedIdx)
+	if flags&(DescFlagAvail|DescFlagUsed) != usedFlags(q.usedWrap) {
+		return UsedElem{}, false, nil
+	}
+	if id >= q.size || q.idLen[id] == 0 {
+		return UsedElem{}, false, fmt.Errorf("%w: used buffer ID %d is not in flight", ErrInvalidQueue, id)
+	}
+
+	e.ID = uint32(id)
+	e.Len = binary.LittleEndian.Uint32(q.desc[q.descOff(q.usedIdx)+8:])
+
+	n := q.idLen[id]
+	q.advance(&q.usedIdx, &q.usedWrap, n)
+	q.numFree += int(n)
+	q.idLen[id] = 0
+	q.ids = append(q.ids, id)
+
+	return e, true, nil
+}
+
+// SetDeviceEvent writes the device event suppression area, which controls the
+// available buffer notifications sent by the driver.
+func (q *PackedQueue) SetDeviceEvent(e EventSuppression) {
+	store32(q.device, 0, uint32(e.OffWrap)|uint32(e.Flags)<<16)
+}
+
+// DriverEvent reads the driver event suppression area.
+func (q *PackedQueue) DriverEvent() EventSuppression {
+	w := load32(q.driver, 0)
+	return EventSuppression{OffWrap: uint16(w), Flags: uint16(w >> 16)}
+}
+
+// available reports whether the descriptor ring slot i was made available
+// under the wrap counter wrap.
+func (q *PackedQueue) available(i uint16, wrap bool) (id uint16, flags uint16, ok bool) {
+	id, flags = q.idFlags(i)
+	return id, flags, flags&(DescFlagAvail|DescFlagUsed) == availFlags(wrap)
+}
+
+// Pop returns the buffer ID and the descriptors of the next available chain.
+// ok is false if no chain is available.
+func (q *PackedQueue) Pop() (id uint16, chain []Descriptor, ok bool, err error) {
+	if _, _, ok := q.available(q.availIdx, q.availWrap); !ok {
+		return 0, nil, false, nil
+	}
+
+	idx, wrap := q.availIdx, q.availWrap
+	for {
+		if len(chain) == int(q.size) {
+			return 0, nil, false, fmt.Errorf("%w: descriptor chain at %d exceeds the queue size", ErrInvalidQueue, q.availIdx)
+		}
+
+		// the head publishes the chain, the following descriptors must be
+		// available as well.
+		did, flags, ok := q.available(idx, wrap)
+		if !ok {
+			return 0, nil, false, fmt.Errorf("%w: descriptor %d of a chain is not available", ErrInvalidQueue, idx)
+		}
+
+		off := q.descOff(idx)
+		chain = append(chain, Descriptor{
+			Addr:  binary.LittleEndian.Uint64(q.desc[off:]),
+			Len:   binary.LittleEndian.Uint32(q.desc[off+8:]),
+			Flags: flags,
+		})
+		id = did
+		q.advance(&idx, &wrap, 1)
+
+		if flags&DescFlagNext == 0 {
+			break
+		}
+	}
+
+	// the buffer ID of a chain is the one of its last descriptor.
+	if id >= q.size || q.popped[id] != 0 {
+		return 0, nil, false, fmt.Errorf("%w: available buffer ID %d is invalid or in use", ErrInvalidQueue, id)
+	}
+	q.popped[id] = uint16(len(chain))
+	q.availIdx, q.availWrap = idx, wrap
+
+	return id, chain, true, nil
+}
+
+// Push returns the chain with buffer ID id to the driver, with written bytes
+// written into its device-writable buffers.
+func (q *PackedQueue) Push(id uint16, written uint32) error {
+	if id >= q.size || q.popped[id] == 0 {
+		return fmt.Errorf("%w: buffer ID %d was not popped", ErrInvalidQueue, id)
+	}
+
+	binary.LittleEndian.PutUint32(q.desc[q.descOff(q.usedIdx)+8:], written)
+	q.setIDFlags(q.usedIdx, id, usedFlags(q.usedWrap))
+
+	q.advance(&q.usedIdx, &q.usedWrap, q.popped[id])
+	q.pushed += q.popped[id]
+	q.popped[id] = 0
+
+	return nil
+}
+
+// PopChain pops the next available chain and resolves it into a
+// DescriptorChain. ok is false if no chain is available. An error means the
+// driver violated the specification and the queue should be reset.
+func (q *PackedQueue) PopChain() (c *DescriptorChain, ok bool, err error) {
+	id, descs, ok, err := q.Pop()
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+
+	if c, err = newChain(q.mem, id, descs, q.MaxChainLen, true); err != nil {
+		return nil, false, err
+	}
+
+	return c, true, nil
+}
+
+// PushChain returns c to the driver with the number of bytes written into it.
+func (q *PackedQueue) PushChain(c *DescriptorChain) error {
+	return q.Push(c.ID, c.Written())
+}
+
+// offWrap returns the off_wrap value of the ring position idx under the wrap
+// counter wrap.
+func offWrap(idx uint16, wrap bool) uint16 {
+	if wrap {
+		return idx | 1<<15
+	}
+	return idx
+}
+
+// needsEvent reports whether e asks for a notification of the n descriptors
+// before the ring position new under the wrap counter wrap.
+func (q *PackedQueue) needsEvent(e EventSuppression, new uint16, wrap bool, n uint16) bool {
+	if n == 0 {
+		return false
+	}
+
+	switch {
+	case e.Flags == EventFlagDisable:
+		return false
+	case e.Flags == EventFlagDesc && q.EventIdx:
+		// positions are compared in the frame of the current lap, a position
+		// of the previous lap is negative.
+		event := e.OffWrap &^ (1 << 15)
+		if (e.OffWrap>>15 != 0) != wrap {
+			event -= q.size
+		}
+		return needEvent(event, new, new-n)
+	default:
+		return true
+	}
+}
+
+// NeedsNotification reports whether the other side must be notified of the
+// descriptors this side published since the last call: on the driver side the
+// chains made available by Add, on the device side the chains returned by
+// Push. It honors the other side's event suppression structure.
+//
+// Kick calls it on the driver side. The device calls it after pushing a
+// batch of chains and interrupts the driver if it returns true.
+func (q *PackedQueue) NeedsNotification() bool {
+	if q.driverSet {
+		n := q.added
+		q.added = 0
+		return q.needsEvent(q.DeviceEvent(), q.availIdx, q.availWrap, n)
+	}
+
+	n := q.pushed
+	q.pushed = 0
+	return q.needsEvent(q.DriverEvent(), q.usedIdx, q.usedWrap, n)
+}
+
+// EnableInterrupts asks the device for used buffer notifications, on the
+// driver side. With EventIdx the notification is requested for the next used
+// descriptor. The driver should check for used chains again afterwards.
+func (q *PackedQueue) EnableInterrupts() {
+	if q.EventIdx {
+		q.SetDriverEvent(EventSuppression{OffWrap: offWrap(q.usedIdx, q.usedWrap), Flags: EventFlagDesc})
+		return
+	}
+	q.SetDriverEvent(EventSuppression{Flags: EventFlagEnable})
+}
+
+// DisableInterrupts asks the device not to send used buffer notifications,
+// on the driver side.
+func (q *PackedQueue) DisableInterrupts() {
+	q.SetDriverEvent(EventSuppression{Flags: EventFlagDisable})
+}
+
+// EnableNotifications asks the driver for available buffer notifications, on
+// the device side. The device should check for available chains again
+// afterwards.
+func (q *PackedQueue) EnableNotifications() {
+	if q.EventIdx {
+		q.SetDeviceEvent(EventSuppression{OffWrap: offWrap(q.availIdx, q.availWrap), Flags: EventFlagDesc})
+		return
+	}
+	q.SetDeviceEvent(EventSuppression{Flags: EventFlagEnable})
+}
+
+// DisableNotifications asks the driver not to send available buffer
+// notifications, on the device side.
+func (q *PackedQueue) DisableNotifications() {
+	q.SetDeviceEvent(EventSuppression{Flags: EventFlagDisable})
+}
@@ -0,0 +1,244 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+	"testing/quick"
+)
+
+// newTestPacked returns the driver and device sides of a packed queue.
+func newTestPacked(t *testing.T, size uint16) (drv, dev *PackedQueue) {
+	t.Helper()
+
+	driver, device, total := PackedLayout(size)
+	mem := newTestMemory(t, make([]byte, total))
+
+	var err error
+	if drv, err = NewPackedQueue(mem, size, 0, driver, device); err != nil {
+		t.Fatal(err)
+	}
+	if dev, err = NewPackedQueue(mem, size, 0, driver, device); err != nil {
+		t.Fatal(err)
+	}
+
+	return drv, dev
+}
+
+// packedModel runs a random sequence of driver and device operations on a
+// packed queue and checks it against the expected in-flight chains.
+func packedModel(t *testing.T, seed int64, size uint16, steps int) error {
+	drv, dev := newTestPacked(t, size)
+	rnd := rand.New(rand.NewSource(seed))
+
+	type chain struct {
+		bufs    []Buffer
+		written uint32
+	}
+	var (
+		added   = make(map[uint16]chain) // made available, not yet popped
+		order   []uint16                 // buffer IDs in ring order, not yet popped
+		popped  []uint16                 // popped, not yet pushed
+		pushed  = make(map[uint16]chain) // pushed, not yet reaped
+		inUse   int                      // descriptors not yet reaped
+		nextBuf uint64
+	)
+
+	for step := 0; step < steps; step++ {
+		switch op := rnd.Intn(4); {
+		case op == 0:
+			// driver: add a chain of random length and direction split.
+			n := 1 + rnd.Intn(4)
+			bufs := make([]Buffer, n)
+			w := rnd.Intn(n + 1)
+			for i := range bufs {
+				nextBuf++
+				bufs[i] = Buffer{Addr: nextBuf << 12, Len: uint32(rnd.Intn(4096)), Writable: i >= w}
+			}
+
+			id, err := drv.Add(bufs)
+			if inUse+n > int(size) {
+				if !errors.Is(err, ErrQueueFull) {
+					return fmt.Errorf("step %d: Add with %d of %d in use = %v, want %v", step, inUse, size, err, ErrQueueFull)
+				}
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("step %d: Add: %v", step, err)
+			}
+			if _, dup := added[id]; dup {
+				return fmt.Errorf("step %d: buffer ID %d reused while in flight", step, id)
+			}
+			added[id] = chain{bufs: bufs}
+			order = append(order, id)
+			inUse += n
+
+		case op == 1:
+			// device: pop the next chain, which must be the oldest added one.
+			id, descs, ok, err := dev.Pop()
+			if err != nil {
+				return fmt.Errorf("step %d: Pop: %v", step, err)
+			}
+			if ok != (len(order) > 0) {
+				return fmt.Errorf("step %d: Pop ok = %v with %d available", step, ok, len(order))
+			}
+			if !ok {
+				continue
+			}
+			if id != order[0] {
+				return fmt.Errorf("step %d: Pop = ID %d, want %d", step, id, order[0])
+			}
+			want := added[id].bufs
+			if len(descs) != len(want) {
+				return fmt.Errorf("step %d: chain of %d descriptors, want %d", step, len(descs), len(want))
+			}
+			for i, d := range descs {
+				if d.Addr != want[i].Addr || d.Len != want[i].Len || (d.Flags&DescFlagWrite != 0) != want[i].Writable {
+					return fmt.Errorf("step %d: descriptor %d = %+v, want %+v", step, i, d, want[i])
+				}
+			}
+			order = order[1:]
+			popped = append(popped, id)
+
+		case op == 2 && len(popped) > 0:
+			// device: push any popped chain, completing out of order.
+			i := rnd.Intn(len(popped))
+			id := popped[i]
+			popped = append(popped[:i], popped[i+1:]...)
+
+			c := added[id]
+			delete(added, id)
+			c.written = rnd.Uint32()
+			if err := dev.Push(id, c.written); err != nil {
+				return fmt.Errorf("step %d: Push: %v", step, err)
+			}
+			pushed[id] = c
+
+		case op == 3:
+			// driver: reap.
+			e, ok, err := drv.Reap()
+			if err != nil {
+				return fmt.Errorf("step %d: Reap: %v", step, err)
+			}
+			if ok != (len(pushed) > 0) {
+				return fmt.Errorf("step %d: Reap ok = %v with %d pushed", step, ok, len(pushed))
+			}
+			if !ok {
+				continue
+			}
+			c, found := pushed[uint16(e.ID)]
+			if !found || e.Len != c.written {
+				return fmt.Errorf("step %d: Reap = %+v, want one of %v", step, e, pushed)
+			}
+			delete(pushed, uint16(e.ID))
+			inUse -= len(c.bufs)
+		}
+
+		if drv.NumFree() != int(size)-inUse {
+			return fmt.Errorf("step %d: %d free descriptors, want %d", step, drv.NumFree(), int(size)-inUse)
+		}
+	}
+
+	return nil
+}
+
+func TestPackedQueueModel(t *testing.T) {
+	f := func(seed int64, size uint8) bool {
+		// small queues wrap often.
+		if err := packedModel(t, seed, uint16(size%16)+1, 500); err != nil {
+			t.Logf("seed %d, size %d: %v", seed, size%16+1, err)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 200}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPackedQueueConcurrent(t *testing.T) {
+	drv, dev := newTestPacked(t, 8)
+
+	const n = 1000
+	done := make(chan error, 1)
+	go func() {
+		for served := 0; served < n; {
+			id, descs, ok, err := dev.Pop()
+			if err != nil {
+				done <- err
+				return
+			}
+			if !ok {
+				runtime.Gosched()
+				continue
+			}
+			if err := dev.Push(id, uint32(descs[0].Addr)); err != nil {
+				done <- err
+				return
+			}
+			served++
+		}
+		done <- nil
+	}()
+
+	want := make(map[uint16]uint32)
+	for sent, reaped := 0, 0; reaped < n; {
+		if sent < n {
+			id, err := drv.Add([]Buffer{{Addr: uint64(sent)}, {Writable: true}})
+			if err == nil {
+				want[id] = uint32(sent)
+				sent++
+			} else if !errors.Is(err, ErrQueueFull) {
+				t.Fatalf("Add: %v", err)
+			}
+		}
+
+		e, ok, err := drv.Reap()
+		if err != nil {
+			t.Fatalf("Reap: %v", err)
+		}
+		if !ok {
+			runtime.Gosched()
+			continue
+		}
+		if e.Len != want[uint16(e.ID)] {
+			t.Fatalf("Reap = %+v, want length %d", e, want[uint16(e.ID)])
+		}
+		reaped++
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("device: %v", err)
+	}
+}
+
+func TestPackedQueueEvents(t *testing.T) {
+	drv, dev := newTestPacked(t, 4)
+
+	var kicks int
+	drv.Notify = func() { kicks++ }
+
+	kick := func() {
+		if _, err := drv.Add([]Buffer{{}}); err != nil {
+			t.Fatal(err)
+		}
+		drv.Kick()
+	}
+
+	kick()
+	dev.SetDeviceEvent(EventSuppression{Flags: EventFlagDisable})
+	kick()
+	if kicks != 1 {
+		t.Fatalf("%d notifications, want 1", kicks)
+	}
+
+	drv.SetDriverEvent(EventSuppression{OffWrap: 1<<15 | 3, Flags: EventFlagDesc})
+	if got := dev.DriverEvent(); got.Flags != EventFlagDesc || got.OffWrap != 1<<15|3 {
+		t.Fatalf("DriverEvent = %+v", got)
+	}
+}
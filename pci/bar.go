@@ -0,0 +1,273 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package pci
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/go-hypervisor/virtio"
+	"github.com/go-hypervisor/virtio/internal/transport"
+)
+
+// list of common configuration fields.
+const (
+	commonDeviceFeatureSel = 0x00
+	commonDeviceFeature    = 0x04
+	commonDriverFeatureSel = 0x08
+	commonDriverFeature    = 0x0c
+	commonConfigVector     = 0x10
+	commonNumQueues        = 0x12
+	commonDeviceStatus     = 0x14
+	commonConfigGeneration = 0x15
+	commonQueueSelect      = 0x16
+	commonQueueSize        = 0x18
+	commonQueueVector      = 0x1a
+	commonQueueEnable      = 0x1c
+	commonQueueNotifyOff   = 0x1e
+	commonQueueDesc        = 0x20
+	commonQueueDriver      = 0x28
+	commonQueueDevice      = 0x30
+)
+
+// ReadBAR handles a read of p at the offset off of BAR 0. p is zeroed on
+// error.
+func (t *Transport) ReadBAR(off uint64, p []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.readBAR(off, p)
+}
+
+// WriteBAR handles a write of p at the offset off of BAR 0.
+func (t *Transport) WriteBAR(off uint64, p []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.writeBAR(off, p)
+}
+
+// region returns the offset of the access of n bytes at off in the BAR 0
+// structure starting at base, of size bytes.
+func region(off uint64, n int, base, size uint64) (uint64, bool) {
+	if off < base || off-base > size || uint64(n) > size-(off-base) {
+		return 0, false
+	}
+
+	return off - base, true
+}
+
+func (t *Transport) readBAR(off uint64, p []byte) error {
+	for i := range p {
+		p[i] = 0
+	}
+
+	if o, ok := region(off, len(p), CommonCfgOffset, commonCfgSize); ok {
+		b := t.common()
+		copy(p, b[o:])
+		return nil
+	}
+	if _, ok := region(off, len(p), ISROffset, isrSize); ok {
+		// reading the ISR status acknowledges the interrupt.
+		t.irqMu.Lock()
+		if off == ISROffset && len(p) > 0 {
+			p[0] = t.isr
+		}
+		t.setISR(0)
+		t.irqMu.Unlock()
+		return nil
+	}
+	if o, ok := region(off, len(p), DeviceCfgOffset, deviceCfgSize); ok {
+		t.state.Dev.ReadConfig(o, p)
+		return nil
+	}
+	if o, ok := region(off, len(p), MSIXTableOffset, uint64(len(t.msix.table))); ok {
+		t.irqMu.Lock()
+		copy(p, t.msix.table[o:])
+		t.irqMu.Unlock()
+		return nil
+	}
+	if o, ok := region(off, len(p), MSIXPBAOffset, uint64(len(t.msix.pba))); ok {
+		t.irqMu.Lock()
+		copy(p, t.msix.pba[o:])
+		t.irqMu.Unlock()
+		return nil
+	}
+
+	return fmt.Errorf("%w: %d byte BAR read at %#x", ErrInvalidAccess, len(p), off)
+}
+
+func (t *Transport) writeBAR(off uint64, p []byte) error {
+	if o, ok := region(off, len(p), CommonCfgOffset, commonCfgSize); ok {
+		return t.writeCommon(o, p)
+	}
+	if o, ok := region(off, len(p), DeviceCfgOffset, deviceCfgSize); ok {
+		t.state.Dev.WriteConfig(o, p)
+		return nil
+	}
+	if o, ok := region(off, len(p), NotifyOffset, uint64(len(t.state.Queues))*NotifyOffMultiplier); ok {
+		t.state.Notify(int(o / NotifyOffMultiplier))
+		return nil
+	}
+	if o, ok := region(off, len(p), MSIXTableOffset, uint64(len(t.msix.table))); ok {
+		t.irqMu.Lock()
+		copy(t.msix.table[o:], p)
+		t.msix.flush(t.MSI)
+		t.irqMu.Unlock()
+		return nil
+	}
+
+	return fmt.Errorf("%w: %d byte BAR write at %#x", ErrInvalidAccess, len(p), off)
+}
+
+// common returns the common configuration structure.
+func (t *Transport) common() []byte {
+	le := binary.LittleEndian
+	s := t.state
+	b := make([]byte, commonCfgSize)
+
+	le.PutUint32(b[commonDeviceFeatureSel:], s.DeviceFeaturesSel)
+	le.PutUint32(b[commonDeviceFeature:], s.DeviceFeatures())
+	le.PutUint32(b[commonDriverFeatureSel:], s.DriverFeaturesSel)
+	le.PutUint32(b[commonDriverFeature:], s.DriverFeatures())
+	le.PutUint16(b[commonNumQueues:], uint16(len(s.Queues)))
+	b[commonDeviceStatus] = uint8(s.Status.Status())
+	le.PutUint16(b[commonQueueSelect:], uint16(s.QueueSel))
+
+	t.irqMu.Lock()
+	le.PutUint16(b[commonConfigVector:], t.configVector)
+	b[commonConfigGeneration] = t.generation
+	if q := s.Queue(); q != nil {
+		le.PutUint16(b[commonQueueVector:], t.queueVectors[s.QueueSel])
+	}
+	t.irqMu.Unlock()
+
+	if q := s.Queue(); q != nil {
+		le.PutUint16(b[commonQueueSize:], q.Num)
+		if q.Ready {
+			le.PutUint16(b[commonQueueEnable:], 1)
+		}
+		le.PutUint16(b[commonQueueNotifyOff:], uint16(s.QueueSel))
+		le.PutUint64(b[commonQueueDesc:], q.Desc)
+		le.PutUint64(b[commonQueueDriver:], q.Driver)
+		le.PutUint64(b[commonQueueDevice:], q.Device)
+	}
+
+	return b
+}
+
+// writeCommon writes p at the offset off of the common configuration
+// structure, applying the fields it overlaps in order. A field written
+// partially, like half of a queue address, is merged with its current value.
+func (t *Transport) writeCommon(off uint64, p []byte) error {
+	le := binary.LittleEndian
+	s := t.state
+	old := t.common()
+	b := append([]byte(nil), old...)
+	copy(b[off:], p)
+	touched := func(field, size uint64) bool {
+		return overlaps(off, len(p), field, size)
+	}
+
+	for _, ro := range []struct{ field, size uint64 }{
+		{commonDeviceFeature, 4},
+		{commonNumQueues, 2},
+		{commonConfigGeneration, 1},
+		{commonQueueNotifyOff, 2},
+	} {
+		if touched(ro.field, ro.size) && !bytes.Equal(b[ro.field:ro.field+ro.size], old[ro.field:ro.field+ro.size]) {
+			return fmt.Errorf("%w: write of read-only common configuration field %#x", ErrInvalidAccess, ro.field)
+		}
+	}
+
+	if touched(commonDeviceFeatureSel, 4) {
+		s.DeviceFeaturesSel = le.Uint32(b[commonDeviceFeatureSel:])
+	}
+	if touched(commonDriverFeatureSel, 4) {
+		s.DriverFeaturesSel = le.Uint32(b[commonDriverFeatureSel:])
+	}
+	if touched(commonDriverFeature, 4) {
+		if err := s.SetDriverFeatures(le.Uint32(b[commonDriverFeature:])); err != nil {
+			return err
+		}
+	}
+	if touched(commonConfigVector, 2) {
+		t.irqMu.Lock()
+		t.configVector = t.vector(le.Uint16(b[commonConfigVector:]))
+		t.irqMu.Unlock()
+	}
+	if touched(commonDeviceStatus, 1) {
+		if err := t.setStatus(virtio.Status(b[commonDeviceStatus])); err != nil {
+			return err
+		}
+	}
+	if touched(commonQueueSelect, 2) {
+		s.QueueSel = uint32(le.Uint16(b[commonQueueSelect:]))
+	}
+	if touched(commonQueueSize, 2) {
+		if err := s.SetQueueNum(uint32(le.Uint16(b[commonQueueSize:]))); err != nil {
+			return fmt.Errorf("pci: %w", err)
+		}
+	}
+	if touched(commonQueueVector, 2) && s.Queue() != nil {
+		t.irqMu.Lock()
+		t.queueVectors[s.QueueSel] = t.vector(le.Uint16(b[commonQueueVector:]))
+		t.irqMu.Unlock()
+	}
+	for _, a := range []struct {
+		field uint64
+		addr  func(q *transport.Queue) *uint64
+	}{
+		{commonQueueDesc, func(q *transport.Queue) *uint64 { return &q.Desc }},
+		{commonQueueDriver, func(q *transport.Queue) *uint64 { return &q.Driver }},
+		{commonQueueDevice, func(q *transport.Queue) *uint64 { return &q.Device }},
+	} {
+		if !touched(a.field, 8) {
+			continue
+		}
+		v := le.Uint64(b[a.field:])
+		if err := s.SetQueue(func(q *transport.Queue) error { *a.addr(q) = v; return nil }); err != nil {
+			return fmt.Errorf("pci: %w", err)
+		}
+	}
+	// the driver never disables a queue but resets the device, so writes of
+	// 0 are ignored.
+	if touched(commonQueueEnable, 2) && le.Uint16(b[commonQueueEnable:]) == 1 {
+		if err := s.SetQueueReady(true); err != nil {
+			return fmt.Errorf("pci: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// vector returns v if it is in the MSI-X table, NoVector otherwise; the driver
+// reads the vector back to detect the failure. irqMu must be held.
+func (t *Transport) vector(v uint16) uint16 {
+	if int(v) >= t.msix.size() {
+		return NoVector
+	}
+
+	return v
+}
+
+// setStatus applies a write of device_status, resetting or activating the
+// device.
+func (t *Transport) setStatus(v virtio.Status) error {
+	if v != 0 {
+		if err := t.state.SetStatus(v, t); err != nil {
+			return fmt.Errorf("pci: %w", err)
+		}
+		return nil
+	}
+
+	t.state.Reset()
+	t.irqMu.Lock()
+	t.resetVectors()
+	t.setISR(0)
+	t.irqMu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,22 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package pci implements the device side of the virtio over PCI transport,
+// for modern devices.
+//
+// A Transport emulates the config space of the PCI function, with the virtio
+// vendor-specific capabilities and MSI-X, and its BAR 0 which holds the common
+// configuration, the ISR status, the device configuration, the notification
+// addresses and the MSI-X table. The VMM forwards the config space and BAR
+// accesses of the driver, and delivers the interrupts through the IRQ and MSI
+// callbacks.
+//
+// BAR 0 is a 64-bit memory BAR of BARSize bytes:
+//
+//	0x0000 common configuration
+//	0x1000 ISR status
+//	0x2000 device configuration
+//	0x3000 notifications, NotifyOffMultiplier bytes per queue
+//	0x4000 MSI-X table
+//	0x6000 MSI-X pending bit array
+package pci
@@ -0,0 +1,90 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package pci
+
+import "encoding/binary"
+
+// NoVector is the MSI-X vector of a queue or configuration change without
+// interrupt.
+const NoVector = 0xffff
+
+// list of MSI-X message control bits.
+const (
+	msixEnable       = 1 << 15
+	msixFunctionMask = 1 << 14
+)
+
+// msixEntrySize is the size of an MSI-X table entry: the message address,
+// the message data and the vector control, whose bit 0 masks the vector.
+const msixEntrySize = 16
+
+// msix is the MSI-X table and pending bit array of a function.
+type msix struct {
+	table   []byte
+	pba     []byte
+	control uint16
+}
+
+// newMSIX returns the MSI-X state of n vectors, all masked as after reset.
+func newMSIX(n int) *msix {
+	m := &msix{
+		table: make([]byte, n*msixEntrySize),
+		pba:   make([]byte, (n+63)/64*8),
+	}
+	for i := 0; i < n; i++ {
+		m.table[i*msixEntrySize+12] = 1
+	}
+
+	return m
+}
+
+// size returns the number of vectors.
+func (m *msix) size() int {
+	return len(m.table) / msixEntrySize
+}
+
+// enabled reports whether MSI-X replaces INTx.
+func (m *msix) enabled() bool {
+	return m.control&msixEnable != 0
+}
+
+func (m *msix) masked(v int) bool {
+	return m.control&msixFunctionMask != 0 || m.table[v*msixEntrySize+12]&1 != 0
+}
+
+// signal sends the message of vector v through deliver, or marks it pending
+// if the vector or the function is masked.
+func (m *msix) signal(v uint16, deliver func(addr uint64, data uint32)) {
+	if int(v) >= m.size() {
+		return
+	}
+	if m.masked(int(v)) {
+		m.pba[v/8] |= 1 << (v % 8)
+		return
+	}
+	m.send(int(v), deliver)
+}
+
+func (m *msix) send(v int, deliver func(addr uint64, data uint32)) {
+	if deliver == nil {
+		return
+	}
+	e := m.table[v*msixEntrySize:]
+	deliver(binary.LittleEndian.Uint64(e), binary.LittleEndian.Uint32(e[8:]))
+}
+
+// flush sends the pending messages of the vectors unmasked since they were
+// signalled.
+func (m *msix) flush(deliver func(addr uint64, data uint32)) {
+	if !m.enabled() {
+		return
+	}
+	for v := 0; v < m.size(); v++ {
+		if m.pba[v/8]&(1<<(v%8)) == 0 || m.masked(v) {
+			continue
+		}
+		m.pba[v/8] &^= 1 << (v % 8)
+		m.send(v, deliver)
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package pci
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/go-hypervisor/virtio"
+	"github.com/go-hypervisor/virtio/internal/transport"
+)
+
+const (
+	// VendorID is the PCI vendor ID of virtio devices.
+	VendorID = 0x1af4
+
+	// DeviceIDBase is added to the virtio device ID to form the PCI device ID
+	// of a modern device.
+	DeviceIDBase = 0x1040
+
+	// SubsystemID is the PCI subsystem ID of the devices.
+	SubsystemID = 0x1100
+)
+
+// list of virtio capability types.
+const (
+	CapCommonCfg = 1
+	CapNotifyCfg = 2
+	CapISRCfg    = 3
+	CapDeviceCfg = 4
+	CapPCICfg    = 5
+)
+
+// list of offsets of the BAR 0 structures.
+const (
+	CommonCfgOffset = 0x0000
+	ISROffset       = 0x1000
+	DeviceCfgOffset = 0x2000
+	NotifyOffset    = 0x3000
+	MSIXTableOffset = 0x4000
+	MSIXPBAOffset   = 0x6000
+
+	// BARSize is the size of BAR 0, a 64-bit memory BAR.
+	BARSize = 0x8000
+)
+
+const (
+	commonCfgSize = 0x38
+	isrSize       = 4
+	deviceCfgSize = 0x1000
+	notifySize    = 0x1000
+
+	// NotifyOffMultiplier is the distance between the notification
+	// addresses of the queues.
+	NotifyOffMultiplier = 4
+
+	// maxVectors is the number of MSI-X table entries fitting before the PBA.
+	maxVectors = (MSIXPBAOffset - MSIXTableOffset) / msixEntrySize
+)
+
+// list of ISR status bits.
+const (
+	ISRQueue  = 1 << 0
+	ISRConfig = 1 << 1
+)
+
+// list of config space offsets.
+const (
+	cfgVendorID    = 0x00
+	cfgDeviceID    = 0x02
+	cfgCommand     = 0x04
+	cfgStatus      = 0x06
+	cfgRevision    = 0x08
+	cfgClass       = 0x09
+	cfgHeaderType  = 0x0e
+	cfgBAR0        = 0x10
+	cfgSubVendorID = 0x2c
+	cfgSubsystemID = 0x2e
+	cfgCapPtr      = 0x34
+	cfgIntLine     = 0x3c
+	cfgIntPin      = 0x3d
+
+	// the capability list.
+	capMSIX   = 0x40
+	capCommon = 0x4c
+	capNotify = 0x5c
+	capISR    = 0x70
+	capDevice = 0x80
+	capPCICfg = 0x90
+
+	configSize = 0x100
+)
+
+// ErrInvalidAccess is returned for accesses outside of the config space and
+// the structures of BAR 0, or writes to read-only fields.
+var ErrInvalidAccess = errors.New("pci: invalid access")
+
+// classes are the PCI class codes of the device types, others being 0xff.
+var classes = map[virtio.DeviceID]uint16{
+	virtio.DeviceNet:     0x0200,
+	virtio.DeviceBlock:   0x0100,
+	virtio.DeviceConsole: 0x0780,
+}
+
+// Transport is the PCI function of a device: its config space with the virtio
+// capabilities and BAR 0 holding the virtio structures and the MSI-X table.
+type Transport struct {
+	// IRQ, if non-nil, is called with the new level of the INTx line when
+	// the ISR status changes between zero and non-zero.
+	IRQ func(level bool)
+
+	// MSI, if non-nil, is called to send an MSI-X message once the driver
+	// enabled MSI-X.
+	MSI func(addr uint64, data uint32)
+
+	mu     sync.Mutex
+	state  *transport.State
+	config [configSize]byte
+	wmask  [configSize]byte
+
+	// interrupts are sent by the device outside of register accesses.
+	irqMu        sync.Mutex
+	isr          uint8
+	generation   uint8
+	msix         *msix
+	configVector uint16
+	queueVectors []uint16
+}
+
+var _ virtio.Interrupter = (*Transport)(nil)
+
+// New returns the PCI function of dev, whose queues are in mem. The transport
+// offers VERSION_1 in addition to the features of the device.
+func New(mem virtio.GuestMemory, dev virtio.Device) *Transport {
+	t := &Transport{state: transport.New(mem, dev)}
+
+	// a vector per queue and one for configuration changes.
+	n := len(t.state.Queues) + 1
+	if n > maxVectors {
+		n = maxVectors
+	}
+	t.msix = newMSIX(n)
+	t.resetVectors()
+	t.buildConfig(n)
+
+	return t
+}
+
+// buildConfig builds the type 0 header and the capability list, and the mask
+// of the bits writable by the driver.
+func (t *Transport) buildConfig(vectors int) {
+	le := binary.LittleEndian
+	c, w := t.config[:], t.wmask[:]
+	id := t.state.Dev.DeviceID()
+
+	le.PutUint16(c[cfgVendorID:], VendorID)
+	le.PutUint16(c[cfgDeviceID:], DeviceIDBase+uint16(id))
+	le.PutUint16(w[cfgCommand:], 0x0407) // I/O, memory, bus master, INTx disable
+	le.PutUint16(c[cfgStatus:], 0x0010)  // capability list
+	c[cfgRevision] = 1
+	class, ok := classes[id]
+	if !ok {
+		class = 0xff00
+	}
+	le.PutUint16(c[cfgClass+1:], class)
+	c[cfgHeaderType] = 0
+	le.PutUint32(c[cfgBAR0:], 0x4) // 64-bit memory
+	le.PutUint32(w[cfgBAR0:], ^uint32(BARSize-1))
+	le.PutUint32(w[cfgBAR0+4:], 0xffffffff)
+	le.PutUint16(c[cfgSubVendorID:], VendorID)
+	le.PutUint16(c[cfgSubsystemID:], SubsystemID)
+	c[cfgCapPtr] = capMSIX
+	w[cfgIntLine] = 0xff
+	c[cfgIntPin] = 1
+
+	// MSI-X, with the table and PBA in BAR 0.
+	c[capMSIX], c[capMSIX+1] = 0x11, capCommon
+	le.PutUint16(c[capMSIX+2:], uint16(vectors-1))
+	w[capMSIX+3] = (msixEnable | msixFunctionMask) >> 8
+	le.PutUint32(c[capMSIX+4:], MSIXTableOffset)
+	le.PutUint32(c[capMSIX+8:], MSIXPBAOffset)
+
+	t.putCap(capCommon, capNotify, 16, CapCommonCfg, CommonCfgOffset, commonCfgSize)
+	t.putCap(capNotify, capISR, 20, CapNotifyCfg, NotifyOffset, notifySize)
+	le.PutUint32(c[capNotify+16:], NotifyOffMultiplier)
+	t.putCap(capISR, capDevice, 16, CapISRCfg, ISROffset, isrSize)
+	t.putCap(capDevice, capPCICfg, 16, CapDeviceCfg, DeviceCfgOffset, deviceCfgSize)
+
+	// the window of the PCI configuration access capability.
+	t.putCap(capPCICfg, 0, 20, CapPCICfg, 0, 0)
+	w[capPCICfg+4] = 0xff
+	le.PutUint32(w[capPCICfg+8:], 0xffffffff)
+	le.PutUint32(w[capPCICfg+12:], 0xffffffff)
+	le.PutUint32(w[capPCICfg+16:], 0xffffffff)
+}
+
+// putCap writes a virtio vendor-specific capability for a structure of BAR 0.
+func (t *Transport) putCap(off, next, length int, typ uint8, barOff, size uint32) {
+	c := t.config[off:]
+	c[0], c[1], c[2], c[3], c[4] = 0x09, uint8(next), uint8(length), typ, 0
+	binary.LittleEndian.PutUint32(c[8:], barOff)
+	binary.LittleEndian.PutUint32(c[12:], size)
+}
+
+// BARAddress returns the guest physical address of BAR 0 programmed by the
+// driver.
+func (t *Transport) BARAddress() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return binary.LittleEndian.Uint64(t.config[cfgBAR0:]) &^ 0xf
+}
+
+// ReadConfig handles a read of p at the offset off of the config space.
+func (t *Transport) ReadConfig(off uint64, p []byte) error {
+	if off > configSize || uint64(len(p)) > configSize-off {
+		return fmt.Errorf("%w: %d byte config read at %#x", ErrInvalidAccess, len(p), off)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// reads of the PCI configuration access window read BAR 0.
+	if overlaps(off, len(p), capPCICfg+16, 4) {
+		bar, barOff, n := t.pciCfgWindow()
+		data := t.config[capPCICfg+16 : capPCICfg+20]
+		for i := range data {
+			data[i] = 0
+		}
+		if bar == 0 && n <= 4 {
+			_ = t.readBAR(barOff, data[:n])
+		}
+	}
+	copy(p, t.config[off:])
+
+	return nil
+}
+
+// WriteConfig handles a write of p at the offset off of the config space.
+// Read-only bits are ignored.
+func (t *Transport) WriteConfig(off uint64, p []byte) error {
+	if off > configSize || uint64(len(p)) > configSize-off {
+		return fmt.Errorf("%w: %d byte config write at %#x", ErrInvalidAccess, len(p), off)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, b := range p {
+		j := int(off) + i
+		t.config[j] = t.config[j]&^t.wmask[j] | b&t.wmask[j]
+	}
+
+	if overlaps(off, len(p), capMSIX+2, 2) {
+		t.irqMu.Lock()
+		t.msix.control = binary.LittleEndian.Uint16(t.config[capMSIX+2:])
+		t.msix.flush(t.MSI)
+		t.irqMu.Unlock()
+	}
+	if overlaps(off, len(p), capPCICfg+16, 4) {
+		bar, barOff, n := t.pciCfgWindow()
+		if bar == 0 && n <= 4 {
+			return t.writeBAR(barOff, t.config[capPCICfg+16:capPCICfg+16+n])
+		}
+	}
+
+	return nil
+}
+
+// pciCfgWindow returns the BAR, offset and length selected in the PCI
+// configuration access capability.
+func (t *Transport) pciCfgWindow() (bar uint8, off uint64, n int) {
+	c := t.config[capPCICfg:]
+
+	return c[4], uint64(binary.LittleEndian.Uint32(c[8:])), int(binary.LittleEndian.Uint32(c[12:]))
+}
+
+// overlaps reports whether the access of n bytes at off overlaps the field of
+// size bytes at field.
+func overlaps(off uint64, n int, field, size uint64) bool {
+	return off < field+size && field < off+uint64(n)
+}
+
+// resetVectors unassigns the MSI-X vectors of the queues and configuration
+// changes. irqMu must be held or the transport unused.
+func (t *Transport) resetVectors() {
+	t.configVector = NoVector
+	t.queueVectors = make([]uint16, len(t.state.Queues))
+	for i := range t.queueVectors {
+		t.queueVectors[i] = NoVector
+	}
+}
+
+// setISR sets the ISR status and the level of the INTx line. irqMu must be
+// held.
+func (t *Transport) setISR(v uint8) {
+	old := t.isr
+	t.isr = v
+	if t.IRQ != nil && (old == 0) != (v == 0) {
+		t.IRQ(v != 0)
+	}
+}
+
+// InterruptQueue implements virtio.Interrupter.InterruptQueue.
+func (t *Transport) InterruptQueue(index int) {
+	t.irqMu.Lock()
+	defer t.irqMu.Unlock()
+
+	if t.msix.enabled() {
+		if index >= 0 && index < len(t.queueVectors) {
+			t.msix.signal(t.queueVectors[index], t.MSI)
+		}
+		return
+	}
+	t.setISR(t.isr | ISRQueue)
+}
+
+// InterruptConfig implements virtio.Interrupter.InterruptConfig. It also
+// bumps config_generation.
+func (t *Transport) InterruptConfig() {
+	t.irqMu.Lock()
+	defer t.irqMu.Unlock()
+
+	t.generation++
+	if t.msix.enabled() {
+		t.msix.signal(t.configVector, t.MSI)
+		return
+	}
+	t.setISR(t.isr | ISRConfig)
+}
@@ -0,0 +1,322 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package pci
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+// testDevice is an entropy-like device with one queue and 8 bytes of
+// configuration space.
+type testDevice struct {
+	config [8]byte
+	queues []*virtio.Queue
+	irq    virtio.Interrupter
+}
+
+func (d *testDevice) DeviceID() virtio.DeviceID        { return virtio.DeviceEntropy }
+func (d *testDevice) Features() virtio.Features        { return 0 }
+func (d *testDevice) AckFeatures(f virtio.Features)    {}
+func (d *testDevice) QueueMaxSizes() []uint16          { return []uint16{16} }
+func (d *testDevice) ReadConfig(off uint64, p []byte)  { copy(p, d.config[off:]) }
+func (d *testDevice) WriteConfig(off uint64, p []byte) { copy(d.config[off:], p) }
+func (d *testDevice) Reset()                           { d.queues, d.irq = nil, nil }
+
+func (d *testDevice) Activate(mem virtio.GuestMemory, queues []*virtio.Queue, irq virtio.Interrupter) error {
+	d.queues, d.irq = queues, irq
+	return nil
+}
+
+// testDriver drives the config space and BAR 0 of a transport.
+type testDriver struct {
+	t  *testing.T
+	tr *Transport
+}
+
+func (d testDriver) cfg(off uint64, n int) uint32 {
+	d.t.Helper()
+
+	p := make([]byte, 4)
+	if err := d.tr.ReadConfig(off, p[:n]); err != nil {
+		d.t.Fatal(err)
+	}
+
+	return binary.LittleEndian.Uint32(p)
+}
+
+func (d testDriver) setCfg(off uint64, n int, v uint32) {
+	d.t.Helper()
+
+	p := make([]byte, 4)
+	binary.LittleEndian.PutUint32(p, v)
+	if err := d.tr.WriteConfig(off, p[:n]); err != nil {
+		d.t.Fatal(err)
+	}
+}
+
+func (d testDriver) bar(off uint64, n int) uint64 {
+	d.t.Helper()
+
+	p := make([]byte, 8)
+	if err := d.tr.ReadBAR(off, p[:n]); err != nil {
+		d.t.Fatal(err)
+	}
+
+	return binary.LittleEndian.Uint64(p)
+}
+
+func (d testDriver) setBAR(off uint64, n int, v uint64) {
+	d.t.Helper()
+
+	p := make([]byte, 8)
+	binary.LittleEndian.PutUint64(p, v)
+	if err := d.tr.WriteBAR(off, p[:n]); err != nil {
+		d.t.Fatal(err)
+	}
+}
+
+func newTestTransport(t *testing.T) (*Transport, *testDevice, virtio.GuestMemory, testDriver) {
+	t.Helper()
+
+	mem, err := virtio.NewMemory(&virtio.Region{Data: make([]byte, 1<<16)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := &testDevice{}
+	tr := New(mem, dev)
+
+	return tr, dev, mem, testDriver{t: t, tr: tr}
+}
+
+// setup initializes the device through the common configuration, with the
+// split queue 0 of 16 descriptors at 0 using MSI-X vector 1, and returns the
+// driver side of the queue.
+func (d testDriver) setup(mem virtio.GuestMemory) *virtio.SplitQueue {
+	d.t.Helper()
+
+	status := virtio.StatusAcknowledge | virtio.StatusDriver
+	d.setBAR(commonDeviceStatus, 1, uint64(status))
+	d.setBAR(commonDriverFeatureSel, 4, 1)
+	d.setBAR(commonDriverFeature, 4, 1)
+	status |= virtio.StatusFeaturesOK
+	d.setBAR(commonDeviceStatus, 1, uint64(status))
+
+	const size = 16
+	avail, used, _ := virtio.SplitLayout(size)
+	d.setBAR(commonConfigVector, 2, 0)
+	d.setBAR(commonQueueSelect, 2, 0)
+	d.setBAR(commonQueueSize, 2, size)
+	d.setBAR(commonQueueVector, 2, 1)
+	if v := d.bar(commonQueueVector, 2); v != 1 {
+		d.t.Fatalf("queue vector %#x", v)
+	}
+	d.setBAR(commonQueueDesc, 4, 0)
+	d.setBAR(commonQueueDesc+4, 4, 0)
+	d.setBAR(commonQueueDriver, 8, avail)
+	d.setBAR(commonQueueDevice, 8, used)
+	d.setBAR(commonQueueEnable, 2, 1)
+	d.setBAR(commonDeviceStatus, 1, uint64(status|virtio.StatusDriverOK))
+
+	q, err := virtio.NewSplitQueue(mem, size, 0, avail, used)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+
+	return q
+}
+
+func TestConfigSpace(t *testing.T) {
+	tr, _, _, drv := newTestTransport(t)
+
+	if v := drv.cfg(cfgVendorID, 2); v != VendorID {
+		t.Errorf("vendor ID %#x", v)
+	}
+	if v := drv.cfg(cfgDeviceID, 2); v != DeviceIDBase+uint32(virtio.DeviceEntropy) {
+		t.Errorf("device ID %#x", v)
+	}
+	if drv.cfg(cfgStatus, 2)&0x10 == 0 {
+		t.Fatal("no capability list")
+	}
+
+	// walk the capability list.
+	virtioCaps := map[uint32][3]uint32{}
+	var notifyMultiplier, msixSize uint32
+	for off := drv.cfg(cfgCapPtr, 1); off != 0; off = drv.cfg(uint64(off)+1, 1) {
+		switch id := drv.cfg(uint64(off), 1); id {
+		case 0x11:
+			msixSize = drv.cfg(uint64(off)+2, 2)&0x7ff + 1
+		case 0x09:
+			typ := drv.cfg(uint64(off)+3, 1)
+			virtioCaps[typ] = [3]uint32{drv.cfg(uint64(off)+4, 1), drv.cfg(uint64(off)+8, 4), drv.cfg(uint64(off)+12, 4)}
+			if typ == CapNotifyCfg {
+				notifyMultiplier = drv.cfg(uint64(off)+16, 4)
+			}
+		default:
+			t.Fatalf("unexpected capability %#x at %#x", id, off)
+		}
+	}
+	for typ, want := range map[uint32][3]uint32{
+		CapCommonCfg: {0, CommonCfgOffset, commonCfgSize},
+		CapNotifyCfg: {0, NotifyOffset, notifySize},
+		CapISRCfg:    {0, ISROffset, isrSize},
+		CapDeviceCfg: {0, DeviceCfgOffset, deviceCfgSize},
+		CapPCICfg:    {0, 0, 0},
+	} {
+		if got, ok := virtioCaps[typ]; !ok || got != want {
+			t.Errorf("capability %d = %v, want %v", typ, got, want)
+		}
+	}
+	if notifyMultiplier != NotifyOffMultiplier || msixSize != 2 {
+		t.Errorf("notify multiplier %d, %d MSI-X vectors", notifyMultiplier, msixSize)
+	}
+
+	// BAR 0 sizing and programming.
+	drv.setCfg(cfgBAR0, 4, 0xffffffff)
+	drv.setCfg(cfgBAR0+4, 4, 0xffffffff)
+	if v := drv.cfg(cfgBAR0, 4); v != ^uint32(BARSize-1)|0x4 {
+		t.Errorf("BAR 0 size mask %#x", v)
+	}
+	drv.setCfg(cfgBAR0, 4, 0xfe000000)
+	drv.setCfg(cfgBAR0+4, 4, 0x1)
+	if addr := tr.BARAddress(); addr != 0x1fe000000 {
+		t.Errorf("BAR 0 address %#x", addr)
+	}
+	if v := drv.cfg(cfgBAR0+8, 4); v != 0 {
+		t.Errorf("BAR 2 %#x, want unimplemented", v)
+	}
+
+	// read-only fields are preserved.
+	drv.setCfg(cfgVendorID, 4, 0)
+	if v := drv.cfg(cfgVendorID, 2); v != VendorID {
+		t.Errorf("vendor ID overwritten with %#x", v)
+	}
+}
+
+func TestMSIX(t *testing.T) {
+	tr, dev, mem, drv := newTestTransport(t)
+	type message struct {
+		addr uint64
+		data uint32
+	}
+	var msgs []message
+	tr.MSI = func(addr uint64, data uint32) { msgs = append(msgs, message{addr, data}) }
+
+	// enable MSI-X and program the queue vector, still masked.
+	drv.setCfg(capMSIX+2, 2, msixEnable)
+	drv.setBAR(MSIXTableOffset+msixEntrySize, 8, 0xfee00000)
+	drv.setBAR(MSIXTableOffset+msixEntrySize+8, 4, 0x41)
+
+	q := drv.setup(mem)
+	if len(dev.queues) != 1 {
+		t.Fatalf("device activated with queues %v", dev.queues)
+	}
+	if _, err := q.Add([]virtio.Buffer{{Addr: 0x8000, Len: 4, Writable: true}}); err != nil {
+		t.Fatal(err)
+	}
+	q.Notify = func() { drv.setBAR(NotifyOffset, 2, 0) }
+	q.Kick()
+	select {
+	case <-dev.queues[0].Notified():
+	default:
+		t.Fatal("queue not notified")
+	}
+
+	dev.irq.InterruptQueue(0)
+	if len(msgs) != 0 || drv.bar(MSIXPBAOffset, 8) != 1<<1 {
+		t.Fatalf("masked vector: messages %v, PBA %#x", msgs, drv.bar(MSIXPBAOffset, 8))
+	}
+	drv.setBAR(MSIXTableOffset+msixEntrySize+12, 4, 0)
+	if len(msgs) != 1 || msgs[0] != (message{0xfee00000, 0x41}) || drv.bar(MSIXPBAOffset, 8) != 0 {
+		t.Fatalf("unmasked vector: messages %v", msgs)
+	}
+	dev.irq.InterruptQueue(0)
+	if len(msgs) != 2 {
+		t.Fatalf("%d messages, want 2", len(msgs))
+	}
+
+	// the function mask holds all vectors.
+	drv.setCfg(capMSIX+2, 2, msixEnable|msixFunctionMask)
+	dev.irq.InterruptQueue(0)
+	drv.setCfg(capMSIX+2, 2, msixEnable)
+	if len(msgs) != 3 {
+		t.Fatalf("%d messages after the function is unmasked, want 3", len(msgs))
+	}
+}
+
+func TestINTx(t *testing.T) {
+	tr, dev, mem, drv := newTestTransport(t)
+	var level bool
+	tr.IRQ = func(l bool) { level = l }
+
+	drv.setup(mem)
+	dev.irq.InterruptQueue(0)
+	if !level {
+		t.Fatal("INTx not raised")
+	}
+	if isr := drv.bar(ISROffset, 1); isr != ISRQueue || level {
+		t.Fatalf("ISR %#x, level %v", isr, level)
+	}
+	if isr := drv.bar(ISROffset, 1); isr != 0 {
+		t.Fatalf("ISR %#x after read", isr)
+	}
+
+	gen := drv.bar(commonConfigGeneration, 1)
+	dev.irq.InterruptConfig()
+	if drv.bar(commonConfigGeneration, 1) == gen || drv.bar(ISROffset, 1) != ISRConfig {
+		t.Fatal("config change not signalled")
+	}
+
+	drv.setBAR(commonDeviceStatus, 1, 0)
+	if drv.bar(commonDeviceStatus, 1) != 0 || drv.bar(commonQueueEnable, 2) != 0 || dev.queues != nil {
+		t.Fatal("device not reset")
+	}
+}
+
+func TestPCICfgAccess(t *testing.T) {
+	_, dev, _, drv := newTestTransport(t)
+	copy(dev.config[:], "abcdefgh")
+
+	drv.setCfg(capPCICfg+4, 1, 0)
+	drv.setCfg(capPCICfg+8, 4, DeviceCfgOffset+4)
+	drv.setCfg(capPCICfg+12, 4, 4)
+	if v := drv.cfg(capPCICfg+16, 4); v != binary.LittleEndian.Uint32([]byte("efgh")) {
+		t.Fatalf("window read %#x", v)
+	}
+	drv.setCfg(capPCICfg+16, 4, binary.LittleEndian.Uint32([]byte("EFGH")))
+	if string(dev.config[:]) != "abcdEFGH" {
+		t.Fatalf("window write: config %q", dev.config)
+	}
+}
+
+func TestInvalidAccess(t *testing.T) {
+	tr, _, _, drv := newTestTransport(t)
+
+	for _, tt := range []struct {
+		name string
+		err  error
+	}{
+		{"config space overflow", tr.ReadConfig(configSize-2, make([]byte, 4))},
+		{"outside of the structures", tr.ReadBAR(0x7000, make([]byte, 4))},
+		{"across the common configuration", tr.ReadBAR(commonCfgSize-2, make([]byte, 4))},
+		{"read-only field", tr.WriteBAR(commonNumQueues, []byte{9, 0})},
+		{"notification of a missing queue", tr.WriteBAR(NotifyOffset+NotifyOffMultiplier, []byte{1, 0})},
+	} {
+		if !errors.Is(tt.err, ErrInvalidAccess) {
+			t.Errorf("%s: %v, want %v", tt.name, tt.err, ErrInvalidAccess)
+		}
+	}
+
+	// vectors beyond the table are refused.
+	drv.setBAR(commonConfigVector, 2, 5)
+	if v := drv.bar(commonConfigVector, 2); v != NoVector {
+		t.Errorf("config vector %#x, want NoVector", v)
+	}
+	if err := tr.WriteBAR(commonQueueEnable, []byte{1, 0}); err == nil {
+		t.Error("queue enabled before FEATURES_OK")
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package qga
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// syncDelimiter is the byte emitted by the agent before a guest-sync-delimited
+// response. Sent by the client, it also resets the agent's JSON parser.
+const syncDelimiter = 0xff
+
+// ErrClosed is returned by Client methods after Close has been called.
+var ErrClosed = errors.New("qga: client closed")
+
+// Error is an error reported by the guest agent.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("qga: %s: %s", e.Class, e.Desc)
+}
+
+// request is a QGA command.
+type request struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+// response is a QGA command reply.
+type response struct {
+	Return json.RawMessage `json:"return"`
+	Error  *Error          `json:"error"`
+}
+
+// Client is a qemu-ga protocol client.
+//
+// Commands are serialized; a Client is safe for concurrent use.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu     sync.Mutex
+	synced bool
+	closed bool
+	syncID func() int64
+}
+
+// NewClient returns a Client speaking the QGA protocol over conn.
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+		syncID: rand.Int63,
+	}
+}
+
+// Dial connects to a guest agent exposed by a virtio-serial chardev or any
+// other stream socket, for example Dial("unix", "/run/vm/qga.sock").
+func Dial(network, address string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn), nil
+}
+
+// Close closes the underlying connection.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	c.closed = true
+
+	return c.conn.Close()
+}
+
+// Sync resynchronizes the stream with guest-sync-delimited, discarding any
+// stale data left by an interrupted exchange.
+func (c *Client) Sync(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	return c.withContext(ctx, c.sync)
+}
+
+// Execute runs the command with args and decodes its return value into ret,
+// which may be nil to discard it.
+func (c *Client) Execute(ctx context.Context, command string, args, ret interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	return c.withContext(ctx, func() error {
+		if !c.synced {
+			if err := c.sync(); err != nil {
+				return err
+			}
+		}
+
+		return c.execute(command, args, ret)
+	})
+}
+
+// withContext runs fn with the connection deadlines bound to ctx.
+//
+// A failed exchange leaves the stream in an unknown state; the next command
+// resynchronizes first.
+func (c *Client) withContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if ctx.Done() == nil {
+		// never canceled, no need to watch it. Clearing a deadline left by a
+		// previous call fails on conns without deadline support, which is fine.
+		c.conn.SetDeadline(time.Time{})
+
+		err := fn()
+		c.checkSync(err)
+		return err
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// unblock the pending read or write.
+			c.conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	err := fn()
+	close(done)
+	<-stopped
+
+	c.checkSync(err)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("%w: %v", ctxErr, err)
+		}
+	}
+
+	return err
+}
+
+// checkSync marks the stream for resynchronization if err interrupted an
+// exchange. Errors reported by the agent leave the stream in sync.
+func (c *Client) checkSync(err error) {
+	var qerr *Error
+	if err != nil && !errors.As(err, &qerr) {
+		c.synced = false
+	}
+}
+
+// sync performs the guest-sync-delimited handshake.
+func (c *Client) sync() error {
+	id := c.syncID()
+
+	// flush the agent's parser state and discard any buffered replies.
+	if _, err := c.conn.Write([]byte{syncDelimiter}); err != nil {
+		return err
+	}
+	if err := c.send("guest-sync-delimited", struct {
+		ID int64 `json:"id"`
+	}{id}); err != nil {
+		return err
+	}
+
+	for {
+		// skip everything up to and including the delimiter.
+		if _, err := c.r.ReadBytes(syncDelimiter); err != nil {
+			return err
+		}
+
+		var got int64
+		if err := c.recv(&got); err != nil {
+			var qerr *Error
+			if errors.As(err, &qerr) {
+				return err
+			}
+			// garbage after a stray delimiter, keep scanning.
+			continue
+		}
+		if got == id {
+			c.synced = true
+			return nil
+		}
+	}
+}
+
+// execute sends the command and reads its response.
+func (c *Client) execute(command string, args, ret interface{}) error {
+	if err := c.send(command, args); err != nil {
+		return err
+	}
+
+	return c.recv(ret)
+}
+
+// send writes a single command.
+func (c *Client) send(command string, args interface{}) error {
+	b, err := json.Marshal(request{
+		Execute:   command,
+		Arguments: args,
+	})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	_, err = c.conn.Write(b)
+	return err
+}
+
+// recv reads a single response line and decodes its return value into ret.
+func (c *Client) recv(ret interface{}) error {
+	line, err := c.r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+
+	var resp response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return fmt.Errorf("qga: decode response %q: %w", line, err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if ret == nil || len(resp.Return) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(resp.Return, ret); err != nil {
+		return fmt.Errorf("qga: decode return value: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package qga_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-hypervisor/virtio/qga"
+	"github.com/go-hypervisor/virtio/qga/qgatest"
+)
+
+func newTestClient(t *testing.T, agent *qgatest.Agent) *qga.Client {
+	t.Helper()
+
+	c := qga.NewClient(agent.Pipe())
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func TestClientSyncGarbage(t *testing.T) {
+	agent := &qgatest.Agent{
+		Garbage: []byte(`{"return": {}}` + "\n" + `{"ret`),
+	}
+	c := newTestClient(t, agent)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+}
+
+func TestClientOSInfo(t *testing.T) {
+	agent := &qgatest.Agent{
+		OSInfo: map[string]string{
+			"id":             "fedora",
+			"kernel-release": "5.14.0",
+			"machine":        "x86_64",
+		},
+	}
+	c := newTestClient(t, agent)
+
+	info, err := c.OSInfo(context.Background())
+	if err != nil {
+		t.Fatalf("OSInfo: %v", err)
+	}
+	if info.ID != "fedora" || info.KernelRelease != "5.14.0" || info.Machine != "x86_64" {
+		t.Fatalf("OSInfo = %+v", info)
+	}
+}
+
+func TestClientExec(t *testing.T) {
+	agent := &qgatest.Agent{
+		Exec: func(path string, args, env []string, input []byte) ([]byte, []byte, int) {
+			return []byte(path + " " + strings.Join(args, " ") + ":" + string(input)), []byte("warn"), 3
+		},
+	}
+	c := newTestClient(t, agent)
+
+	st, err := c.Exec(context.Background(), &qga.ExecRequest{
+		Path:          "/bin/echo",
+		Args:          []string{"hello"},
+		Input:         []byte("stdin"),
+		CaptureOutput: true,
+	})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if !st.Exited || st.ExitCode != 3 {
+		t.Fatalf("status = %+v", st)
+	}
+	if got, want := string(st.Stdout), "/bin/echo hello:stdin"; got != want {
+		t.Fatalf("stdout = %q, want %q", got, want)
+	}
+	if got, want := string(st.Stderr), "warn"; got != want {
+		t.Fatalf("stderr = %q, want %q", got, want)
+	}
+}
+
+func TestClientFile(t *testing.T) {
+	agent := &qgatest.Agent{}
+	c := newTestClient(t, agent)
+	ctx := context.Background()
+
+	if _, err := c.OpenFile(ctx, "/missing", "r"); err == nil {
+		t.Fatal("OpenFile of a missing file succeeded")
+	} else {
+		var qerr *qga.Error
+		if !errors.As(err, &qerr) || qerr.Class != "GenericError" {
+			t.Fatalf("OpenFile error = %v, want a GenericError", err)
+		}
+	}
+
+	content := strings.Repeat("virtio ", 1000)
+
+	f, err := c.OpenFile(ctx, "/etc/motd", "w")
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if _, err := io.Copy(f, strings.NewReader(content)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err = c.OpenFile(ctx, "/etc/motd", "r")
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != content {
+		t.Fatalf("read %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestClientFSFreeze(t *testing.T) {
+	c := newTestClient(t, &qgatest.Agent{})
+	ctx := context.Background()
+
+	if n, err := c.FSFreeze(ctx); err != nil || n != 1 {
+		t.Fatalf("FSFreeze = %d, %v", n, err)
+	}
+	if st, err := c.FSFreezeStatus(ctx); err != nil || st != qga.FSFrozen {
+		t.Fatalf("FSFreezeStatus = %q, %v", st, err)
+	}
+	if n, err := c.FSThaw(ctx); err != nil || n != 1 {
+		t.Fatalf("FSThaw = %d, %v", n, err)
+	}
+	if st, err := c.FSFreezeStatus(ctx); err != nil || st != qga.FSThawed {
+		t.Fatalf("FSFreezeStatus = %q, %v", st, err)
+	}
+}
+
+func TestClientUnknownCommand(t *testing.T) {
+	c := newTestClient(t, &qgatest.Agent{})
+
+	err := c.Execute(context.Background(), "guest-unknown", nil, nil)
+	var qerr *qga.Error
+	if !errors.As(err, &qerr) || qerr.Class != "CommandNotFound" {
+		t.Fatalf("Execute = %v, want CommandNotFound", err)
+	}
+
+	// the stream stays usable after an agent error.
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package qga
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Ping checks that the agent is responsive.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.Execute(ctx, "guest-ping", nil, nil)
+}
+
+// OSInfo is the result of guest-get-osinfo.
+type OSInfo struct {
+	KernelRelease string `json:"kernel-release,omitempty"`
+	KernelVersion string `json:"kernel-version,omitempty"`
+	Machine       string `json:"machine,omitempty"`
+	ID            string `json:"id,omitempty"`
+	Name          string `json:"name,omitempty"`
+	PrettyName    string `json:"pretty-name,omitempty"`
+	Version       string `json:"version,omitempty"`
+	VersionID     string `json:"version-id,omitempty"`
+	Variant       string `json:"variant,omitempty"`
+	VariantID     string `json:"variant-id,omitempty"`
+}
+
+// OSInfo returns the guest operating system information.
+func (c *Client) OSInfo(ctx context.Context) (*OSInfo, error) {
+	info := new(OSInfo)
+	if err := c.Execute(ctx, "guest-get-osinfo", nil, info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// ExecRequest holds the arguments of guest-exec.
+type ExecRequest struct {
+	Path          string   `json:"path"`
+	Args          []string `json:"arg,omitempty"`
+	Env           []string `json:"env,omitempty"`
+	Input         []byte   `json:"input-data,omitempty"`
+	CaptureOutput bool     `json:"capture-output,omitempty"`
+}
+
+// ExecStatus is the result of guest-exec-status.
+type ExecStatus struct {
+	Exited       bool   `json:"exited"`
+	ExitCode     int    `json:"exitcode,omitempty"`
+	Signal       int    `json:"signal,omitempty"`
+	Stdout       []byte `json:"out-data,omitempty"`
+	Stderr       []byte `json:"err-data,omitempty"`
+	OutTruncated bool   `json:"out-truncated,omitempty"`
+	ErrTruncated bool   `json:"err-truncated,omitempty"`
+}
+
+// ExecStart starts a process in the guest and returns its PID.
+//
+// Input, Stdout and Stderr are base64-encoded on the wire by encoding/json.
+func (c *Client) ExecStart(ctx context.Context, req *ExecRequest) (int, error) {
+	var ret struct {
+		PID int `json:"pid"`
+	}
+	if err := c.Execute(ctx, "guest-exec", req, &ret); err != nil {
+		return 0, err
+	}
+
+	return ret.PID, nil
+}
+
+// ExecStatus returns the status of a process started by ExecStart.
+func (c *Client) ExecStatus(ctx context.Context, pid int) (*ExecStatus, error) {
+	args := struct {
+		PID int `json:"pid"`
+	}{pid}
+
+	st := new(ExecStatus)
+	if err := c.Execute(ctx, "guest-exec-status", args, st); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// execPollInterval is the delay between two guest-exec-status calls in Exec.
+const execPollInterval = 50 * time.Millisecond
+
+// Exec runs a process in the guest and waits for it to exit.
+func (c *Client) Exec(ctx context.Context, req *ExecRequest) (*ExecStatus, error) {
+	pid, err := c.ExecStart(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(execPollInterval)
+	defer ticker.Stop()
+
+	for {
+		st, err := c.ExecStatus(ctx, pid)
+		if err != nil {
+			return nil, err
+		}
+		if st.Exited {
+			return st, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// File is an open file in the guest.
+//
+// File implements io.ReadWriteCloser; its methods use context.Background.
+type File struct {
+	c      *Client
+	handle int64
+}
+
+var _ io.ReadWriteCloser = (*File)(nil)
+
+// OpenFile opens path in the guest with the fopen(3) mode, such as "r" or "w+".
+func (c *Client) OpenFile(ctx context.Context, path, mode string) (*File, error) {
+	args := struct {
+		Path string `json:"path"`
+		Mode string `json:"mode,omitempty"`
+	}{path, mode}
+
+	var handle int64
+	if err := c.Execute(ctx, "guest-file-open", args, &handle); err != nil {
+		return nil, err
+	}
+
+	return &File{
+		c:      c,
+		handle: handle,
+	}, nil
+}
+
+// Handle returns the agent's handle of the file.
+func (f *File) Handle() int64 {
+	return f.handle
+}
+
+// ReadContext reads up to len(buf) bytes from the file.
+func (f *File) ReadContext(ctx context.Context, buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	args := struct {
+		Handle int64 `json:"handle"`
+		Count  int   `json:"count"`
+	}{f.handle, len(buf)}
+
+	var ret struct {
+		Count int    `json:"count"`
+		Buf   string `json:"buf-b64"`
+		EOF   bool   `json:"eof"`
+	}
+	if err := f.c.Execute(ctx, "guest-file-read", args, &ret); err != nil {
+		return 0, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(ret.Buf)
+	if err != nil {
+		return 0, fmt.Errorf("qga: decode file data: %w", err)
+	}
+	if len(data) > len(buf) {
+		return 0, fmt.Errorf("qga: agent returned %d bytes, requested %d", len(data), len(buf))
+	}
+	n := copy(buf, data)
+
+	if n == 0 && ret.EOF {
+		return 0, io.EOF
+	}
+
+	return n, nil
+}
+
+// WriteContext writes buf to the file.
+func (f *File) WriteContext(ctx context.Context, buf []byte) (int, error) {
+	args := struct {
+		Handle int64  `json:"handle"`
+		Buf    string `json:"buf-b64"`
+		Count  int    `json:"count"`
+	}{f.handle, base64.StdEncoding.EncodeToString(buf), len(buf)}
+
+	var ret struct {
+		Count int  `json:"count"`
+		EOF   bool `json:"eof"`
+	}
+	if err := f.c.Execute(ctx, "guest-file-write", args, &ret); err != nil {
+		return 0, err
+	}
+	if ret.Count < len(buf) {
+		return ret.Count, io.ErrShortWrite
+	}
+
+	return ret.Count, nil
+}
+
+// Read implements io.Reader.
+func (f *File) Read(buf []byte) (int, error) {
+	return f.ReadContext(context.Background(), buf)
+}
+
+// Write implements io.Writer.
+func (f *File) Write(buf []byte) (int, error) {
+	return f.WriteContext(context.Background(), buf)
+}
+
+// Close closes the file in the guest.
+//
+// Close implements io.Closer.
+func (f *File) Close() error {
+	args := struct {
+		Handle int64 `json:"handle"`
+	}{f.handle}
+
+	return f.c.Execute(context.Background(), "guest-file-close", args, nil)
+}
+
+// FSFreezeStatus is the filesystem freeze state of the guest.
+type FSFreezeStatus string
+
+// list of FSFreezeStatus.
+const (
+	FSThawed FSFreezeStatus = "thawed"
+	FSFrozen FSFreezeStatus = "frozen"
+)
+
+// FSFreezeStatus returns the filesystem freeze state.
+func (c *Client) FSFreezeStatus(ctx context.Context) (FSFreezeStatus, error) {
+	var st FSFreezeStatus
+	if err := c.Execute(ctx, "guest-fsfreeze-status", nil, &st); err != nil {
+		return "", err
+	}
+
+	return st, nil
+}
+
+// FSFreeze freezes all guest filesystems and returns the number frozen.
+func (c *Client) FSFreeze(ctx context.Context) (int, error) {
+	var n int
+	if err := c.Execute(ctx, "guest-fsfreeze-freeze", nil, &n); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// FSFreezeList freezes the filesystems mounted on mountpoints and returns the number frozen.
+func (c *Client) FSFreezeList(ctx context.Context, mountpoints []string) (int, error) {
+	args := struct {
+		Mountpoints []string `json:"mountpoints,omitempty"`
+	}{mountpoints}
+
+	var n int
+	if err := c.Execute(ctx, "guest-fsfreeze-freeze-list", args, &n); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// FSThaw thaws all guest filesystems and returns the number thawed.
+func (c *Client) FSThaw(ctx context.Context) (int, error) {
+	var n int
+	if err := c.Execute(ctx, "guest-fsfreeze-thaw", nil, &n); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
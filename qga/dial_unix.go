@@ -0,0 +1,22 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build darwin || linux
+
+package qga
+
+import (
+	"context"
+
+	"github.com/go-hypervisor/virtio/vsock"
+)
+
+// DialVsock connects to a guest agent listening on the vsock cid and port.
+func DialVsock(ctx context.Context, cid, port uint32) (*Client, error) {
+	conn, err := vsock.DialContext(ctx, cid, port)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn), nil
+}
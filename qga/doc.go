@@ -0,0 +1,9 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package qga implements a client for the QEMU guest agent (qemu-ga) protocol.
+//
+// The agent speaks line-delimited JSON over a vsock port or a virtio-serial
+// chardev. The client resynchronizes the stream with guest-sync-delimited
+// before the first command and after any interrupted exchange.
+package qga
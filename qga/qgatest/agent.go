@@ -0,0 +1,339 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package qgatest provides a fake qemu-ga agent for testing QGA clients.
+package qgatest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// syncDelimiter resets the parser on input and prefixes sync responses on output.
+const syncDelimiter = 0xff
+
+// ExecFunc runs a guest-exec request and returns its output and exit code.
+type ExecFunc func(path string, args, env []string, input []byte) (stdout, stderr []byte, exitCode int)
+
+// Agent is an in-memory fake of qemu-ga.
+//
+// The exported fields must be set before Serve is called.
+type Agent struct {
+	// Files is the guest filesystem, keyed by path.
+	Files map[string][]byte
+
+	// OSInfo is returned by guest-get-osinfo.
+	OSInfo map[string]string
+
+	// Exec handles guest-exec. If nil, guest-exec fails.
+	Exec ExecFunc
+
+	// Garbage, if non-empty, is written before the first response to
+	// exercise client resynchronization.
+	Garbage []byte
+
+	mu      sync.Mutex
+	frozen  bool
+	handles map[int64]*file
+	procs   map[int]*proc
+	nextFD  int64
+	nextPID int
+	garbled bool
+}
+
+// file is an open guest file.
+type file struct {
+	path string
+	off  int
+}
+
+// proc is a finished guest-exec process.
+type proc struct {
+	stdout, stderr []byte
+	exitCode       int
+	polls          int
+}
+
+// request is a QGA command.
+type request struct {
+	Execute   string          `json:"execute"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// qgaError is a QGA error reply.
+type qgaError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+// genericError returns a GenericError reply, as most qemu-ga commands fail with.
+func genericError(format string, args ...interface{}) *qgaError {
+	return &qgaError{Class: "GenericError", Desc: fmt.Sprintf(format, args...)}
+}
+
+// Pipe returns the client end of an in-memory connection served by a.
+func (a *Agent) Pipe() net.Conn {
+	client, server := net.Pipe()
+	go a.Serve(server)
+
+	return client
+}
+
+// Serve handles commands from conn until it is closed.
+func (a *Agent) Serve(conn net.Conn) error {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		switch b {
+		case syncDelimiter:
+			line = line[:0]
+			continue
+		case '\n':
+		default:
+			line = append(line, b)
+			continue
+		}
+
+		if len(line) == 0 {
+			continue
+		}
+		out := a.handle(line)
+		line = line[:0]
+		if _, err := conn.Write(out); err != nil {
+			return err
+		}
+	}
+}
+
+// handle processes a single command line and returns the encoded reply.
+func (a *Agent) handle(line []byte) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var prefix []byte
+	if !a.garbled && len(a.Garbage) > 0 {
+		a.garbled = true
+		prefix = append(prefix, a.Garbage...)
+	}
+
+	var req request
+	if err := json.Unmarshal(line, &req); err != nil {
+		return reply(prefix, nil, genericError("invalid JSON: %v", err))
+	}
+
+	if req.Execute == "guest-sync-delimited" {
+		prefix = append(prefix, syncDelimiter)
+	}
+
+	ret, err := a.dispatch(req.Execute, req.Arguments)
+
+	return reply(prefix, ret, err)
+}
+
+// reply encodes a response line.
+func reply(prefix []byte, ret interface{}, err *qgaError) []byte {
+	var resp interface{}
+	if err != nil {
+		resp = struct {
+			Error *qgaError `json:"error"`
+		}{err}
+	} else {
+		if ret == nil {
+			ret = struct{}{}
+		}
+		resp = struct {
+			Return interface{} `json:"return"`
+		}{ret}
+	}
+
+	b, _ := json.Marshal(resp)
+	out := append(prefix, b...)
+
+	return append(out, '\n')
+}
+
+// dispatch runs a command. a.mu must be held.
+func (a *Agent) dispatch(cmd string, raw json.RawMessage) (interface{}, *qgaError) {
+	var args struct {
+		ID            int64    `json:"id"`
+		Path          string   `json:"path"`
+		Mode          string   `json:"mode"`
+		Handle        int64    `json:"handle"`
+		Count         int      `json:"count"`
+		Buf           string   `json:"buf-b64"`
+		PID           int      `json:"pid"`
+		Arg           []string `json:"arg"`
+		Env           []string `json:"env"`
+		Input         string   `json:"input-data"`
+		CaptureOutput bool     `json:"capture-output"`
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return nil, genericError("invalid arguments: %v", err)
+		}
+	}
+
+	switch cmd {
+	case "guest-sync-delimited", "guest-sync":
+		return args.ID, nil
+
+	case "guest-ping":
+		return nil, nil
+
+	case "guest-get-osinfo":
+		return a.OSInfo, nil
+
+	case "guest-file-open":
+		if a.Files == nil {
+			a.Files = make(map[string][]byte)
+		}
+		mode := args.Mode
+		if mode == "" {
+			mode = "r"
+		}
+		if _, ok := a.Files[args.Path]; !ok {
+			if mode[0] == 'r' {
+				return nil, genericError("failed to open file '%s' (mode: '%s'): No such file or directory", args.Path, mode)
+			}
+			a.Files[args.Path] = []byte{}
+		}
+		f := &file{path: args.Path}
+		switch mode[0] {
+		case 'w':
+			a.Files[args.Path] = []byte{}
+		case 'a':
+			f.off = len(a.Files[args.Path])
+		}
+		if a.handles == nil {
+			a.handles = make(map[int64]*file)
+		}
+		a.nextFD++
+		a.handles[a.nextFD] = f
+		return a.nextFD, nil
+
+	case "guest-file-read":
+		f, ok := a.handles[args.Handle]
+		if !ok {
+			return nil, genericError("handle '%d' has not been found", args.Handle)
+		}
+		data := a.Files[f.path][f.off:]
+		if args.Count < len(data) {
+			data = data[:args.Count]
+		}
+		f.off += len(data)
+		return map[string]interface{}{
+			"count":   len(data),
+			"buf-b64": base64.StdEncoding.EncodeToString(data),
+			"eof":     f.off == len(a.Files[f.path]),
+		}, nil
+
+	case "guest-file-write":
+		f, ok := a.handles[args.Handle]
+		if !ok {
+			return nil, genericError("handle '%d' has not been found", args.Handle)
+		}
+		data, err := base64.StdEncoding.DecodeString(args.Buf)
+		if err != nil {
+			return nil, genericError("invalid base64: %v", err)
+		}
+		cur := a.Files[f.path]
+		if end := f.off + len(data); end > len(cur) {
+			cur = append(cur, make([]byte, end-len(cur))...)
+		}
+		copy(cur[f.off:], data)
+		a.Files[f.path] = cur
+		f.off += len(data)
+		return map[string]interface{}{
+			"count": len(data),
+			"eof":   false,
+		}, nil
+
+	case "guest-file-close":
+		if _, ok := a.handles[args.Handle]; !ok {
+			return nil, genericError("handle '%d' has not been found", args.Handle)
+		}
+		delete(a.handles, args.Handle)
+		return nil, nil
+
+	case "guest-exec":
+		if a.Exec == nil {
+			return nil, genericError("Guest agent command failed, error was 'Failed to execute child process “%s” (No such file or directory)'", args.Path)
+		}
+		input, err := base64.StdEncoding.DecodeString(args.Input)
+		if err != nil {
+			return nil, genericError("invalid base64: %v", err)
+		}
+		stdout, stderr, code := a.Exec(args.Path, args.Arg, args.Env, input)
+		if !args.CaptureOutput {
+			stdout, stderr = nil, nil
+		}
+		if a.procs == nil {
+			a.procs = make(map[int]*proc)
+		}
+		a.nextPID++
+		a.procs[a.nextPID] = &proc{stdout: stdout, stderr: stderr, exitCode: code}
+		return map[string]int{"pid": a.nextPID}, nil
+
+	case "guest-exec-status":
+		p, ok := a.procs[args.PID]
+		if !ok {
+			return nil, genericError("Invalid parameter 'pid'")
+		}
+		// report the process as running once to exercise polling.
+		p.polls++
+		if p.polls == 1 {
+			return map[string]bool{"exited": false}, nil
+		}
+		delete(a.procs, args.PID)
+		st := map[string]interface{}{
+			"exited":   true,
+			"exitcode": p.exitCode,
+		}
+		if p.stdout != nil {
+			st["out-data"] = base64.StdEncoding.EncodeToString(p.stdout)
+		}
+		if p.stderr != nil {
+			st["err-data"] = base64.StdEncoding.EncodeToString(p.stderr)
+		}
+		return st, nil
+
+	case "guest-fsfreeze-status":
+		if a.frozen {
+			return "frozen", nil
+		}
+		return "thawed", nil
+
+	case "guest-fsfreeze-freeze", "guest-fsfreeze-freeze-list":
+		if a.frozen {
+			return nil, genericError("The command guest-fsfreeze-freeze has been disabled for this instance")
+		}
+		a.frozen = true
+		return 1, nil
+
+	case "guest-fsfreeze-thaw":
+		n := 0
+		if a.frozen {
+			n = 1
+		}
+		a.frozen = false
+		return n, nil
+
+	default:
+		return nil, &qgaError{Class: "CommandNotFound", Desc: fmt.Sprintf("The command %s has not been found", cmd)}
+	}
+}
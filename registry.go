@@ -0,0 +1,71 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrUnknownDevice is returned by NewDevice for device IDs without a
+// registered model.
+var ErrUnknownDevice = errors.New("virtio: unknown device")
+
+// DeviceFactory returns a new instance of a device model, configured through
+// its fields before it is handed to a transport.
+type DeviceFactory func() Device
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[DeviceID]DeviceFactory{}
+)
+
+func init() {
+	Register(DeviceNull, func() Device { return &NullDevice{} })
+}
+
+// Register makes the device model returned by f available by its device ID.
+// It is meant to be called from the init function of the package of the
+// model, and panics if the ID is already registered or f is nil.
+func Register(id DeviceID, f DeviceFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if f == nil {
+		panic("virtio: Register factory is nil")
+	}
+	if _, dup := registry[id]; dup {
+		panic(fmt.Sprintf("virtio: Register called twice for %v", id))
+	}
+	registry[id] = f
+}
+
+// NewDevice returns a new instance of the device model registered for id.
+func NewDevice(id DeviceID) (Device, error) {
+	registryMu.RLock()
+	f, ok := registry[id]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownDevice, id)
+	}
+
+	return f(), nil
+}
+
+// Devices returns the registered device IDs in increasing order.
+func Devices() []DeviceID {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	ids := make([]DeviceID, 0, len(registry))
+	for id := range registry {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
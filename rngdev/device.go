@@ -0,0 +1,148 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package rngdev
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/go-hypervisor/virtio"
+)
+
+const (
+	// queueSize is the maximum size of the request queue.
+	queueSize = 256
+
+	// maxRequest is the largest number of bytes returned for a buffer.
+	maxRequest = 64 << 10
+)
+
+// ErrQueues is returned by Activate when the driver did not enable the
+// request queue.
+var ErrQueues = errors.New("rngdev: the request queue is required")
+
+func init() {
+	virtio.Register(virtio.DeviceEntropy, func() virtio.Device { return &Device{} })
+}
+
+// Device is a virtio-rng device. Its fields are set before the device is
+// activated.
+type Device struct {
+	// Source is the entropy source, crypto/rand.Reader if nil. A buffer is
+	// returned empty if the source fails.
+	Source io.Reader
+
+	// Rate limits the entropy to Rate bytes per second, if not zero. A
+	// buffer waits for its bytes, up to Burst, Rate if zero: a larger buffer
+	// is only partly filled.
+	Rate  int
+	Burst int
+
+	mu   sync.Mutex
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+var _ virtio.Device = (*Device)(nil)
+
+// DeviceID implements virtio.Device.DeviceID.
+func (d *Device) DeviceID() virtio.DeviceID {
+	return virtio.DeviceEntropy
+}
+
+// Features implements virtio.Device.Features.
+func (d *Device) Features() virtio.Features {
+	return virtio.FeatureIndirectDesc | virtio.FeatureEventIdx | virtio.FeatureRingPacked
+}
+
+// AckFeatures implements virtio.Device.AckFeatures. The device has no
+// feature of its own.
+func (d *Device) AckFeatures(f virtio.Features) {}
+
+// QueueMaxSizes implements virtio.Device.QueueMaxSizes.
+func (d *Device) QueueMaxSizes() []uint16 {
+	return []uint16{queueSize}
+}
+
+// ReadConfig implements virtio.Device.ReadConfig. The device has no
+// configuration space.
+func (d *Device) ReadConfig(off uint64, p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
+
+// WriteConfig implements virtio.Device.WriteConfig. The device has no
+// configuration space.
+func (d *Device) WriteConfig(off uint64, p []byte) {}
+
+// Activate implements virtio.Device.Activate.
+func (d *Device) Activate(mem virtio.GuestMemory, queues []*virtio.Queue, irq virtio.Interrupter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if queues[0] == nil {
+		return ErrQueues
+	}
+	var l *limiter
+	if d.Rate > 0 {
+		l = newLimiter(d.Rate, d.Burst)
+	}
+
+	d.done = make(chan struct{})
+	d.wg.Add(1)
+	go d.serve(queues[0], irq, l, d.done)
+
+	return nil
+}
+
+// Reset implements virtio.Device.Reset.
+func (d *Device) Reset() {
+	d.mu.Lock()
+	done := d.done
+	d.done = nil
+	d.mu.Unlock()
+
+	if done != nil {
+		close(done)
+		d.wg.Wait()
+	}
+}
+
+// source returns the entropy source.
+func (d *Device) source() io.Reader {
+	if d.Source == nil {
+		return rand.Reader
+	}
+
+	return d.Source
+}
+
+// serve fills the buffers of q, limited by l if not nil, until done is
+// closed. The chains left once done is closed while waiting for the limiter
+// are dropped with the queue.
+func (d *Device) serve(q *virtio.Queue, irq virtio.Interrupter, l *limiter, done <-chan struct{}) {
+	defer d.wg.Done()
+
+	buf := make([]byte, maxRequest)
+	q.Serve(irq, done, func(c *virtio.DescriptorChain) bool {
+		n := c.WritableLen()
+		if n > maxRequest {
+			n = maxRequest
+		}
+		b := buf[:n]
+		if l != nil && n > 0 {
+			if b = buf[:l.take(int(n), done)]; len(b) == 0 {
+				return false
+			}
+		}
+		if _, err := io.ReadFull(d.source(), b); err == nil {
+			c.Write(b)
+		}
+
+		return true
+	})
+}
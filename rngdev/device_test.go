@@ -0,0 +1,146 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package rngdev
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-hypervisor/virtio"
+	"github.com/go-hypervisor/virtio/driver"
+	"github.com/go-hypervisor/virtio/driver/drivertest"
+)
+
+// newGuest returns the request queue of dev over a loopback.
+func newGuest(t *testing.T, dev *Device, features virtio.Features) (context.Context, *driver.Queue) {
+	t.Helper()
+
+	g := drivertest.New(t, dev, drivertest.Config{Features: features, Queues: []int{0}})
+
+	return g.Ctx, g.Queues[0]
+}
+
+// counter is an entropy source returning 0, 1, 2...
+type counter struct {
+	n byte
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = c.n
+		c.n++
+	}
+
+	return len(p), nil
+}
+
+func TestRead(t *testing.T) {
+	for _, features := range []virtio.Features{0, virtio.FeatureEventIdx | virtio.FeatureRingPacked} {
+		t.Run(fmt.Sprint(features), func(t *testing.T) {
+			ctx, q := newGuest(t, &Device{Source: &counter{}}, features)
+
+			var want counter
+			for _, sizes := range [][]int{{1}, {100}, {4096}, {3, 5, 7}} {
+				r := &driver.Request{}
+				n := 0
+				for _, size := range sizes {
+					r.In = append(r.In, make([]byte, size))
+					n += size
+				}
+				if err := q.Do(ctx, r); err != nil {
+					t.Fatal(err)
+				}
+				if r.Written != uint32(n) {
+					t.Fatalf("%v: %d bytes written, want %d", sizes, r.Written, n)
+				}
+				b := make([]byte, n)
+				want.Read(b)
+				if got := bytes.Join(r.In, nil); !bytes.Equal(got, b) {
+					t.Fatalf("%v: got %v", sizes, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultSource(t *testing.T) {
+	ctx, q := newGuest(t, &Device{}, 0)
+
+	r := &driver.Request{In: [][]byte{make([]byte, 64)}}
+	if err := q.Do(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Written != 64 || bytes.Equal(r.In[0], make([]byte, 64)) {
+		t.Fatalf("%d bytes written: %x", r.Written, r.In[0])
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("no entropy")
+}
+
+func TestSourceError(t *testing.T) {
+	ctx, q := newGuest(t, &Device{Source: io.MultiReader(bytes.NewReader(make([]byte, 10)), errReader{})}, 0)
+
+	for _, want := range []uint32{8, 0, 0} {
+		r := &driver.Request{In: [][]byte{make([]byte, 8)}}
+		if err := q.Do(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Written != want {
+			t.Fatalf("%d bytes written, want %d", r.Written, want)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	const rate, burst = 1000, 100
+	ctx, q := newGuest(t, &Device{Source: &counter{}, Rate: rate, Burst: burst}, 0)
+
+	// the first burst is immediate, the next ones wait for the bucket.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		r := &driver.Request{In: [][]byte{make([]byte, 4096)}}
+		if err := q.Do(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Written != burst {
+			t.Fatalf("%d bytes written, want %d", r.Written, burst)
+		}
+	}
+	if d := time.Since(start); d < 2*burst*time.Second/rate-20*time.Millisecond {
+		t.Fatalf("%d bytes in %v", 3*burst, d)
+	}
+
+	r := &driver.Request{In: [][]byte{make([]byte, 10)}}
+	if err := q.Do(ctx, r); err != nil || r.Written != 10 {
+		t.Fatalf("%d bytes written, %v", r.Written, err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	// a reset does not wait for the limiter.
+	dev := &Device{Rate: 1, Burst: 1}
+	ctx, q := newGuest(t, dev, 0)
+
+	if err := q.Do(ctx, &driver.Request{In: [][]byte{make([]byte, 1)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Submit(&driver.Request{In: [][]byte{make([]byte, 1)}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	dev.Reset()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("reset took %v", d)
+	}
+}
@@ -0,0 +1,9 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package rngdev implements the device side of virtio-rng.
+//
+// A Device fills the buffers of its request queue with entropy read from a
+// source, crypto/rand by default, optionally limited to a rate in bytes per
+// second so a guest cannot drain the entropy of the host.
+package rngdev
@@ -0,0 +1,51 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package rngdev
+
+import "time"
+
+// limiter is a token bucket of bytes, filled at rate bytes per second up to
+// burst bytes. It starts full.
+type limiter struct {
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate, burst int) *limiter {
+	if burst < 1 {
+		burst = rate
+	}
+
+	return &limiter{rate: float64(rate), burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// take takes n bytes, at most a burst, waiting for them until done is closed.
+// It returns the bytes taken, 0 once done is closed.
+func (l *limiter) take(n int, done <-chan struct{}) int {
+	if n > l.burst {
+		n = l.burst
+	}
+	for {
+		now := time.Now()
+		l.tokens += l.rate * now.Sub(l.last).Seconds()
+		if l.tokens > float64(l.burst) {
+			l.tokens = float64(l.burst)
+		}
+		l.last = now
+		if l.tokens >= float64(n) {
+			l.tokens -= float64(n)
+			return n
+		}
+
+		t := time.NewTimer(time.Duration((float64(n) - l.tokens) / l.rate * float64(time.Second)))
+		select {
+		case <-done:
+			t.Stop()
+			return 0
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,472 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// list of virtq_desc flags.
+const (
+	DescFlagNext     = 1 // the buffer continues in the Next descriptor
+	DescFlagWrite    = 2 // the buffer is device-writable
+	DescFlagIndirect = 4 // the buffer contains a table of descriptors
+)
+
+// list of split ring element sizes.
+const (
+	descSize     = 16 // virtq_desc
+	usedElemSize = 8  // virtq_used_elem
+	ringHdrSize  = 4  // flags and idx of virtq_avail and virtq_used
+)
+
+// MaxQueueSize is the largest number of descriptors of a split queue.
+const MaxQueueSize = 32768
+
+var (
+	// ErrQueueFull is returned by SplitQueue.Add when there are not enough free descriptors.
+	ErrQueueFull = errors.New("virtio: not enough free descriptors")
+
+	// ErrInvalidQueue is returned when the ring contents violate the virtio specification.
+	ErrInvalidQueue = errors.New("virtio: invalid queue")
+)
+
+// Descriptor is an entry of the descriptor table.
+type Descriptor struct {
+	Addr  uint64
+	Len   uint32
+	Flags uint16
+	Next  uint16
+}
+
+// Buffer is a guest buffer added to a queue by the driver.
+type Buffer struct {
+	// Addr is the guest physical address of the buffer.
+	Addr uint64
+
+	// Len is the length of the buffer in bytes.
+	Len uint32
+
+	// Writable marks a buffer the device writes to. Device-writable buffers
+	// follow all device-readable buffers of a chain.
+	Writable bool
+}
+
+// UsedElem is an entry of the used ring.
+type UsedElem struct {
+	// ID is the head descriptor index of the used chain.
+	ID uint32
+
+	// Len is the number of bytes the device wrote into the chain.
+	Len uint32
+}
+
+// SplitLayout returns the offsets of the available and used rings and the
+// total size of a split queue of size descriptors laid out contiguously.
+func SplitLayout(size uint16) (avail, used, total uint64) {
+	n := uint64(size)
+	avail = descSize * n
+	used = align(avail+ringHdrSize+2*n+2, 4)
+	total = used + ringHdrSize + usedElemSize*n + 2
+
+	return avail, used, total
+}
+
+// align rounds v up to a multiple of a, which must be a power of two.
+func align(v, a uint64) uint64 {
+	return (v + a - 1) &^ (a - 1)
+}
+
+// SplitQueue is a virtio 1.x split virtqueue over guest memory.
+//
+// The driver and the device each use their own SplitQueue over the same
+// memory: the driver adds buffers with Add, publishes them with Kick and reaps
+// them with Reap; the device takes chains with Pop and returns them with Push.
+// The rings may be accessed concurrently by the two sides, but a SplitQueue
+// itself is not safe for concurrent use.
+type SplitQueue struct {
+	mem   GuestMemory
+	size  uint16
+	desc  []byte // descriptor table
+	avail []byte // available ring, from the 4-byte aligned address below it
+	used  []byte // used ring
+
+	// availOff is the offset of the available ring in avail, which is only
+	// 2-byte aligned.
+	availOff uint64
+
+	// MaxChainLen limits the descriptors of a chain returned by PopChain,
+	// counting the ones of indirect tables. Zero means DefaultMaxChainLen.
+	MaxChainLen int
+
+	// EventIdx enables VIRTIO_F_EVENT_IDX notification suppression. Both
+	// sides must agree on it, as negotiated.
+	EventIdx bool
+
+	// Notify, if non-nil, is called by Kick when the device needs a notification.
+	Notify func()
+
+	// driver state.
+	free      []uint16 // stack of free descriptors
+	next      []uint16 // chain links as written by the driver
+	chainLen  []uint16 // number of descriptors of each in-flight head, 0 if not in flight
+	availIdx  uint16   // next avail idx, published by Kick
+	lastUsed  uint16   // next used entry to reap
+	kickedIdx uint16   // avail idx at the last notification check
+	driverSet bool     // driver state initialized
+
+	// device state.
+	lastAvail    uint16 // next avail entry to pop
+	usedIdx      uint16 // used idx published by Push
+	signalledIdx uint16 // used idx at the last notification check
+}
+
+// NewSplitQueue returns a split queue of size descriptors whose descriptor
+// table, available ring and used ring are at the guest addresses desc, avail
+// and used of mem. size must be a power of two, and the rings must be zeroed
+// when the queue is set up.
+func NewSplitQueue(mem GuestMemory, size uint16, desc, avail, used uint64) (*SplitQueue, error) {
+	if size == 0 || size&(size-1) != 0 || size > MaxQueueSize {
+		return nil, fmt.Errorf("%w: size %d is not a power of two up to %d", ErrInvalidQueue, size, MaxQueueSize)
+	}
+	if desc%16 != 0 || avail%2 != 0 || used%4 != 0 {
+		return nil, fmt.Errorf("%w: misaligned rings (desc %#x, avail %#x, used %#x)", ErrInvalidQueue, desc, avail, used)
+	}
+
+	q := &SplitQueue{
+		mem:      mem,
+		size:     size,
+		availOff: avail & 3,
+	}
+
+	n := uint64(size)
+	for _, r := range []struct {
+		name      string
+		b         *[]byte
+		addr, len uint64
+	}{
+		{"descriptor table", &q.desc, desc, descSize * n},
+		{"available ring", &q.avail, avail &^ 3, q.availOff + ringHdrSize + 2*n + 2},
+		{"used ring", &q.used, used, ringHdrSize + usedElemSize*n + 2},
+	} {
+		b, err := Slice(mem, r.addr, r.len)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidQueue, r.name, err)
+		}
+		if !aligned(b) {
+			return nil, fmt.Errorf("%w: %s is not 4-byte aligned in host memory", ErrInvalidQueue, r.name)
+		}
+		*r.b = b
+	}
+
+	return q, nil
+}
+
+// Size returns the number of descriptors of the queue.
+func (q *SplitQueue) Size() uint16 {
+	return q.size
+}
+
+// initDriver sets up the driver state on first use, so that a device-side
+// queue does not allocate it.
+func (q *SplitQueue) initDriver() {
+	if q.driverSet {
+		return
+	}
+
+	q.free = make([]uint16, q.size)
+	for i := range q.free {
+		q.free[i] = q.size - 1 - uint16(i)
+	}
+	q.next = make([]uint16, q.size)
+	q.chainLen = make([]uint16, q.size)
+	q.driverSet = true
+}
+
+// NumFree returns the number of free descriptors on the driver side.
+func (q *SplitQueue) NumFree() int {
+	q.initDriver()
+	return len(q.free)
+}
+
+// Add chains bufs into free descriptors and places the chain in the available
+// ring. It returns the head descriptor index. The chain becomes visible to the
+// device with the next Kick.
+func (q *SplitQueue) Add(bufs []Buffer) (uint16, error) {
+	q.initDriver()
+
+	if len(bufs) == 0 {
+		return 0, fmt.Errorf("%w: empty chain", ErrInvalidQueue)
+	}
+	if len(bufs) > len(q.free) {
+		return 0, ErrQueueFull
+	}
+	for i := 1; i < len(bufs); i++ {
+		if bufs[i-1].Writable && !bufs[i].Writable {
+			return 0, fmt.Errorf("%w: device-readable buffer after a device-writable one", ErrInvalidQueue)
+		}
+	}
+
+	// the chain is built backwards, so that each descriptor knows its successor.
+	var head uint16
+	for i := len(bufs) - 1; i >= 0; i-- {
+		id := q.free[len(q.free)-1]
+		q.free = q.free[:len(q.free)-1]
+
+		d := Descriptor{Addr: bufs[i].Addr, Len: bufs[i].Len}
+		if bufs[i].Writable {
+			d.Flags |= DescFlagWrite
+		}
+		if i < len(bufs)-1 {
+			d.Flags |= DescFlagNext
+			d.Next = head
+			q.next[id] = head
+		}
+		q.putDesc(id, d)
+		head = id
+	}
+	q.chainLen[head] = uint16(len(bufs))
+
+	binary.LittleEndian.PutUint16(q.avail[q.availOff+ringHdrSize+2*uint64(q.availIdx%q.size):], head)
+	q.availIdx++
+
+	return head, nil
+}
+
+// Kick publishes the chains added since the last Kick to the device and
+// notifies it if NeedsNotification.
+func (q *SplitQueue) Kick() {
+	store16(q.avail, q.availOff+2, q.availIdx)
+	if q.NeedsNotification() && q.Notify != nil {
+		q.Notify()
+	}
+}
+
+// Reap returns the next chain used by the device and frees its descriptors.
+// ok is false if no used chain is pending.
+func (q *SplitQueue) Reap() (e UsedElem, ok bool, err error) {
+	q.initDriver()
+
+	if q.lastUsed == load16(q.used, 2) {
+		return UsedElem{}, false, nil
+	}
+
+	off := ringHdrSize + usedElemSize*uint64(q.lastUsed%q.size)
+	e.ID = binary.LittleEndian.Uint32(q.used[off:])
+	e.Len = binary.LittleEndian.Uint32(q.used[off+4:])
+	if e.ID >= uint32(q.size) || q.chainLen[e.ID] == 0 {
+		return UsedElem{}, false, fmt.Errorf("%w: used descriptor %d is not in flight", ErrInvalidQueue, e.ID)
+	}
+	q.lastUsed++
+
+	id := uint16(e.ID)
+	for n := q.chainLen[id]; n > 0; n-- {
+		q.free = append(q.free, id)
+		id = q.next[id]
+	}
+	q.chainLen[e.ID] = 0
+
+	return e, true, nil
+}
+
+// Pop returns the head descriptor index of the next available chain.
+// ok is false if no chain is available.
+func (q *SplitQueue) Pop() (head uint16, ok bool, err error) {
+	idx := load16(q.avail, q.availOff+2)
+	if idx == q.lastAvail {
+		return 0, false, nil
+	}
+	if pending := idx - q.lastAvail; pending > q.size {
+		return 0, false, fmt.Errorf("%w: %d available chains in a queue of %d", ErrInvalidQueue, pending, q.size)
+	}
+
+	head = binary.LittleEndian.Uint16(q.avail[q.availOff+ringHdrSize+2*uint64(q.lastAvail%q.size):])
+	if head >= q.size {
+		return 0, false, fmt.Errorf("%w: available head %d out of range", ErrInvalidQueue, head)
+	}
+	q.lastAvail++
+
+	return head, true, nil
+}
+
+// Descriptor returns the entry i of the descriptor table.
+func (q *SplitQueue) Descriptor(i uint16) (Descriptor, error) {
+	if i >= q.size {
+		return Descriptor{}, fmt.Errorf("%w: descriptor %d out of range", ErrInvalidQueue, i)
+	}
+
+	b := q.desc[descSize*uint64(i):]
+	return Descriptor{
+		Addr:  binary.LittleEndian.Uint64(b),
+		Len:   binary.LittleEndian.Uint32(b[8:]),
+		Flags: binary.LittleEndian.Uint16(b[12:]),
+		Next:  binary.LittleEndian.Uint16(b[14:]),
+	}, nil
+}
+
+// putDesc writes d to the entry i of the descriptor table.
+func (q *SplitQueue) putDesc(i uint16, d Descriptor) {
+	b := q.desc[descSize*uint64(i):]
+	binary.LittleEndian.PutUint64(b, d.Addr)
+	binary.LittleEndian.PutUint32(b[8:], d.Len)
+	binary.LittleEndian.PutUint16(b[12:], d.Flags)
+	binary.LittleEndian.PutUint16(b[14:], d.Next)
+}
+
+// Chain returns the descriptors of the chain starting at head. A chain longer
+// than the queue contains a loop and is rejected.
+func (q *SplitQueue) Chain(head uint16) ([]Descriptor, error) {
+	var chain []Descriptor
+	for i := head; ; {
+		if len(chain) == int(q.size) {
+			return nil, fmt.Errorf("%w: descriptor chain at %d loops", ErrInvalidQueue, head)
+		}
+
+		d, err := q.Descriptor(i)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, d)
+
+		if d.Flags&DescFlagNext == 0 {
+			return chain, nil
+		}
+		i = d.Next
+	}
+}
+
+// Push returns the chain at head to the driver, with written bytes written
+// into its device-writable buffers.
+func (q *SplitQueue) Push(head uint16, written uint32) error {
+	if head >= q.size {
+		return fmt.Errorf("%w: used head %d out of range", ErrInvalidQueue, head)
+	}
+
+	off := ringHdrSize + usedElemSize*uint64(q.usedIdx%q.size)
+	binary.LittleEndian.PutUint32(q.used[off:], uint32(head))
+	binary.LittleEndian.PutUint32(q.used[off+4:], written)
+	q.usedIdx++
+	store16(q.used, 2, q.usedIdx)
+
+	return nil
+}
+
+// PopChain pops the next available chain and resolves it into a
+// DescriptorChain. ok is false if no chain is available. An error means the
+// driver violated the specification and the queue should be reset.
+func (q *SplitQueue) PopChain() (c *DescriptorChain, ok bool, err error) {
+	head, ok, err := q.Pop()
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+
+	descs, err := q.Chain(head)
+	if err != nil {
+		return nil, false, err
+	}
+	if c, err = newChain(q.mem, head, descs, q.MaxChainLen, false); err != nil {
+		return nil, false, err
+	}
+
+	return c, true, nil
+}
+
+// PushChain returns c to the driver with the number of bytes written into it.
+func (q *SplitQueue) PushChain(c *DescriptorChain) error {
+	return q.Push(c.ID, c.Written())
+}
+
+// list of split ring flags.
+const (
+	availFlagNoInterrupt = 1 // virtq_avail.flags: the driver does not want used buffer notifications
+	usedFlagNoNotify     = 1 // virtq_used.flags: the device does not want available buffer notifications
+)
+
+// usedEventOff returns the offset of used_event in avail, written by the driver.
+func (q *SplitQueue) usedEventOff() uint64 {
+	return q.availOff + ringHdrSize + 2*uint64(q.size)
+}
+
+// availEventOff returns the offset of avail_event in used, written by the device.
+func (q *SplitQueue) availEventOff() uint64 {
+	return ringHdrSize + usedElemSize*uint64(q.size)
+}
+
+// NeedsNotification reports whether the other side must be notified of the
+// buffers this side published since the last call: on the driver side the
+// chains published by Kick, on the device side the chains returned by Push.
+// It honors the other side's used_event or avail_event with EventIdx, and
+// its NO_INTERRUPT or NO_NOTIFY flag otherwise.
+//
+// Kick calls it on the driver side. The device calls it after pushing a
+// batch of chains and interrupts the driver if it returns true.
+func (q *SplitQueue) NeedsNotification() bool {
+	if q.driverSet {
+		old, new := q.kickedIdx, q.availIdx
+		q.kickedIdx = new
+		if old == new {
+			return false
+		}
+		if q.EventIdx {
+			return needEvent(load16(q.used, q.availEventOff()), new, old)
+		}
+		return load16(q.used, 0)&usedFlagNoNotify == 0
+	}
+
+	old, new := q.signalledIdx, q.usedIdx
+	q.signalledIdx = new
+	if old == new {
+		return false
+	}
+	if q.EventIdx {
+		return needEvent(load16(q.avail, q.usedEventOff()), new, old)
+	}
+	return load16(q.avail, q.availOff)&availFlagNoInterrupt == 0
+}
+
+// EnableInterrupts asks the device for used buffer notifications, on the
+// driver side. With EventIdx the notification is requested for the next
+// used chain. The driver should check for used chains again afterwards, since
+// the device may have pushed some before it saw the request.
+func (q *SplitQueue) EnableInterrupts() {
+	if q.EventIdx {
+		store16(q.avail, q.usedEventOff(), q.lastUsed)
+		return
+	}
+	store16(q.avail, q.availOff, 0)
+}
+
+// DisableInterrupts asks the device not to send used buffer notifications,
+// on the driver side.
+func (q *SplitQueue) DisableInterrupts() {
+	if q.EventIdx {
+		// an event index just behind makes the device wait for a whole lap.
+		store16(q.avail, q.usedEventOff(), q.lastUsed-1)
+		return
+	}
+	store16(q.avail, q.availOff, availFlagNoInterrupt)
+}
+
+// EnableNotifications asks the driver for available buffer notifications, on
+// the device side. The device should check for available chains again
+// afterwards.
+func (q *SplitQueue) EnableNotifications() {
+	if q.EventIdx {
+		store16(q.used, q.availEventOff(), q.lastAvail)
+		return
+	}
+	store16(q.used, 0, 0)
+}
+
+// DisableNotifications asks the driver not to send available buffer
+// notifications, on the device side.
+func (q *SplitQueue) DisableNotifications() {
+	if q.EventIdx {
+		store16(q.used, q.availEventOff(), q.lastAvail-1)
+		return
+	}
+	store16(q.used, 0, usedFlagNoNotify)
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+const (
+	testQueueSize = 16
+	testBufSize   = 64
+)
+
+// newTestSplit returns the driver and device sides of a split queue over
+// memory with room for 2*testQueueSize buffers after the rings.
+func newTestSplit(t *testing.T) (mem []byte, drv, dev *SplitQueue, bufs uint64) {
+	t.Helper()
+
+	avail, used, total := SplitLayout(testQueueSize)
+	bufs = align(total, 64)
+	mem = make([]byte, bufs+2*testQueueSize*testBufSize)
+
+	var err error
+	if drv, err = NewSplitQueue(newTestMemory(t, mem), testQueueSize, 0, avail, used); err != nil {
+		t.Fatal(err)
+	}
+	if dev, err = NewSplitQueue(newTestMemory(t, mem), testQueueSize, 0, avail, used); err != nil {
+		t.Fatal(err)
+	}
+
+	return mem, drv, dev, bufs
+}
+
+func TestNewSplitQueue(t *testing.T) {
+	mem := newTestMemory(t, make([]byte, 4096))
+	for _, tt := range []struct {
+		size              uint16
+		desc, avail, used uint64
+	}{
+		{0, 0, 256, 512},
+		{3, 0, 256, 512},
+		{16, 8, 256, 512},
+		{16, 0, 257, 512},
+		{16, 0, 256, 514},
+		{16, 0, 256, 4000},
+		{1024, 0, 256, 512},
+	} {
+		if _, err := NewSplitQueue(mem, tt.size, tt.desc, tt.avail, tt.used); !errors.Is(err, ErrInvalidQueue) {
+			t.Errorf("NewSplitQueue(%d, %#x, %#x, %#x) = %v, want %v", tt.size, tt.desc, tt.avail, tt.used, err, ErrInvalidQueue)
+		}
+	}
+}
+
+func TestSplitQueueRoundTrip(t *testing.T) {
+	mem, drv, dev, bufs := newTestSplit(t)
+
+	const n = 1000
+	kicks := make(chan struct{}, 1)
+	drv.Notify = func() {
+		select {
+		case kicks <- struct{}{}:
+		default:
+		}
+	}
+
+	// the device uppercases each request into the response buffer.
+	done := make(chan error, 1)
+	go func() {
+		for served := 0; served < n; {
+			head, ok, err := dev.Pop()
+			if err != nil {
+				done <- err
+				return
+			}
+			if !ok {
+				<-kicks
+				continue
+			}
+
+			chain, err := dev.Chain(head)
+			if err != nil {
+				done <- err
+				return
+			}
+			if len(chain) != 2 || chain[0].Flags&DescFlagWrite != 0 || chain[1].Flags&DescFlagWrite == 0 {
+				done <- fmt.Errorf("unexpected chain %+v", chain)
+				return
+			}
+
+			req := mem[chain[0].Addr : chain[0].Addr+uint64(chain[0].Len)]
+			resp := bytes.ToUpper(req)
+			copy(mem[chain[1].Addr:chain[1].Addr+uint64(chain[1].Len)], resp)
+			if err := dev.Push(head, uint32(len(resp))); err != nil {
+				done <- err
+				return
+			}
+			served++
+		}
+		done <- nil
+	}()
+
+	// at most testQueueSize/2 chains are in flight and the device serves them
+	// in order, so request i uses slot i%testQueueSize.
+	slot := func(i int) (req, resp uint64) {
+		base := bufs + uint64(i%testQueueSize)*2*testBufSize
+		return base, base + testBufSize
+	}
+	sentAs := make(map[uint16]int)
+
+	for sent, reaped := 0, 0; reaped < n; {
+		for sent < n && drv.NumFree() >= 2 {
+			msg := fmt.Sprintf("request %d", sent)
+			req, resp := slot(sent)
+			copy(mem[req:], msg)
+
+			head, err := drv.Add([]Buffer{{Addr: req, Len: uint32(len(msg))}, {Addr: resp, Len: testBufSize, Writable: true}})
+			if err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+			sentAs[head] = sent
+			sent++
+		}
+		drv.Kick()
+
+		e, ok, err := drv.Reap()
+		if err != nil {
+			t.Fatalf("Reap: %v", err)
+		}
+		if !ok {
+			runtime.Gosched()
+			continue
+		}
+
+		i := sentAs[uint16(e.ID)]
+		_, resp := slot(i)
+		if got, want := string(mem[resp:resp+uint64(e.Len)]), fmt.Sprintf("REQUEST %d", i); got != want {
+			t.Fatalf("response %q, want %q", got, want)
+		}
+		reaped++
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("device: %v", err)
+	}
+	if drv.NumFree() != testQueueSize {
+		t.Fatalf("%d free descriptors after the round trip, want %d", drv.NumFree(), testQueueSize)
+	}
+}
+
+func TestSplitQueueFull(t *testing.T) {
+	_, drv, _, _ := newTestSplit(t)
+
+	for i := 0; i < testQueueSize/4; i++ {
+		if _, err := drv.Add(make([]Buffer, 4)); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if _, err := drv.Add(make([]Buffer, 1)); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Add = %v, want %v", err, ErrQueueFull)
+	}
+	if _, err := drv.Add(nil); !errors.Is(err, ErrInvalidQueue) {
+		t.Fatalf("Add(nil) = %v, want %v", err, ErrInvalidQueue)
+	}
+}
+
+func TestSplitQueueInvalid(t *testing.T) {
+	_, drv, dev, _ := newTestSplit(t)
+
+	// readable after writable.
+	if _, err := drv.Add([]Buffer{{Writable: true}, {}}); !errors.Is(err, ErrInvalidQueue) {
+		t.Fatalf("Add = %v, want %v", err, ErrInvalidQueue)
+	}
+
+	head, err := drv.Add([]Buffer{{Len: 1}, {Len: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drv.Kick()
+
+	// a malicious driver loops the chain back to its head.
+	d, _ := drv.Descriptor(head)
+	drv.putDesc(d.Next, Descriptor{Flags: DescFlagNext, Next: head})
+
+	got, ok, err := dev.Pop()
+	if err != nil || !ok || got != head {
+		t.Fatalf("Pop = %d, %v, %v, want %d", got, ok, err, head)
+	}
+	if _, err := dev.Chain(head); !errors.Is(err, ErrInvalidQueue) {
+		t.Fatalf("Chain = %v, want %v", err, ErrInvalidQueue)
+	}
+
+	// a malicious device returns a descriptor which is not in flight.
+	if err := dev.Push(head+1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := drv.Reap(); !errors.Is(err, ErrInvalidQueue) {
+		t.Fatalf("Reap = %v, want %v", err, ErrInvalidQueue)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Status is the value of the device status field.
+type Status uint8
+
+// list of device status bits.
+const (
+	StatusAcknowledge Status = 1   // the guest found the device
+	StatusDriver      Status = 2   // the guest has a driver for the device
+	StatusDriverOK    Status = 4   // the driver is set up and ready
+	StatusFeaturesOK  Status = 8   // the driver acknowledged the features it understands
+	StatusNeedsReset  Status = 64  // the device experienced an unrecoverable error
+	StatusFailed      Status = 128 // the driver gave up on the device
+)
+
+// String returns the names of the bits of s.
+func (s Status) String() string {
+	if s == 0 {
+		return "RESET"
+	}
+
+	var names []string
+	for _, b := range []struct {
+		bit  Status
+		name string
+	}{
+		{StatusAcknowledge, "ACKNOWLEDGE"},
+		{StatusDriver, "DRIVER"},
+		{StatusFeaturesOK, "FEATURES_OK"},
+		{StatusDriverOK, "DRIVER_OK"},
+		{StatusNeedsReset, "NEEDS_RESET"},
+		{StatusFailed, "FAILED"},
+	} {
+		if s&b.bit != 0 {
+			names = append(names, b.name)
+			s &^= b.bit
+		}
+	}
+	if s != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint8(s)))
+	}
+
+	return strings.Join(names, "|")
+}
+
+// ErrInvalidStatus is returned for device status writes and feature
+// negotiations violating the virtio specification.
+var ErrInvalidStatus = errors.New("virtio: invalid device status transition")
+
+// DeviceStatus is the device status state machine shared by the transports.
+//
+// The driver goes through ACKNOWLEDGE, DRIVER, FEATURES_OK and DRIVER_OK,
+// setting one more bit with each write, and may set FAILED at any time.
+// Writing 0 resets the device. NEEDS_RESET is only set by the device.
+//
+// A DeviceStatus is not safe for concurrent use; transports serialize the
+// register accesses of a device.
+type DeviceStatus struct {
+	// Validate, if non-nil, is called when the driver sets FEATURES_OK, to
+	// reject feature combinations the device does not support.
+	Validate func(Features) error
+
+	offered Features
+	driver  Features
+	status  Status
+}
+
+// NewDeviceStatus returns the status of a device offering the features offered.
+func NewDeviceStatus(offered Features) *DeviceStatus {
+	return &DeviceStatus{offered: offered}
+}
+
+// Status returns the current device status.
+func (s *DeviceStatus) Status() Status {
+	return s.status
+}
+
+// Offered returns the features offered by the device.
+func (s *DeviceStatus) Offered() Features {
+	return s.offered
+}
+
+// DriverFeatures returns the features written by the driver so far.
+func (s *DeviceStatus) DriverFeatures() Features {
+	return s.driver
+}
+
+// Negotiated returns the negotiated features, or 0 before FEATURES_OK.
+func (s *DeviceStatus) Negotiated() Features {
+	if s.status&StatusFeaturesOK == 0 {
+		return 0
+	}
+
+	return s.driver
+}
+
+// Ready reports whether the driver set DRIVER_OK and the device is usable.
+func (s *DeviceStatus) Ready() bool {
+	return s.status&(StatusDriverOK|StatusNeedsReset|StatusFailed) == StatusDriverOK
+}
+
+// Reset returns the device to its initial state.
+func (s *DeviceStatus) Reset() {
+	s.status = 0
+	s.driver = 0
+}
+
+// SetNeedsReset marks that the device experienced an error and must be reset
+// by the driver. The transport then raises a configuration change.
+func (s *DeviceStatus) SetNeedsReset() {
+	s.status |= StatusNeedsReset
+}
+
+// SetDriverFeatures records the features accepted by the driver. They can
+// only be written after DRIVER and before FEATURES_OK.
+func (s *DeviceStatus) SetDriverFeatures(f Features) error {
+	if s.status&StatusDriver == 0 || s.status&(StatusFeaturesOK|StatusFailed) != 0 {
+		return fmt.Errorf("%w: driver features written in state %v", ErrInvalidStatus, s.status)
+	}
+	s.driver = f
+
+	return nil
+}
+
+// Set applies a write of v to the status field. Writing 0 resets the device.
+// An invalid write leaves the status unchanged and returns an error wrapping
+// ErrInvalidStatus; in particular FEATURES_OK is not set if the driver
+// features are not acceptable, which the driver detects by reading it back.
+func (s *DeviceStatus) Set(v Status) error {
+	if v == 0 {
+		s.Reset()
+		return nil
+	}
+
+	old := s.status
+	switch {
+	case v&^old&StatusNeedsReset != 0:
+		return fmt.Errorf("%w: the driver set NEEDS_RESET", ErrInvalidStatus)
+	case v&old != old:
+		return fmt.Errorf("%w: %v clears bits of %v", ErrInvalidStatus, v, old)
+	case old&StatusFailed != 0 && v != old:
+		return fmt.Errorf("%w: %v after FAILED", ErrInvalidStatus, v)
+	case v&StatusFailed != 0:
+		// the driver may give up at any point.
+		s.status = v
+		return nil
+	}
+
+	for _, step := range []struct {
+		bit, requires Status
+	}{
+		{StatusAcknowledge, 0},
+		{StatusDriver, StatusAcknowledge},
+		{StatusFeaturesOK, StatusDriver},
+		{StatusDriverOK, StatusFeaturesOK},
+	} {
+		if v&step.bit != 0 && v&step.requires != step.requires {
+			return fmt.Errorf("%w: %v without %v", ErrInvalidStatus, step.bit, step.requires)
+		}
+	}
+
+	if v&^old&StatusFeaturesOK != 0 {
+		if err := s.checkFeatures(); err != nil {
+			return err
+		}
+	}
+	s.status = v
+
+	return nil
+}
+
+// checkFeatures validates the driver features when it sets FEATURES_OK.
+func (s *DeviceStatus) checkFeatures() error {
+	if !s.driver.IsSubset(s.offered) {
+		return fmt.Errorf("%w: driver accepted features %v which were not offered", ErrInvalidStatus, s.driver&^s.offered)
+	}
+	// the transports only implement the modern interface.
+	if s.offered.Has(FeatureVersion1) && !s.driver.Has(FeatureVersion1) {
+		return fmt.Errorf("%w: driver did not accept VERSION_1", ErrInvalidStatus)
+	}
+	if s.Validate != nil {
+		if err := s.Validate(s.driver); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidStatus, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package virtio
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeviceStatus(t *testing.T) {
+	offered := FeatureVersion1 | FeatureEventIdx | FeatureIndirectDesc
+	s := NewDeviceStatus(offered)
+
+	if err := s.SetDriverFeatures(FeatureVersion1); !errors.Is(err, ErrInvalidStatus) {
+		t.Fatalf("SetDriverFeatures before DRIVER = %v, want %v", err, ErrInvalidStatus)
+	}
+
+	steps := []Status{
+		StatusAcknowledge,
+		StatusAcknowledge | StatusDriver,
+	}
+	for _, v := range steps {
+		if err := s.Set(v); err != nil {
+			t.Fatalf("Set(%v): %v", v, err)
+		}
+	}
+
+	// a feature which was not offered, then a missing VERSION_1.
+	status := StatusAcknowledge | StatusDriver | StatusFeaturesOK
+	for _, f := range []Features{FeatureVersion1 | FeatureRingPacked, FeatureEventIdx} {
+		if err := s.SetDriverFeatures(f); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Set(status); !errors.Is(err, ErrInvalidStatus) {
+			t.Fatalf("Set(%v) with features %v = %v, want %v", status, f, err, ErrInvalidStatus)
+		}
+		if s.Status()&StatusFeaturesOK != 0 {
+			t.Fatal("FEATURES_OK set with invalid features")
+		}
+	}
+
+	if err := s.SetDriverFeatures(FeatureVersion1 | FeatureEventIdx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(status); err != nil {
+		t.Fatalf("Set(%v): %v", status, err)
+	}
+	if got := s.Negotiated(); got != FeatureVersion1|FeatureEventIdx {
+		t.Fatalf("Negotiated = %v", got)
+	}
+	if err := s.SetDriverFeatures(offered); !errors.Is(err, ErrInvalidStatus) {
+		t.Fatalf("SetDriverFeatures after FEATURES_OK = %v, want %v", err, ErrInvalidStatus)
+	}
+
+	if err := s.Set(status | StatusDriverOK); err != nil || !s.Ready() {
+		t.Fatalf("Set(DRIVER_OK) = %v, ready %v", err, s.Ready())
+	}
+
+	s.SetNeedsReset()
+	if s.Ready() {
+		t.Fatal("ready after NEEDS_RESET")
+	}
+	if err := s.Set(0); err != nil || s.Status() != 0 || s.DriverFeatures() != 0 {
+		t.Fatalf("reset = %v, status %v, features %v", err, s.Status(), s.DriverFeatures())
+	}
+}
+
+func TestDeviceStatusInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		from, to Status
+	}{
+		{0, StatusDriver},
+		{StatusAcknowledge, StatusAcknowledge | StatusFeaturesOK},
+		{StatusAcknowledge | StatusDriver, StatusAcknowledge | StatusDriver | StatusDriverOK},
+		{StatusAcknowledge | StatusDriver, StatusAcknowledge},
+		{StatusAcknowledge, StatusAcknowledge | StatusNeedsReset},
+		{StatusAcknowledge | StatusFailed, StatusAcknowledge | StatusFailed | StatusDriver},
+	} {
+		s := NewDeviceStatus(0)
+		s.status = tt.from
+		if err := s.Set(tt.to); !errors.Is(err, ErrInvalidStatus) {
+			t.Errorf("%v -> %v = %v, want %v", tt.from, tt.to, err, ErrInvalidStatus)
+		}
+		if s.Status() != tt.from {
+			t.Errorf("%v -> %v changed the status to %v", tt.from, tt.to, s.Status())
+		}
+	}
+
+	// FAILED is allowed at any point.
+	s := NewDeviceStatus(0)
+	if err := s.Set(StatusAcknowledge | StatusFailed); err != nil {
+		t.Fatalf("Set(FAILED) = %v", err)
+	}
+}
@@ -6,9 +6,11 @@
 package vsock
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
+	"syscall"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -31,7 +33,10 @@ type conn struct {
 	remote *Addr
 }
 
-var _ Conn = (*conn)(nil)
+var (
+	_ Conn         = (*conn)(nil)
+	_ syscall.Conn = (*conn)(nil)
+)
 
 // Dial connects to the cid and port via virtio socket.
 func Dial(cid, port uint32) (Conn, error) {
@@ -64,6 +69,100 @@ func Dial(cid, port uint32) (Conn, error) {
 	return newConn(uintptr(fd), nil, addr), nil
 }
 
+// DialContext connects to the cid and port via virtio socket using a
+// non-blocking connect, giving up when ctx is done.
+//
+// Unlike Dial, the returned connection stays in non-blocking mode and is
+// driven by the runtime network poller, so its deadlines are honored.
+func DialContext(ctx context.Context, cid, port uint32) (Conn, error) {
+	fd, err := newSocket()
+	if err != nil {
+		return nil, fmt.Errorf("create AF_VSOCK socket: %w", err)
+	}
+
+	if err := connectContext(ctx, fd, cid, port); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("connect to %08x.%08x: %w", cid, port, err)
+	}
+
+	addr := &Addr{
+		CID:  cid,
+		Port: port,
+	}
+
+	return newConn(uintptr(fd), nil, addr), nil
+}
+
+// connectPollInterval bounds a single poll so that ctx cancellation is noticed.
+const connectPollInterval = 50 * time.Millisecond
+
+// connectContext connects fd in non-blocking mode and waits for completion.
+func connectContext(ctx context.Context, fd int, cid, port uint32) error {
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return os.NewSyscallError("setnonblock", err)
+	}
+
+	sa := &unix.SockaddrVM{
+		CID:  cid,
+		Port: port,
+	}
+
+	for {
+		err := unix.Connect(fd, sa)
+		switch err {
+		case nil:
+			return nil
+		case unix.EINTR:
+			// retry connect in a loop if EINTR is encountered.
+			continue
+		case unix.EINPROGRESS, unix.EALREADY:
+			// wait for the connection below.
+		default:
+			return err
+		}
+		break
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		timeout := connectPollInterval
+		if deadline, ok := ctx.Deadline(); ok {
+			if d := time.Until(deadline); d < timeout {
+				timeout = d
+			}
+		}
+		if timeout < time.Millisecond {
+			timeout = time.Millisecond
+		}
+
+		pfd := &unix.PollFd{
+			Fd:     int32(fd),
+			Events: unix.POLLOUT,
+		}
+		n, err := pollTimeout(pfd, int(timeout/time.Millisecond))
+		if err == unix.EINTR || n == 0 {
+			continue
+		}
+		if err != nil {
+			return os.NewSyscallError("poll", err)
+		}
+
+		// the socket is writable, the result of the connect is in SO_ERROR.
+		errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			return os.NewSyscallError("getsockopt", err)
+		}
+		if errno != 0 {
+			return unix.Errno(errno)
+		}
+
+		return nil
+	}
+}
+
 // newConn returns the vsock connection.
 func newConn(fd uintptr, local, remote *Addr) Conn {
 	vsock := os.NewFile(fd, fmt.Sprintf("%s:%d", network, fd))
@@ -89,6 +188,14 @@ func (c *conn) FD() (*os.File, error) {
 	return os.NewFile(uintptr(fd), c.vsock.Name()), nil
 }
 
+// SyscallConn returns a raw network connection, so that callers can use
+// zero-copy paths such as sendfile(2) with the runtime poller.
+//
+// SyscallConn implements syscall.Conn.
+func (c *conn) SyscallConn() (syscall.RawConn, error) {
+	return c.vsock.SyscallConn()
+}
+
 // CloseRead shuts down the reading side of a vsock connection.
 //
 // CloseRead implements Conn.CloseRead.
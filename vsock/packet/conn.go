@@ -0,0 +1,318 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package packet
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrAddress is returned by Conn.Recv for a packet of another
+	// connection. The connection is left unchanged.
+	ErrAddress = errors.New("packet: packet of another connection")
+
+	// ErrState is returned for an operation or a packet not allowed in the
+	// state of the connection.
+	ErrState = errors.New("packet: not allowed in connection state")
+
+	// ErrCredit is returned when data exceeds the credit of the receiver.
+	ErrCredit = errors.New("packet: credit exceeded")
+
+	// ErrShutdown is returned for data in a direction shut down.
+	ErrShutdown = errors.New("packet: connection shut down")
+
+	// ErrRefused is returned by Conn.Recv when the peer resets a connection
+	// being connected.
+	ErrRefused = errors.New("packet: connection refused")
+)
+
+// Addr is the address of an end of a connection.
+type Addr struct {
+	CID  uint64
+	Port uint32
+}
+
+// String returns the address as cid:port.
+func (a Addr) String() string {
+	return fmt.Sprintf("%d:%d", a.CID, a.Port)
+}
+
+// State is the state of a connection.
+type State int
+
+// list of State.
+const (
+	StateIdle        State = iota // neither connected nor accepted
+	StateConnecting               // request sent, waiting for the response
+	StateEstablished              // passing data, until both ends shut down
+	StateClosed                   // reset by either end
+)
+
+var stateNames = [...]string{
+	StateIdle:        "idle",
+	StateConnecting:  "connecting",
+	StateEstablished: "established",
+	StateClosed:      "closed",
+}
+
+// String returns the name of the state.
+func (s State) String() string {
+	if s >= 0 && int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+
+	return fmt.Sprintf("state %d", int(s))
+}
+
+// Conn is the protocol state of an end of a connection. It is not safe for
+// concurrent use.
+//
+// The methods return the packets to send to the peer. When a packet of the
+// peer violates the protocol, Recv resets the connection and returns the
+// reset to send with the error.
+type Conn struct {
+	// Local and Peer are the addresses of the ends of the connection.
+	Local, Peer Addr
+
+	// Type is the socket type of the connection.
+	Type Type
+
+	// BufAlloc is the receive buffer size advertised to the peer.
+	BufAlloc uint32
+
+	state State
+
+	// credit of the peer: its receive buffer size, the number of bytes sent
+	// and the number of bytes it consumed.
+	peerBufAlloc, txCnt, peerFwdCnt uint32
+
+	// the number of bytes received and consumed.
+	rxCnt, fwdCnt uint32
+
+	localShutdown, peerShutdown uint32
+}
+
+// NewConn returns an idle connection of type typ between local and peer,
+// with a receive buffer of bufAlloc bytes.
+func NewConn(typ Type, local, peer Addr, bufAlloc uint32) *Conn {
+	return &Conn{Local: local, Peer: peer, Type: typ, BufAlloc: bufAlloc}
+}
+
+// Accept returns the established connection requested by req, addressed to
+// the local end, with a receive buffer of bufAlloc bytes, and the response
+// to send.
+func Accept(req Packet, bufAlloc uint32) (*Conn, Packet, error) {
+	if err := req.Validate(); err != nil {
+		return nil, Packet{}, err
+	}
+	if req.Op != OpRequest {
+		return nil, Packet{}, fmt.Errorf("%w: accept %v", ErrState, req.Op)
+	}
+
+	c := NewConn(req.Type, Addr{req.DstCID, req.DstPort}, Addr{req.SrcCID, req.SrcPort}, bufAlloc)
+	c.state = StateEstablished
+	c.peerBufAlloc, c.peerFwdCnt = req.BufAlloc, req.FwdCnt
+
+	return c, c.packet(OpResponse, 0, nil), nil
+}
+
+// State returns the state of the connection.
+func (c *Conn) State() State {
+	return c.state
+}
+
+// Credit returns the number of bytes the peer can receive.
+func (c *Conn) Credit() uint32 {
+	inflight := c.txCnt - c.peerFwdCnt
+	if inflight >= c.peerBufAlloc {
+		return 0
+	}
+
+	return c.peerBufAlloc - inflight
+}
+
+// Buffered returns the number of bytes received and not yet consumed.
+func (c *Conn) Buffered() uint32 {
+	return c.rxCnt - c.fwdCnt
+}
+
+// LocalShutdown returns the shutdown flags sent to the peer.
+func (c *Conn) LocalShutdown() uint32 {
+	return c.localShutdown
+}
+
+// PeerShutdown returns the shutdown flags received from the peer.
+func (c *Conn) PeerShutdown() uint32 {
+	return c.peerShutdown
+}
+
+// packet returns a packet of the connection, with its credit.
+func (c *Conn) packet(op Op, flags uint32, data []byte) Packet {
+	return Packet{
+		Header: Header{
+			SrcCID:   c.Local.CID,
+			DstCID:   c.Peer.CID,
+			SrcPort:  c.Local.Port,
+			DstPort:  c.Peer.Port,
+			Len:      uint32(len(data)),
+			Type:     c.Type,
+			Op:       op,
+			Flags:    flags,
+			BufAlloc: c.BufAlloc,
+			FwdCnt:   c.fwdCnt,
+		},
+		Data: data,
+	}
+}
+
+// Connect returns the request connecting an idle connection.
+func (c *Conn) Connect() (Packet, error) {
+	if c.state != StateIdle {
+		return Packet{}, fmt.Errorf("%w: connect %v", ErrState, c.state)
+	}
+	c.state = StateConnecting
+
+	return c.packet(OpRequest, 0, nil), nil
+}
+
+// Write returns the packet sending data, which must fit the credit of the
+// peer. The flags of seqpacket messages are set on the packet by the caller.
+func (c *Conn) Write(data []byte) (Packet, error) {
+	switch {
+	case c.state != StateEstablished:
+		return Packet{}, fmt.Errorf("%w: write %v", ErrState, c.state)
+	case c.localShutdown&ShutdownSend != 0:
+		return Packet{}, ErrShutdown
+	case uint64(len(data)) > uint64(c.Credit()):
+		return Packet{}, fmt.Errorf("%w: %d bytes, credit %d", ErrCredit, len(data), c.Credit())
+	}
+	c.txCnt += uint32(len(data))
+
+	return c.packet(OpRW, 0, data), nil
+}
+
+// Consume records that n bytes received were consumed, freeing their room
+// in the receive buffer. The peer learns of it from the next packet, or from
+// CreditUpdate.
+func (c *Conn) Consume(n uint32) error {
+	if n > c.Buffered() {
+		return fmt.Errorf("packet: consume %d of %d bytes", n, c.Buffered())
+	}
+	c.fwdCnt += n
+
+	return nil
+}
+
+// CreditUpdate returns a packet sending the credit of the connection.
+func (c *Conn) CreditUpdate() Packet {
+	return c.packet(OpCreditUpdate, 0, nil)
+}
+
+// CreditRequest returns a packet asking the peer for its credit.
+func (c *Conn) CreditRequest() Packet {
+	return c.packet(OpCreditRequest, 0, nil)
+}
+
+// Shutdown returns the packet shutting down the directions in flags, a
+// combination of ShutdownRcv and ShutdownSend.
+func (c *Conn) Shutdown(flags uint32) (Packet, error) {
+	if c.state != StateEstablished {
+		return Packet{}, fmt.Errorf("%w: shutdown %v", ErrState, c.state)
+	}
+	if flags == 0 || flags&^ShutdownBoth != 0 {
+		return Packet{}, fmt.Errorf("packet: shutdown flags %#x", flags)
+	}
+	c.localShutdown |= flags
+
+	return c.packet(OpShutdown, flags, nil), nil
+}
+
+// Reset closes the connection and returns the reset to send.
+func (c *Conn) Reset() Packet {
+	c.state = StateClosed
+
+	return c.packet(OpRst, 0, nil)
+}
+
+// fail resets the connection after a protocol violation of the peer.
+func (c *Conn) fail(err error) ([]Packet, error) {
+	return []Packet{c.Reset()}, err
+}
+
+// Recv updates the connection with the packet p of the peer and returns the
+// packets to send in reply. Data received is accounted until consumed.
+//
+// Once the peer shut down both directions, the connection is closed and
+// Recv replies with a reset, completing the close.
+func (c *Conn) Recv(p Packet) ([]Packet, error) {
+	h := &p.Header
+	if h.SrcCID != c.Peer.CID || h.SrcPort != c.Peer.Port || h.DstCID != c.Local.CID || h.DstPort != c.Local.Port {
+		return nil, fmt.Errorf("%w: %v", ErrAddress, h)
+	}
+	if c.state == StateClosed {
+		if h.Op == OpRst {
+			return nil, nil
+		}
+		return []Packet{c.packet(OpRst, 0, nil)}, fmt.Errorf("%w: %v %v", ErrState, h.Op, c.state)
+	}
+	if err := h.Validate(); err != nil {
+		return c.fail(err)
+	}
+	if h.Type != c.Type {
+		return c.fail(fmt.Errorf("%w: %v on %v connection", ErrInvalid, h.Type, c.Type))
+	}
+	if uint64(len(p.Data)) != uint64(h.Len) {
+		return c.fail(fmt.Errorf("%w: %d of %d bytes", ErrLength, len(p.Data), h.Len))
+	}
+
+	if h.Op == OpRst {
+		connecting := c.state == StateConnecting
+		c.state = StateClosed
+		if connecting {
+			return nil, ErrRefused
+		}
+		return nil, nil
+	}
+
+	// the peer cannot have consumed more than was sent.
+	if h.FwdCnt-c.peerFwdCnt > c.txCnt-c.peerFwdCnt {
+		return c.fail(fmt.Errorf("packet: peer forwarded %d of %d bytes", h.FwdCnt, c.txCnt))
+	}
+	c.peerBufAlloc, c.peerFwdCnt = h.BufAlloc, h.FwdCnt
+
+	switch c.state {
+	case StateIdle:
+		return c.fail(fmt.Errorf("%w: %v %v", ErrState, h.Op, c.state))
+	case StateConnecting:
+		if h.Op != OpResponse {
+			return c.fail(fmt.Errorf("%w: %v %v", ErrState, h.Op, c.state))
+		}
+		c.state = StateEstablished
+		return nil, nil
+	}
+
+	switch h.Op {
+	case OpRW:
+		if c.peerShutdown&ShutdownSend != 0 {
+			return c.fail(ErrShutdown)
+		}
+		if uint64(c.Buffered())+uint64(h.Len) > uint64(c.BufAlloc) {
+			return c.fail(fmt.Errorf("%w: %d bytes, %d buffered of %d", ErrCredit, h.Len, c.Buffered(), c.BufAlloc))
+		}
+		c.rxCnt += h.Len
+	case OpCreditUpdate:
+	case OpCreditRequest:
+		return []Packet{c.CreditUpdate()}, nil
+	case OpShutdown:
+		c.peerShutdown |= h.Flags
+		if c.peerShutdown == ShutdownBoth {
+			return []Packet{c.Reset()}, nil
+		}
+	default:
+		return c.fail(fmt.Errorf("%w: %v %v", ErrState, h.Op, c.state))
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package packet
+
+import (
+	"errors"
+	"testing"
+)
+
+var (
+	guest = Addr{CID: 3, Port: 1024}
+	host  = Addr{CID: HostCID, Port: 80}
+)
+
+// connect returns the ends of an established connection.
+func connect(t *testing.T, bufAlloc uint32) (client, server *Conn) {
+	t.Helper()
+
+	client = NewConn(TypeStream, guest, host, bufAlloc)
+	req, err := client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.State() != StateConnecting {
+		t.Fatalf("client %v after Connect", client.State())
+	}
+	server, resp, err := Accept(req, bufAlloc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Local != host || server.Peer != guest || resp.Op != OpResponse {
+		t.Fatalf("Accept = %v, %v", server, resp.Header)
+	}
+	deliver(t, client, resp)
+	if client.State() != StateEstablished || server.State() != StateEstablished {
+		t.Fatalf("client %v, server %v", client.State(), server.State())
+	}
+
+	return client, server
+}
+
+// deliver delivers p to c, which must not reply.
+func deliver(t *testing.T, c *Conn, p Packet) {
+	t.Helper()
+
+	if out, err := c.Recv(p); err != nil || len(out) > 0 {
+		t.Fatalf("Recv(%v) = %v, %v", p.Header, out, err)
+	}
+}
+
+func TestConnCredit(t *testing.T) {
+	client, server := connect(t, 8)
+
+	if n := client.Credit(); n != 8 {
+		t.Fatalf("credit %d", n)
+	}
+	p, err := client.Write([]byte("0123456789"))
+	if !errors.Is(err, ErrCredit) {
+		t.Fatalf("Write beyond credit: %v", err)
+	}
+	if p, err = client.Write([]byte("012345")); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, server, p)
+	if n := server.Buffered(); n != 6 {
+		t.Fatalf("server buffered %d", n)
+	}
+
+	// the credit is restored once the server consumes the data and tells
+	// the client.
+	if err := server.Consume(7); err == nil {
+		t.Fatal("Consume beyond buffered data succeeded")
+	}
+	if err := server.Consume(4); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.Credit(); n != 2 {
+		t.Fatalf("credit %d before update", n)
+	}
+	out, err := server.Recv(client.CreditRequest())
+	if err != nil || len(out) != 1 || out[0].Op != OpCreditUpdate || out[0].FwdCnt != 4 {
+		t.Fatalf("credit request: %v, %v", out, err)
+	}
+	deliver(t, client, out[0])
+	if n := client.Credit(); n != 6 {
+		t.Fatalf("credit %d after update", n)
+	}
+
+	// a peer exceeding the credit is reset.
+	p = Packet{Header: client.packet(OpRW, 0, nil).Header, Data: []byte("0123456")}
+	p.Len = uint32(len(p.Data))
+	out, err = server.Recv(p)
+	if !errors.Is(err, ErrCredit) || len(out) != 1 || out[0].Op != OpRst || server.State() != StateClosed {
+		t.Fatalf("Recv beyond credit: %v, %v, %v", out, err, server.State())
+	}
+}
+
+func TestConnShutdown(t *testing.T) {
+	client, server := connect(t, 64)
+
+	p, err := client.Shutdown(ShutdownSend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, server, p)
+	if _, err := client.Write([]byte("x")); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("Write after shutdown: %v", err)
+	}
+	if server.PeerShutdown() != ShutdownSend || client.LocalShutdown() != ShutdownSend {
+		t.Fatalf("shutdown flags %#x, %#x", server.PeerShutdown(), client.LocalShutdown())
+	}
+
+	// the server can still send.
+	if p, err = server.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, client, p)
+
+	// shutting down both directions completes with a reset.
+	if p, err = client.Shutdown(ShutdownRcv); err != nil {
+		t.Fatal(err)
+	}
+	out, err := server.Recv(p)
+	if err != nil || len(out) != 1 || out[0].Op != OpRst || server.State() != StateClosed {
+		t.Fatalf("Recv of the full shutdown: %v, %v", out, err)
+	}
+	deliver(t, client, out[0])
+	if client.State() != StateClosed {
+		t.Fatalf("client %v after reset", client.State())
+	}
+
+	// a closed connection replies with resets, except to resets.
+	if out, err := client.Recv(server.CreditUpdate()); !errors.Is(err, ErrState) || len(out) != 1 || out[0].Op != OpRst {
+		t.Fatalf("Recv on a closed connection: %v, %v", out, err)
+	}
+	deliver(t, client, server.Reset())
+}
+
+func TestConnErrors(t *testing.T) {
+	client := NewConn(TypeStream, guest, host, 64)
+	req, err := client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Connect(); !errors.Is(err, ErrState) {
+		t.Fatalf("second Connect: %v", err)
+	}
+	if _, err := client.Write(nil); !errors.Is(err, ErrState) {
+		t.Fatalf("Write while connecting: %v", err)
+	}
+	if _, _, err := Accept(Packet{Header: Header{Type: TypeStream, Op: OpRW}}, 64); !errors.Is(err, ErrState) {
+		t.Fatalf("Accept of data: %v", err)
+	}
+
+	// packets of other connections are left alone.
+	server, _, err := Accept(req, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := server.CreditUpdate()
+	other.DstPort++
+	if _, err := client.Recv(other); !errors.Is(err, ErrAddress) || client.State() != StateConnecting {
+		t.Fatalf("Recv of another connection: %v, %v", err, client.State())
+	}
+
+	// a reset while connecting refuses the connection.
+	if _, err := client.Recv(server.Reset()); !errors.Is(err, ErrRefused) || client.State() != StateClosed {
+		t.Fatalf("Recv of a reset while connecting: %v, %v", err, client.State())
+	}
+
+	// a request on an established connection violates the protocol.
+	client, server = connect(t, 64)
+	req.FwdCnt = 0
+	if out, err := server.Recv(req); !errors.Is(err, ErrState) || len(out) != 1 || out[0].Op != OpRst {
+		t.Fatalf("Recv of a request: %v, %v", out, err)
+	}
+
+	// so does a peer consuming more than was sent.
+	client, server = connect(t, 64)
+	p := server.CreditUpdate()
+	p.FwdCnt = 1
+	if _, err := client.Recv(p); err == nil || client.State() != StateClosed {
+		t.Fatalf("Recv of a bad fwd_cnt: %v, %v", err, client.State())
+	}
+}
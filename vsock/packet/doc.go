@@ -0,0 +1,18 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package packet encodes and decodes virtio-vsock packets, and tracks the
+// protocol state of a connection.
+//
+// A packet is a struct virtio_vsock_hdr followed by its payload. The package
+// does not depend on a device or a transport, for debugging tools and
+// tunnels as much as for device models.
+//
+// A Conn follows a connection from either end: its state, the credit-based
+// flow control, where an end sends no more than
+//
+//	buf_alloc - (tx_cnt - peer_fwd_cnt)
+//
+// bytes the peer has not consumed, and the shutdown of each direction. It
+// returns the packets to send; moving them is left to the caller.
+package packet
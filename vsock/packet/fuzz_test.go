@@ -0,0 +1,80 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build go1.18
+
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzParse(f *testing.F) {
+	hello := Packet{Header: Header{SrcCID: 3, DstCID: HostCID, Type: TypeStream, Op: OpRW}, Data: []byte("hello")}
+	f.Add(hello.Marshal())
+	f.Add(make([]byte, HeaderSize))
+	f.Add([]byte{1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p, err := Parse(b)
+		if err != nil {
+			return
+		}
+		_ = p.Validate()
+		_ = p.String()
+
+		// the encoding of a packet is the bytes it was parsed from.
+		if m := p.Marshal(); !bytes.Equal(m, b[:HeaderSize+int(p.Len)]) {
+			t.Fatalf("Marshal(Parse(%x)) = %x", b, m)
+		}
+	})
+}
+
+// FuzzConn delivers the packets decoded from the input to an established
+// connection and checks its accounting.
+func FuzzConn(f *testing.F) {
+	var seed []byte
+	for _, h := range []Header{
+		{Op: OpRW, Len: 4},
+		{Op: OpCreditRequest},
+		{Op: OpShutdown, Flags: ShutdownSend},
+		{Op: OpRst},
+	} {
+		h.SrcCID, h.DstCID, h.SrcPort, h.DstPort, h.Type = guest.CID, host.CID, guest.Port, host.Port, TypeStream
+		h.BufAlloc = 16
+		b := make([]byte, HeaderSize+int(h.Len))
+		h.Encode(b)
+		seed = append(seed, b...)
+	}
+	f.Add(seed)
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c := NewConn(TypeStream, host, guest, 16)
+		c.state = StateEstablished
+		for len(b) > 0 {
+			p, err := Parse(b)
+			if err != nil {
+				return
+			}
+			b = b[HeaderSize+int(p.Len):]
+
+			out, err := c.Recv(p)
+			if err != nil && c.State() != StateClosed && len(out) == 0 {
+				// only packets of other connections leave it open.
+				if p.SrcPort == guest.Port && p.DstPort == host.Port && p.SrcCID == guest.CID && p.DstCID == host.CID {
+					t.Fatalf("Recv(%v) failed with %v, leaving the connection %v", p.Header, err, c.State())
+				}
+			}
+			if c.Buffered() > c.BufAlloc {
+				t.Fatalf("%d bytes buffered of %d", c.Buffered(), c.BufAlloc)
+			}
+			if c.Credit() > c.peerBufAlloc {
+				t.Fatalf("credit %d of %d", c.Credit(), c.peerBufAlloc)
+			}
+			if err := c.Consume(c.Buffered()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
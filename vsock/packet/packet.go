@@ -0,0 +1,214 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// HeaderSize is the size of struct virtio_vsock_hdr.
+const HeaderSize = 44
+
+// HostCID is the context ID of the host.
+const HostCID = 2
+
+var (
+	// ErrShort is returned when decoding fewer bytes than a header.
+	ErrShort = errors.New("packet: short header")
+
+	// ErrLength is returned when the payload is shorter than the length in
+	// the header.
+	ErrLength = errors.New("packet: truncated payload")
+
+	// ErrInvalid is returned by Header.Validate for headers no peer sends.
+	ErrInvalid = errors.New("packet: invalid header")
+)
+
+// Type is the socket type of a packet.
+type Type uint16
+
+// list of Type.
+const (
+	TypeStream    Type = 1
+	TypeSeqpacket Type = 2
+)
+
+// String returns the name of the socket type.
+func (t Type) String() string {
+	switch t {
+	case TypeStream:
+		return "stream"
+	case TypeSeqpacket:
+		return "seqpacket"
+	}
+
+	return fmt.Sprintf("type %d", uint16(t))
+}
+
+// Op is the operation of a packet.
+type Op uint16
+
+// list of Op.
+const (
+	OpInvalid Op = iota
+	OpRequest
+	OpResponse
+	OpRst
+	OpShutdown
+	OpRW
+	OpCreditUpdate
+	OpCreditRequest
+)
+
+var opNames = [...]string{
+	OpInvalid:       "INVALID",
+	OpRequest:       "REQUEST",
+	OpResponse:      "RESPONSE",
+	OpRst:           "RST",
+	OpShutdown:      "SHUTDOWN",
+	OpRW:            "RW",
+	OpCreditUpdate:  "CREDIT_UPDATE",
+	OpCreditRequest: "CREDIT_REQUEST",
+}
+
+// String returns the name of the operation.
+func (op Op) String() string {
+	if int(op) < len(opNames) {
+		return opNames[op]
+	}
+
+	return fmt.Sprintf("op %d", uint16(op))
+}
+
+// list of the flags of OpShutdown.
+const (
+	ShutdownRcv  = 1 << 0
+	ShutdownSend = 1 << 1
+
+	ShutdownBoth = ShutdownRcv | ShutdownSend
+)
+
+// list of the flags of OpRW on seqpacket sockets.
+const (
+	SeqEOM = 1 << 0 // end of message
+	SeqEOR = 1 << 1 // end of record
+)
+
+// Header is struct virtio_vsock_hdr, in host byte order.
+type Header struct {
+	SrcCID   uint64
+	DstCID   uint64
+	SrcPort  uint32
+	DstPort  uint32
+	Len      uint32
+	Type     Type
+	Op       Op
+	Flags    uint32
+	BufAlloc uint32
+	FwdCnt   uint32
+}
+
+// Encode encodes h in the first HeaderSize bytes of b. It panics if b is
+// shorter.
+func (h *Header) Encode(b []byte) {
+	_ = b[HeaderSize-1]
+	le := binary.LittleEndian
+	le.PutUint64(b[0:], h.SrcCID)
+	le.PutUint64(b[8:], h.DstCID)
+	le.PutUint32(b[16:], h.SrcPort)
+	le.PutUint32(b[20:], h.DstPort)
+	le.PutUint32(b[24:], h.Len)
+	le.PutUint16(b[28:], uint16(h.Type))
+	le.PutUint16(b[30:], uint16(h.Op))
+	le.PutUint32(b[32:], h.Flags)
+	le.PutUint32(b[36:], h.BufAlloc)
+	le.PutUint32(b[40:], h.FwdCnt)
+}
+
+// Decode decodes the header at the start of b.
+func Decode(b []byte) (Header, error) {
+	if len(b) < HeaderSize {
+		return Header{}, ErrShort
+	}
+
+	le := binary.LittleEndian
+	return Header{
+		SrcCID:   le.Uint64(b[0:]),
+		DstCID:   le.Uint64(b[8:]),
+		SrcPort:  le.Uint32(b[16:]),
+		DstPort:  le.Uint32(b[20:]),
+		Len:      le.Uint32(b[24:]),
+		Type:     Type(le.Uint16(b[28:])),
+		Op:       Op(le.Uint16(b[30:])),
+		Flags:    le.Uint32(b[32:]),
+		BufAlloc: le.Uint32(b[36:]),
+		FwdCnt:   le.Uint32(b[40:]),
+	}, nil
+}
+
+// Validate checks the type and operation of h, the flags of the operation,
+// and that only OpRW carries a payload.
+func (h *Header) Validate() error {
+	switch {
+	case h.Type != TypeStream && h.Type != TypeSeqpacket:
+		return fmt.Errorf("%w: %v", ErrInvalid, h.Type)
+	case h.Op == OpInvalid || int(h.Op) >= len(opNames):
+		return fmt.Errorf("%w: %v", ErrInvalid, h.Op)
+	case h.Op != OpRW && h.Len != 0:
+		return fmt.Errorf("%w: %v with %d bytes", ErrInvalid, h.Op, h.Len)
+	}
+
+	var flags uint32
+	switch {
+	case h.Op == OpShutdown:
+		flags = ShutdownBoth
+	case h.Op == OpRW && h.Type == TypeSeqpacket:
+		flags = SeqEOM | SeqEOR
+	}
+	if h.Flags&^flags != 0 {
+		return fmt.Errorf("%w: %v flags %#x", ErrInvalid, h.Op, h.Flags)
+	}
+
+	return nil
+}
+
+// String returns a one-line description of h.
+func (h Header) String() string {
+	return fmt.Sprintf("%d:%d -> %d:%d %v %v len=%d flags=%#x buf_alloc=%d fwd_cnt=%d",
+		h.SrcCID, h.SrcPort, h.DstCID, h.DstPort, h.Type, h.Op, h.Len, h.Flags, h.BufAlloc, h.FwdCnt)
+}
+
+// Packet is a header and its payload.
+type Packet struct {
+	Header
+	Data []byte
+}
+
+// Parse decodes the packet at the start of b. Data aliases b, and bytes
+// beyond the length of the header are ignored.
+func Parse(b []byte) (Packet, error) {
+	h, err := Decode(b)
+	if err != nil {
+		return Packet{}, err
+	}
+	if uint64(h.Len) > uint64(len(b)-HeaderSize) {
+		return Packet{}, fmt.Errorf("%w: %d of %d bytes", ErrLength, len(b)-HeaderSize, h.Len)
+	}
+
+	return Packet{Header: h, Data: b[HeaderSize : HeaderSize+int(h.Len)]}, nil
+}
+
+// Marshal returns the encoding of p, with the length of the header set to
+// the length of Data.
+func (p *Packet) Marshal() []byte {
+	b := make([]byte, HeaderSize+len(p.Data))
+	h := p.Header
+	h.Len = uint32(len(p.Data))
+	h.Encode(b)
+	copy(b[HeaderSize:], p.Data)
+
+	return b
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	p := Packet{
+		Header: Header{
+			SrcCID:   3,
+			DstCID:   HostCID,
+			SrcPort:  1024,
+			DstPort:  0x01020304,
+			Type:     TypeSeqpacket,
+			Op:       OpRW,
+			Flags:    SeqEOM,
+			BufAlloc: 1 << 18,
+			FwdCnt:   0xfffffff0,
+		},
+		Data: []byte("hello"),
+	}
+	b := p.Marshal()
+	want := []byte{
+		3, 0, 0, 0, 0, 0, 0, 0,
+		2, 0, 0, 0, 0, 0, 0, 0,
+		0, 4, 0, 0,
+		4, 3, 2, 1,
+		5, 0, 0, 0,
+		2, 0,
+		5, 0,
+		1, 0, 0, 0,
+		0, 0, 4, 0,
+		0xf0, 0xff, 0xff, 0xff,
+		'h', 'e', 'l', 'l', 'o',
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("Marshal = %v, want %v", b, want)
+	}
+
+	// trailing bytes are ignored.
+	got, err := Parse(append(b, 0xff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Len = 5
+	if got.Header != p.Header || string(got.Data) != "hello" {
+		t.Fatalf("Parse = %v %q, want %v", got.Header, got.Data, p.Header)
+	}
+	if err := got.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if s := got.String(); s != "3:1024 -> 2:16909060 seqpacket RW len=5 flags=0x1 buf_alloc=262144 fwd_cnt=4294967280" {
+		t.Fatalf("String = %q", s)
+	}
+
+	if _, err := Parse(b[:HeaderSize-1]); !errors.Is(err, ErrShort) {
+		t.Fatalf("Parse of a short header: %v", err)
+	}
+	if _, err := Parse(b[:len(b)-1]); !errors.Is(err, ErrLength) {
+		t.Fatalf("Parse of a truncated payload: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		h  Header
+		ok bool
+	}{
+		{Header{Type: TypeStream, Op: OpRequest}, true},
+		{Header{Type: TypeStream, Op: OpShutdown, Flags: ShutdownBoth}, true},
+		{Header{Type: TypeSeqpacket, Op: OpRW, Len: 1, Flags: SeqEOM | SeqEOR}, true},
+		{Header{Type: 3, Op: OpRequest}, false},
+		{Header{Type: TypeStream, Op: OpInvalid}, false},
+		{Header{Type: TypeStream, Op: OpCreditRequest + 1}, false},
+		{Header{Type: TypeStream, Op: OpResponse, Len: 1}, false},
+		{Header{Type: TypeStream, Op: OpShutdown, Flags: 4}, false},
+		{Header{Type: TypeStream, Op: OpRW, Flags: SeqEOM}, false},
+	} {
+		err := tt.h.Validate()
+		if (err == nil) != tt.ok || (err != nil && !errors.Is(err, ErrInvalid)) {
+			t.Errorf("Validate(%v) = %v", tt.h, err)
+		}
+	}
+}
@@ -0,0 +1,579 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build darwin || linux
+
+package vsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrConnClosed is returned by ReconnectingConn methods after Close has been called.
+var ErrConnClosed = errors.New("vsock: reconnecting connection closed")
+
+// IsTemporary reports whether err is a transient vsock error worth retrying.
+//
+// Transient errors are the ones seen while a guest reboots, migrates or has not
+// yet started listening on the port, such as ECONNRESET, ENODEV or ETIMEDOUT.
+// Errors caused by the caller, such as EACCES or an invalid context ID, are
+// permanent and retrying them never succeeds. Deadline errors are not
+// connection failures and are not temporary.
+func IsTemporary(err error) bool {
+	var errno unix.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+
+	switch errno {
+	case unix.ECONNRESET,
+		unix.ECONNREFUSED,
+		unix.ECONNABORTED,
+		unix.ENODEV,
+		unix.ETIMEDOUT,
+		unix.EHOSTUNREACH,
+		unix.EHOSTDOWN,
+		unix.ENETUNREACH,
+		unix.ENOTCONN,
+		unix.EPIPE:
+		return true
+	default:
+		// EACCES, EPERM, EINVAL (bad CID), EADDRNOTAVAIL, EAFNOSUPPORT, etc.
+		return false
+	}
+}
+
+// Backoff describes a jittered exponential backoff policy.
+//
+// The zero value is usable and backs off from 100ms up to 10s, doubling each
+// attempt with 20% jitter.
+type Backoff struct {
+	// Min is the delay before the first retry.
+	Min time.Duration
+
+	// Max caps the delay between two attempts.
+	Max time.Duration
+
+	// Factor is the multiplier applied to the delay after each attempt.
+	Factor float64
+
+	// Jitter is the fraction of the delay which is randomized, in [0, 1].
+	Jitter float64
+}
+
+// default backoff parameters.
+const (
+	defaultBackoffMin    = 100 * time.Millisecond
+	defaultBackoffMax    = 10 * time.Second
+	defaultBackoffFactor = 2
+	defaultBackoffJitter = 0.2
+)
+
+// Duration returns the delay before the given retry attempt, counting from 0.
+func (b Backoff) Duration(attempt int) time.Duration {
+	min, max, factor, jitter := b.Min, b.Max, b.Factor, b.Jitter
+	if min <= 0 {
+		min = defaultBackoffMin
+	}
+	if max <= 0 {
+		max = defaultBackoffMax
+	}
+	if factor < 1 {
+		factor = defaultBackoffFactor
+	}
+	if jitter <= 0 && b == (Backoff{}) {
+		jitter = defaultBackoffJitter
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+
+	d := float64(min)
+	for i := 0; i < attempt && d < float64(max); i++ {
+		d *= factor
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+
+	// spread the delay over [d*(1-jitter), d*(1+jitter)) to avoid every host
+	// process hammering a rebooting guest at the same instant.
+	if jitter > 0 {
+		d += d * jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(d)
+}
+
+// ReconnectState represents the connection state of a ReconnectingConn.
+type ReconnectState int
+
+// list of ReconnectState.
+const (
+	// StateDisconnected is the state before the first dial and after a transient failure.
+	StateDisconnected ReconnectState = iota
+
+	// StateConnecting is the state while dialing, including backoff delays.
+	StateConnecting
+
+	// StateConnected is the state while an underlying connection is established.
+	StateConnected
+
+	// StateClosed is the terminal state after Close or a permanent error.
+	StateClosed
+)
+
+// String returns a string representation of the ReconnectState.
+func (s ReconnectState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("ReconnectState(%d)", int(s))
+	}
+}
+
+// dialFunc is the signature of Dial, swappable for tests.
+type dialFunc func(cid, port uint32) (Conn, error)
+
+// ReconnectingConn is a vsock client connection which re-dials the peer with
+// backoff whenever the connection fails with a transient error.
+//
+// Stream data in flight when a connection breaks is lost; the failing Read or
+// Write returns the error and the next call transparently reconnects. Callers
+// that speak request/response protocols should retry the whole exchange.
+type ReconnectingConn struct {
+	// Backoff is the retry policy used when (re)connecting.
+	Backoff Backoff
+
+	// MaxAttempts limits the number of dials per reconnect. Zero means unlimited.
+	MaxAttempts int
+
+	// OnStateChange, if non-nil, is called on every state transition together
+	// with the error which caused it, if any. It must not block.
+	OnStateChange func(state ReconnectState, err error)
+
+	cid  uint32
+	port uint32
+	dial dialFunc
+
+	// dialMu serializes dials so that concurrent callers share one reconnect.
+	dialMu sync.Mutex
+
+	mu     sync.Mutex
+	conn   Conn
+	state  ReconnectState
+	closed chan struct{}
+	once   sync.Once
+
+	// readDeadline and writeDeadline are applied to every new connection.
+	readDeadline, writeDeadline time.Time
+
+	// events are the state changes not yet passed to OnStateChange, and
+	// notifying is set while a goroutine passes them, without r.mu held.
+	events    []stateEvent
+	notifying bool
+}
+
+// stateEvent is a state change for OnStateChange.
+type stateEvent struct {
+	state ReconnectState
+	err   error
+}
+
+var _ net.Conn = (*ReconnectingConn)(nil)
+
+// NewReconnectingConn returns a ReconnectingConn for the cid and port.
+//
+// No connection is made until Connect, Read or Write is called.
+func NewReconnectingConn(cid, port uint32) *ReconnectingConn {
+	return &ReconnectingConn{
+		cid:    cid,
+		port:   port,
+		dial:   Dial,
+		closed: make(chan struct{}),
+	}
+}
+
+// DialRetry dials the cid and port, retrying transient errors with backoff
+// until it succeeds, a permanent error occurs or ctx is done.
+//
+// It is the building block to wait until a guest agent becomes ready.
+func DialRetry(ctx context.Context, cid, port uint32, backoff Backoff) (Conn, error) {
+	return dialRetry(ctx, Dial, cid, port, backoff, 0, nil)
+}
+
+// dialRetry implements DialRetry and ReconnectingConn.Connect.
+func dialRetry(ctx context.Context, dial dialFunc, cid, port uint32, backoff Backoff, maxAttempts int, cancel <-chan struct{}) (Conn, error) {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for attempt := 0; ; attempt++ {
+		c, err := dial(cid, port)
+		if err == nil {
+			return c, nil
+		}
+		if !IsTemporary(err) {
+			return nil, err
+		}
+		if maxAttempts > 0 && attempt+1 >= maxAttempts {
+			return nil, fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+		}
+
+		d := backoff.Duration(attempt)
+		if timer == nil {
+			timer = time.NewTimer(d)
+		} else {
+			timer.Reset(d)
+		}
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-cancel:
+			return nil, ErrConnClosed
+		}
+	}
+}
+
+// setState updates the state and queues the change for notify.
+//
+// r.mu must be held.
+func (r *ReconnectingConn) setState(state ReconnectState, err error) {
+	if r.state == state {
+		return
+	}
+	r.state = state
+
+	if r.OnStateChange != nil {
+		r.events = append(r.events, stateEvent{state, err})
+	}
+}
+
+// notify passes the queued state changes to OnStateChange in order, without
+// r.mu held so that it may call the methods of r. A change queued while
+// another goroutine notifies is passed by that goroutine.
+//
+// r.mu must not be held.
+func (r *ReconnectingConn) notify() {
+	r.mu.Lock()
+	if r.notifying {
+		r.mu.Unlock()
+		return
+	}
+	r.notifying = true
+	for len(r.events) > 0 {
+		events := r.events
+		r.events = nil
+		r.mu.Unlock()
+
+		for _, e := range events {
+			r.OnStateChange(e.state, e.err)
+		}
+
+		r.mu.Lock()
+	}
+	r.notifying = false
+	r.mu.Unlock()
+}
+
+// State returns the current connection state.
+func (r *ReconnectingConn) State() ReconnectState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.state
+}
+
+// Connect establishes the underlying connection if there is none, retrying
+// transient errors with backoff. It returns immediately if already connected.
+func (r *ReconnectingConn) Connect(ctx context.Context) error {
+	_, err := r.get(ctx)
+	return err
+}
+
+// get returns the current connection, dialing a new one if needed.
+func (r *ReconnectingConn) get(ctx context.Context) (Conn, error) {
+	defer r.notify()
+	r.dialMu.Lock()
+	defer r.dialMu.Unlock()
+
+	r.mu.Lock()
+	if r.state == StateClosed {
+		r.mu.Unlock()
+		return nil, ErrConnClosed
+	}
+	if c := r.conn; c != nil {
+		r.mu.Unlock()
+		return c, nil
+	}
+	r.setState(StateConnecting, nil)
+	r.mu.Unlock()
+	r.notify()
+
+	c, err := dialRetry(ctx, r.dial, r.cid, r.port, r.Backoff, r.MaxAttempts, r.closed)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err == nil && r.state == StateClosed {
+		// lost the race against Close.
+		c.Close()
+		err = ErrConnClosed
+	}
+	if err == nil {
+		if err = r.applyDeadlines(c); err != nil {
+			c.Close()
+		}
+	}
+	if err != nil {
+		if r.state != StateClosed {
+			if IsTemporary(err) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				r.setState(StateDisconnected, err)
+			} else {
+				r.setState(StateClosed, err)
+			}
+		}
+		return nil, err
+	}
+
+	r.conn = c
+	r.setState(StateConnected, nil)
+
+	return c, nil
+}
+
+// applyDeadlines sets the stored deadlines on the new connection c. Zero
+// deadlines are skipped, and os.ErrNoDeadline is ignored: the blocking
+// sockets of Dial do not support deadlines.
+//
+// r.mu must be held.
+func (r *ReconnectingConn) applyDeadlines(c Conn) error {
+	if !r.readDeadline.IsZero() {
+		if err := c.SetReadDeadline(r.readDeadline); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+			return err
+		}
+	}
+	if !r.writeDeadline.IsZero() {
+		if err := c.SetWriteDeadline(r.writeDeadline); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isConnFailure reports whether err means the connection is gone and a new one
+// must be dialed. Other errors, such as deadline errors, leave the connection
+// usable.
+func isConnFailure(err error) bool {
+	for _, target := range []error{io.EOF, unix.ECONNRESET, unix.EPIPE, unix.ETIMEDOUT, unix.ENOTCONN, unix.ECONNABORTED} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fail drops c if it is still the current connection and err is a connection
+// failure.
+func (r *ReconnectingConn) fail(c Conn, err error) {
+	if !isConnFailure(err) {
+		return
+	}
+	defer r.notify()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn != c {
+		return
+	}
+	r.conn = nil
+	c.Close()
+	if r.state != StateClosed {
+		r.setState(StateDisconnected, err)
+	}
+}
+
+// getUntil returns the current connection like get, dialing until the
+// deadline t if it is not zero. An expired deadline is reported as
+// os.ErrDeadlineExceeded, like the deadlines of the connection.
+func (r *ReconnectingConn) getUntil(t time.Time) (Conn, error) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if !t.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, t)
+	}
+	defer cancel()
+
+	c, err := r.get(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, os.ErrDeadlineExceeded
+	}
+
+	return c, err
+}
+
+// Read reads data from the connection, reconnecting first if needed until
+// the read deadline.
+//
+// Read implements net.Conn.Read.
+func (r *ReconnectingConn) Read(buf []byte) (int, error) {
+	r.mu.Lock()
+	deadline := r.readDeadline
+	r.mu.Unlock()
+
+	c, err := r.getUntil(deadline)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := c.Read(buf)
+	if err != nil {
+		r.fail(c, err)
+	}
+
+	return n, err
+}
+
+// Write writes data over the connection, reconnecting first if needed until
+// the write deadline.
+//
+// Write implements net.Conn.Write.
+func (r *ReconnectingConn) Write(buf []byte) (int, error) {
+	r.mu.Lock()
+	deadline := r.writeDeadline
+	r.mu.Unlock()
+
+	c, err := r.getUntil(deadline)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := c.Write(buf)
+	if err != nil {
+		r.fail(c, err)
+	}
+
+	return n, err
+}
+
+// Close closes the current connection and stops any further reconnects.
+//
+// Close implements net.Conn.Close.
+func (r *ReconnectingConn) Close() error {
+	r.once.Do(func() { close(r.closed) })
+	defer r.notify()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	if r.conn != nil {
+		err = r.conn.Close()
+		r.conn = nil
+	}
+	r.setState(StateClosed, nil)
+
+	return err
+}
+
+// current returns the current connection, which may be nil.
+func (r *ReconnectingConn) current() Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.conn
+}
+
+// LocalAddr returns the local address of the current connection, if any.
+//
+// LocalAddr implements net.Conn.LocalAddr.
+func (r *ReconnectingConn) LocalAddr() net.Addr {
+	if c := r.current(); c != nil {
+		return c.LocalAddr()
+	}
+
+	return nil
+}
+
+// RemoteAddr returns the address of the peer.
+//
+// RemoteAddr implements net.Conn.RemoteAddr.
+func (r *ReconnectingConn) RemoteAddr() net.Addr {
+	return &Addr{
+		CID:  r.cid,
+		Port: r.port,
+	}
+}
+
+// SetDeadline sets the read and write deadlines of the current connection
+// and of the next ones. The deadlines also bound the reconnects of Read and
+// Write.
+//
+// SetDeadline implements net.Conn.SetDeadline.
+func (r *ReconnectingConn) SetDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.readDeadline, r.writeDeadline = t, t
+	if r.conn != nil {
+		return r.conn.SetDeadline(t)
+	}
+
+	return nil
+}
+
+// SetReadDeadline sets the read deadline of the current connection and of the
+// next ones.
+//
+// SetReadDeadline implements net.Conn.SetReadDeadline.
+func (r *ReconnectingConn) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.readDeadline = t
+	if r.conn != nil {
+		return r.conn.SetReadDeadline(t)
+	}
+
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the current connection and of
+// the next ones.
+//
+// SetWriteDeadline implements net.Conn.SetWriteDeadline.
+func (r *ReconnectingConn) SetWriteDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.writeDeadline = t
+	if r.conn != nil {
+		return r.conn.SetWriteDeadline(t)
+	}
+
+	return nil
+}
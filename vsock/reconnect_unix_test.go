@@ -0,0 +1,325 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build darwin || linux
+
+package vsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// pipeConn adapts a net.Pipe end to Conn.
+type pipeConn struct {
+	net.Conn
+}
+
+func (pipeConn) FD() (*os.File, error) { return nil, unix.ENOTSUP }
+func (pipeConn) CloseRead() error      { return nil }
+func (pipeConn) CloseWrite() error     { return nil }
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{unix.ECONNRESET, true},
+		{unix.ENODEV, true},
+		{unix.ETIMEDOUT, true},
+		{fmt.Errorf("connect to 00000003.00000400: %w", unix.ECONNREFUSED), true},
+		{unix.EAGAIN, false},
+		{unix.EINTR, false},
+		{os.ErrDeadlineExceeded, false},
+		{unix.EACCES, false},
+		{unix.EINVAL, false},
+		{errors.New("random"), false},
+	}
+	for _, tt := range tests {
+		if got := IsTemporary(tt.err); got != tt.want {
+			t.Errorf("IsTemporary(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestIsConnFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{io.EOF, true},
+		{unix.ECONNRESET, true},
+		{unix.EPIPE, true},
+		{unix.ETIMEDOUT, true},
+		{unix.ENOTCONN, true},
+		{&os.SyscallError{Syscall: "read", Err: unix.ECONNABORTED}, true},
+		{os.ErrDeadlineExceeded, false},
+		{unix.EAGAIN, false},
+		{unix.EINTR, false},
+		{errors.New("random"), false},
+	}
+	for _, tt := range tests {
+		if got := isConnFailure(tt.err); got != tt.want {
+			t.Errorf("isConnFailure(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBackoffDuration(t *testing.T) {
+	b := Backoff{Min: 10 * time.Millisecond, Max: 80 * time.Millisecond, Factor: 2}
+	want := []time.Duration{10, 20, 40, 80, 80}
+	for i, w := range want {
+		if got := b.Duration(i); got != w*time.Millisecond {
+			t.Errorf("Duration(%d) = %v, want %v", i, got, w*time.Millisecond)
+		}
+	}
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := b.Duration(1)
+		if d < 10*time.Millisecond || d >= 30*time.Millisecond {
+			t.Fatalf("jittered Duration(1) = %v, want in [10ms, 30ms)", d)
+		}
+	}
+}
+
+func TestReconnectingConn(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		dials   int
+		servers = make(chan net.Conn, 4)
+	)
+	// fail twice like a rebooting guest, then accept.
+	dial := func(cid, port uint32) (Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		dials++
+		if dials <= 2 {
+			return nil, unix.ENODEV
+		}
+		c1, c2 := net.Pipe()
+		servers <- c2
+
+		return pipeConn{c1}, nil
+	}
+
+	var states []ReconnectState
+	r := NewReconnectingConn(3, 1024)
+	r.dial = dial
+	r.Backoff = Backoff{Min: time.Millisecond, Max: time.Millisecond}
+	r.OnStateChange = func(s ReconnectState, err error) { states = append(states, s) }
+
+	if err := r.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if dials != 3 {
+		t.Fatalf("dials = %d, want 3", dials)
+	}
+
+	srv := <-servers
+	go srv.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Read = %q, %v", buf, err)
+	}
+
+	// the guest goes away: the read fails and the next call reconnects.
+	srv.Close()
+	if _, err := r.Read(buf); err == nil {
+		t.Fatal("Read after peer close succeeded")
+	}
+	if got := r.State(); got != StateDisconnected {
+		t.Fatalf("State = %v, want %v", got, StateDisconnected)
+	}
+
+	go func() {
+		srv := <-servers
+		io.Copy(io.Discard, srv)
+	}()
+	if _, err := r.Write([]byte("pong")); err != nil {
+		t.Fatalf("Write after reconnect: %v", err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := r.Write(buf); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("Write after Close = %v, want %v", err, ErrConnClosed)
+	}
+
+	want := []ReconnectState{StateConnecting, StateConnected, StateDisconnected, StateConnecting, StateConnected, StateClosed}
+	if fmt.Sprint(states) != fmt.Sprint(want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+}
+
+func TestReconnectingConnPermanentError(t *testing.T) {
+	r := NewReconnectingConn(3, 1024)
+	r.dial = func(cid, port uint32) (Conn, error) {
+		return nil, unix.EACCES
+	}
+
+	if err := r.Connect(context.Background()); !errors.Is(err, unix.EACCES) {
+		t.Fatalf("Connect = %v, want %v", err, unix.EACCES)
+	}
+	if got := r.State(); got != StateClosed {
+		t.Fatalf("State = %v, want %v", got, StateClosed)
+	}
+}
+
+func TestDialRetryContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	dial := func(cid, port uint32) (Conn, error) {
+		return nil, unix.ECONNRESET
+	}
+	_, err := dialRetry(ctx, dial, 3, 1024, Backoff{Min: time.Millisecond}, 0, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("dialRetry = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestReconnectingConnDeadline(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		up      bool
+		servers = make(chan net.Conn, 4)
+	)
+	dial := func(cid, port uint32) (Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !up {
+			return nil, unix.ENODEV
+		}
+		c1, c2 := net.Pipe()
+		servers <- c2
+
+		return pipeConn{c1}, nil
+	}
+
+	r := NewReconnectingConn(3, 1024)
+	r.dial = dial
+	r.Backoff = Backoff{Min: time.Millisecond, Max: time.Millisecond}
+	defer r.Close()
+
+	// the deadline bounds the reconnect of the guest which never comes up.
+	if err := r.SetDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := r.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	// the deadline set without connection applies to the new one, and its
+	// expiry does not drop it.
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	if err := r.SetDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if _, err := r.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if got := r.State(); got != StateConnected {
+		t.Fatalf("State = %v, want %v", got, StateConnected)
+	}
+
+	srv := <-servers
+	go srv.Write([]byte("ping"))
+	if err := r.SetDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Read = %q, %v", buf, err)
+	}
+	if len(servers) != 0 {
+		t.Fatal("reconnected after a deadline")
+	}
+}
+
+func TestReconnectingConnStateChange(t *testing.T) {
+	r := NewReconnectingConn(3, 1024)
+	r.dial = func(cid, port uint32) (Conn, error) {
+		c1, _ := net.Pipe()
+		return pipeConn{c1}, nil
+	}
+
+	// the callback may use the connection.
+	var states []ReconnectState
+	r.OnStateChange = func(s ReconnectState, err error) {
+		states = append(states, s)
+		if r.State() == StateConnected {
+			r.Close()
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- r.Connect(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnStateChange deadlocked")
+	}
+
+	want := []ReconnectState{StateConnecting, StateConnected, StateClosed}
+	if fmt.Sprint(states) != fmt.Sprint(want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+}
+
+func TestReconnectingConnBlockingSocket(t *testing.T) {
+	for _, deadline := range []time.Time{{}, time.Now().Add(time.Hour)} {
+		t.Run(fmt.Sprint(!deadline.IsZero()), func(t *testing.T) {
+			// the blocking sockets of Dial do not support deadlines.
+			fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			peer := os.NewFile(uintptr(fds[1]), "peer")
+			defer peer.Close()
+
+			r := NewReconnectingConn(3, 1024)
+			r.dial = func(cid, port uint32) (Conn, error) {
+				return newConn(uintptr(fds[0]), nil, &Addr{CID: cid, Port: port}), nil
+			}
+			defer r.Close()
+			r.SetDeadline(deadline)
+
+			if err := r.Connect(context.Background()); err != nil {
+				t.Fatalf("Connect: %v", err)
+			}
+			if got := r.State(); got != StateConnected {
+				t.Fatalf("State = %v, want %v", got, StateConnected)
+			}
+			if _, err := peer.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("Read = %q, %v", buf, err)
+			}
+		})
+	}
+}
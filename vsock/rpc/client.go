@@ -0,0 +1,287 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrShutdown is returned by calls on a closed Client or after the connection broke.
+var ErrShutdown = errors.New("rpc: connection is shut down")
+
+// streamBuffer is the number of stream messages buffered per call before the
+// connection reader blocks.
+const streamBuffer = 64
+
+// Client is an RPC client. It is safe for concurrent use and multiplexes
+// calls over a single connection.
+type Client struct {
+	conn io.ReadWriteCloser
+	w    *frameWriter
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*call
+	err     error // set once the connection is shut down
+	done    chan struct{}
+}
+
+// call is a pending call.
+type call struct {
+	// ch receives the frames of the call. It is closed if the connection
+	// breaks before the call completes.
+	ch chan frame
+
+	// abandoned is closed when the caller stops waiting for frames.
+	abandoned chan struct{}
+}
+
+// NewClient returns a Client which issues calls over conn.
+func NewClient(conn io.ReadWriteCloser) *Client {
+	c := &Client{
+		conn:    conn,
+		w:       &frameWriter{w: conn},
+		pending: make(map[uint64]*call),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+
+	return c
+}
+
+// Close closes the connection. Pending calls fail with ErrShutdown.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	<-c.done
+
+	return err
+}
+
+// readLoop dispatches frames to pending calls until the connection fails.
+func (c *Client) readLoop() {
+	var err error
+	for {
+		var f frame
+		f, err = readFrame(c.conn)
+		if err != nil {
+			break
+		}
+
+		c.mu.Lock()
+		cl, ok := c.pending[f.id]
+		if ok && f.typ != frameData {
+			delete(c.pending, f.id)
+		}
+		c.mu.Unlock()
+
+		if ok {
+			select {
+			case cl.ch <- f:
+			case <-cl.abandoned:
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.err = fmt.Errorf("%w: %v", ErrShutdown, err)
+	for id, cl := range c.pending {
+		close(cl.ch)
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+
+	close(c.done)
+}
+
+// start registers a call and sends its request.
+func (c *Client) start(ctx context.Context, name string, args interface{}, buf int) (uint64, *call, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	b, err := json.Marshal(args)
+	if err != nil {
+		return 0, nil, err
+	}
+	hdr := requestHeader{
+		Method: name,
+		Args:   b,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		hdr.Timeout = int64(time.Until(deadline))
+		if hdr.Timeout <= 0 {
+			return 0, nil, context.DeadlineExceeded
+		}
+	}
+	payload, err := json.Marshal(hdr)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	cl := &call{
+		ch:        make(chan frame, buf),
+		abandoned: make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return 0, nil, err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = cl
+	c.mu.Unlock()
+
+	if err := c.w.write(frameRequest, id, payload); err != nil {
+		c.forget(id, cl)
+		return 0, nil, fmt.Errorf("%w: %v", ErrShutdown, err)
+	}
+
+	return id, cl, nil
+}
+
+// forget drops a pending call.
+func (c *Client) forget(id uint64, cl *call) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, id)
+	close(cl.abandoned)
+}
+
+// abort cancels the call on the server and returns the context error.
+func (c *Client) abort(ctx context.Context, id uint64, cl *call) error {
+	c.forget(id, cl)
+	c.w.write(frameCancel, id, nil)
+
+	return ctx.Err()
+}
+
+// shutdownErr returns the error the connection was shut down with.
+func (c *Client) shutdownErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		return ErrShutdown
+	}
+
+	return c.err
+}
+
+// decodeError decodes the payload of a frameError.
+func decodeError(payload []byte) error {
+	rerr := new(Error)
+	if err := json.Unmarshal(payload, rerr); err != nil {
+		return fmt.Errorf("rpc: decode error: %w", err)
+	}
+
+	return rerr
+}
+
+// Call invokes the named "Service.Method" with args and decodes the result
+// into reply. The ctx deadline is enforced by the server as well.
+func (c *Client) Call(ctx context.Context, name string, args, reply interface{}) error {
+	id, cl, err := c.start(ctx, name, args, 1)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case f, ok := <-cl.ch:
+		if !ok {
+			return c.shutdownErr()
+		}
+
+		switch f.typ {
+		case frameResponse:
+			if reply == nil {
+				return nil
+			}
+			return json.Unmarshal(f.payload, reply)
+		case frameError:
+			return decodeError(f.payload)
+		default:
+			return fmt.Errorf("rpc: unexpected %s frame for unary call", f.typ)
+		}
+
+	case <-ctx.Done():
+		return c.abort(ctx, id, cl)
+	}
+}
+
+// Stream invokes a server streaming "Service.Method" with args.
+func (c *Client) Stream(ctx context.Context, name string, args interface{}) (*ClientStream, error) {
+	id, cl, err := c.start(ctx, name, args, streamBuffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ClientStream{
+		c:   c,
+		ctx: ctx,
+		id:  id,
+		cl:  cl,
+	}, nil
+}
+
+// ClientStream receives the messages of a streaming call.
+type ClientStream struct {
+	c   *Client
+	ctx context.Context
+	id  uint64
+	cl  *call
+	err error
+}
+
+// Recv decodes the next message into v. It returns io.EOF once the server
+// completes the call successfully.
+func (cs *ClientStream) Recv(v interface{}) error {
+	if cs.err != nil {
+		return cs.err
+	}
+
+	select {
+	case f, ok := <-cs.cl.ch:
+		if !ok {
+			cs.err = cs.c.shutdownErr()
+			return cs.err
+		}
+
+		switch f.typ {
+		case frameData:
+			return json.Unmarshal(f.payload, v)
+		case frameEnd:
+			cs.err = io.EOF
+		case frameError:
+			cs.err = decodeError(f.payload)
+		default:
+			cs.err = fmt.Errorf("rpc: unexpected %s frame for stream", f.typ)
+		}
+		return cs.err
+
+	case <-cs.ctx.Done():
+		cs.err = cs.c.abort(cs.ctx, cs.id, cs.cl)
+		return cs.err
+	}
+}
+
+// Close cancels the call if it is still running.
+func (cs *ClientStream) Close() error {
+	if cs.err == nil {
+		cs.c.forget(cs.id, cs.cl)
+		cs.c.w.write(frameCancel, cs.id, nil)
+		cs.err = context.Canceled
+	}
+
+	return nil
+}
@@ -0,0 +1,18 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package rpc provides framed host/guest RPC over a vsock connection.
+//
+// It works over any net.Conn. Calls are multiplexed on a single connection,
+// carry their remaining timeout so that the server enforces the same deadline,
+// and can be canceled by the client. Services are registered by reflection
+// from methods of the form
+//
+//	func (t *T) Method(ctx context.Context, args A, reply *R) error
+//
+// for unary calls, and
+//
+//	func (t *T) Method(ctx context.Context, args A, stream *rpc.ServerStream) error
+//
+// for server streaming calls. Messages are encoded as JSON.
+package rpc
@@ -0,0 +1,73 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Code classifies an Error.
+type Code string
+
+// list of Code.
+const (
+	// CodeUnknown is an error returned by a handler.
+	CodeUnknown Code = "unknown"
+
+	// CodeNotFound means the method is not registered on the server.
+	CodeNotFound Code = "not_found"
+
+	// CodeInvalidArgument means the arguments could not be decoded.
+	CodeInvalidArgument Code = "invalid_argument"
+
+	// CodeCanceled means the call was canceled by the client.
+	CodeCanceled Code = "canceled"
+
+	// CodeDeadlineExceeded means the call deadline expired.
+	CodeDeadlineExceeded Code = "deadline_exceeded"
+
+	// CodeInternal means the server failed to encode the reply.
+	CodeInternal Code = "internal"
+)
+
+// Error is an error returned by a remote call.
+type Error struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc: %s: %s", e.Code, e.Message)
+}
+
+// Unwrap maps cancellation codes to the context errors, so that
+// errors.Is(err, context.DeadlineExceeded) works across the wire.
+func (e *Error) Unwrap() error {
+	switch e.Code {
+	case CodeCanceled:
+		return context.Canceled
+	case CodeDeadlineExceeded:
+		return context.DeadlineExceeded
+	default:
+		return nil
+	}
+}
+
+// toError converts a handler error into an *Error.
+func toError(err error) *Error {
+	var rerr *Error
+	switch {
+	case errors.As(err, &rerr):
+		return rerr
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Code: CodeDeadlineExceeded, Message: err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &Error{Code: CodeCanceled, Message: err.Error()}
+	default:
+		return &Error{Code: CodeUnknown, Message: err.Error()}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// frameType is the kind of a frame.
+type frameType uint8
+
+// list of frameType.
+const (
+	// frameRequest starts a call. Its payload is a requestHeader.
+	frameRequest frameType = iota + 1
+
+	// frameResponse completes a unary call with the encoded reply.
+	frameResponse
+
+	// frameError completes a call with an encoded *Error.
+	frameError
+
+	// frameCancel asks the server to cancel a call. It has no payload.
+	frameCancel
+
+	// frameData carries one message of a streaming call.
+	frameData
+
+	// frameEnd completes a streaming call successfully. It has no payload.
+	frameEnd
+)
+
+// String returns a string representation of the frameType.
+func (t frameType) String() string {
+	switch t {
+	case frameRequest:
+		return "request"
+	case frameResponse:
+		return "response"
+	case frameError:
+		return "error"
+	case frameCancel:
+		return "cancel"
+	case frameData:
+		return "data"
+	case frameEnd:
+		return "end"
+	default:
+		return fmt.Sprintf("frameType(%d)", uint8(t))
+	}
+}
+
+const (
+	// headerSize is the size of a frame header: payload length, type and call ID.
+	headerSize = 4 + 1 + 8
+
+	// MaxFrameSize is the largest payload accepted on the wire.
+	MaxFrameSize = 16 << 20
+)
+
+// ErrFrameTooLarge is returned when a frame payload exceeds MaxFrameSize.
+var ErrFrameTooLarge = errors.New("rpc: frame too large")
+
+// frame is a single unit on the wire.
+//
+// The encoding is a big-endian uint32 payload length, a frameType byte and a
+// big-endian uint64 call ID, followed by the payload.
+type frame struct {
+	typ     frameType
+	id      uint64
+	payload []byte
+}
+
+// readFrame reads a single frame from r.
+func readFrame(r io.Reader) (frame, error) {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return frame{}, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[0:4])
+	if n > MaxFrameSize {
+		return frame{}, ErrFrameTooLarge
+	}
+
+	f := frame{
+		typ: frameType(hdr[4]),
+		id:  binary.BigEndian.Uint64(hdr[5:13]),
+	}
+	if n > 0 {
+		f.payload = make([]byte, n)
+		if _, err := io.ReadFull(r, f.payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return frame{}, err
+		}
+	}
+
+	return f, nil
+}
+
+// frameWriter serializes frame writes from concurrent calls.
+type frameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// write writes a single frame.
+func (fw *frameWriter) write(typ frameType, id uint64, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	buf[4] = byte(typ)
+	binary.BigEndian.PutUint64(buf[5:13], id)
+	copy(buf[headerSize:], payload)
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	_, err := fw.w.Write(buf)
+	return err
+}
@@ -0,0 +1,231 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Args struct {
+	A, B int
+}
+
+type Agent struct {
+	canceled chan error
+}
+
+func (a *Agent) Add(ctx context.Context, args Args, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+func (a *Agent) Fail(ctx context.Context, msg string, reply *struct{}) error {
+	return errors.New(msg)
+}
+
+func (a *Agent) Deadline(ctx context.Context, _ struct{}, reply *time.Duration) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return errors.New("no deadline")
+	}
+	*reply = time.Until(deadline)
+	return nil
+}
+
+func (a *Agent) Block(ctx context.Context, _ struct{}, reply *struct{}) error {
+	<-ctx.Done()
+	a.canceled <- ctx.Err()
+	return ctx.Err()
+}
+
+func (a *Agent) Count(ctx context.Context, n int, stream *ServerStream) error {
+	for i := 0; i < n; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// not suitable: no context.
+func (a *Agent) Ignored(args Args, reply *int) error {
+	return nil
+}
+
+func newTestPair(t *testing.T) (*Client, *Agent) {
+	t.Helper()
+
+	agent := &Agent{canceled: make(chan error, 1)}
+	s := NewServer()
+	if err := s.Register(agent); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	c1, c2 := net.Pipe()
+	go s.ServeConn(c2)
+
+	c := NewClient(c1)
+	t.Cleanup(func() { c.Close() })
+
+	return c, agent
+}
+
+func TestRegister(t *testing.T) {
+	s := NewServer()
+	if err := s.Register(new(Agent)); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if _, ok := s.lookup("Agent.Ignored"); ok {
+		t.Fatal("Agent.Ignored registered")
+	}
+	if err := s.Register(new(Agent)); err == nil {
+		t.Fatal("duplicate Register succeeded")
+	}
+	if err := s.Register(new(int)); err == nil {
+		t.Fatal("Register of a type without methods succeeded")
+	}
+}
+
+func TestCall(t *testing.T) {
+	c, _ := newTestPair(t)
+	ctx := context.Background()
+
+	var sum int
+	if err := c.Call(ctx, "Agent.Add", Args{1, 2}, &sum); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if sum != 3 {
+		t.Fatalf("sum = %d, want 3", sum)
+	}
+
+	err := c.Call(ctx, "Agent.Fail", "boom", nil)
+	var rerr *Error
+	if !errors.As(err, &rerr) || rerr.Code != CodeUnknown || rerr.Message != "boom" {
+		t.Fatalf("Call = %v, want unknown: boom", err)
+	}
+
+	err = c.Call(ctx, "Agent.Missing", nil, nil)
+	if !errors.As(err, &rerr) || rerr.Code != CodeNotFound {
+		t.Fatalf("Call = %v, want not found", err)
+	}
+}
+
+func TestCallConcurrent(t *testing.T) {
+	c, _ := newTestPair(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var sum int
+			if err := c.Call(context.Background(), "Agent.Add", Args{i, i}, &sum); err != nil {
+				errs <- err
+				return
+			}
+			if sum != 2*i {
+				errs <- fmt.Errorf("sum = %d, want %d", sum, 2*i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCallDeadlinePropagation(t *testing.T) {
+	c, _ := newTestPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var remaining time.Duration
+	if err := c.Call(ctx, "Agent.Deadline", struct{}{}, &remaining); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if remaining <= 0 || remaining > time.Minute {
+		t.Fatalf("server deadline in %v, want within a minute", remaining)
+	}
+}
+
+func TestCallCancel(t *testing.T) {
+	c, agent := newTestPair(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	if err := c.Call(ctx, "Agent.Block", struct{}{}, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Call = %v, want %v", err, context.Canceled)
+	}
+	if err := <-agent.canceled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("server context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestCallServerDeadline(t *testing.T) {
+	c, agent := newTestPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := c.Call(ctx, "Agent.Block", struct{}{}, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Call = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// the server deadline is later than the client one by the transit time,
+	// so the cancel frame sent on expiry may win.
+	if err := <-agent.canceled; err == nil {
+		t.Fatal("server context not done")
+	}
+}
+
+func TestStream(t *testing.T) {
+	c, _ := newTestPair(t)
+
+	const n = 200 // more than streamBuffer
+	s, err := c.Stream(context.Background(), "Agent.Count", n)
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	defer s.Close()
+
+	for i := 0; ; i++ {
+		var got int
+		err := s.Recv(&got)
+		if err == io.EOF {
+			if i != n {
+				t.Fatalf("received %d messages, want %d", i, n)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		if got != i {
+			t.Fatalf("message %d = %d", i, got)
+		}
+	}
+}
+
+func TestClientShutdown(t *testing.T) {
+	c1, c2 := net.Pipe()
+	c := NewClient(c1)
+	c2.Close()
+
+	if err := c.Call(context.Background(), "Agent.Add", Args{}, nil); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("Call = %v, want %v", err, ErrShutdown)
+	}
+	c.Close()
+}
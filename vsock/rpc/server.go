@@ -0,0 +1,358 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// requestHeader is the payload of a frameRequest.
+type requestHeader struct {
+	// Method is the "Service.Method" name.
+	Method string `json:"method"`
+
+	// Timeout is the remaining time of the client deadline in nanoseconds.
+	// A relative value is sent since host and guest clocks may differ.
+	Timeout int64 `json:"timeout,omitempty"`
+
+	// Args is the encoded argument.
+	Args json.RawMessage `json:"args"`
+}
+
+var (
+	typeOfError        = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext      = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfServerStream = reflect.TypeOf((*ServerStream)(nil))
+)
+
+// method is a registered service method.
+type method struct {
+	rcvr   reflect.Value
+	fn     reflect.Value
+	args   reflect.Type
+	reply  reflect.Type // nil for streaming methods
+	stream bool
+}
+
+// Server serves registered services.
+type Server struct {
+	mu      sync.RWMutex
+	methods map[string]*method
+}
+
+// NewServer returns a new Server with no registered services.
+func NewServer() *Server {
+	return &Server{
+		methods: make(map[string]*method),
+	}
+}
+
+// Register publishes the exported methods of rcvr which have a suitable
+// signature, under the concrete type name of rcvr.
+func (s *Server) Register(rcvr interface{}) error {
+	return s.RegisterName(reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name(), rcvr)
+}
+
+// RegisterName is like Register but uses name as the service name.
+func (s *Server) RegisterName(name string, rcvr interface{}) error {
+	if name == "" {
+		return errors.New("rpc: no service name for type " + reflect.TypeOf(rcvr).String())
+	}
+
+	v := reflect.ValueOf(rcvr)
+	t := v.Type()
+
+	methods := make(map[string]*method)
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if !m.IsExported() {
+			continue
+		}
+		if meth, ok := suitableMethod(v, m); ok {
+			methods[name+"."+m.Name] = meth
+		}
+	}
+	if len(methods) == 0 {
+		return fmt.Errorf("rpc: type %s has no suitable methods", t)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for n := range methods {
+		if _, dup := s.methods[n]; dup {
+			return fmt.Errorf("rpc: method %s already registered", n)
+		}
+	}
+	for n, m := range methods {
+		s.methods[n] = m
+	}
+
+	return nil
+}
+
+// suitableMethod checks the signature of m.
+func suitableMethod(rcvr reflect.Value, m reflect.Method) (*method, bool) {
+	mt := m.Type
+	if mt.NumIn() != 4 || mt.NumOut() != 1 {
+		return nil, false
+	}
+	if mt.In(1) != typeOfContext || mt.Out(0) != typeOfError {
+		return nil, false
+	}
+
+	args := mt.In(2)
+	if !isExportedOrBuiltin(args) {
+		return nil, false
+	}
+
+	meth := &method{
+		rcvr: rcvr,
+		fn:   m.Func,
+		args: args,
+	}
+
+	last := mt.In(3)
+	switch {
+	case last == typeOfServerStream:
+		meth.stream = true
+	case last.Kind() == reflect.Ptr && isExportedOrBuiltin(last):
+		meth.reply = last.Elem()
+	default:
+		return nil, false
+	}
+
+	return meth, true
+}
+
+// isExportedOrBuiltin reports whether t is usable as an argument type.
+func isExportedOrBuiltin(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return token.IsExported(t.Name()) || t.PkgPath() == ""
+}
+
+// lookup returns the registered method.
+func (s *Server) lookup(name string) (*method, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, ok := s.methods[name]
+	return m, ok
+}
+
+// Serve accepts connections on ln and serves each on its own goroutine.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single connection until the client hangs up.
+//
+// In-flight calls are canceled when the connection is closed.
+func (s *Server) ServeConn(conn io.ReadWriteCloser) error {
+	sc := &serverConn{
+		s:     s,
+		w:     &frameWriter{w: conn},
+		calls: make(map[uint64]context.CancelFunc),
+	}
+	defer func() {
+		sc.cancelAll()
+		// unblock handlers still writing, then wait for them.
+		conn.Close()
+		sc.wg.Wait()
+	}()
+
+	for {
+		f, err := readFrame(conn)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		switch f.typ {
+		case frameRequest:
+			sc.start(f)
+		case frameCancel:
+			sc.cancel(f.id)
+		default:
+			return fmt.Errorf("rpc: unexpected %s frame from client", f.typ)
+		}
+	}
+}
+
+// serverConn is the state of a connection served by a Server.
+type serverConn struct {
+	s  *Server
+	w  *frameWriter
+	wg sync.WaitGroup
+
+	mu    sync.Mutex
+	calls map[uint64]context.CancelFunc
+}
+
+// start decodes a request and runs its handler.
+func (sc *serverConn) start(f frame) {
+	var hdr requestHeader
+	if err := json.Unmarshal(f.payload, &hdr); err != nil {
+		sc.writeError(f.id, &Error{Code: CodeInvalidArgument, Message: err.Error()})
+		return
+	}
+
+	m, ok := sc.s.lookup(hdr.Method)
+	if !ok {
+		sc.writeError(f.id, &Error{Code: CodeNotFound, Message: "method " + hdr.Method + " not found"})
+		return
+	}
+
+	argv := reflect.New(m.args)
+	if len(hdr.Args) > 0 {
+		if err := json.Unmarshal(hdr.Args, argv.Interface()); err != nil {
+			sc.writeError(f.id, &Error{Code: CodeInvalidArgument, Message: err.Error()})
+			return
+		}
+	}
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if hdr.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(hdr.Timeout))
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	sc.mu.Lock()
+	if _, dup := sc.calls[f.id]; dup {
+		sc.mu.Unlock()
+		cancel()
+		sc.writeError(f.id, &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("duplicate call id %d", f.id)})
+		return
+	}
+	sc.calls[f.id] = cancel
+	sc.mu.Unlock()
+
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		defer sc.finish(f.id)
+
+		sc.run(ctx, f.id, m, argv.Elem())
+	}()
+}
+
+// run invokes the method and writes its result.
+func (sc *serverConn) run(ctx context.Context, id uint64, m *method, argv reflect.Value) {
+	var third reflect.Value
+	if m.stream {
+		third = reflect.ValueOf(&ServerStream{ctx: ctx, id: id, w: sc.w})
+	} else {
+		third = reflect.New(m.reply)
+	}
+
+	out := m.fn.Call([]reflect.Value{m.rcvr, reflect.ValueOf(ctx), argv, third})
+	if err, _ := out[0].Interface().(error); err != nil {
+		sc.writeError(id, toError(err))
+		return
+	}
+	if err := ctx.Err(); err != nil {
+		// the handler ignored the cancellation, report it anyway.
+		sc.writeError(id, toError(err))
+		return
+	}
+
+	if m.stream {
+		sc.w.write(frameEnd, id, nil)
+		return
+	}
+
+	b, err := json.Marshal(third.Interface())
+	if err != nil {
+		sc.writeError(id, &Error{Code: CodeInternal, Message: err.Error()})
+		return
+	}
+	sc.w.write(frameResponse, id, b)
+}
+
+// writeError completes the call with an error frame.
+func (sc *serverConn) writeError(id uint64, rerr *Error) {
+	b, _ := json.Marshal(rerr)
+	sc.w.write(frameError, id, b)
+}
+
+// cancel cancels a running call.
+func (sc *serverConn) cancel(id uint64) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if cancel, ok := sc.calls[id]; ok {
+		cancel()
+	}
+}
+
+// finish forgets a completed call.
+func (sc *serverConn) finish(id uint64) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if cancel, ok := sc.calls[id]; ok {
+		cancel()
+		delete(sc.calls, id)
+	}
+}
+
+// cancelAll cancels every running call.
+func (sc *serverConn) cancelAll() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for _, cancel := range sc.calls {
+		cancel()
+	}
+}
+
+// ServerStream sends the messages of a streaming call.
+type ServerStream struct {
+	ctx context.Context
+	id  uint64
+	w   *frameWriter
+}
+
+// Context returns the context of the call.
+func (ss *ServerStream) Context() context.Context {
+	return ss.ctx
+}
+
+// Send sends a single message to the client.
+func (ss *ServerStream) Send(v interface{}) error {
+	if err := ss.ctx.Err(); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return ss.w.write(frameData, ss.id, b)
+}
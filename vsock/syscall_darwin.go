@@ -19,3 +19,8 @@ func libc_poll(fds *unix.PollFd, nfds int, timeout int) (n int, err error)
 func poll(fds *unix.PollFd) (n int, err error) {
 	return libc_poll(fds, 1, 0)
 }
+
+// pollTimeout is like poll but waits up to timeout milliseconds for an event.
+func pollTimeout(fds *unix.PollFd, timeout int) (n int, err error) {
+	return libc_poll(fds, 1, timeout)
+}
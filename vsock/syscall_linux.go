@@ -14,3 +14,12 @@ import (
 func poll(fds *unix.PollFd) (n int, err error) {
 	return unix.Ppoll([]unix.PollFd{*fds}, &unix.Timespec{}, &unix.Sigset_t{})
 }
+
+// pollTimeout is like poll but waits up to timeout milliseconds for an event.
+func pollTimeout(fds *unix.PollFd, timeout int) (n int, err error) {
+	pfds := []unix.PollFd{*fds}
+	n, err = unix.Poll(pfds, timeout)
+	*fds = pfds[0]
+
+	return n, err
+}
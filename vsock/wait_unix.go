@@ -0,0 +1,208 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build darwin || linux
+
+package vsock
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// defaultAttemptTimeout is the default per-attempt timeout of a Prober.
+const defaultAttemptTimeout = 2 * time.Second
+
+// Prober polls a guest port until it accepts connections and, optionally,
+// speaks the expected protocol.
+//
+// The zero value only waits for a successful connect.
+type Prober struct {
+	// Backoff is the delay policy between two attempts.
+	Backoff Backoff
+
+	// AttemptTimeout bounds a single attempt, including the connect and
+	// any banner or handshake exchange. Zero means 2 seconds.
+	AttemptTimeout time.Duration
+
+	// Banner, if non-empty, is the prefix the peer must send right after
+	// the connection is accepted.
+	Banner []byte
+
+	// Request, if non-empty, is written once connected (after Banner is
+	// matched) and Response must be received as the reply prefix.
+	Request  []byte
+	Response []byte
+
+	// Dial, if non-nil, replaces DialContext. It lets tests and callers
+	// probe through in-process listeners or proxies.
+	Dial func(ctx context.Context, cid, port uint32) (net.Conn, error)
+}
+
+// ProbeResult reports the outcome of a successful Prober.Wait.
+type ProbeResult struct {
+	// Attempts is the number of connection attempts, including the successful one.
+	Attempts int
+
+	// Elapsed is the time from the first attempt until the port was ready.
+	Elapsed time.Duration
+
+	// Connect is the duration of the connect of the successful attempt.
+	Connect time.Duration
+
+	// LastError is the error of the last failed attempt, if any.
+	LastError error
+}
+
+// WaitForPort polls cid and port until a connection succeeds or ctx is done.
+func WaitForPort(ctx context.Context, cid, port uint32) error {
+	var p Prober
+	_, err := p.Wait(ctx, cid, port)
+	return err
+}
+
+// Wait polls cid and port until a probe succeeds, a permanent error occurs
+// or ctx is done.
+func (p *Prober) Wait(ctx context.Context, cid, port uint32) (*ProbeResult, error) {
+	res := new(ProbeResult)
+	start := time.Now()
+
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for attempt := 0; ; attempt++ {
+		res.Attempts++
+
+		connect, err := p.probe(ctx, cid, port)
+		if err == nil {
+			res.Elapsed = time.Since(start)
+			res.Connect = connect
+			return res, nil
+		}
+		res.LastError = err
+
+		if ctx.Err() != nil {
+			return res, fmt.Errorf("%w after %d attempts (last error: %v)", ctx.Err(), res.Attempts, err)
+		}
+		if !p.retriable(err) {
+			return res, err
+		}
+
+		d := p.Backoff.Duration(attempt)
+		if timer == nil {
+			timer = time.NewTimer(d)
+		} else {
+			timer.Reset(d)
+		}
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return res, fmt.Errorf("%w after %d attempts (last error: %v)", ctx.Err(), res.Attempts, err)
+		}
+	}
+}
+
+// retriable reports whether a failed probe should be retried: dial and
+// connection errors are, a banner or response mismatch is not.
+func (p *Prober) retriable(err error) bool {
+	if IsTemporary(err) || errors.Is(err, context.DeadlineExceeded) {
+		// the per-attempt timeout expired, the parent ctx is checked by Wait.
+		return true
+	}
+
+	// a guest agent which accepted but did not answer yet, or dropped the
+	// connection while starting up, is not ready rather than broken.
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// probeError reports a banner or handshake failure.
+type probeError struct {
+	stage string
+	err   error
+}
+
+// Error implements error.
+func (e *probeError) Error() string {
+	return fmt.Sprintf("%s: %v", e.stage, e.err)
+}
+
+// Unwrap returns the underlying error.
+func (e *probeError) Unwrap() error {
+	return e.err
+}
+
+// probe performs a single attempt and returns the connect duration.
+func (p *Prober) probe(ctx context.Context, cid, port uint32) (time.Duration, error) {
+	timeout := p.AttemptTimeout
+	if timeout <= 0 {
+		timeout = defaultAttemptTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dial := p.Dial
+	if dial == nil {
+		dial = func(ctx context.Context, cid, port uint32) (net.Conn, error) {
+			return DialContext(ctx, cid, port)
+		}
+	}
+
+	start := time.Now()
+	c, err := dial(ctx, cid, port)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	connect := time.Since(start)
+
+	if len(p.Banner) == 0 && len(p.Request) == 0 {
+		return connect, nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.SetDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(p.Banner) > 0 {
+		if err := expect(c, p.Banner); err != nil {
+			return 0, &probeError{stage: "banner", err: err}
+		}
+	}
+
+	if len(p.Request) > 0 {
+		if _, err := c.Write(p.Request); err != nil {
+			return 0, &probeError{stage: "handshake", err: err}
+		}
+		if err := expect(c, p.Response); err != nil {
+			return 0, &probeError{stage: "handshake", err: err}
+		}
+	}
+
+	return connect, nil
+}
+
+// expect reads len(want) bytes from r and compares them with want.
+func expect(r io.Reader, want []byte) error {
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("got %q, want %q", got, want)
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build darwin || linux
+
+package vsock
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// testProber returns a Prober dialing ln in place of a vsock port. Until ready
+// is closed, dials fail with ECONNREFUSED as a guest still booting would.
+func testProber(ln net.Listener, ready <-chan struct{}) *Prober {
+	return &Prober{
+		Backoff:        Backoff{Min: time.Millisecond, Max: 5 * time.Millisecond},
+		AttemptTimeout: time.Second,
+		Dial: func(ctx context.Context, cid, port uint32) (net.Conn, error) {
+			select {
+			case <-ready:
+			default:
+				return nil, unix.ECONNREFUSED
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, ln.Addr().Network(), ln.Addr().String())
+		},
+	}
+}
+
+func TestProberWait(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write([]byte("READY\n"))
+				req := make([]byte, 5)
+				if _, err := io.ReadFull(c, req); err != nil || string(req) != "ping\n" {
+					return
+				}
+				c.Write([]byte("pong\n"))
+			}()
+		}
+	}()
+
+	ready := make(chan struct{})
+	time.AfterFunc(20*time.Millisecond, func() { close(ready) })
+
+	p := testProber(ln, ready)
+	p.Banner = []byte("READY\n")
+	p.Request = []byte("ping\n")
+	p.Response = []byte("pong\n")
+
+	res, err := p.Wait(context.Background(), 3, 1024)
+	if err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if res.Attempts < 2 {
+		t.Fatalf("Attempts = %d, want at least 2", res.Attempts)
+	}
+	if !errors.Is(res.LastError, unix.ECONNREFUSED) {
+		t.Fatalf("LastError = %v, want %v", res.LastError, unix.ECONNREFUSED)
+	}
+}
+
+func TestProberWaitTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// accept but never send the banner.
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	ready := make(chan struct{})
+	close(ready)
+
+	p := testProber(ln, ready)
+	p.AttemptTimeout = 10 * time.Millisecond
+	p.Banner = []byte("READY\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	res, err := p.Wait(ctx, 3, 1024)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if res.Attempts < 2 {
+		t.Fatalf("Attempts = %d, want at least 2", res.Attempts)
+	}
+}
+
+func TestProberWaitPermanent(t *testing.T) {
+	p := &Prober{
+		Dial: func(ctx context.Context, cid, port uint32) (net.Conn, error) {
+			return nil, unix.EACCES
+		},
+	}
+
+	res, err := p.Wait(context.Background(), 3, 1024)
+	if !errors.Is(err, unix.EACCES) {
+		t.Fatalf("Wait = %v, want %v", err, unix.EACCES)
+	}
+	if res.Attempts != 1 {
+		t.Fatalf("Attempts = %d, want 1", res.Attempts)
+	}
+}
+
+func TestProberWaitMismatch(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("HELLO\n"))
+			c.Close()
+		}
+	}()
+
+	ready := make(chan struct{})
+	close(ready)
+
+	p := testProber(ln, ready)
+	p.Banner = []byte("READY\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := p.Wait(ctx, 3, 1024)
+	var perr *probeError
+	if !errors.As(err, &perr) || perr.stage != "banner" {
+		t.Fatalf("Wait = %v, want a banner mismatch", err)
+	}
+	if res.Attempts != 1 {
+		t.Fatalf("Attempts = %d, want 1", res.Attempts)
+	}
+}
@@ -0,0 +1,11 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package xfer transfers files and directory trees over a vsock connection.
+//
+// Entries carry their mode, owner, modification time and symlink target.
+// Regular files are verified with per-chunk SHA-256 digests and written to a
+// partial file chunk by chunk, so a transfer interrupted by a reconnect
+// resumes from the last verified chunk. On Linux file data is sent with
+// sendfile(2) when the connection exposes its descriptor.
+package xfer
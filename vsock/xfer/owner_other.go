@@ -0,0 +1,13 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !darwin && !linux
+
+package xfer
+
+import "os"
+
+// owner returns -1, -1 since numeric owners are not available on this platform.
+func owner(fi os.FileInfo) (uid, gid int) {
+	return -1, -1
+}
@@ -0,0 +1,21 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build darwin || linux
+
+package xfer
+
+import (
+	"os"
+	"syscall"
+)
+
+// owner returns the numeric owner and group of fi.
+func owner(fi os.FileInfo) (uid, gid int) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1
+	}
+
+	return int(st.Uid), int(st.Gid)
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package xfer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// protocolVersion is the version sent in the hello message.
+	protocolVersion = 1
+
+	// DefaultChunkSize is the size of a verified chunk.
+	DefaultChunkSize = 1 << 20
+
+	// maxChunkSize bounds the chunk size accepted from the peer.
+	maxChunkSize = 64 << 20
+
+	// maxMessageSize bounds a control message.
+	maxMessageSize = 16 << 20
+)
+
+// msgType is the type of a control message.
+type msgType string
+
+// list of msgType.
+const (
+	msgHello  msgType = "hello"  // first message of both sides
+	msgPush   msgType = "push"   // client asks the server to receive into Path
+	msgPull   msgType = "pull"   // client asks the server to send Path
+	msgEntry  msgType = "entry"  // sender announces Entry
+	msgOffer  msgType = "offer"  // receiver lists the digests of the chunks it already has
+	msgStart  msgType = "start"  // sender starts the data at Offset with the remaining digests
+	msgAck    msgType = "ack"    // receiver completed an entry, or failed with Error
+	msgDone   msgType = "done"   // sender has no more entries
+	msgFailed msgType = "failed" // sender aborts with Error
+)
+
+// message is a length-prefixed JSON control message.
+type message struct {
+	Type      msgType  `json:"type"`
+	Version   int      `json:"version,omitempty"`
+	ChunkSize int      `json:"chunk_size,omitempty"`
+	Path      string   `json:"path,omitempty"`
+	Entry     *Entry   `json:"entry,omitempty"`
+	Offset    int64    `json:"offset,omitempty"`
+	Hashes    [][]byte `json:"hashes,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// EntryType is the kind of a transferred entry.
+type EntryType string
+
+// list of EntryType.
+const (
+	TypeFile    EntryType = "file"
+	TypeDir     EntryType = "dir"
+	TypeSymlink EntryType = "symlink"
+)
+
+// Entry is the metadata of a transferred file, directory or symlink.
+type Entry struct {
+	// Path is the slash-separated path relative to the transfer root.
+	// The root itself is ".".
+	Path string `json:"path"`
+
+	Type    EntryType   `json:"type"`
+	Mode    os.FileMode `json:"mode"`
+	UID     int         `json:"uid"`
+	GID     int         `json:"gid"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size,omitempty"`
+	Target  string      `json:"target,omitempty"`
+}
+
+// RemoteError is an error reported by the peer.
+type RemoteError string
+
+// Error implements error.
+func (e RemoteError) Error() string {
+	return "xfer: remote: " + string(e)
+}
+
+// ErrChecksum is returned when a chunk does not match its SHA-256 digest.
+var ErrChecksum = errors.New("xfer: chunk checksum mismatch")
+
+// writeMessage writes a single control message.
+func writeMessage(w io.Writer, m *message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+
+	_, err = w.Write(buf)
+	return err
+}
+
+// readMessage reads a single control message. A msgFailed message from the
+// peer is returned as a RemoteError.
+func readMessage(r io.Reader) (*message, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxMessageSize {
+		return nil, fmt.Errorf("xfer: message too large (%d bytes)", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	m := new(message)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("xfer: decode message: %w", err)
+	}
+	if m.Type == msgFailed {
+		return nil, RemoteError(m.Error)
+	}
+
+	return m, nil
+}
+
+// expectMessage reads a message of type typ.
+func expectMessage(r io.Reader, typ msgType) (*message, error) {
+	m, err := readMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if m.Type != typ {
+		return nil, fmt.Errorf("xfer: unexpected %q message, want %q", m.Type, typ)
+	}
+
+	return m, nil
+}
+
+// hashChunks returns the SHA-256 digests of the chunks of r covering size bytes.
+// A trailing short chunk is hashed only if partial is true.
+func hashChunks(r io.ReaderAt, size int64, chunkSize int, partial bool) ([][]byte, error) {
+	var hashes [][]byte
+
+	buf := make([]byte, chunkSize)
+	for off := int64(0); off < size; off += int64(chunkSize) {
+		n := int64(chunkSize)
+		if rem := size - off; rem < n {
+			if !partial {
+				break
+			}
+			n = rem
+		}
+
+		if m, err := r.ReadAt(buf[:n], off); int64(m) < n {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		sum := sha256.Sum256(buf[:n])
+		hashes = append(hashes, sum[:])
+	}
+
+	return hashes, nil
+}
+
+// localPath resolves the slash-separated relative path p under root,
+// rejecting paths which would escape it.
+func localPath(root, p string) (string, error) {
+	if p == "" || path.IsAbs(p) {
+		return "", fmt.Errorf("xfer: invalid path %q", p)
+	}
+
+	clean := path.Clean(p)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("xfer: path %q escapes the destination", p)
+	}
+	if clean == "." {
+		return root, nil
+	}
+
+	return filepath.Join(root, filepath.FromSlash(clean)), nil
+}
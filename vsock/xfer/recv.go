@@ -0,0 +1,350 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package xfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// partialSuffix is appended to the name of a file being received.
+const partialSuffix = ".xferpart"
+
+// Receiver receives a file or directory tree from a Sender.
+type Receiver struct {
+	// PreserveOwner applies the sender's numeric owner and group. It
+	// usually requires root privileges.
+	PreserveOwner bool
+
+	// Progress, if non-nil, is called after each entry is written.
+	Progress Progress
+}
+
+// Receive receives entries from conn into dst. The root entry of the sender
+// is written to dst itself.
+func (r *Receiver) Receive(conn io.ReadWriter, dst string) error {
+	hello, err := expectMessage(conn, msgHello)
+	if err != nil {
+		return err
+	}
+	if err := writeMessage(conn, &message{Type: msgHello, Version: protocolVersion}); err != nil {
+		return err
+	}
+
+	return r.receive(conn, dst, hello.ChunkSize)
+}
+
+// dirMeta is the metadata of a directory, applied once its content is written.
+type dirMeta struct {
+	path string
+	e    *Entry
+}
+
+// receive handles entries until msgDone.
+func (r *Receiver) receive(conn io.ReadWriter, dst string, chunkSize int) error {
+	if chunkSize <= 0 || chunkSize > maxChunkSize {
+		return fmt.Errorf("xfer: invalid chunk size %d", chunkSize)
+	}
+
+	var dirs []dirMeta
+	for {
+		m, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+
+		switch m.Type {
+		case msgEntry:
+		case msgDone:
+			// apply the directory metadata bottom-up, since writing the
+			// content updated the modification times.
+			var errs []error
+			for i := len(dirs) - 1; i >= 0; i-- {
+				if err := r.applyMeta(dirs[i].path, dirs[i].e); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			ack := &message{Type: msgAck}
+			if len(errs) > 0 {
+				ack.Error = errs[0].Error()
+			}
+			if err := writeMessage(conn, ack); err != nil {
+				return err
+			}
+			if len(errs) > 0 {
+				return errs[0]
+			}
+			return nil
+		default:
+			return fmt.Errorf("xfer: unexpected %q message, want %q", m.Type, msgEntry)
+		}
+
+		e := m.Entry
+		if e == nil {
+			return errors.New("xfer: entry message without entry")
+		}
+
+		p, err := localPath(dst, e.Path)
+		if err != nil {
+			return err
+		}
+
+		// an entry is never written through a symlink received before it.
+		dir := p
+		if e.Type != TypeDir {
+			dir = filepath.Dir(p)
+		}
+		if err := checkNoSymlinks(dst, dir); err != nil {
+			return err
+		}
+
+		var (
+			skipped int64
+			eerr    error
+		)
+		switch e.Type {
+		case TypeDir:
+			if eerr = os.MkdirAll(p, 0o700); eerr == nil {
+				dirs = append(dirs, dirMeta{p, e})
+			}
+		case TypeSymlink:
+			eerr = r.receiveSymlink(p, e)
+		case TypeFile:
+			// a data error desynchronizes the stream, give up on the connection.
+			if skipped, err = r.receiveFile(conn, p, e, chunkSize); err != nil {
+				return err
+			}
+		default:
+			eerr = fmt.Errorf("unsupported entry type %q", e.Type)
+		}
+
+		ack := &message{Type: msgAck}
+		if eerr != nil {
+			ack.Error = eerr.Error()
+		}
+		if err := writeMessage(conn, ack); err != nil {
+			return err
+		}
+		if eerr != nil {
+			return eerr
+		}
+
+		if r.Progress != nil {
+			r.Progress(e, skipped)
+		}
+	}
+}
+
+// receiveSymlink replaces p with a symlink. Its target must be relative and
+// stay within the destination.
+func (r *Receiver) receiveSymlink(p string, e *Entry) error {
+	if err := checkTarget(e); err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(e.Target, p); err != nil {
+		return err
+	}
+	if r.PreserveOwner && e.UID >= 0 {
+		return os.Lchown(p, e.UID, e.GID)
+	}
+
+	return nil
+}
+
+// checkTarget returns an error if the target of the symlink e is absolute or
+// resolves outside of the transfer root.
+func checkTarget(e *Entry) error {
+	target := filepath.ToSlash(e.Target)
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(e.Target) {
+		return fmt.Errorf("xfer: symlink %q has an absolute target %q", e.Path, e.Target)
+	}
+
+	// the target is relative to the directory of the link, which is outside
+	// of the root for the root itself.
+	dir := path.Dir(path.Clean(e.Path))
+	if path.Clean(e.Path) == "." {
+		dir = ".."
+	}
+	clean := path.Join(dir, target)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("xfer: symlink %q target %q escapes the destination", e.Path, e.Target)
+	}
+
+	return nil
+}
+
+// checkNoSymlinks returns an error if a path component below root up to p,
+// included, is a symlink. The components which do not exist yet are created
+// as directories by the receiver.
+func checkNoSymlinks(root, p string) error {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return err
+	}
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		root = filepath.Join(root, name)
+		fi, err := os.Lstat(root)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("xfer: %s is a symlink", root)
+		}
+	}
+
+	return nil
+}
+
+// resumeCandidate returns the existing file to resume from, which is the
+// partial file of a previous attempt or an existing destination file.
+func resumeCandidate(p string) (string, os.FileInfo) {
+	for _, name := range []string{partialName(p), p} {
+		// Lstat, so that a symlink at the destination is never followed.
+		fi, err := os.Lstat(name)
+		if err == nil && fi.Mode().IsRegular() {
+			return name, fi
+		}
+	}
+
+	return "", nil
+}
+
+// partialName returns the name of the partial file of p.
+func partialName(p string) string {
+	dir, base := filepath.Split(p)
+	return filepath.Join(dir, "."+base+partialSuffix)
+}
+
+// receiveFile offers the chunks already present, then receives and verifies
+// the remaining data into the partial file and renames it to p. It returns
+// the number of bytes skipped by the resume.
+func (r *Receiver) receiveFile(conn io.ReadWriter, p string, e *Entry, chunkSize int) (int64, error) {
+	partial := partialName(p)
+
+	var hashes [][]byte
+	candidate, fi := resumeCandidate(p)
+	if candidate != "" {
+		if f, err := os.Open(candidate); err == nil {
+			size := fi.Size()
+			if size > e.Size {
+				size = e.Size
+			}
+			// a previous partial file only holds complete chunks, a previous
+			// destination may match entirely including its tail.
+			hashes, _ = hashChunks(f, size, chunkSize, candidate == p && fi.Size() == e.Size)
+			f.Close()
+		}
+	}
+
+	if err := writeMessage(conn, &message{Type: msgOffer, Hashes: hashes}); err != nil {
+		return 0, err
+	}
+
+	start, err := expectMessage(conn, msgStart)
+	if err != nil {
+		return 0, err
+	}
+	if start.Offset < 0 || start.Offset > e.Size || start.Offset%int64(chunkSize) != 0 && start.Offset != e.Size {
+		return 0, fmt.Errorf("xfer: invalid resume offset %d", start.Offset)
+	}
+
+	if start.Offset > 0 && candidate == p {
+		// resume from the existing destination: move it aside.
+		if err := os.Rename(p, partial); err != nil {
+			return 0, err
+		}
+	}
+
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(start.Offset); err != nil {
+		return 0, err
+	}
+
+	if err := receiveData(conn, f, start.Offset, e.Size, chunkSize, start.Hashes); err != nil {
+		return 0, err
+	}
+
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := r.applyMeta(partial, e); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(partial, p); err != nil {
+		return 0, err
+	}
+
+	return start.Offset, nil
+}
+
+// receiveData reads the data from offset to size chunk by chunk, verifies
+// each chunk and writes it to f. On a checksum mismatch the stream is out of
+// sync and the connection must be dropped; the verified chunks written so far
+// are kept for the next attempt.
+func receiveData(r io.Reader, f *os.File, offset, size int64, chunkSize int, hashes [][]byte) error {
+	buf := make([]byte, chunkSize)
+	for i := 0; offset < size; i++ {
+		n := int64(chunkSize)
+		if rem := size - offset; rem < n {
+			n = rem
+		}
+
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(buf[:n])
+		if i >= len(hashes) || !bytes.Equal(sum[:], hashes[i]) {
+			return fmt.Errorf("%w at offset %d", ErrChecksum, offset)
+		}
+
+		// only verified chunks reach the partial file, so a broken
+		// connection can resume right after the last one.
+		if _, err := f.WriteAt(buf[:n], offset); err != nil {
+			return err
+		}
+		offset += n
+	}
+
+	return nil
+}
+
+// applyMeta applies the mode, owner and modification time of e to p.
+func (r *Receiver) applyMeta(p string, e *Entry) error {
+	if r.PreserveOwner && e.UID >= 0 {
+		if err := os.Lchown(p, e.UID, e.GID); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(p, e.Mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+
+	return os.Chtimes(p, e.ModTime, e.ModTime)
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package xfer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Progress, if set on a Sender or Receiver, is called after each entry.
+// skipped is the number of bytes not sent thanks to a resume.
+type Progress func(e *Entry, skipped int64)
+
+// Sender sends a file or directory tree to a Receiver.
+type Sender struct {
+	// ChunkSize is the size of a verified chunk. Zero means DefaultChunkSize.
+	ChunkSize int
+
+	// Progress, if non-nil, is called after each entry is acknowledged.
+	Progress Progress
+}
+
+// chunkSize returns the effective chunk size.
+func (s *Sender) chunkSize() int {
+	if s.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+
+	return s.ChunkSize
+}
+
+// Send sends the file or directory tree at src over conn, which must be
+// connected to a Receiver.
+func (s *Sender) Send(conn io.ReadWriter, src string) error {
+	if err := writeMessage(conn, &message{Type: msgHello, Version: protocolVersion, ChunkSize: s.chunkSize()}); err != nil {
+		return err
+	}
+	if _, err := expectMessage(conn, msgHello); err != nil {
+		return err
+	}
+
+	return s.send(conn, src)
+}
+
+// send walks src and sends every entry, then msgDone.
+func (s *Sender) send(conn io.ReadWriter, src string) error {
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+
+		return s.sendEntry(conn, p, filepath.ToSlash(rel))
+	})
+	if err != nil {
+		// best effort, the receiver may already be gone.
+		writeMessage(conn, &message{Type: msgFailed, Error: err.Error()})
+		return err
+	}
+
+	if err := writeMessage(conn, &message{Type: msgDone}); err != nil {
+		return err
+	}
+	_, err = expectMessage(conn, msgAck)
+
+	return err
+}
+
+// sendEntry sends a single entry and waits for its acknowledgement.
+func (s *Sender) sendEntry(conn io.ReadWriter, p, rel string) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+
+	e := &Entry{
+		Path:    rel,
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+	}
+	e.UID, e.GID = owner(fi)
+
+	switch {
+	case fi.Mode().IsRegular():
+		e.Type = TypeFile
+		e.Size = fi.Size()
+	case fi.IsDir():
+		e.Type = TypeDir
+	case fi.Mode()&os.ModeSymlink != 0:
+		e.Type = TypeSymlink
+		if e.Target, err = os.Readlink(p); err != nil {
+			return err
+		}
+	default:
+		// devices, sockets and fifos are not transferred.
+		return nil
+	}
+
+	if err := writeMessage(conn, &message{Type: msgEntry, Entry: e}); err != nil {
+		return err
+	}
+
+	var skipped int64
+	if e.Type == TypeFile {
+		if skipped, err = s.sendFile(conn, p, e); err != nil {
+			return err
+		}
+	}
+
+	m, err := expectMessage(conn, msgAck)
+	if err != nil {
+		return err
+	}
+	if m.Error != "" {
+		return fmt.Errorf("%s: %w", rel, RemoteError(m.Error))
+	}
+
+	if s.Progress != nil {
+		s.Progress(e, skipped)
+	}
+
+	return nil
+}
+
+// sendFile negotiates the resume offset and sends the file data.
+// It returns the number of bytes skipped by the resume.
+func (s *Sender) sendFile(conn io.ReadWriter, p string, e *Entry) (int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	chunkSize := s.chunkSize()
+	hashes, err := hashChunks(f, e.Size, chunkSize, true)
+	if err != nil {
+		return 0, err
+	}
+
+	offer, err := expectMessage(conn, msgOffer)
+	if err != nil {
+		return 0, err
+	}
+
+	// resume after the longest prefix of chunks the receiver already has.
+	var n int
+	for n < len(offer.Hashes) && n < len(hashes) && bytes.Equal(offer.Hashes[n], hashes[n]) {
+		n++
+	}
+	offset := int64(n) * int64(chunkSize)
+	if offset > e.Size {
+		offset = e.Size
+	}
+
+	if err := writeMessage(conn, &message{Type: msgStart, Offset: offset, Hashes: hashes[n:]}); err != nil {
+		return 0, err
+	}
+
+	if err := sendData(conn, f, offset, e.Size-offset); err != nil {
+		return 0, err
+	}
+
+	return offset, nil
+}
+
+// sendData writes n bytes of f starting at offset to w, using a zero-copy
+// path when the platform and w support it.
+func sendData(w io.Writer, f *os.File, offset, n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	written, handled, err := sendFile(w, f, offset, n)
+	if handled {
+		if err == nil && written != n {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	m, err := io.Copy(w, io.NewSectionReader(f, offset+written, n-written))
+	if err == nil && m != n-written {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return err
+}
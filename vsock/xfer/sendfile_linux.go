@@ -0,0 +1,82 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package xfer
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSendfileSize is the largest chunk size we ask the kernel to copy
+// at a time.
+const maxSendfileSize int = 4 << 20
+
+// sendFile sends n bytes of f starting at offset to w with sendfile(2) if w
+// exposes its socket through syscall.Conn.
+//
+// The loop follows poll.SendFile of the forked internal/poll package, but is
+// driven by the RawConn of w so that the runtime poller waits on EAGAIN.
+// handled is false if sendfile is not usable and nothing was written.
+func sendFile(w io.Writer, f *os.File, offset, n int64) (written int64, handled bool, err error) {
+	sc, ok := w.(syscall.Conn)
+	if !ok {
+		return 0, false, nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	src := int(f.Fd())
+	remain := n
+
+	var werr error
+	err = rc.Write(func(fd uintptr) bool {
+		for remain > 0 {
+			max := maxSendfileSize
+			if int64(max) > remain {
+				max = int(remain)
+			}
+
+			m, err1 := unix.Sendfile(int(fd), src, &offset, max)
+			if m > 0 {
+				written += int64(m)
+				remain -= int64(m)
+			}
+
+			switch {
+			case err1 == unix.EINTR:
+				continue
+			case err1 == unix.EAGAIN:
+				// let the poller wait for the socket to become writable.
+				return false
+			case err1 != nil:
+				// this includes ENOSYS (no kernel support) and EINVAL
+				// (fd types which don't implement sendfile).
+				werr = err1
+				return true
+			case m == 0:
+				werr = io.ErrUnexpectedEOF
+				return true
+			}
+		}
+
+		return true
+	})
+	if err == nil {
+		err = werr
+	}
+
+	if written == 0 && (werr == unix.ENOSYS || werr == unix.EINVAL) {
+		// fall back to a generic copy.
+		return 0, false, nil
+	}
+
+	return written, true, err
+}
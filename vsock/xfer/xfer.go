@@ -0,0 +1,113 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package xfer
+
+import (
+	"io"
+	"net"
+)
+
+// Server serves push and pull requests for paths below Root.
+type Server struct {
+	// Root is the directory push destinations and pull sources are resolved in.
+	Root string
+
+	// Sender is used to serve pull requests.
+	Sender Sender
+
+	// Receiver is used to serve push requests.
+	Receiver Receiver
+}
+
+// Serve accepts connections on ln and serves each on its own goroutine.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			s.ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConn serves a single push or pull request on conn.
+func (s *Server) ServeConn(conn io.ReadWriter) error {
+	m, err := readMessage(conn)
+	if err != nil {
+		return err
+	}
+
+	p, err := localPath(s.Root, m.Path)
+	if err == nil && m.Type != msgPush && m.Type != msgPull {
+		err = RemoteError("unexpected " + string(m.Type) + " request")
+	}
+
+	ack := &message{Type: msgAck}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+	if werr := writeMessage(conn, ack); werr != nil || err != nil {
+		if err == nil {
+			err = werr
+		}
+		return err
+	}
+
+	if m.Type == msgPush {
+		return s.Receiver.Receive(conn, p)
+	}
+
+	return s.Sender.Send(conn, p)
+}
+
+// request asks the server for a push or pull of the remote path.
+func request(conn io.ReadWriter, typ msgType, remote string) error {
+	if err := writeMessage(conn, &message{Type: typ, Path: remote}); err != nil {
+		return err
+	}
+
+	m, err := expectMessage(conn, msgAck)
+	if err != nil {
+		return err
+	}
+	if m.Error != "" {
+		return RemoteError(m.Error)
+	}
+
+	return nil
+}
+
+// Push sends the local src to the remote path dst, relative to the server Root.
+func (s *Sender) Push(conn io.ReadWriter, src, dst string) error {
+	if err := request(conn, msgPush, dst); err != nil {
+		return err
+	}
+
+	return s.Send(conn, src)
+}
+
+// Pull receives the remote path src, relative to the server Root, into the local dst.
+func (r *Receiver) Pull(conn io.ReadWriter, src, dst string) error {
+	if err := request(conn, msgPull, src); err != nil {
+		return err
+	}
+
+	return r.Receive(conn, dst)
+}
+
+// Push sends the local src to the remote path dst with the default Sender.
+func Push(conn io.ReadWriter, src, dst string) error {
+	var s Sender
+	return s.Push(conn, src, dst)
+}
+
+// Pull receives the remote path src into the local dst with the default Receiver.
+func Pull(conn io.ReadWriter, src, dst string) error {
+	var r Receiver
+	return r.Pull(conn, src, dst)
+}
@@ -0,0 +1,334 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package xfer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testChunkSize = 4 << 10
+
+// writeTree creates a small directory tree below dir.
+func writeTree(t *testing.T, dir string) {
+	t.Helper()
+
+	rnd := rand.New(rand.NewSource(1))
+	big := make([]byte, 10*testChunkSize+123)
+	rnd.Read(big)
+
+	files := map[string][]byte{
+		"a.txt":         []byte("hello"),
+		"empty":         nil,
+		"sub/big.bin":   big,
+		"sub/deep/x.sh": []byte("#!/bin/sh\n"),
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(dir, "sub/deep/x.sh"), 0o751); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../a.txt", filepath.Join(dir, "sub/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2021, 10, 7, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{"a.txt", "sub/big.bin", "sub/deep", "sub"} {
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// compareTree checks that got has the content and metadata of want.
+func compareTree(t *testing.T, want, got string) {
+	t.Helper()
+
+	err := filepath.Walk(want, func(p string, wfi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(want, p)
+		q := filepath.Join(got, rel)
+
+		gfi, err := os.Lstat(q)
+		if err != nil {
+			t.Errorf("%s: %v", rel, err)
+			return nil
+		}
+		if gfi.Mode() != wfi.Mode() {
+			t.Errorf("%s: mode = %v, want %v", rel, gfi.Mode(), wfi.Mode())
+		}
+
+		switch {
+		case wfi.Mode()&os.ModeSymlink != 0:
+			wt, _ := os.Readlink(p)
+			gt, _ := os.Readlink(q)
+			if gt != wt {
+				t.Errorf("%s: target = %q, want %q", rel, gt, wt)
+			}
+		case wfi.Mode().IsRegular():
+			wb, _ := os.ReadFile(p)
+			gb, _ := os.ReadFile(q)
+			if !bytes.Equal(wb, gb) {
+				t.Errorf("%s: content differs", rel)
+			}
+			fallthrough
+		default:
+			if !gfi.ModTime().Equal(wfi.ModTime()) {
+				t.Errorf("%s: mtime = %v, want %v", rel, gfi.ModTime(), wfi.ModTime())
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// transfer sends src to dst over a connected pair.
+func transfer(t *testing.T, c1, c2 net.Conn, s *Sender, r *Receiver, src, dst string) (sendErr, recvErr error) {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() {
+		err := r.Receive(c2, dst)
+		c2.Close()
+		done <- err
+	}()
+
+	sendErr = s.Send(c1, src)
+	c1.Close()
+
+	return sendErr, <-done
+}
+
+func TestSendReceiveTree(t *testing.T) {
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "out")
+	writeTree(t, src)
+
+	c1, c2 := net.Pipe()
+	s := &Sender{ChunkSize: testChunkSize}
+	if serr, rerr := transfer(t, c1, c2, s, new(Receiver), src, dst); serr != nil || rerr != nil {
+		t.Fatalf("transfer: send %v, receive %v", serr, rerr)
+	}
+
+	compareTree(t, src, dst)
+}
+
+func TestSendReceiveSendfile(t *testing.T) {
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "out")
+	writeTree(t, src)
+
+	dir := t.TempDir()
+	ln, err := net.Listen("unix", filepath.Join(dir, "xfer.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	c1, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-accepted
+
+	s := &Sender{ChunkSize: testChunkSize}
+	if serr, rerr := transfer(t, c1, c2, s, new(Receiver), src, dst); serr != nil || rerr != nil {
+		t.Fatalf("transfer: send %v, receive %v", serr, rerr)
+	}
+
+	compareTree(t, src, dst)
+}
+
+// failingConn breaks the connection after limit bytes were written.
+type failingConn struct {
+	net.Conn
+	limit int64
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	if atomic.AddInt64(&c.limit, -int64(len(b))) < 0 {
+		c.Conn.Close()
+		return 0, io.ErrClosedPipe
+	}
+
+	return c.Conn.Write(b)
+}
+
+func TestResume(t *testing.T) {
+	src := t.TempDir()
+	writeTree(t, src)
+	file := filepath.Join(src, "sub/big.bin")
+	dst := filepath.Join(t.TempDir(), "big.bin")
+
+	// the first attempt breaks in the middle of the data, after io.Copy
+	// wrote its first 32KB buffer.
+	c1, c2 := net.Pipe()
+	s := &Sender{ChunkSize: testChunkSize}
+	serr, rerr := transfer(t, &failingConn{Conn: c1, limit: 8*testChunkSize + 2048}, c2, s, new(Receiver), file, dst)
+	if serr == nil || rerr == nil {
+		t.Fatalf("interrupted transfer: send %v, receive %v", serr, rerr)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("destination exists after a failed transfer: %v", err)
+	}
+
+	var skipped int64
+	s.Progress = func(e *Entry, n int64) { skipped = n }
+
+	c1, c2 = net.Pipe()
+	if serr, rerr := transfer(t, c1, c2, s, new(Receiver), file, dst); serr != nil || rerr != nil {
+		t.Fatalf("resumed transfer: send %v, receive %v", serr, rerr)
+	}
+	if skipped == 0 || skipped%testChunkSize != 0 {
+		t.Fatalf("resume skipped %d bytes, want a positive multiple of %d", skipped, testChunkSize)
+	}
+
+	want, _ := os.ReadFile(file)
+	got, _ := os.ReadFile(dst)
+	if !bytes.Equal(got, want) {
+		t.Fatal("resumed content differs")
+	}
+
+	// an identical destination is not sent again.
+	c1, c2 = net.Pipe()
+	if serr, rerr := transfer(t, c1, c2, s, new(Receiver), file, dst); serr != nil || rerr != nil {
+		t.Fatalf("repeated transfer: send %v, receive %v", serr, rerr)
+	}
+	if skipped != int64(len(want)) {
+		t.Fatalf("repeated transfer skipped %d bytes, want %d", skipped, len(want))
+	}
+}
+
+func TestServerPushPull(t *testing.T) {
+	root := t.TempDir()
+	local := t.TempDir()
+	writeTree(t, local)
+
+	srv := &Server{Root: root}
+
+	c1, c2 := net.Pipe()
+	go func() {
+		defer c2.Close()
+		srv.ServeConn(c2)
+	}()
+	if err := Push(c1, local, "guest/tree"); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	c1.Close()
+	compareTree(t, local, filepath.Join(root, "guest/tree"))
+
+	back := filepath.Join(t.TempDir(), "back")
+	c1, c2 = net.Pipe()
+	go func() {
+		defer c2.Close()
+		srv.ServeConn(c2)
+	}()
+	if err := Pull(c1, "guest/tree", back); err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	c1.Close()
+	compareTree(t, local, back)
+
+	c1, c2 = net.Pipe()
+	go func() {
+		defer c2.Close()
+		srv.ServeConn(c2)
+	}()
+	var rerr RemoteError
+	if err := Pull(c1, "../etc", back); !errors.As(err, &rerr) {
+		t.Fatalf("Pull outside of the root = %v, want a RemoteError", err)
+	}
+	c1.Close()
+}
+
+func TestReceiveSymlinkEscape(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		entries []*Entry
+	}{
+		{"absolute", []*Entry{
+			{Path: "link", Type: TypeSymlink, Target: "/tmp/x"},
+			{Path: "link/file", Type: TypeFile},
+		}},
+		{"relative", []*Entry{
+			{Path: "sub", Type: TypeDir, Mode: os.ModeDir | 0o755},
+			{Path: "sub/link", Type: TypeSymlink, Target: "../../x"},
+		}},
+		{"root", []*Entry{
+			{Path: ".", Type: TypeSymlink, Target: "out"},
+		}},
+		// a link within the destination is never traversed either.
+		{"parent", []*Entry{
+			{Path: "sub", Type: TypeDir, Mode: os.ModeDir | 0o755},
+			{Path: "link", Type: TypeSymlink, Target: "sub"},
+			{Path: "link/file", Type: TypeFile},
+		}},
+		{"dir", []*Entry{
+			{Path: "link", Type: TypeSymlink, Target: "."},
+			{Path: "link", Type: TypeDir, Mode: os.ModeDir | 0o755},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			outside := t.TempDir()
+			dst := filepath.Join(outside, "out")
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				err := new(Receiver).Receive(c2, dst)
+				c2.Close()
+				done <- err
+			}()
+
+			// a hostile sender which ignores the acknowledgements.
+			go func() {
+				writeMessage(c1, &message{Type: msgHello, Version: protocolVersion, ChunkSize: testChunkSize})
+				for _, e := range tt.entries {
+					if writeMessage(c1, &message{Type: msgEntry, Entry: e}) != nil {
+						return
+					}
+				}
+				writeMessage(c1, &message{Type: msgDone})
+			}()
+			go io.Copy(io.Discard, c1)
+
+			if err := <-done; err == nil || !strings.Contains(err.Error(), "symlink") {
+				t.Fatalf("Receive = %v, want a symlink error", err)
+			}
+			if _, err := os.Lstat(filepath.Join(outside, "out", "sub", "file")); !os.IsNotExist(err) {
+				t.Fatalf("file written through a symlink: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vsockdev
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/go-hypervisor/virtio/vsock/packet"
+)
+
+// connKey identifies a connection by its host and guest ports.
+type connKey struct {
+	local, peer uint32
+}
+
+// list of connection states.
+const (
+	// stateDialing is a guest connection being connected to its host socket.
+	stateDialing = iota
+
+	// stateConnecting is a host connection waiting for the guest response.
+	stateConnecting
+
+	// stateEstablished is a connection passing data.
+	stateEstablished
+)
+
+// conn is a connection between a guest socket and a host Unix socket.
+//
+// The fields are guarded by the mutex of the device, which cond waits on. The
+// data of the guest is buffered in buf until written to the host socket, the
+// data of the host socket is read as the credit of the guest allows.
+type conn struct {
+	d     *Device
+	key   connKey
+	sock  net.Conn
+	state int
+	cond  *sync.Cond
+
+	// credit of the guest: its receive buffer size, and the number of bytes
+	// it consumed and the device sent.
+	peerBufAlloc, peerFwdCnt uint32
+	txCnt                    uint32
+
+	// fwdCnt is the number of bytes of the guest written to the host socket,
+	// lastFwdCnt the value last sent to the guest.
+	fwdCnt, lastFwdCnt uint32
+	buf                []byte
+
+	peerShutdown uint32
+	closed       bool
+}
+
+// newConn registers a connection with the credit of h. d.mu must be held.
+func (d *Device) newConn(key connKey, h packet.Header) *conn {
+	c := &conn{
+		d:            d,
+		key:          key,
+		cond:         sync.NewCond(&d.mu),
+		peerBufAlloc: h.BufAlloc,
+		peerFwdCnt:   h.FwdCnt,
+	}
+	d.conns[key] = c
+
+	return c
+}
+
+// credit returns the number of bytes the guest can receive.
+func (c *conn) credit() uint32 {
+	inflight := c.txCnt - c.peerFwdCnt
+	if inflight >= c.peerBufAlloc {
+		return 0
+	}
+
+	return c.peerBufAlloc - inflight
+}
+
+// send queues a packet of the connection for the guest. d.mu must be held.
+func (c *conn) send(op packet.Op, flags uint32, data []byte) {
+	c.lastFwdCnt = c.fwdCnt
+	c.d.queue(packet.Packet{
+		Header: packet.Header{
+			SrcCID:   HostCID,
+			DstCID:   c.d.GuestCID,
+			SrcPort:  c.key.local,
+			DstPort:  c.key.peer,
+			Type:     packet.TypeStream,
+			Op:       op,
+			Flags:    flags,
+			BufAlloc: c.d.bufAlloc(),
+			FwdCnt:   c.fwdCnt,
+		},
+		Data: data,
+	})
+}
+
+// creditUpdate sends the credit of the connection to the guest. A packet of
+// the connection waiting for the guest carries it instead, so repeated
+// credit requests do not grow the queue; the first packet, which may be
+// being written, is left alone. d.mu must be held.
+func (c *conn) creditUpdate() {
+	for i := 1; i < len(c.d.pending); i++ {
+		p := &c.d.pending[i]
+		if p.Op != packet.OpRst && p.SrcPort == c.key.local && p.DstPort == c.key.peer {
+			p.BufAlloc, p.FwdCnt = c.d.bufAlloc(), c.fwdCnt
+			c.lastFwdCnt = c.fwdCnt
+			return
+		}
+	}
+
+	c.send(packet.OpCreditUpdate, 0, nil)
+}
+
+// close closes the host socket and forgets the connection. d.mu must be
+// held.
+func (c *conn) close() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.sock != nil {
+		c.sock.Close()
+	}
+	if c.d.conns[c.key] == c {
+		delete(c.d.conns, c.key)
+	}
+	c.cond.Broadcast()
+}
+
+// abort resets the connection. d.mu must be held.
+func (c *conn) abort() {
+	if !c.closed {
+		c.send(packet.OpRst, 0, nil)
+	}
+	c.close()
+}
+
+// closeIfDone resets the connection once the guest shut it down in both
+// directions and its data was written to the host socket, completing the
+// close of the guest. d.mu must be held.
+func (c *conn) closeIfDone() {
+	if c.peerShutdown == packet.ShutdownBoth && len(c.buf) == 0 {
+		c.abort()
+	}
+}
+
+// dial connects a guest connection to the host socket at path.
+func (c *conn) dial(path string) {
+	defer c.d.wg.Done()
+
+	s, err := net.Dial("unix", path)
+
+	d := c.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if c.closed {
+		if err == nil {
+			s.Close()
+		}
+		return
+	}
+	if err != nil {
+		c.abort()
+		return
+	}
+	c.sock, c.state = s, stateEstablished
+	c.send(packet.OpResponse, 0, nil)
+	d.wg.Add(1)
+	go c.serve("")
+}
+
+// serve writes ack to the host socket, then moves data between the host
+// socket and the guest until the connection is closed.
+func (c *conn) serve(ack string) {
+	defer c.d.wg.Done()
+
+	if ack != "" {
+		if _, err := io.WriteString(c.sock, ack); err != nil {
+			c.d.mu.Lock()
+			c.abort()
+			c.d.mu.Unlock()
+			return
+		}
+	}
+
+	c.d.wg.Add(1)
+	go c.write()
+	c.read()
+}
+
+// read reads the data of the host socket as the credit of the guest allows,
+// and shuts the connection down once the host socket is closed.
+func (c *conn) read() {
+	d := c.d
+	b := make([]byte, maxPayload)
+	for {
+		d.mu.Lock()
+		for !c.closed && c.peerShutdown&packet.ShutdownRcv == 0 && c.credit() == 0 {
+			c.cond.Wait()
+		}
+		if c.closed || c.peerShutdown&packet.ShutdownRcv != 0 {
+			d.mu.Unlock()
+			return
+		}
+		n := c.credit()
+		d.mu.Unlock()
+
+		if n > uint32(len(b)) {
+			n = uint32(len(b))
+		}
+		m, err := c.sock.Read(b[:n])
+
+		d.mu.Lock()
+		if c.closed {
+			d.mu.Unlock()
+			return
+		}
+		if m > 0 && c.peerShutdown&packet.ShutdownRcv == 0 {
+			c.txCnt += uint32(m)
+			c.send(packet.OpRW, 0, append([]byte(nil), b[:m]...))
+		}
+		if err != nil {
+			c.send(packet.OpShutdown, packet.ShutdownBoth, nil)
+			d.mu.Unlock()
+			return
+		}
+		d.mu.Unlock()
+	}
+}
+
+// write writes the data of the guest to the host socket, and sends credit
+// updates to the guest as its buffer drains.
+func (c *conn) write() {
+	d := c.d
+	defer d.wg.Done()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for {
+		for !c.closed && len(c.buf) == 0 && c.peerShutdown&packet.ShutdownSend == 0 {
+			c.cond.Wait()
+		}
+		if c.closed {
+			return
+		}
+		if len(c.buf) == 0 {
+			// the guest will send no more data.
+			if s, ok := c.sock.(interface{ CloseWrite() error }); ok {
+				s.CloseWrite()
+			}
+			c.closeIfDone()
+			return
+		}
+
+		b := c.buf
+		c.buf = nil
+		d.mu.Unlock()
+		_, err := c.sock.Write(b)
+		d.mu.Lock()
+
+		if c.closed {
+			return
+		}
+		if err != nil {
+			c.abort()
+			return
+		}
+		c.fwdCnt += uint32(len(b))
+		// the guest is sent an update at the latest when it runs out of
+		// credit.
+		if c.fwdCnt-c.lastFwdCnt >= d.bufAlloc()/2 {
+			c.creditUpdate()
+		}
+	}
+}
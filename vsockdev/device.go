@@ -0,0 +1,535 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vsockdev
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-hypervisor/virtio"
+	"github.com/go-hypervisor/virtio/vsock/packet"
+)
+
+// HostCID is the context ID of the host.
+const HostCID = packet.HostCID
+
+// list of queue indices.
+const (
+	rxQueue = iota
+	txQueue
+	eventQueue
+)
+
+const (
+	// queueSize is the maximum size of the queues.
+	queueSize = 256
+
+	// defaultBufAlloc is the default receive buffer size of a connection.
+	defaultBufAlloc = 256 << 10
+
+	// maxPayload is the largest payload read from a host socket at once.
+	maxPayload = 4096
+
+	// maxPendingReplies is the number of packets waiting for the guest
+	// beyond which the resets of stray packets are dropped, so a guest not
+	// posting rx buffers cannot grow the queue.
+	maxPendingReplies = queueSize
+
+	// maxGuestPayload is the largest payload of a packet of the guest,
+	// VIRTIO_VSOCK_MAX_PKT_BUF_SIZE. Larger packets are dropped unread.
+	maxGuestPayload = 64 << 10
+
+	// firstHostPort is the first host port of the connections initiated by
+	// the host, above the ports the guest connects to.
+	firstHostPort = 1 << 30
+)
+
+// eventTransportReset is VIRTIO_VSOCK_EVENT_TRANSPORT_RESET.
+const eventTransportReset = 0
+
+// ErrQueues is returned by Activate when the driver did not enable the rx and
+// tx queues.
+var ErrQueues = errors.New("vsockdev: rx and tx queues are required")
+
+func init() {
+	virtio.Register(virtio.DeviceVsock, func() virtio.Device { return &Device{} })
+}
+
+// Device is a virtio-vsock device bridging the connections of the guest to
+// host Unix sockets. Its fields are set before the device is activated.
+type Device struct {
+	// GuestCID is the context ID of the guest. It is changed with
+	// SetGuestCID once the device is active.
+	GuestCID uint64
+
+	// UDSPath is the path of the Unix socket the device listens on for host
+	// connections, and the prefix of the sockets it connects to for guest
+	// connections. If empty, connections are refused.
+	UDSPath string
+
+	// BufAlloc is the receive buffer size of each connection advertised to
+	// the guest, 256 KiB if zero.
+	BufAlloc uint32
+
+	mu         sync.Mutex
+	irq        virtio.Interrupter
+	event      *virtio.Queue
+	ln         *net.UnixListener
+	conns      map[connKey]*conn
+	handshakes map[*net.UnixConn]struct{}
+	pending    []packet.Packet
+	nextPort   uint32
+	kick       chan struct{}
+	done       chan struct{}
+	wg         sync.WaitGroup
+}
+
+var _ virtio.Device = (*Device)(nil)
+
+// DeviceID implements virtio.Device.DeviceID.
+func (d *Device) DeviceID() virtio.DeviceID {
+	return virtio.DeviceVsock
+}
+
+// Features implements virtio.Device.Features. The device supports stream
+// sockets only, which need no feature.
+func (d *Device) Features() virtio.Features {
+	return virtio.FeatureIndirectDesc | virtio.FeatureEventIdx | virtio.FeatureRingPacked
+}
+
+// AckFeatures implements virtio.Device.AckFeatures.
+func (d *Device) AckFeatures(f virtio.Features) {}
+
+// QueueMaxSizes implements virtio.Device.QueueMaxSizes.
+func (d *Device) QueueMaxSizes() []uint16 {
+	return []uint16{queueSize, queueSize, queueSize}
+}
+
+// ReadConfig implements virtio.Device.ReadConfig. The configuration space is
+// the 64-bit guest CID.
+func (d *Device) ReadConfig(off uint64, p []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var config [8]byte
+	binary.LittleEndian.PutUint64(config[:], d.GuestCID)
+	for i := range p {
+		p[i] = 0
+	}
+	if off < uint64(len(config)) {
+		copy(p, config[off:])
+	}
+}
+
+// WriteConfig implements virtio.Device.WriteConfig. The configuration space is
+// read-only.
+func (d *Device) WriteConfig(off uint64, p []byte) {}
+
+// bufAlloc returns the receive buffer size of a connection.
+func (d *Device) bufAlloc() uint32 {
+	if d.BufAlloc == 0 {
+		return defaultBufAlloc
+	}
+
+	return d.BufAlloc
+}
+
+// Activate implements virtio.Device.Activate. It listens on UDSPath, removing
+// a stale socket first.
+func (d *Device) Activate(mem virtio.GuestMemory, queues []*virtio.Queue, irq virtio.Interrupter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if queues[rxQueue] == nil || queues[txQueue] == nil {
+		return ErrQueues
+	}
+	if d.UDSPath != "" {
+		if err := os.Remove(d.UDSPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("vsockdev: %w", err)
+		}
+		ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: d.UDSPath, Net: "unix"})
+		if err != nil {
+			return fmt.Errorf("vsockdev: %w", err)
+		}
+		d.ln = ln
+	}
+
+	d.irq, d.event = irq, queues[eventQueue]
+	d.conns = map[connKey]*conn{}
+	d.handshakes = map[*net.UnixConn]struct{}{}
+	d.nextPort = firstHostPort
+	d.kick = make(chan struct{}, 1)
+	d.done = make(chan struct{})
+	d.wg.Add(2)
+	go d.receive(queues[rxQueue], irq, d.done)
+	go d.transmit(queues[txQueue], irq, d.done)
+	if d.ln != nil {
+		d.wg.Add(1)
+		go d.accept(d.ln)
+	}
+
+	return nil
+}
+
+// Reset implements virtio.Device.Reset. The connections are closed, without
+// notice to the guest, and the listener with them.
+func (d *Device) Reset() {
+	d.mu.Lock()
+	done := d.done
+	if done == nil {
+		d.mu.Unlock()
+		return
+	}
+	close(done)
+	if d.ln != nil {
+		d.ln.Close()
+		d.ln = nil
+	}
+	d.closeAll()
+	for s := range d.handshakes {
+		s.Close()
+	}
+	d.irq, d.event = nil, nil
+	d.conns, d.handshakes, d.pending = nil, nil, nil
+	d.done = nil
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+// closeAll closes all the connections. d.mu must be held.
+func (d *Device) closeAll() {
+	for _, c := range d.conns {
+		c.close()
+	}
+}
+
+// SetGuestCID changes the context ID of the guest. The connections of an
+// active device are closed and the guest is sent a transport reset event, as
+// after a migration.
+func (d *Device) SetGuestCID(cid uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.GuestCID = cid
+	if d.done == nil {
+		return nil
+	}
+	d.closeAll()
+	d.irq.InterruptConfig()
+
+	return d.sendEvent(eventTransportReset)
+}
+
+// sendEvent writes the event id to a buffer of the event queue. The event is
+// dropped if the driver provided no buffer. d.mu must be held.
+func (d *Device) sendEvent(id uint32) error {
+	q := d.event
+	if q == nil {
+		return nil
+	}
+	c, ok, err := q.PopChain()
+	if err != nil || !ok {
+		return err
+	}
+
+	var p [4]byte
+	binary.LittleEndian.PutUint32(p[:], id)
+	c.Write(p[:])
+	if err := q.PushChain(c); err != nil {
+		return err
+	}
+	if q.NeedsNotification() {
+		d.irq.InterruptQueue(q.Index())
+	}
+
+	return nil
+}
+
+// queue queues p for the guest. d.mu must be held.
+func (d *Device) queue(p packet.Packet) {
+	d.pending = append(d.pending, p)
+	select {
+	case d.kick <- struct{}{}:
+	default:
+	}
+}
+
+// rst queues a reset in reply to the packet h, outside of any connection,
+// unless maxPendingReplies packets wait. d.mu must be held.
+func (d *Device) rst(h packet.Header) {
+	if len(d.pending) >= maxPendingReplies {
+		return
+	}
+
+	d.queue(packet.Packet{Header: packet.Header{
+		SrcCID:  h.DstCID,
+		DstCID:  h.SrcCID,
+		SrcPort: h.DstPort,
+		DstPort: h.SrcPort,
+		Type:    h.Type,
+		Op:      packet.OpRst,
+	}})
+}
+
+// receive moves the queued packets to the rx queue q until done is closed.
+func (d *Device) receive(q *virtio.Queue, irq virtio.Interrupter, done <-chan struct{}) {
+	defer d.wg.Done()
+
+	for {
+		if err := d.fill(q, irq); err != nil {
+			<-done
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		case <-q.Notified():
+		case <-d.kick:
+		}
+	}
+}
+
+// fill writes the queued packets to the chains of q, splitting the data of
+// a packet across chains too small for it. It returns once there is no
+// packet or no chain left.
+func (d *Device) fill(q *virtio.Queue, irq virtio.Interrupter) error {
+	for {
+		d.mu.Lock()
+		if len(d.pending) == 0 {
+			d.mu.Unlock()
+			return nil
+		}
+		p := d.pending[0]
+		d.mu.Unlock()
+
+		c, ok, err := q.PopChain()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			q.EnableNotifications()
+			if c, ok, err = q.PopChain(); err != nil || !ok {
+				return err
+			}
+			q.DisableNotifications()
+		}
+
+		// a chain too small for a header is returned empty.
+		var n int
+		if room := c.WritableLen(); room >= packet.HeaderSize {
+			n = len(p.Data)
+			if uint64(n) > room-packet.HeaderSize {
+				n = int(room - packet.HeaderSize)
+			}
+			chunk := packet.Packet{Header: p.Header, Data: p.Data[:n]}
+			c.Write(chunk.Marshal())
+		}
+		if err := q.PushChain(c); err != nil {
+			return err
+		}
+		if q.NeedsNotification() {
+			irq.InterruptQueue(q.Index())
+		}
+		if c.Written() == 0 {
+			continue
+		}
+
+		d.mu.Lock()
+		if len(d.pending) > 0 {
+			if n < len(p.Data) {
+				d.pending[0].Data = p.Data[n:]
+			} else {
+				d.pending = d.pending[1:]
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// transmit handles the packets of the tx queue q until done is closed.
+// Malformed packets and those larger than buf are dropped.
+func (d *Device) transmit(q *virtio.Queue, irq virtio.Interrupter, done <-chan struct{}) {
+	defer d.wg.Done()
+
+	buf := make([]byte, packet.HeaderSize+maxGuestPayload)
+	q.Serve(irq, done, func(c *virtio.DescriptorChain) bool {
+		if n := c.ReadableLen(); n <= uint64(len(buf)) {
+			b := buf[:n]
+			if _, err := io.ReadFull(c, b); err == nil {
+				if p, err := packet.Parse(b); err == nil {
+					d.handle(p.Header, p.Data)
+				}
+			}
+		}
+
+		return true
+	})
+}
+
+// handle handles a packet of the guest.
+func (d *Device) handle(h packet.Header, data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conns == nil {
+		return
+	}
+	if h.SrcCID != d.GuestCID || h.DstCID != HostCID || h.Type != packet.TypeStream {
+		if h.Op != packet.OpRst {
+			d.rst(h)
+		}
+		return
+	}
+
+	key := connKey{local: h.DstPort, peer: h.SrcPort}
+	c := d.conns[key]
+	if c == nil {
+		switch h.Op {
+		case packet.OpRequest:
+			d.connect(key, h)
+		case packet.OpRst:
+		default:
+			d.rst(h)
+		}
+		return
+	}
+
+	c.peerBufAlloc, c.peerFwdCnt = h.BufAlloc, h.FwdCnt
+	c.cond.Broadcast()
+	switch h.Op {
+	case packet.OpResponse:
+		if c.state != stateConnecting {
+			c.abort()
+			return
+		}
+		c.state = stateEstablished
+		d.wg.Add(1)
+		go c.serve(fmt.Sprintf("OK %d\n", key.local))
+	case packet.OpRW:
+		if c.state != stateEstablished || c.peerShutdown&packet.ShutdownSend != 0 ||
+			uint64(len(c.buf))+uint64(len(data)) > uint64(d.bufAlloc()) {
+			c.abort()
+			return
+		}
+		c.buf = append(c.buf, data...)
+	case packet.OpCreditUpdate:
+	case packet.OpCreditRequest:
+		c.creditUpdate()
+	case packet.OpShutdown:
+		c.peerShutdown |= h.Flags & (packet.ShutdownRcv | packet.ShutdownSend)
+		c.closeIfDone()
+	case packet.OpRst:
+		c.close()
+	default:
+		c.abort()
+	}
+}
+
+// connect starts connecting the guest connection key to the Unix socket
+// UDSPath_P, P the host port. d.mu must be held.
+func (d *Device) connect(key connKey, h packet.Header) {
+	if d.UDSPath == "" {
+		d.rst(h)
+		return
+	}
+
+	c := d.newConn(key, h)
+	c.state = stateDialing
+	d.wg.Add(1)
+	go c.dial(fmt.Sprintf("%s_%d", d.UDSPath, key.local))
+}
+
+// accept accepts the host connections on ln until it is closed.
+func (d *Device) accept(ln *net.UnixListener) {
+	defer d.wg.Done()
+
+	for {
+		s, err := ln.AcceptUnix()
+		if err != nil {
+			return
+		}
+
+		d.mu.Lock()
+		if d.handshakes == nil {
+			d.mu.Unlock()
+			s.Close()
+			return
+		}
+		d.handshakes[s] = struct{}{}
+		d.wg.Add(1)
+		go d.handshake(s)
+		d.mu.Unlock()
+	}
+}
+
+// handshake reads the "CONNECT P\n" line of the host connection s and
+// requests a connection to the guest port P.
+func (d *Device) handshake(s *net.UnixConn) {
+	defer d.wg.Done()
+
+	r := bufio.NewReader(s)
+	line, err := r.ReadString('\n')
+	var port uint64
+	if err == nil {
+		f := strings.Fields(line)
+		if len(f) != 2 || f[0] != "CONNECT" {
+			err = fmt.Errorf("vsockdev: bad handshake %q", line)
+		} else {
+			port, err = strconv.ParseUint(f[1], 10, 32)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handshakes == nil {
+		return
+	}
+	delete(d.handshakes, s)
+	if err != nil {
+		s.Close()
+		return
+	}
+
+	key := connKey{local: d.allocPort(uint32(port)), peer: uint32(port)}
+	c := d.newConn(key, packet.Header{})
+	c.sock = &bufferedConn{UnixConn: s, r: r}
+	c.state = stateConnecting
+	c.send(packet.OpRequest, 0, nil)
+}
+
+// allocPort returns a free host port for a connection to the guest port
+// peer. d.mu must be held.
+func (d *Device) allocPort(peer uint32) uint32 {
+	for {
+		port := d.nextPort
+		if d.nextPort++; d.nextPort == 0 {
+			d.nextPort = firstHostPort
+		}
+		if _, ok := d.conns[connKey{local: port, peer: peer}]; !ok {
+			return port
+		}
+	}
+}
+
+// bufferedConn is a Unix connection read through the reader of the
+// handshake.
+type bufferedConn struct {
+	*net.UnixConn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,420 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package vsockdev
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-hypervisor/virtio"
+	"github.com/go-hypervisor/virtio/driver"
+	"github.com/go-hypervisor/virtio/driver/drivertest"
+	"github.com/go-hypervisor/virtio/vsock/packet"
+)
+
+const guestCID = 3
+
+// guest is the guest side of a device, through a loopback driver.
+type guest struct {
+	t      *testing.T
+	ctx    context.Context
+	l      *driver.Loopback
+	rx, tx *driver.Queue
+	event  *driver.Queue
+
+	// posted are the rx buffers, in the order the device uses them.
+	posted []*driver.Request
+
+	// bufAlloc and fwdCnt are the credit sent with the packets of the guest.
+	bufAlloc, fwdCnt uint32
+}
+
+func newGuest(t *testing.T, dev *Device, features virtio.Features) *guest {
+	t.Helper()
+
+	dg := drivertest.New(t, dev, drivertest.Config{Features: features, Queues: drivertest.Range(3), QueueSize: 32})
+	g := &guest{t: t, ctx: dg.Ctx, l: dg.Loopback, bufAlloc: 1 << 16}
+	g.rx, g.tx, g.event = dg.Queues[0], dg.Queues[1], dg.Queues[2]
+	for i := 0; i < 8; i++ {
+		g.post(&driver.Request{In: [][]byte{make([]byte, packet.HeaderSize+64)}})
+	}
+
+	return g
+}
+
+func (g *guest) post(r *driver.Request) {
+	g.t.Helper()
+
+	if err := g.rx.Submit(r); err != nil {
+		g.t.Fatal(err)
+	}
+	g.posted = append(g.posted, r)
+}
+
+// send sends a packet to the host.
+func (g *guest) send(h packet.Header, data string) {
+	g.t.Helper()
+
+	if h.SrcCID == 0 {
+		h.SrcCID, h.DstCID = guestCID, HostCID
+	}
+	if h.Type == 0 {
+		h.Type = packet.TypeStream
+	}
+	h.BufAlloc, h.FwdCnt = g.bufAlloc, g.fwdCnt
+	p := packet.Packet{Header: h, Data: []byte(data)}
+	if err := g.tx.Do(g.ctx, &driver.Request{Out: [][]byte{p.Marshal()}}); err != nil {
+		g.t.Fatal(err)
+	}
+}
+
+// recv receives the next packet of the host and reposts its buffer.
+func (g *guest) recv() (packet.Header, string) {
+	g.t.Helper()
+
+	r := g.posted[0]
+	g.posted = g.posted[1:]
+	if err := r.Wait(g.ctx); err != nil {
+		g.t.Fatal(err)
+	}
+	b := r.In[0][:r.Written]
+	p, err := packet.Parse(b)
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	if len(b) != packet.HeaderSize+len(p.Data) {
+		g.t.Fatalf("packet %v in %d bytes", p.Header, len(b))
+	}
+	if p.Op == packet.OpRW {
+		g.fwdCnt += p.Len
+	}
+	g.post(r)
+
+	return p.Header, string(p.Data)
+}
+
+// expect receives the next packet and checks its operation.
+func (g *guest) expect(op packet.Op) (packet.Header, string) {
+	g.t.Helper()
+
+	h, data := g.recv()
+	if h.Op != op || h.SrcCID != HostCID || h.DstCID != guestCID {
+		g.t.Fatalf("received %v, want %v", h, op)
+	}
+
+	return h, data
+}
+
+// recvData receives n bytes of data packets.
+func (g *guest) recvData(n int) string {
+	g.t.Helper()
+
+	var s string
+	for len(s) < n {
+		_, data := g.expect(packet.OpRW)
+		s += data
+	}
+
+	return s
+}
+
+func newDevice(t *testing.T) *Device {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "vsockdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return &Device{GuestCID: guestCID, UDSPath: filepath.Join(dir, "v.sock")}
+}
+
+func TestGuestConnect(t *testing.T) {
+	for _, features := range []virtio.Features{0, virtio.FeatureEventIdx | virtio.FeatureRingPacked} {
+		t.Run(fmt.Sprint(features), func(t *testing.T) {
+			dev := newDevice(t)
+			ln, err := net.Listen("unix", dev.UDSPath+"_1234")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			g := newGuest(t, dev, features)
+
+			g.send(packet.Header{Op: packet.OpRequest, SrcPort: 5000, DstPort: 1234}, "")
+			h, _ := g.expect(packet.OpResponse)
+			if h.SrcPort != 1234 || h.DstPort != 5000 || h.BufAlloc != defaultBufAlloc {
+				t.Fatalf("response %v", h)
+			}
+			s, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			// guest to host.
+			g.send(packet.Header{Op: packet.OpRW, SrcPort: 5000, DstPort: 1234}, "ping")
+			p := make([]byte, 4)
+			if _, err := io.ReadFull(s, p); err != nil || string(p) != "ping" {
+				t.Fatalf("host read %q, %v", p, err)
+			}
+			g.send(packet.Header{Op: packet.OpCreditRequest, SrcPort: 5000, DstPort: 1234}, "")
+			if h, _ := g.expect(packet.OpCreditUpdate); h.FwdCnt != 4 {
+				t.Fatalf("credit update %v", h)
+			}
+
+			// host to guest, split across the rx buffers.
+			msg := string(make([]byte, 200))
+			if _, err := io.WriteString(s, msg); err != nil {
+				t.Fatal(err)
+			}
+			if got := g.recvData(len(msg)); got != msg {
+				t.Fatalf("guest received %d bytes", len(got))
+			}
+
+			// the guest closes, the device completes the close with a reset.
+			g.send(packet.Header{Op: packet.OpShutdown, SrcPort: 5000, DstPort: 1234, Flags: packet.ShutdownBoth}, "")
+			g.expect(packet.OpRst)
+			if n, err := s.Read(p); err != io.EOF {
+				t.Fatalf("host read %d bytes, %v after close", n, err)
+			}
+		})
+	}
+}
+
+func TestHostConnect(t *testing.T) {
+	dev := newDevice(t)
+	g := newGuest(t, dev, virtio.FeatureEventIdx)
+
+	s, err := net.Dial("unix", dev.UDSPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := io.WriteString(s, "CONNECT 80\nearly"); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := g.expect(packet.OpRequest)
+	if req.DstPort != 80 || req.SrcPort < firstHostPort {
+		t.Fatalf("request %v", req)
+	}
+	g.send(packet.Header{Op: packet.OpResponse, SrcPort: 80, DstPort: req.SrcPort}, "")
+	r := bufio.NewReader(s)
+	line, err := r.ReadString('\n')
+	if err != nil || line != fmt.Sprintf("OK %d\n", req.SrcPort) {
+		t.Fatalf("host read %q, %v", line, err)
+	}
+
+	// data written with the handshake is not lost.
+	if got := g.recvData(5); got != "early" {
+		t.Fatalf("guest received %q", got)
+	}
+	g.send(packet.Header{Op: packet.OpRW, SrcPort: 80, DstPort: req.SrcPort}, "reply")
+	p := make([]byte, 5)
+	if _, err := io.ReadFull(r, p); err != nil || string(p) != "reply" {
+		t.Fatalf("host read %q, %v", p, err)
+	}
+
+	// the host closes: the device shuts down the guest socket.
+	s.Close()
+	if h, _ := g.expect(packet.OpShutdown); h.Flags != packet.ShutdownBoth {
+		t.Fatalf("shutdown %v", h)
+	}
+	g.send(packet.Header{Op: packet.OpRst, SrcPort: 80, DstPort: req.SrcPort}, "")
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if n := len(dev.conns); n != 0 {
+		t.Fatalf("%d connections left", n)
+	}
+}
+
+func TestRefused(t *testing.T) {
+	dev := newDevice(t)
+	g := newGuest(t, dev, 0)
+
+	for _, h := range []packet.Header{
+		// no host socket.
+		{Op: packet.OpRequest, SrcPort: 5000, DstPort: 1},
+		// no connection.
+		{Op: packet.OpRW, SrcPort: 5000, DstPort: 1},
+		// not for the host.
+		{Op: packet.OpRequest, SrcCID: guestCID, DstCID: 7, SrcPort: 5000, DstPort: 1},
+		// not a stream.
+		{Op: packet.OpRequest, SrcPort: 5000, DstPort: 1, Type: packet.TypeSeqpacket},
+	} {
+		g.send(h, "")
+		if rst, _ := g.recv(); rst.Op != packet.OpRst || rst.SrcPort != 1 || rst.DstPort != 5000 {
+			t.Fatalf("reply to %v: %v", h, rst)
+		}
+	}
+
+	// an oversized packet is dropped unanswered.
+	g.send(packet.Header{Op: packet.OpRW, SrcPort: 5001, DstPort: 1}, strings.Repeat("x", maxGuestPayload+1))
+	g.send(packet.Header{Op: packet.OpRW, SrcPort: 5002, DstPort: 1}, "")
+	if rst, _ := g.recv(); rst.Op != packet.OpRst || rst.DstPort != 5002 {
+		t.Fatalf("reply after an oversized packet: %v", rst)
+	}
+
+	// a bad handshake of the host is refused.
+	s, err := net.Dial("unix", dev.UDSPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	io.WriteString(s, "HELLO\n")
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after bad handshake: %v", err)
+	}
+}
+
+func TestCredit(t *testing.T) {
+	dev := newDevice(t)
+	dev.BufAlloc = 16
+	ln, err := net.Listen("unix", dev.UDSPath+"_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	g := newGuest(t, dev, 0)
+	g.bufAlloc = 8
+
+	g.send(packet.Header{Op: packet.OpRequest, SrcPort: 5000, DstPort: 1}, "")
+	g.expect(packet.OpResponse)
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the host writes more than the guest can receive.
+	if _, err := io.WriteString(s, "0123456789abcdefghij"); err != nil {
+		t.Fatal(err)
+	}
+	if got := g.recvData(8); got != "01234567" {
+		t.Fatalf("guest received %q", got)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(g.posted) > 0 {
+		select {
+		case <-g.posted[0].Done():
+			t.Fatal("device sent data beyond the credit of the guest")
+		default:
+		}
+	}
+	g.send(packet.Header{Op: packet.OpCreditUpdate, SrcPort: 5000, DstPort: 1}, "")
+	if got := g.recvData(8); got != "89abcdef" {
+		t.Fatalf("guest received %q", got)
+	}
+
+	// the guest sends more than the device can buffer.
+	g.send(packet.Header{Op: packet.OpRW, SrcPort: 5000, DstPort: 1}, "0123456789abcdefghij")
+	for {
+		h, _ := g.recv()
+		if h.Op == packet.OpRst {
+			break
+		}
+		if h.Op != packet.OpRW && h.Op != packet.OpCreditUpdate {
+			t.Fatalf("received %v", h)
+		}
+	}
+}
+
+func TestFlood(t *testing.T) {
+	dev := newDevice(t)
+	ln, err := net.Listen("unix", dev.UDSPath+"_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	g := newGuest(t, dev, 0)
+	g.send(packet.Header{Op: packet.OpRequest, SrcPort: 5000, DstPort: 1}, "")
+	g.expect(packet.OpResponse)
+
+	// the guest posts no more rx buffers than the first ones, and floods
+	// the device with stray packets and credit requests.
+	for i := 0; i < 2*maxPendingReplies; i++ {
+		g.send(packet.Header{Op: packet.OpRW, SrcPort: uint32(6000 + i), DstPort: 2}, "")
+	}
+	for i := 0; i < 100; i++ {
+		g.send(packet.Header{Op: packet.OpCreditRequest, SrcPort: 5000, DstPort: 1}, "")
+	}
+	dev.mu.Lock()
+	n := len(dev.pending)
+	dev.mu.Unlock()
+	if n > maxPendingReplies+1 {
+		t.Fatalf("%d packets pending", n)
+	}
+
+	// the credit update is still delivered.
+	for {
+		h, _ := g.recv()
+		if h.Op == packet.OpCreditUpdate && h.DstPort == 5000 {
+			break
+		}
+		if h.Op != packet.OpRst {
+			t.Fatalf("received %v", h)
+		}
+	}
+}
+
+func TestGuestCID(t *testing.T) {
+	dev := newDevice(t)
+	g := newGuest(t, dev, 0)
+	configs := make(chan struct{}, 1)
+	g.l.Config = func() {
+		select {
+		case configs <- struct{}{}:
+		default:
+		}
+	}
+
+	p := make([]byte, 8)
+	g.l.ReadConfig(0, p)
+	if cid := binary.LittleEndian.Uint64(p); cid != guestCID {
+		t.Fatalf("guest CID %d", cid)
+	}
+
+	event := &driver.Request{In: [][]byte{make([]byte, 4)}}
+	if err := g.event.Submit(event); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SetGuestCID(guestCID + 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := event.Wait(g.ctx); err != nil {
+		t.Fatal(err)
+	}
+	if id := binary.LittleEndian.Uint32(event.In[0]); event.Written != 4 || id != eventTransportReset {
+		t.Fatalf("event %d of %d bytes", id, event.Written)
+	}
+	select {
+	case <-configs:
+	case <-g.ctx.Done():
+		t.Fatal("no configuration change interrupt")
+	}
+	g.l.ReadConfig(0, p)
+	if cid := binary.LittleEndian.Uint64(p); cid != guestCID+1 {
+		t.Fatalf("guest CID %d after change", cid)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	dev, err := virtio.NewDevice(virtio.DeviceVsock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dev.(*Device); !ok {
+		t.Fatalf("registered device %T", dev)
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2021 The Go Hypervisor Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package vsockdev implements the device side of virtio-vsock.
+//
+// A Device terminates the stream connections of the guest onto host Unix
+// sockets, like the hybrid vsock of Firecracker:
+//
+//   - a guest connection to the host port P is forwarded to a connection to
+//     the Unix socket UDSPath_P, which a host application listens on;
+//   - a host application connects to the Unix socket UDSPath and writes
+//     "CONNECT P\n" to connect to the guest port P. Once the guest accepts
+//     the connection, the device answers "OK L\n", with L the host port of
+//     the connection.
+//
+// The device moves the packets between the rx and tx queues and the sockets,
+// with the credit-based flow control of the protocol bounding the data
+// buffered on either side.
+package vsockdev